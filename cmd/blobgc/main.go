@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
+	"github.com/CosminMocanu97/dissertationBackend/internal/utils"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+const (
+	batchSize = 100
+)
+
+// blobgc removes the blobs no file or version references anymore, and the temporary files of interrupted uploads.
+// The grace period keeps the blobs released by a transaction that could still be reused by an upload in flight.
+func main() {
+	env := flag.String("env", "staging", "Environment of the database")
+	grace := flag.Duration("grace", time.Hour, "How long a blob stays unreferenced before it is removed")
+	interval := flag.Duration("interval", 0, "Run the collection periodically with this interval, instead of once")
+	flag.Parse()
+
+	utils.GetEnvVars()
+
+	db, err := database.CreateDbConnection(*env)
+	if err != nil {
+		log.Fatal("Error creating the database connection: %s", err.Error())
+	}
+	defer db.Close()
+
+	keyManager, err := encryption.NewKeyManagerFromEnv()
+	if err != nil {
+		log.Fatal("Error loading the master keys: %s", err.Error())
+	}
+	store := storage.NewStore(storage.RootFromEnv(), keyManager)
+
+	for {
+		collect(db, store, *grace)
+		if *interval <= 0 {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func collect(db *sql.DB, store *storage.Store, grace time.Duration) {
+	collected := 0
+	for {
+		count, err := database.CollectUnreferencedBlobs(db, grace, batchSize, store.Remove)
+		if err != nil {
+			log.Error("Error collecting the unreferenced blobs: %s", err)
+			break
+		}
+		collected += count
+		if count < batchSize {
+			break
+		}
+	}
+
+	// the temporary files older than the grace period belong to uploads that were interrupted
+	removed, err := store.RemoveStaleTemporaryFiles(grace)
+	if err != nil {
+		log.Error("Error removing the stale temporary files: %s", err)
+	}
+
+	log.Info("Collected %d unreferenced blobs and %d stale temporary files", collected, removed)
+}
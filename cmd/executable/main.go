@@ -6,6 +6,10 @@ import (
 	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
 	"github.com/CosminMocanu97/dissertationBackend/internal/mail"
 	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/internal/oidc"
+	"github.com/CosminMocanu97/dissertationBackend/internal/search"
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
 	"github.com/CosminMocanu97/dissertationBackend/internal/utils"
 	"github.com/CosminMocanu97/dissertationBackend/internal/webserver"
 
@@ -31,6 +35,7 @@ func main() {
 	// retrieve env vars
 	jwtSecret := os.Getenv("JWT_SECRET")
 	sendGridAPIKey := os.Getenv("SENDGRID_API_KEY")
+	scimToken := os.Getenv("SCIM_TOKEN")
 
 	// sleep to give time to the Postgres container to start
 	time.Sleep(time.Second * 5)
@@ -52,10 +57,33 @@ func main() {
 
 	mailer := mail.NewMailerService(sendGridAPIKey)
 
+	// the master keys wrapping the data key of every stored file
+	keyManager, err := encryption.NewKeyManagerFromEnv()
+	if err != nil {
+		log.Fatal("Error loading the master keys: %s", err.Error())
+	}
+
+	store := storage.NewStore(storage.RootFromEnv(), keyManager)
+
+	// the text of the uploaded documents is extracted and indexed in the background
+	indexer := search.NewIndexer(db, store)
+	go indexer.Run(time.Minute)
+
+	// the single sign-on with the identity provider, when OIDC_ISSUER is set
+	var provider *oidc.Provider
+	if config, configured := oidc.ConfigFromEnv(); configured {
+		provider = oidc.NewProvider(config)
+		log.Info("The single sign-on uses %s", provider)
+	}
+
 	service := webserver.Service{
 		Database:       db,
 		JwtSecret: jwtSecret,
 		MailingService: mailer,
+		Storage:        store,
+		Indexer:        indexer,
+		OIDC:           provider,
+		SCIMToken:      scimToken,
 	}
 	a := webserver.Api(&service)
 	err = a.Run(":8080")
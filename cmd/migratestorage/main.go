@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
+	"github.com/CosminMocanu97/dissertationBackend/internal/utils"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+// migratestorage moves the files stored at <folder name>/<subfolder name>/<file name> under generated
+// storage keys, and points files.filepath to the new keys. It can be run again if some files failed.
+func main() {
+	env := flag.String("env", "staging", "Environment of the database")
+	flag.Parse()
+
+	utils.GetEnvVars()
+
+	db, err := database.CreateDbConnection(*env)
+	if err != nil {
+		log.Fatal("Error creating the database connection: %s", err.Error())
+	}
+	defer db.Close()
+
+	keyManager, err := encryption.NewKeyManagerFromEnv()
+	if err != nil {
+		log.Fatal("Error loading the master keys: %s", err.Error())
+	}
+	store := storage.NewStore(storage.RootFromEnv(), keyManager)
+
+	storedFiles, err := database.GetAllStoredFiles(db)
+	if err != nil {
+		log.Fatal("Error retrieving the stored files: %s", err.Error())
+	}
+
+	var migrated, failed int
+	for _, storedFile := range storedFiles {
+		if storage.IsStorageKey(storedFile.Filepath) {
+			continue
+		}
+
+		// before the migration, filepath held the folder of the file on disk
+		oldPath := storedFile.Filepath + storedFile.Filename
+		fileID := storedFile.ID
+		_, err := store.Import(oldPath, func(key string) error {
+			return database.SetFileStorageKey(db, fileID, key)
+		})
+		if err != nil {
+			log.Error("Error migrating the file with ID %d from %s: %s", storedFile.ID, oldPath, err)
+			failed++
+			continue
+		}
+		migrated++
+	}
+
+	log.Info("Migrated %d files under storage keys, %d files failed", migrated, failed)
+	if failed > 0 {
+		log.Fatal("Not all the files were migrated")
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	keyID        = "mockoidc"
+	codeLifetime = time.Minute
+)
+
+// authorization is an authorization code waiting to be exchanged for the ID token
+type authorization struct {
+	redirectURI string
+	challenge   string
+	claims      jwt.MapClaims
+	expiresAt   time.Time
+}
+
+// provider is an identity provider for the local tests of the single sign-on, logging in anyone with the email
+// and the groups typed in its login page. It supports only the authorization code flow with PKCE (S256).
+type provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+	auto         bool
+	defaults     loginForm
+
+	mutex          sync.Mutex
+	authorizations map[string]authorization
+}
+
+// loginForm is the identity chosen in the login page
+type loginForm struct {
+	Email         string
+	Subject       string
+	Groups        string
+	EmailVerified bool
+	MFA           bool
+	Query         template.URL
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><head><title>Mock OIDC login</title></head><body>
+<h1>Mock OIDC login</h1>
+<form method="POST" action="/authorize?{{.Query}}">
+<p><label>Email <input name="email" value="{{.Email}}"></label></p>
+<p><label>Subject <input name="sub" value="{{.Subject}}" placeholder="the email when empty"></label></p>
+<p><label>Groups <input name="groups" value="{{.Groups}}" placeholder="comma separated"></label></p>
+<p><label><input type="checkbox" name="email_verified" value="true" {{if .EmailVerified}}checked{{end}}> Email verified</label></p>
+<p><label><input type="checkbox" name="mfa" value="true" {{if .MFA}}checked{{end}}> Logged in with MFA</label></p>
+<p><button type="submit">Log in</button></p>
+</form></body></html>`))
+
+// mockoidc runs an OpenID Connect provider for the local tests of the single sign-on. The server is configured
+// with OIDC_ISSUER set to the issuer of the mock, OIDC_CLIENT_ID to its client id and OIDC_REDIRECT_URL to the
+// callback page of the frontend.
+func main() {
+	address := flag.String("addr", ":9000", "Address the provider listens on")
+	issuer := flag.String("issuer", "http://localhost:9000", "Issuer of the provider, the address the server reaches it at")
+	clientID := flag.String("client-id", "dissertation", "Id of the only client")
+	clientSecret := flag.String("client-secret", "", "Secret of the client, the client being public when it is empty")
+	email := flag.String("email", "user@example.com", "Email filled in the login page")
+	groups := flag.String("groups", "", "Comma separated groups filled in the login page")
+	unverified := flag.Bool("unverified", false, "Leave the email unverified by default")
+	mfa := flag.Bool("mfa", false, "Report a login with MFA by default")
+	auto := flag.Bool("auto", false, "Log in with the defaults without showing the login page, for scripted tests")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal("Error generating the signing key: %s", err)
+	}
+
+	p := &provider{
+		issuer:       strings.TrimSuffix(*issuer, "/"),
+		clientID:     *clientID,
+		clientSecret: *clientSecret,
+		key:          key,
+		auto:         *auto,
+		defaults: loginForm{
+			Email:         *email,
+			Groups:        *groups,
+			EmailVerified: !*unverified,
+			MFA:           *mfa,
+		},
+		authorizations: map[string]authorization{},
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	http.HandleFunc("/authorize", p.handleAuthorize)
+	http.HandleFunc("/token", p.handleToken)
+	http.HandleFunc("/jwks", p.handleJWKS)
+
+	log.Info("The mock OIDC provider %s listens on %s", p.issuer, *address)
+	err = http.ListenAndServe(*address, nil)
+	if err != nil {
+		log.Fatal("Error running the mock OIDC provider: %s", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeTokenError responds with an error of the token endpoint of RFC 6749
+func writeTokenError(w http.ResponseWriter, status int, code string, description string) {
+	log.Error("Refused the token request: %s", description)
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func (p *provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "email", "profile", "groups"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"claims_supported":                      []string{"sub", "email", "email_verified", "groups", "amr"},
+	})
+}
+
+func (p *provider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	exponent := big.NewInt(int64(p.key.PublicKey.E)).Bytes()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(exponent),
+		}},
+	})
+}
+
+// handleAuthorize shows the login page, and redirects back to the client with a code once it is submitted
+func (p *provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI := query.Get("redirect_uri")
+	if query.Get("client_id") != p.clientID || len(redirectURI) == 0 {
+		http.Error(w, "unknown client or missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if query.Get("response_type") != "code" || !strings.Contains(" "+query.Get("scope")+" ", " openid ") {
+		http.Error(w, "only the authorization code flow of OpenID Connect is supported", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge_method") != "S256" || len(query.Get("code_challenge")) == 0 {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	form := p.defaults
+	if r.Method == http.MethodPost {
+		form = loginForm{
+			Email:         r.PostFormValue("email"),
+			Subject:       r.PostFormValue("sub"),
+			Groups:        r.PostFormValue("groups"),
+			EmailVerified: r.PostFormValue("email_verified") == "true",
+			MFA:           r.PostFormValue("mfa") == "true",
+		}
+	} else if !p.auto {
+		form.Query = template.URL(r.URL.RawQuery)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginPage.Execute(w, form)
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.mutex.Lock()
+	p.authorizations[code] = authorization{
+		redirectURI: redirectURI,
+		challenge:   query.Get("code_challenge"),
+		claims:      p.claims(form, query.Get("nonce")),
+		expiresAt:   time.Now().Add(codeLifetime),
+	}
+	p.mutex.Unlock()
+
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "the redirect_uri is not valid", http.StatusBadRequest)
+		return
+	}
+	values := target.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	target.RawQuery = values.Encode()
+	log.Info("Logged in %s, redirecting to %s", form.Email, redirectURI)
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// claims returns the claims of the ID token of the identity, the subject defaulting to the email
+func (p *provider) claims(form loginForm, nonce string) jwt.MapClaims {
+	subject := strings.TrimSpace(form.Subject)
+	if len(subject) == 0 {
+		subject = form.Email
+	}
+	groups := []string{}
+	for _, group := range strings.Split(form.Groups, ",") {
+		if group = strings.TrimSpace(group); len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	amr := []string{"pwd"}
+	if form.MFA {
+		amr = append(amr, "mfa")
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            p.issuer,
+		"sub":            subject,
+		"aud":            p.clientID,
+		"email":          form.Email,
+		"email_verified": form.EmailVerified,
+		"groups":         groups,
+		"amr":            amr,
+	}
+	if len(nonce) > 0 {
+		claims["nonce"] = nonce
+	}
+	return claims
+}
+
+// handleToken exchanges an authorization code for the ID token, checking the client and the PKCE verifier
+func (p *provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeTokenError(w, http.StatusMethodNotAllowed, "invalid_request", "the token endpoint only takes POST")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	clientID, clientSecret, hasBasicAuth := r.BasicAuth()
+	if hasBasicAuth {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != p.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1 {
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+
+	code := r.PostFormValue("code")
+	p.mutex.Lock()
+	granted, found := p.authorizations[code]
+	delete(p.authorizations, code)
+	p.mutex.Unlock()
+	if !found || time.Now().After(granted.expiresAt) {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "unknown, used or expired code")
+		return
+	}
+	if r.PostFormValue("redirect_uri") != granted.redirectURI {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "the redirect_uri doesn't match the authorization")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != granted.challenge {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "the code_verifier doesn't match the code_challenge")
+		return
+	}
+
+	now := time.Now()
+	granted.claims["iat"] = now.Unix()
+	granted.claims["exp"] = now.Add(time.Hour).Unix()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, granted.claims)
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	accessToken, err := randomString()
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func randomString() (string, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(value), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
+	"github.com/CosminMocanu97/dissertationBackend/internal/utils"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+// rewrap wraps the data key of every stored file and blob with the current master key, so the older master keys
+// can be retired. The files stored in plaintext, before the encryption at rest, are encrypted under new
+// storage keys.
+func main() {
+	env := flag.String("env", "staging", "Environment of the database")
+	rotate := flag.Bool("rotate", false, "Generate a new master key in the local KMS before re-wrapping")
+	flag.Parse()
+
+	utils.GetEnvVars()
+
+	db, err := database.CreateDbConnection(*env)
+	if err != nil {
+		log.Fatal("Error creating the database connection: %s", err.Error())
+	}
+	defer db.Close()
+
+	keyManager, err := encryption.NewKeyManagerFromEnv()
+	if err != nil {
+		log.Fatal("Error loading the master keys: %s", err.Error())
+	}
+
+	if *rotate {
+		kms, isLocalKMS := keyManager.(*encryption.LocalKMS)
+		if !isLocalKMS {
+			log.Fatal("The master keys can only be rotated by this command when using the local KMS, " +
+				"otherwise add a new key to MASTER_KEYS and point MASTER_KEY_ID to it")
+		}
+		if _, err := kms.Rotate(); err != nil {
+			log.Fatal("Error rotating the master key: %s", err.Error())
+		}
+	}
+
+	store := storage.NewStore(storage.RootFromEnv(), keyManager)
+	currentKeyID := keyManager.CurrentKeyID()
+
+	storedFiles, err := database.GetAllStoredFiles(db)
+	if err != nil {
+		log.Fatal("Error retrieving the stored files: %s", err.Error())
+	}
+
+	var rewrapped, encrypted, failed int
+	for _, storedFile := range storedFiles {
+		// the files encrypted with their password don't depend on the master keys
+		if storedFile.KeyID == currentKeyID || storedFile.KeyID == encryption.PasswordKeyID {
+			continue
+		}
+
+		if !storage.IsStorageKey(storedFile.Filepath) {
+			log.Error("The file with ID %d is not stored under a storage key, run migratestorage first", storedFile.ID)
+			failed++
+			continue
+		}
+
+		if len(storedFile.KeyID) == 0 {
+			// the plaintext is encrypted under a new key, so it stays readable until the file points to the copy
+			fileID, previousKey := storedFile.ID, storedFile.Filepath
+			_, err = store.Encrypt(previousKey, func(newKey string, keyID string, wrappedKey string) error {
+				return database.SetFileEncryptedStorageKey(db, fileID, previousKey, newKey, keyID, wrappedKey)
+			})
+		} else {
+			var keyID, wrappedKey string
+			keyID, wrappedKey, err = store.Rewrap(storedFile.KeyID, storedFile.WrappedKey)
+			if err == nil {
+				err = database.SetFileEncryptionKey(db, storedFile.ID, keyID, wrappedKey)
+			}
+		}
+		if err != nil {
+			log.Error("Error processing the file with ID %d: %s", storedFile.ID, err)
+			failed++
+			continue
+		}
+
+		if len(storedFile.KeyID) == 0 {
+			encrypted++
+		} else {
+			rewrapped++
+		}
+	}
+
+	blobs, err := database.GetAllBlobs(db)
+	if err != nil {
+		log.Fatal("Error retrieving the blobs: %s", err.Error())
+	}
+
+	for _, blob := range blobs {
+		if blob.KeyID == currentKeyID || blob.KeyID == encryption.PasswordKeyID {
+			continue
+		}
+
+		// the blobs made from the previous content of files stored before the encryption at rest can be plaintext
+		if len(blob.KeyID) == 0 {
+			blobID, previousKey := blob.ID, blob.StorageKey
+			_, err = store.Encrypt(previousKey, func(newKey string, keyID string, wrappedKey string) error {
+				return database.SetBlobEncryptedStorageKey(db, blobID, previousKey, newKey, keyID, wrappedKey)
+			})
+		} else {
+			var keyID, wrappedKey string
+			keyID, wrappedKey, err = store.Rewrap(blob.KeyID, blob.WrappedKey)
+			if err == nil {
+				err = database.SetBlobEncryptionKey(db, blob.ID, keyID, wrappedKey)
+			}
+		}
+		if err != nil {
+			log.Error("Error processing the blob with ID %d: %s", blob.ID, err)
+			failed++
+			continue
+		}
+
+		if len(blob.KeyID) == 0 {
+			encrypted++
+		} else {
+			rewrapped++
+		}
+	}
+
+	log.Info("Re-wrapped %d data keys and encrypted %d plaintext files with the master key %s, %d files failed",
+		rewrapped, encrypted, currentKeyID, failed)
+	if failed > 0 {
+		log.Fatal("Not all the files were processed, the older master keys must be kept")
+	}
+}
@@ -37,11 +37,14 @@ type AuthCustomClaims struct {
 	Id          int64  `json:"id"`
 	Email       string `json:"name"`
 	IsActivated bool   `json:"isActivated"`
+	// MFA is true when the user logged in with a second factor
+	MFA bool `json:"mfa"`
 	jwt.StandardClaims
 }
 
 type RefreshAuthCustomClaims struct {
 	Email string `json:"email"`
+	MFA   bool   `json:"mfa"`
 	jwt.StandardClaims
 }
 
@@ -66,11 +69,12 @@ func getSecretKey() string {
 	return secret
 }
 
-func (service *jwtServices) GenerateToken(id int64, email string, isActivated bool) map[string]string {
+func (service *jwtServices) GenerateToken(id int64, email string, isActivated bool, mfa bool) map[string]string {
 	claims := &AuthCustomClaims{
 		id,
 		email,
 		isActivated,
+		mfa,
 		jwt.StandardClaims{
 			ExpiresAt: time.Now().Add(time.Minute * 30).Unix(),
 			Issuer:    service.issuer,
@@ -87,6 +91,7 @@ func (service *jwtServices) GenerateToken(id int64, email string, isActivated bo
 
 	rtClaims := &RefreshAuthCustomClaims{
 		email,
+		mfa,
 		jwt.StandardClaims{
 			ExpiresAt: time.Now().Add(time.Hour * 2).Unix(),
 			Issuer:    service.issuer,
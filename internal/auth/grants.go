@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	UnlockGrantFile      = "file"
+	UnlockGrantSubfolder = "subfolder"
+
+	unlockGrantDuration = 30 * time.Minute
+)
+
+var (
+	InvalidUnlockGrant = errors.New("the unlock grant is not valid")
+)
+
+// UnlockGrantClaims prove that the user provided the password of a locked file or subfolder,
+// so the locked content can be listed without sending the password again
+type UnlockGrantClaims struct {
+	UserID int64  `json:"userId"`
+	Kind   string `json:"kind"`
+	ID     int64  `json:"id"`
+	jwt.StandardClaims
+}
+
+// the grants are signed with a key of their own, so they can never be used as access tokens
+func unlockGrantKey() []byte {
+	return []byte(getSecretKey() + ":unlock-grants")
+}
+
+func GenerateUnlockGrant(userID int64, kind string, id int64) (string, error) {
+	claims := &UnlockGrantClaims{
+		UserID: userID,
+		Kind:   kind,
+		ID:     id,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(unlockGrantDuration).Unix(),
+			Issuer:    "Dissertation",
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(unlockGrantKey())
+}
+
+// ValidateUnlockGrant returns the claims of the grant if it is valid and not expired
+func ValidateUnlockGrant(encodedGrant string) (*UnlockGrantClaims, error) {
+	var claims UnlockGrantClaims
+	token, err := jwt.ParseWithClaims(encodedGrant, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, isValid := token.Method.(*jwt.SigningMethodHMAC); !isValid {
+			return nil, fmt.Errorf("invalid unlock grant %s", token.Header["alg"])
+		}
+		return unlockGrantKey(), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, InvalidUnlockGrant
+	}
+	return &claims, nil
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/types"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
+)
+
+// the scopes of the API tokens, each one allowing what the previous ones allow
+const (
+	APITokenRead  = "read"
+	APITokenWrite = "write"
+	APITokenAdmin = "admin"
+)
+
+// APITokenPrefix starts the secrets of the API tokens, telling them apart from the JWTs
+const APITokenPrefix = "pat_"
+
+// apiTokenLastUsedPrecision is how often the last use of a token is recorded, so the requests of a script don't
+// all write to the database
+const apiTokenLastUsedPrecision = time.Minute
+
+// MaxAPITokenLifetime caps the expiry of the tokens, so a forgotten token stops working
+const MaxAPITokenLifetime = 365 * 24 * time.Hour
+
+var (
+	API_TOKEN_NOT_FOUND        = "the API token doesn't exist or was revoked"
+	API_TOKEN_EXPIRED          = "the API token expired"
+	API_TOKEN_NAME_IS_EMPTY    = "the API token needs a name"
+	INVALID_API_TOKEN_SCOPE    = "the scopes of the API tokens are read, write and admin"
+	API_TOKEN_EXPIRY_NOT_VALID = "the expiry of the API token must be in the future, at most a year away"
+)
+
+// apiTokenScopes ranks the scopes, a scope allowing what the lower ones allow
+var apiTokenScopes = map[string]int{APITokenRead: 1, APITokenWrite: 2, APITokenAdmin: 3}
+
+// APIToken is a personal access token, used by the scripts instead of the login. Only the hash of its secret is
+// stored, the secret being shown once when the token is created.
+type APIToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"userId"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	Revoked    bool       `json:"revoked"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// HasScope returns true if a scope of the token allows what the scope allows
+func (token APIToken) HasScope(scope string) bool {
+	for _, tokenScope := range token.Scopes {
+		if apiTokenScopes[tokenScope] >= apiTokenScopes[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+func CreateAPITokensTable(db *sql.DB) error {
+	// only the hash of the secret is stored, the token can't be rebuilt from the database
+	createAPITokensQuery :=
+		"CREATE TABLE if not exists api_tokens (id bigserial primary key, tokenhash text not null unique, " +
+			"userid bigint not null references users(id) on delete cascade, name text not null, scopes text[] not null, " +
+			"expiresat timestamptz not null, lastusedat timestamptz, revoked bool not null default false, " +
+			"createdat timestamptz not null default now());"
+	_, err := db.Exec(createAPITokensQuery)
+	if err != nil {
+		log.Error("Error creating the api_tokens table: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created api_tokens table")
+	return nil
+}
+
+const apiTokenColumns = "api_tokens.id, api_tokens.userid, api_tokens.name, api_tokens.scopes, api_tokens.expiresat, " +
+	"api_tokens.lastusedat, api_tokens.revoked, api_tokens.createdat"
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }, dest ...interface{}) (APIToken, error) {
+	var token APIToken
+	var lastUsedAt sql.NullTime
+	err := row.Scan(append([]interface{}{&token.ID, &token.UserID, &token.Name, pq.Array(&token.Scopes), &token.ExpiresAt,
+		&lastUsedAt, &token.Revoked, &token.CreatedAt}, dest...)...)
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return token, err
+}
+
+// AddAPIToken stores the token, identified by the hash of its secret, and returns its id
+func AddAPIToken(db *sql.DB, token APIToken, secret string) (int64, error) {
+	token.Name = strings.TrimSpace(token.Name)
+	if len(token.Name) == 0 {
+		return 0, errors.New(API_TOKEN_NAME_IS_EMPTY)
+	}
+	if len(token.Scopes) == 0 {
+		return 0, errors.New(INVALID_API_TOKEN_SCOPE)
+	}
+	for _, scope := range token.Scopes {
+		if _, found := apiTokenScopes[scope]; !found {
+			return 0, errors.New(INVALID_API_TOKEN_SCOPE)
+		}
+	}
+	if !token.ExpiresAt.After(time.Now()) || token.ExpiresAt.After(time.Now().Add(MaxAPITokenLifetime)) {
+		return 0, errors.New(API_TOKEN_EXPIRY_NOT_VALID)
+	}
+
+	addAPITokenStatement :=
+		"INSERT INTO api_tokens(tokenhash, userid, name, scopes, expiresat) VALUES($1, $2, $3, $4, $5) RETURNING id"
+	var tokenID int64
+	err := db.QueryRow(addAPITokenStatement, auth.ComputePasswordHash(secret), token.UserID, token.Name,
+		pq.Array(token.Scopes), token.ExpiresAt).Scan(&tokenID)
+	if err != nil {
+		log.Error("Error adding the API token of the user %d: %s", token.UserID, err)
+		return 0, err
+	}
+	return tokenID, nil
+}
+
+// GetAPIToken returns the token of the user with the id
+func GetAPIToken(db *sql.DB, tokenID int64, userID int64) (APIToken, error) {
+	getAPITokenQuery := "SELECT " + apiTokenColumns + " FROM api_tokens WHERE id=$1 AND userid=$2"
+	token, err := scanAPIToken(db.QueryRow(getAPITokenQuery, tokenID, userID))
+	if err == sql.ErrNoRows {
+		return token, errors.New(API_TOKEN_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error retrieving the API token %d: %s", tokenID, err)
+	}
+	return token, err
+}
+
+// GetAPITokens returns the tokens of the user, the newest first
+func GetAPITokens(db *sql.DB, userID int64) ([]APIToken, error) {
+	getAPITokensQuery := "SELECT " + apiTokenColumns + " FROM api_tokens WHERE userid=$1 ORDER BY id DESC"
+	rows, err := db.Query(getAPITokensQuery, userID)
+	if err != nil {
+		log.Error("Error retrieving the API tokens of the user %d: %s", userID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			log.Error("Error reading the API token of the user %d: %s", userID, err)
+			return tokens, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken disables the token, only its user can revoke it
+func RevokeAPIToken(db *sql.DB, tokenID int64, userID int64) error {
+	revokeAPITokenStatement := "UPDATE api_tokens SET revoked=true WHERE id=$1 AND userid=$2"
+	result, err := db.Exec(revokeAPITokenStatement, tokenID, userID)
+	if err != nil {
+		log.Error("Error revoking the API token %d: %s", tokenID, err)
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return errors.New(API_TOKEN_NOT_FOUND)
+	}
+	return nil
+}
+
+// GetAPITokenForSecret returns the token of the secret with its user, if it can still be used, and records its
+// use. The last use is only written once per minute.
+func GetAPITokenForSecret(db *sql.DB, secret string) (APIToken, types.User, error) {
+	var user types.User
+	getAPITokenQuery := "SELECT " + apiTokenColumns + ", users.email, users.isactivated FROM api_tokens " +
+		"JOIN users ON users.id=api_tokens.userid WHERE api_tokens.tokenhash=$1"
+	token, err := scanAPIToken(db.QueryRow(getAPITokenQuery, auth.ComputePasswordHash(secret)), &user.Email, &user.IsActivated)
+	if err == sql.ErrNoRows || (err == nil && token.Revoked) {
+		return token, user, errors.New(API_TOKEN_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error retrieving the API token: %s", err)
+		return token, user, err
+	}
+	user.ID = token.UserID
+	if !token.ExpiresAt.After(time.Now()) {
+		return token, user, errors.New(API_TOKEN_EXPIRED)
+	}
+
+	if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) >= apiTokenLastUsedPrecision {
+		_, err = db.Exec("UPDATE api_tokens SET lastusedat=now() WHERE id=$1", token.ID)
+		if err != nil {
+			// the token can still be used, only its last use is out of date
+			log.Error("Error recording the use of the API token %d: %s", token.ID, err)
+		}
+	}
+	return token, user, nil
+}
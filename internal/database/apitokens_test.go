@@ -0,0 +1,89 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPITokenScopesAreRanked(t *testing.T) {
+	for _, test := range []struct {
+		scopes  []string
+		scope   string
+		allowed bool
+	}{
+		{[]string{APITokenRead}, APITokenRead, true},
+		{[]string{APITokenRead}, APITokenWrite, false},
+		{[]string{APITokenWrite}, APITokenRead, true},
+		{[]string{APITokenWrite}, APITokenAdmin, false},
+		{[]string{APITokenRead, APITokenAdmin}, APITokenWrite, true},
+		{[]string{"unknown"}, APITokenRead, false},
+		{nil, APITokenRead, false},
+	} {
+		if allowed := (APIToken{Scopes: test.scopes}).HasScope(test.scope); allowed != test.allowed {
+			t.Errorf("the scopes %v allowed %s: %v, want %v", test.scopes, test.scope, allowed, test.allowed)
+		}
+	}
+}
+
+func TestAPITokenSecretExpiryAndRevocation(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ownerID := addTestUser(t, db, "owner@example.com")
+	otherUserID := addTestUser(t, db, "other@example.com")
+
+	token := APIToken{UserID: ownerID, Name: "script", Scopes: []string{APITokenRead}, ExpiresAt: time.Now().Add(time.Hour)}
+	for _, invalid := range []APIToken{
+		{UserID: ownerID, Scopes: token.Scopes, ExpiresAt: token.ExpiresAt},
+		{UserID: ownerID, Name: "script", ExpiresAt: token.ExpiresAt},
+		{UserID: ownerID, Name: "script", Scopes: []string{"root"}, ExpiresAt: token.ExpiresAt},
+		{UserID: ownerID, Name: "script", Scopes: token.Scopes, ExpiresAt: time.Now().Add(-time.Hour)},
+	} {
+		if _, err := AddAPIToken(db, invalid, APITokenPrefix+"invalid"); err == nil {
+			t.Fatalf("the invalid token %+v was added", invalid)
+		}
+	}
+
+	tokenID, err := AddAPIToken(db, token, APITokenPrefix+"secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, user, err := GetAPITokenForSecret(db, APITokenPrefix+"secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != tokenID || user.ID != ownerID {
+		t.Fatalf("the secret returned the token %d of the user %d", found.ID, user.ID)
+	}
+	if _, _, err = GetAPITokenForSecret(db, APITokenPrefix+"other secret"); errorText(err) != API_TOKEN_NOT_FOUND {
+		t.Fatalf("an unknown secret returned %v, want %s", err, API_TOKEN_NOT_FOUND)
+	}
+	var tokenHash string
+	if err = db.QueryRow("SELECT tokenhash FROM api_tokens WHERE id=$1", tokenID).Scan(&tokenHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = GetAPITokenForSecret(db, tokenHash); errorText(err) != API_TOKEN_NOT_FOUND {
+		t.Fatalf("the hash of the secret returned %v, want %s", err, API_TOKEN_NOT_FOUND)
+	}
+
+	// only the owner revokes the token
+	if err = RevokeAPIToken(db, tokenID, otherUserID); errorText(err) != API_TOKEN_NOT_FOUND {
+		t.Fatalf("revoking the token of another user returned %v, want %s", err, API_TOKEN_NOT_FOUND)
+	}
+	if err = RevokeAPIToken(db, tokenID, ownerID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = GetAPITokenForSecret(db, APITokenPrefix+"secret"); errorText(err) != API_TOKEN_NOT_FOUND {
+		t.Fatalf("the revoked token returned %v, want %s", err, API_TOKEN_NOT_FOUND)
+	}
+
+	expiringTokenID, err := AddAPIToken(db, token, APITokenPrefix+"expiring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("UPDATE api_tokens SET expiresat=$1 WHERE id=$2", time.Now().Add(-time.Hour), expiringTokenID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = GetAPITokenForSecret(db, APITokenPrefix+"expiring"); errorText(err) != API_TOKEN_EXPIRED {
+		t.Fatalf("the expired token returned %v, want %s", err, API_TOKEN_EXPIRED)
+	}
+}
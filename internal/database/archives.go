@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"path"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
+)
+
+// archiveNameReplacer keeps the filenames from adding folders to the archive
+var archiveNameReplacer = strings.NewReplacer("/", "_", "\\", "_")
+
+// setArchivePaths sets the paths of the files, renaming the ones with the same path like the copies
+func setArchivePaths(files []FileEntry, folderPaths []string) {
+	usedPaths := map[string]bool{}
+	for i := range files {
+		filename := archiveNameReplacer.Replace(files[i].Filename)
+		for n := 0; ; n++ {
+			filePath := path.Join(folderPaths[i], copyName(filename, n, true))
+			if !usedPaths[filePath] {
+				usedPaths[filePath] = true
+				files[i].Path = filePath
+				break
+			}
+		}
+	}
+}
+
+// GetNodeArchiveFiles returns the files of the node and of its descendants, their paths holding the names of the
+// folders between the node and them
+func GetNodeArchiveFiles(db *sql.DB, node Node) ([]FileEntry, error) {
+	filesCondition, arg := nodeFilesCondition(node)
+	files, err := getFileEntries(db, filesCondition, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	type archiveNode struct {
+		parentID int64
+		name     string
+	}
+	nodes := map[int64]archiveNode{}
+	getArchiveNodesQuery := "SELECT id, coalesce(parentid, 0), name FROM nodes WHERE path LIKE $1"
+	rows, err := db.Query(getArchiveNodesQuery, node.Path+"%")
+	if err != nil {
+		log.Error("Error retrieving the folders of the archive of the node %d: %s", node.ID, err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nodeID int64
+		var folder archiveNode
+		if err = rows.Scan(&nodeID, &folder.parentID, &folder.name); err != nil {
+			log.Error("Error binding a folder of the archive of the node %d: %s", node.ID, err)
+			return nil, err
+		}
+		nodes[nodeID] = folder
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the paths are built from the folder of each file up to the node, which is the root of the archive
+	folderPaths := make([]string, len(files))
+	for i, file := range files {
+		nodeID := file.NodeID
+		var names []string
+		for nodeID != node.ID {
+			folder, found := nodes[nodeID]
+			if !found {
+				break
+			}
+			names = append([]string{folder.name}, names...)
+			nodeID = folder.parentID
+		}
+		folderPaths[i] = path.Join(names...)
+	}
+	setArchivePaths(files, folderPaths)
+	return files, nil
+}
+
+// GetSelectedArchiveFiles returns the files with the ids, at the root of the archive. The missing files and the
+// files without a stored content are left out.
+func GetSelectedArchiveFiles(db *sql.DB, fileIDs []int64) ([]FileEntry, error) {
+	files, err := getFileEntries(db, "files.id = ANY($1)", pq.Array(fileIDs))
+	if err != nil {
+		return nil, err
+	}
+	setArchivePaths(files, make([]string, len(files)))
+	return files, nil
+}
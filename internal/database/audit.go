@@ -0,0 +1,409 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+// the actions recorded in the audit log
+const (
+	AuditRegister             = "register"
+	AuditLogin                = "login"
+	AuditActivate             = "activate"
+	AuditPasswordResetRequest = "password_reset_request"
+	AuditPasswordReset        = "password_reset"
+	AuditCreate               = "create"
+	AuditRead                 = "read"
+	AuditDownload             = "download"
+	AuditUpdate               = "update"
+	AuditDelete               = "delete"
+	AuditPasswordCheck        = "password_check"
+)
+
+// the types of the targets of the audit events
+const (
+	AuditTargetUser      = "user"
+	AuditTargetFolder    = "folder"
+	AuditTargetSubfolder = "subfolder"
+	AuditTargetFile      = "file"
+	AuditTargetLabel     = "label"
+	AuditTargetAuditLog  = "audit_log"
+	AuditTargetShareLink = "share_link"
+	AuditTargetNode      = "node"
+	AuditTargetAPIToken  = "api_token"
+	AuditTargetGroup     = "group"
+)
+
+// the results of the audited actions
+const (
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+	AuditFailure = "failure"
+)
+
+var INVALID_AUDIT_FILTER = "the filters of the audit log are not valid"
+
+// AuditEvent is an entry of the audit log. The zero ActorID and TargetID mean they are unknown.
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ActorID    int64     `json:"actorId"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"targetType"`
+	TargetID   int64     `json:"targetId"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+	Result     string    `json:"result"`
+	PrevHash   string    `json:"prevHash"`
+	Hash       string    `json:"hash"`
+}
+
+// AuditVerification is the result of checking the hash chain of the audit log
+type AuditVerification struct {
+	Valid          bool   `json:"valid"`
+	Events         int64  `json:"events"`
+	FirstInvalidID int64  `json:"firstInvalidId,omitempty"`
+	LastHash       string `json:"lastHash"`
+	HeadHash       string `json:"headHash"`
+	HeadEvents     int64  `json:"headEvents"`
+}
+
+// AuditFilter selects the audit events, the zero fields matching every event
+type AuditFilter struct {
+	ActorID    int64
+	TargetType string
+	TargetID   int64
+	Action     string
+	Result     string
+	From       time.Time
+	To         time.Time
+}
+
+var auditSortColumns = map[string]sortColumn{
+	"id":        {expression: "id", sqlType: "bigint"},
+	"createdAt": {expression: "createdat", sqlType: "timestamptz"},
+}
+
+func CreateAuditEventsTable(db *sql.DB) error {
+	createAuditEventsQuery :=
+		"CREATE TABLE if not exists audit_events (id bigserial primary key, createdat timestamptz not null, actorid bigint, " +
+			"action text not null, targettype text not null, targetid bigint, ip text not null, useragent text not null, " +
+			"result text not null, prevhash text not null, hash text not null unique);"
+	_, err := db.Exec(createAuditEventsQuery)
+	if err != nil {
+		log.Error("Error creating the audit_events table: %s", err)
+		return err
+	}
+
+	createAuditEventsIndexQuery := "CREATE INDEX if not exists audit_events_target ON audit_events (targettype, targetid)"
+	_, err = db.Exec(createAuditEventsIndexQuery)
+	if err != nil {
+		log.Error("Error creating the index of the audit_events targets: %s", err)
+		return err
+	}
+
+	// the head of the chain is kept out of the events, so removing the last events is detected too. The logs
+	// recorded before the head was kept start from their last event
+	createAuditChainHeadQuery :=
+		"CREATE TABLE if not exists audit_chain_head (id int primary key check (id = 1), hash text not null, events bigint not null)"
+	_, err = db.Exec(createAuditChainHeadQuery)
+	if err != nil {
+		log.Error("Error creating the audit_chain_head table: %s", err)
+		return err
+	}
+	initAuditChainHeadStatement :=
+		"INSERT INTO audit_chain_head(id, hash, events) " +
+			"SELECT 1, coalesce((SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1), ''), (SELECT count(*) FROM audit_events) " +
+			"ON CONFLICT (id) DO NOTHING"
+	_, err = db.Exec(initAuditChainHeadStatement)
+	if err != nil {
+		log.Error("Error initializing the head of the audit log: %s", err)
+		return err
+	}
+
+	// the auditors read the audit log without being admins
+	addAuditorColumnQuery := "ALTER TABLE users ADD COLUMN IF NOT EXISTS isauditor bool not null default false"
+	_, err = db.Exec(addAuditorColumnQuery)
+	if err != nil {
+		log.Error("Error adding the auditor role to the users table: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created audit_events table")
+	return nil
+}
+
+// UserIsAuditor returns true if the user can read the audit log, as an auditor or as an admin
+func UserIsAuditor(db *sql.DB, userID int64) (bool, error) {
+	userIsAuditorQuery := "SELECT isauditor OR isadmin FROM users WHERE id=$1"
+	var isAuditor bool
+	err := db.QueryRow(userIsAuditorQuery, userID).Scan(&isAuditor)
+	if err != nil {
+		log.Error("Error checking if the user with ID %d is an auditor: %s", userID, err)
+		return false, err
+	}
+	return isAuditor, nil
+}
+
+// SetUserAuditor grants or revokes the auditor role
+func SetUserAuditor(db *sql.DB, userID int64, isAuditor bool) error {
+	setUserAuditorStatement := "UPDATE users SET isauditor=$1 WHERE id=$2"
+	result, err := db.Exec(setUserAuditorStatement, isAuditor, userID)
+	if err != nil {
+		log.Error("Error changing the auditor role of the user %d: %s", userID, err)
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// auditHash chains the event to the previous one, every field being prefixed by its length so they can't be shifted
+func auditHash(event AuditEvent) string {
+	hash := sha256.New()
+	fields := []string{
+		event.PrevHash,
+		event.CreatedAt.UTC().Format(time.RFC3339Nano),
+		fmt.Sprint(event.ActorID),
+		event.Action,
+		event.TargetType,
+		fmt.Sprint(event.TargetID),
+		event.IP,
+		event.UserAgent,
+		event.Result,
+	}
+	for _, field := range fields {
+		fmt.Fprintf(hash, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// nullableID stores the unknown ids as NULL
+func nullableID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// RecordAuditEvent appends the event to the audit log, chained to the hash of the last event. The head of the chain
+// is locked, which serializes the inserts, and moved to the new event.
+func RecordAuditEvent(db *sql.DB, event AuditEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction recording the audit event: %s", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	lastHashQuery := "SELECT hash FROM audit_chain_head WHERE id=1 FOR UPDATE"
+	err = tx.QueryRow(lastHashQuery).Scan(&event.PrevHash)
+	if err != nil {
+		log.Error("Error retrieving the last hash of the audit log: %s", err)
+		return err
+	}
+
+	// postgres keeps microseconds, the hash is computed on the stored time
+	event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	event.Hash = auditHash(event)
+
+	insertAuditEventStatement :=
+		"INSERT INTO audit_events(createdat, actorid, action, targettype, targetid, ip, useragent, result, prevhash, hash) " +
+			"VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+	_, err = tx.Exec(insertAuditEventStatement, event.CreatedAt, nullableID(event.ActorID), event.Action, event.TargetType,
+		nullableID(event.TargetID), event.IP, event.UserAgent, event.Result, event.PrevHash, event.Hash)
+	if err != nil {
+		log.Error("Error recording the audit event %s of the user %d: %s", event.Action, event.ActorID, err)
+		return err
+	}
+
+	moveAuditChainHeadStatement := "UPDATE audit_chain_head SET hash=$1, events=events+1 WHERE id=1"
+	_, err = tx.Exec(moveAuditChainHeadStatement, event.Hash)
+	if err != nil {
+		log.Error("Error moving the head of the audit log: %s", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// scanAuditEvent reads a row selected with auditEventColumns
+func scanAuditEvent(rows *sql.Rows) (AuditEvent, error) {
+	var event AuditEvent
+	var actorID, targetID sql.NullInt64
+	err := rows.Scan(&event.ID, &event.CreatedAt, &actorID, &event.Action, &event.TargetType, &targetID,
+		&event.IP, &event.UserAgent, &event.Result, &event.PrevHash, &event.Hash)
+	event.ActorID, event.TargetID = actorID.Int64, targetID.Int64
+	event.CreatedAt = event.CreatedAt.UTC()
+	return event, err
+}
+
+const auditEventColumns = "id, createdat, actorid, action, targettype, targetid, ip, useragent, result, prevhash, hash"
+
+// auditFilterConditions returns the conditions selecting the events matching the filter
+func auditFilterConditions(filter AuditFilter, args *queryArgs) []string {
+	var conditions []string
+	if filter.ActorID != 0 {
+		conditions = append(conditions, "actorid="+args.add(filter.ActorID))
+	}
+	if len(filter.TargetType) > 0 {
+		conditions = append(conditions, "targettype="+args.add(filter.TargetType))
+	}
+	if filter.TargetID != 0 {
+		conditions = append(conditions, "targetid="+args.add(filter.TargetID))
+	}
+	if len(filter.Action) > 0 {
+		conditions = append(conditions, "action="+args.add(filter.Action))
+	}
+	if len(filter.Result) > 0 {
+		conditions = append(conditions, "result="+args.add(filter.Result))
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "createdat>="+args.add(filter.From))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "createdat<"+args.add(filter.To))
+	}
+	return conditions
+}
+
+// QueryAuditEvents returns a page of the events matching the filter
+func QueryAuditEvents(db *sql.DB, filter AuditFilter, page PageRequest) ([]AuditEvent, PageInfo, error) {
+	var pageInfo PageInfo
+	query, err := newPageQuery(page, auditSortColumns, "id", "id")
+	if err != nil {
+		log.Error("Error reading the page request of the audit log: %s", err)
+		return nil, pageInfo, err
+	}
+
+	var args queryArgs
+	conditions := auditFilterConditions(filter, &args)
+	countAuditEventsQuery := "SELECT count(*) FROM audit_events" + where(conditions)
+	err = db.QueryRow(countAuditEventsQuery, args...).Scan(&pageInfo.TotalCount)
+	if err != nil {
+		log.Error("Error counting the audit events: %s", err)
+		return nil, pageInfo, err
+	}
+
+	conditions = append(conditions, query.condition(&args))
+	queryAuditEventsQuery := "SELECT " + auditEventColumns + ", " + query.sortValue() + " FROM audit_events" +
+		where(conditions) + query.orderBy()
+	rows, err := db.Query(queryAuditEventsQuery, args...)
+	if err != nil {
+		log.Error("Error retrieving the audit events: %s", err)
+		return nil, pageInfo, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	var sortValues []string
+	for rows.Next() {
+		var event AuditEvent
+		var actorID, targetID sql.NullInt64
+		var sortValue string
+		err = rows.Scan(&event.ID, &event.CreatedAt, &actorID, &event.Action, &event.TargetType, &targetID,
+			&event.IP, &event.UserAgent, &event.Result, &event.PrevHash, &event.Hash, &sortValue)
+		if err != nil {
+			log.Error("Error reading the audit event: %s", err)
+			return events, pageInfo, err
+		}
+		event.ActorID, event.TargetID = actorID.Int64, targetID.Int64
+		event.CreatedAt = event.CreatedAt.UTC()
+		events = append(events, event)
+		sortValues = append(sortValues, sortValue)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Error reading the audit events: %s", err)
+		return events, pageInfo, err
+	}
+
+	var keep int
+	pageInfo.NextCursor, keep = query.nextCursor(len(events), func(index int) (string, int64) {
+		return sortValues[index], events[index].ID
+	})
+	return events[:keep], pageInfo, nil
+}
+
+// ExportAuditEvents calls export with every event matching the filter, in order, without holding them in memory
+func ExportAuditEvents(db *sql.DB, filter AuditFilter, export func(AuditEvent) error) error {
+	var args queryArgs
+	exportAuditEventsQuery := "SELECT " + auditEventColumns + " FROM audit_events" +
+		where(auditFilterConditions(filter, &args)) + " ORDER BY id"
+	rows, err := db.Query(exportAuditEventsQuery, args...)
+	if err != nil {
+		log.Error("Error exporting the audit events: %s", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			log.Error("Error reading the exported audit event: %s", err)
+			return err
+		}
+		if err = export(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// VerifyAuditChain recomputes the hashes of the audit log in order. An edited event doesn't match its hash,
+// a removed or reordered one breaks the link of the next event to the previous hash, and removing the last
+// events leaves the chain short of its head.
+func VerifyAuditChain(db *sql.DB) (AuditVerification, error) {
+	verification := AuditVerification{Valid: true}
+
+	// the events and the head are read from the same snapshot, the events recorded meanwhile being left out
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		log.Error("Error starting the transaction verifying the audit log: %s", err)
+		return verification, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT hash, events FROM audit_chain_head WHERE id=1").Scan(&verification.HeadHash, &verification.HeadEvents)
+	if err != nil {
+		log.Error("Error retrieving the head of the audit log: %s", err)
+		return verification, err
+	}
+
+	rows, err := tx.Query("SELECT " + auditEventColumns + " FROM audit_events ORDER BY id")
+	if err != nil {
+		log.Error("Error retrieving the audit log: %s", err)
+		return verification, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			log.Error("Error reading the audit event: %s", err)
+			return verification, err
+		}
+		verification.Events++
+		if event.PrevHash != verification.LastHash || auditHash(event) != event.Hash {
+			log.Error("The audit event %d doesn't match the hash chain", event.ID)
+			verification.Valid = false
+			verification.FirstInvalidID = event.ID
+			return verification, nil
+		}
+		verification.LastHash = event.Hash
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Error reading the audit log: %s", err)
+		return verification, err
+	}
+
+	if verification.LastHash != verification.HeadHash || verification.Events != verification.HeadEvents {
+		log.Error("The audit log ends with %d events at %s, while its head is at %d events and %s",
+			verification.Events, verification.LastHash, verification.HeadEvents, verification.HeadHash)
+		verification.Valid = false
+	}
+	return verification, nil
+}
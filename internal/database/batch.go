@@ -0,0 +1,248 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
+)
+
+// the operations of the batches
+const (
+	BatchDelete = "delete"
+	BatchMove   = "move"
+	BatchTag    = "tag"
+	BatchLock   = "lock"
+)
+
+var (
+	INVALID_BATCH_OPERATION = "the operation must be delete, move, tag or lock"
+	BATCH_ITEM_NOT_FOUND    = "the item doesn't exist"
+	BATCH_ITEM_NOT_OWNED    = "the item is not owned by the user"
+	BATCH_ITEM_NOT_APPLIED  = "the item was not changed, since another item of the batch failed"
+	ITEM_ALREADY_LOCKED     = "the item is already locked with a password"
+	BATCH_TAGS_MISSING      = "the tag operation needs tags to add or to remove"
+	BATCH_PASSWORD_MISSING  = "the lock operation needs a password"
+)
+
+// BatchOperation is the change applied to every item of a batch. The target is used by the moves, the tags by
+// the tag operation and the password by the locks.
+type BatchOperation struct {
+	Operation  string
+	Target     Node
+	AddTags    []string
+	RemoveTags []string
+	Password   string
+}
+
+// BatchItem is a file or a subfolder of a batch, with the details its checks need
+type BatchItem struct {
+	IsSubfolder bool
+	ID          int64
+	OwnerID     int64
+	FolderID    int64
+	SubfolderID int64
+	Locked      bool
+}
+
+// PrepareBatchOperation validates the operation, hashing the password of the locks
+func PrepareBatchOperation(operation *BatchOperation) error {
+	var err error
+	switch operation.Operation {
+	case BatchDelete, BatchMove:
+	case BatchTag:
+		if operation.AddTags, err = normalizeTags(operation.AddTags); err != nil {
+			return err
+		}
+		if operation.RemoveTags, err = normalizeTags(operation.RemoveTags); err != nil {
+			return err
+		}
+		if len(operation.AddTags) == 0 && len(operation.RemoveTags) == 0 {
+			return errors.New(BATCH_TAGS_MISSING)
+		}
+	case BatchLock:
+		if len(operation.Password) == 0 {
+			return errors.New(BATCH_PASSWORD_MISSING)
+		}
+		operation.Password = auth.ComputePasswordHash(operation.Password)
+	default:
+		return errors.New(INVALID_BATCH_OPERATION)
+	}
+	return nil
+}
+
+// GetBatchItems returns the files and the subfolders with the ids, the missing ones being left out
+func GetBatchItems(db *sql.DB, fileIDs []int64, subfolderIDs []int64) (map[int64]BatchItem, map[int64]BatchItem, error) {
+	files := map[int64]BatchItem{}
+	subfolders := map[int64]BatchItem{}
+	for _, items := range []struct {
+		query       string
+		ids         []int64
+		isSubfolder bool
+		found       map[int64]BatchItem
+	}{
+		{"SELECT id, ownerid, folderid, subfolderid, filelocked FROM files WHERE id = ANY($1)", fileIDs, false, files},
+		{"SELECT id, ownerid, folderid, id, islocked FROM subfolders WHERE id = ANY($1)", subfolderIDs, true, subfolders},
+	} {
+		if len(items.ids) == 0 {
+			continue
+		}
+		rows, err := db.Query(items.query, pq.Array(items.ids))
+		if err != nil {
+			log.Error("Error retrieving the items of the batch: %s", err)
+			return files, subfolders, err
+		}
+		for rows.Next() {
+			item := BatchItem{IsSubfolder: items.isSubfolder}
+			err = rows.Scan(&item.ID, &item.OwnerID, &item.FolderID, &item.SubfolderID, &item.Locked)
+			if err != nil {
+				rows.Close()
+				log.Error("Error binding an item of the batch: %s", err)
+				return files, subfolders, err
+			}
+			items.found[item.ID] = item
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return files, subfolders, err
+		}
+	}
+	return files, subfolders, nil
+}
+
+// ApplyBatch applies the operation prepared by PrepareBatchOperation to the items, and returns the error of each of
+// them, nil for the changed ones. Each item is changed in its own transaction, or, when atomic is set, all of them
+// in one transaction which is rolled back at the first error, the other items getting BATCH_ITEM_NOT_APPLIED.
+func ApplyBatch(db *sql.DB, userID int64, operation BatchOperation, items []BatchItem, atomic bool) ([]error, error) {
+	itemErrors := make([]error, len(items))
+	if !atomic {
+		for i, item := range items {
+			itemErrors[i] = applyBatchItemInTransaction(db, userID, operation, item)
+		}
+		return itemErrors, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction of the batch: %s", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for i, item := range items {
+		if err = applyBatchItem(tx, userID, operation, item); err != nil {
+			for j := range itemErrors {
+				itemErrors[j] = errors.New(BATCH_ITEM_NOT_APPLIED)
+			}
+			itemErrors[i] = err
+			return itemErrors, nil
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error("Error committing the batch: %s", err)
+		return nil, err
+	}
+	return itemErrors, nil
+}
+
+func applyBatchItemInTransaction(db *sql.DB, userID int64, operation BatchOperation, item BatchItem) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction of the batch: %s", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = applyBatchItem(tx, userID, operation, item); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyBatchItem applies the operation to the item. The content of the deleted files stored before the
+// deduplication gets a blob first, so it is removed by the blob garbage collection like the other contents.
+func applyBatchItem(tx *sql.Tx, userID int64, operation BatchOperation, item BatchItem) error {
+	var err error
+	switch {
+	case operation.Operation == BatchDelete && !item.IsSubfolder:
+		if _, err = ensureFileBlob(tx, item.ID); err == nil {
+			_, err = removeFiles(tx, "files.id=$1", item.ID)
+		}
+	case operation.Operation == BatchDelete:
+		if err = ensureFilesBlobs(tx, "subfolderid=$1", item.ID); err == nil {
+			_, err = removeFiles(tx, "files.subfolderid=$1", item.ID)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM subfolders WHERE id=$1", item.ID)
+		}
+	case operation.Operation == BatchMove && !item.IsSubfolder:
+		err = moveFile(tx, item.ID, operation.Target, "")
+	case operation.Operation == BatchMove:
+		getSubfolderNodeQuery := "SELECT " + nodeColumns + " FROM nodes WHERE nodes.subfolderid=$1 AND nodes.depth=1"
+		var node Node
+		node, err = scanNode(tx.QueryRow(getSubfolderNodeQuery, item.ID))
+		if err == nil {
+			err = moveNode(tx, node, operation.Target, node.Name)
+		}
+	case operation.Operation == BatchTag:
+		target := fileMetadataTarget
+		if item.IsSubfolder {
+			target = subfolderMetadataTarget
+		}
+		edit := MetadataEdit{AddTags: operation.AddTags, RemoveTags: operation.RemoveTags}
+		err = editItemsMetadata(tx, target, item.FolderID, userID, []int64{item.ID}, edit, nil)
+	case operation.Operation == BatchLock:
+		lockStatement := "UPDATE files SET filepassword=$1, filelocked=true WHERE id=$2 AND NOT filelocked"
+		if item.IsSubfolder {
+			lockStatement = "UPDATE subfolders SET password=$1, islocked=true WHERE id=$2 AND NOT islocked"
+		}
+		var res sql.Result
+		res, err = tx.Exec(lockStatement, operation.Password, item.ID)
+		if err == nil {
+			var rowsAffected int64
+			rowsAffected, err = res.RowsAffected()
+			if err == nil && rowsAffected == 0 {
+				err = errors.New(ITEM_ALREADY_LOCKED)
+			}
+		}
+	}
+	if err == sql.ErrNoRows {
+		// the item was removed since it was checked
+		return errors.New(BATCH_ITEM_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error applying the %s operation to the item %d: %s", operation.Operation, item.ID, err)
+	}
+	return err
+}
+
+// ensureFilesBlobs is ensureFileBlob for the files matching the condition on the files table
+func ensureFilesBlobs(tx *sql.Tx, filesCondition string, args ...interface{}) error {
+	rows, err := tx.Query("SELECT id FROM files WHERE blobid IS NULL AND "+filesCondition, args...)
+	if err != nil {
+		log.Error("Error retrieving the files stored without a blob: %s", err)
+		return err
+	}
+	var fileIDs []int64
+	for rows.Next() {
+		var fileID int64
+		if err = rows.Scan(&fileID); err != nil {
+			rows.Close()
+			log.Error("Error binding a file stored without a blob: %s", err)
+			return err
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, fileID := range fileIDs {
+		if _, err = ensureFileBlob(tx, fileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,541 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+// Blob is the stored content of one or more files and file versions.
+// The blobs with the same hash are shared, refcount holding the number of files and versions referencing them.
+type Blob struct {
+	ID         int64
+	Hash       string
+	StorageKey string
+	Size       int64
+	KeyID      string
+	WrappedKey string
+	KeySalt    string
+}
+
+type FileVersionDetails struct {
+	ID        int64
+	Size      int64
+	CreatedAt time.Time
+	CreatedBy int64
+}
+
+func CreateBlobsTable(db *sql.DB) error {
+	// hash is null for the blobs that can't be shared: the files encrypted with their password and the files
+	// stored before the deduplication
+	createBlobsQuery :=
+		"CREATE TABLE if not exists blobs (id serial primary key, hash text unique, storagekey text not null unique, " +
+			"size bigint not null default 0, keyid text not null default '', wrappedkey text not null default '', " +
+			"keysalt text not null default '', refcount bigint not null default 0, updatedat timestamptz not null default now());"
+	_, err := db.Exec(createBlobsQuery)
+	if err != nil {
+		log.Error("Error creating the blobs table: %s", err)
+		return err
+	}
+
+	addBlobToFilesQuery := "ALTER TABLE files ADD COLUMN IF NOT EXISTS blobid bigint references blobs(id);"
+	_, err = db.Exec(addBlobToFilesQuery)
+	if err != nil {
+		log.Error("Error adding the blob column to the files table: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created blobs table")
+	return nil
+}
+
+func CreateFileVersionsTable(db *sql.DB) error {
+	createFileVersionsQuery :=
+		"CREATE TABLE if not exists file_versions (id serial primary key, fileid bigint not null, " +
+			"blobid bigint not null references blobs(id), createdby bigint not null, createdat timestamptz not null default now());"
+	_, err := db.Exec(createFileVersionsQuery)
+	if err != nil {
+		log.Error("Error creating the file_versions table: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created file_versions table")
+	return nil
+}
+
+// AttachBlob makes the blob the current content of the file, inside a transaction.
+// If a blob with the same hash already exists it is shared and place is not called, otherwise the blob is
+// inserted and place is called to move its content under the storage key before the transaction is committed.
+// The previous content of the file is kept as a version when keepVersion is set, and released otherwise.
+// It returns true if the blob content was placed, false if an existing blob was reused.
+func AttachBlob(db *sql.DB, fileID int64, userID int64, blob Blob, keepVersion bool, place func(storageKey string) error) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction to attach a blob to the file with ID %d: %s", fileID, err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	placed, err := attachBlob(tx, fileID, userID, blob, keepVersion, place)
+	if err != nil {
+		return placed, err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error("Error committing the blob of the file with ID %d: %s", fileID, err)
+		return placed, err
+	}
+	return placed, nil
+}
+
+// attachBlob is AttachBlob inside a transaction
+func attachBlob(tx *sql.Tx, fileID int64, userID int64, blob Blob, keepVersion bool, place func(storageKey string) error) (bool, error) {
+	// lock the file first, so concurrent updates of the same file are versioned one after the other
+	var previousBlobID sql.NullInt64
+	var ownerID, folderID, previousSize int64
+	var legacyStorageKey, legacyKeyID, legacyWrappedKey, legacyKeySalt string
+	lockFileQuery :=
+		"SELECT files.blobid, files.ownerid, files.folderid, coalesce(blobs.size, 0), files.filepath, files.keyid, files.wrappedkey, files.keysalt " +
+			"FROM files LEFT JOIN blobs ON blobs.id=files.blobid WHERE files.id=$1 FOR UPDATE OF files"
+	err := tx.QueryRow(lockFileQuery, fileID).Scan(&previousBlobID, &ownerID, &folderID, &previousSize,
+		&legacyStorageKey, &legacyKeyID, &legacyWrappedKey, &legacyKeySalt)
+	if err != nil {
+		log.Error("Error locking the file with ID %d: %s", fileID, err)
+		return false, err
+	}
+	isLegacyFile := !previousBlobID.Valid && storage.IsStorageKey(legacyStorageKey)
+
+	// the new content is charged to the owner of the file and to its workspace, the previous content
+	// stays charged when it is kept as a version. A file counts once it has content
+	chargedBytes := blob.Size
+	if !keepVersion {
+		chargedBytes -= previousSize
+	}
+	chargedFiles := int64(0)
+	if !previousBlobID.Valid && len(legacyStorageKey) == 0 {
+		chargedFiles = 1
+	}
+	if err = chargeFileQuotas(tx, ownerID, folderID, chargedBytes, chargedFiles); err != nil {
+		return false, err
+	}
+
+	var placed bool
+	blob.ID, placed, err = addBlob(tx, blob, place)
+	if err != nil {
+		log.Error("Error adding the blob for the file with ID %d: %s", fileID, err)
+		return placed, err
+	}
+
+	// the files stored before the deduplication get a blob for their previous content, so it can be versioned
+	if isLegacyFile {
+		insertLegacyBlobStatement :=
+			"INSERT INTO blobs(storagekey, keyid, wrappedkey, keysalt, refcount) VALUES($1, $2, $3, $4, 1) RETURNING id"
+		var legacyBlobID int64
+		err = tx.QueryRow(insertLegacyBlobStatement, legacyStorageKey, legacyKeyID, legacyWrappedKey, legacyKeySalt).Scan(&legacyBlobID)
+		if err != nil {
+			log.Error("Error adding the blob for the previous content of the file with ID %d: %s", fileID, err)
+			return placed, err
+		}
+		previousBlobID = sql.NullInt64{Int64: legacyBlobID, Valid: true}
+	}
+
+	if previousBlobID.Valid {
+		if keepVersion {
+			// the reference of the file moves to the version, so the refcount stays the same
+			addVersionStatement := "INSERT INTO file_versions(fileid, blobid, createdby) VALUES($1, $2, $3)"
+			_, err = tx.Exec(addVersionStatement, fileID, previousBlobID.Int64, userID)
+		} else {
+			releaseBlobStatement := "UPDATE blobs SET refcount=refcount-1, updatedat=now() WHERE id=$1"
+			_, err = tx.Exec(releaseBlobStatement, previousBlobID.Int64)
+		}
+		if err != nil {
+			log.Error("Error keeping the previous content of the file with ID %d: %s", fileID, err)
+			return placed, err
+		}
+	}
+
+	setFileBlobStatement := "UPDATE files SET blobid=$1, size=$2, modifiedat=now() WHERE id=$3"
+	_, err = tx.Exec(setFileBlobStatement, blob.ID, blob.Size, fileID)
+	if err != nil {
+		log.Error("Error setting the blob of the file with ID %d: %s", fileID, err)
+		return placed, err
+	}
+	return placed, nil
+}
+
+// addBlob returns the id of the blob with a reference to it. A stored blob with the same hash is shared, otherwise
+// the blob is inserted and place is called to move its content under the storage key. It returns true if the blob
+// content was placed.
+func addBlob(tx *sql.Tx, blob Blob, place func(storageKey string) error) (int64, bool, error) {
+	blobID, err := findBlobByHash(tx, blob.Hash)
+	if err != nil || blobID != 0 {
+		return blobID, false, err
+	}
+
+	var hash interface{}
+	if len(blob.Hash) > 0 {
+		hash = blob.Hash
+	}
+	// an upload of the same content committing first makes the insert do nothing, the blob is then shared
+	insertBlobStatement :=
+		"INSERT INTO blobs(hash, storagekey, size, keyid, wrappedkey, keysalt, refcount) VALUES($1, $2, $3, $4, $5, $6, 1) " +
+			"ON CONFLICT (hash) DO NOTHING RETURNING id"
+	err = tx.QueryRow(insertBlobStatement, hash, blob.StorageKey, blob.Size, blob.KeyID, blob.WrappedKey, blob.KeySalt).Scan(&blobID)
+	if err == sql.ErrNoRows {
+		blobID, err = findBlobByHash(tx, blob.Hash)
+		return blobID, false, err
+	} else if err != nil {
+		return 0, false, err
+	}
+	err = place(blob.StorageKey)
+	return blobID, err == nil, err
+}
+
+// findBlobByHash returns the id of the stored blob with the hash, after adding a reference to it, or 0 if there's none.
+// The row lock makes the garbage collector skip the blob, or makes us wait until it was removed.
+func findBlobByHash(tx *sql.Tx, hash string) (int64, error) {
+	if len(hash) == 0 {
+		return 0, nil
+	}
+
+	var blobID int64
+	referenceBlobStatement :=
+		"UPDATE blobs SET refcount=refcount+1, updatedat=now() WHERE id=(SELECT id FROM blobs WHERE hash=$1 FOR UPDATE) RETURNING id"
+	err := tx.QueryRow(referenceBlobStatement, hash).Scan(&blobID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		log.Error("Error referencing the blob with hash %s: %s", hash, err)
+		return 0, err
+	}
+
+	log.Info("The content with hash %s is already stored as the blob %d", hash, blobID)
+	return blobID, nil
+}
+
+// releaseFileBlobs drops the references held by the files matching the condition and by their versions,
+// and removes the versions. It must run in the transaction removing the files.
+func releaseFileBlobs(tx *sql.Tx, filesCondition string, args ...interface{}) error {
+	releaseBlobsStatement := fmt.Sprintf(
+		"UPDATE blobs SET refcount=blobs.refcount-refs.count, updatedat=now() FROM ("+
+			"SELECT blobid, count(*) AS count FROM ("+
+			"SELECT blobid FROM files WHERE blobid IS NOT NULL AND %[1]s "+
+			"UNION ALL SELECT file_versions.blobid FROM file_versions JOIN files ON files.id=file_versions.fileid WHERE %[1]s"+
+			") AS referenced GROUP BY blobid) AS refs WHERE blobs.id=refs.blobid", filesCondition)
+	_, err := tx.Exec(releaseBlobsStatement, args...)
+	if err != nil {
+		log.Error("Error releasing the blobs of the files: %s", err)
+		return err
+	}
+
+	removeVersionsStatement := fmt.Sprintf("DELETE FROM file_versions WHERE fileid IN (SELECT id FROM files WHERE %s)", filesCondition)
+	_, err = tx.Exec(removeVersionsStatement, args...)
+	if err != nil {
+		log.Error("Error removing the versions of the files: %s", err)
+		return err
+	}
+	return nil
+}
+
+// removeFilesReleasingBlobs deletes the files matching the condition, and releases their blobs and their usage
+// of the quotas, in a transaction
+func removeFilesReleasingBlobs(db *sql.DB, filesCondition string, args ...interface{}) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction to remove files: %s", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rowsAffected, err := removeFiles(tx, filesCondition, args...)
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected, tx.Commit()
+}
+
+// removeFiles is removeFilesReleasingBlobs inside a transaction
+func removeFiles(tx *sql.Tx, filesCondition string, args ...interface{}) (int64, error) {
+	if err := releaseFilesQuotas(tx, filesCondition, args...); err != nil {
+		return 0, err
+	}
+	if err := releaseFileBlobs(tx, filesCondition, args...); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec("DELETE FROM files WHERE "+filesCondition, args...)
+	if err != nil {
+		log.Error("Error removing the files: %s", err)
+		return 0, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		log.Error("Error retrieving the number of removed files: %s", err)
+		return 0, err
+	}
+	return rowsAffected, nil
+}
+
+func GetFileVersions(db *sql.DB, fileID int64) ([]FileVersionDetails, error) {
+	getFileVersionsQuery :=
+		"SELECT file_versions.id, blobs.size, file_versions.createdat, file_versions.createdby FROM file_versions " +
+			"JOIN blobs ON blobs.id=file_versions.blobid WHERE file_versions.fileid=$1 ORDER BY file_versions.id DESC"
+	rows, err := db.Query(getFileVersionsQuery, fileID)
+	if err != nil {
+		log.Error("Error getting the versions of the file with ID %d: %s", fileID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []FileVersionDetails
+	for rows.Next() {
+		var version FileVersionDetails
+		err = rows.Scan(&version.ID, &version.Size, &version.CreatedAt, &version.CreatedBy)
+		if err != nil {
+			log.Error("Error binding the version details of the file with ID %d: %s", fileID, err)
+			return versions, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+func GetFileVersionBlob(db *sql.DB, fileID int64, versionID int64) (Blob, error) {
+	getFileVersionBlobQuery :=
+		"SELECT blobs.id, coalesce(blobs.hash, ''), blobs.storagekey, blobs.size, blobs.keyid, blobs.wrappedkey, blobs.keysalt " +
+			"FROM file_versions JOIN blobs ON blobs.id=file_versions.blobid WHERE file_versions.id=$1 AND file_versions.fileid=$2"
+	var blob Blob
+	err := db.QueryRow(getFileVersionBlobQuery, versionID, fileID).Scan(&blob.ID, &blob.Hash, &blob.StorageKey, &blob.Size,
+		&blob.KeyID, &blob.WrappedKey, &blob.KeySalt)
+	if err == sql.ErrNoRows {
+		errorMessage := fmt.Sprintf("No version %d found for the file with ID %d", versionID, fileID)
+		log.Error(errorMessage)
+		return blob, errors.New(errorMessage)
+	} else if err != nil {
+		log.Error("Error getting the version %d of the file with ID %d: %s", versionID, fileID, err)
+		return blob, err
+	}
+	return blob, nil
+}
+
+// GetFileVersionBlobs returns the blobs of the versions of the file, by version id
+func GetFileVersionBlobs(db *sql.DB, fileID int64) (map[int64]Blob, error) {
+	getFileVersionBlobsQuery :=
+		"SELECT file_versions.id, blobs.id, coalesce(blobs.hash, ''), blobs.storagekey, blobs.size, blobs.keyid, blobs.wrappedkey, " +
+			"blobs.keysalt FROM file_versions JOIN blobs ON blobs.id=file_versions.blobid WHERE file_versions.fileid=$1"
+	rows, err := db.Query(getFileVersionBlobsQuery, fileID)
+	if err != nil {
+		log.Error("Error getting the version blobs of the file with ID %d: %s", fileID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := map[int64]Blob{}
+	for rows.Next() {
+		var versionID int64
+		var blob Blob
+		err = rows.Scan(&versionID, &blob.ID, &blob.Hash, &blob.StorageKey, &blob.Size, &blob.KeyID, &blob.WrappedKey, &blob.KeySalt)
+		if err != nil {
+			log.Error("Error binding the version blobs of the file with ID %d: %s", fileID, err)
+			return nil, err
+		}
+		blobs[versionID] = blob
+	}
+	return blobs, rows.Err()
+}
+
+// ReencryptFileBlobs replaces, in one transaction, the content of a file encrypted with its password and the
+// versions encrypted with it by their blobs encrypted again, so none of them stays readable with the old password.
+// The removed versions, the ones the old password couldn't decrypt, are dropped. The file stays locked when
+// passwordEncrypted is set, the blobs then being encrypted with the new password, and is unlocked otherwise.
+// place is called like for AttachBlob, for each blob whose content is stored.
+func ReencryptFileBlobs(db *sql.DB, fileID int64, userID int64, blob Blob, versions map[int64]Blob, removedVersionIDs []int64,
+	passwordEncrypted bool, place func(storageKey string) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction to re-encrypt the file with ID %d: %s", fileID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = attachBlob(tx, fileID, userID, blob, false, place); err != nil {
+		return err
+	}
+
+	// the blobs of the versions are replaced rather than changed, they may be shared
+	for versionID, versionBlob := range versions {
+		versionBlob.ID, _, err = addBlob(tx, versionBlob, place)
+		if err != nil {
+			log.Error("Error adding the re-encrypted blob of the version %d of the file with ID %d: %s", versionID, fileID, err)
+			return err
+		}
+
+		var previousBlobID int64
+		getVersionBlobQuery := "SELECT blobid FROM file_versions WHERE id=$1 AND fileid=$2 FOR UPDATE"
+		err = tx.QueryRow(getVersionBlobQuery, versionID, fileID).Scan(&previousBlobID)
+		if err == sql.ErrNoRows {
+			// the version was removed meanwhile, nothing references the new blob
+			previousBlobID, err = versionBlob.ID, nil
+		} else if err == nil {
+			_, err = tx.Exec("UPDATE file_versions SET blobid=$1 WHERE id=$2", versionBlob.ID, versionID)
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE blobs SET refcount=refcount-1, updatedat=now() WHERE id=$1", previousBlobID)
+		}
+		if err != nil {
+			log.Error("Error replacing the blob of the version %d of the file with ID %d: %s", versionID, fileID, err)
+			return err
+		}
+	}
+
+	var removedBytes int64
+	for _, versionID := range removedVersionIDs {
+		var blobID, size int64
+		removeVersionStatement := "DELETE FROM file_versions WHERE id=$1 AND fileid=$2 RETURNING blobid"
+		err = tx.QueryRow(removeVersionStatement, versionID, fileID).Scan(&blobID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err == nil {
+			releaseBlobStatement := "UPDATE blobs SET refcount=refcount-1, updatedat=now() WHERE id=$1 RETURNING size"
+			err = tx.QueryRow(releaseBlobStatement, blobID).Scan(&size)
+		}
+		if err != nil {
+			log.Error("Error removing the version %d of the file with ID %d: %s", versionID, fileID, err)
+			return err
+		}
+		removedBytes += size
+	}
+	if removedBytes > 0 {
+		var ownerID, folderID int64
+		err = tx.QueryRow("SELECT ownerid, folderid FROM files WHERE id=$1", fileID).Scan(&ownerID, &folderID)
+		if err != nil {
+			log.Error("Error retrieving the owner of the file with ID %d: %s", fileID, err)
+			return err
+		}
+		if err = chargeFileQuotas(tx, ownerID, folderID, -removedBytes, 0); err != nil {
+			return err
+		}
+	}
+
+	setFilePasswordStatement := "UPDATE files SET filepassword='', filelocked=$1 WHERE id=$2"
+	_, err = tx.Exec(setFilePasswordStatement, passwordEncrypted, fileID)
+	if err != nil {
+		log.Error("Error setting the password of the file with ID %d: %s", fileID, err)
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("Error committing the re-encryption of the file with ID %d: %s", fileID, err)
+		return err
+	}
+	return nil
+}
+
+// GetAllBlobs returns every blob, used by the maintenance commands
+func GetAllBlobs(db *sql.DB) ([]Blob, error) {
+	getAllBlobsQuery :=
+		"SELECT id, coalesce(hash, ''), storagekey, size, keyid, wrappedkey, keysalt FROM blobs ORDER BY id"
+	rows, err := db.Query(getAllBlobsQuery)
+	if err != nil {
+		log.Error("Error getting the blobs: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []Blob
+	for rows.Next() {
+		var blob Blob
+		err = rows.Scan(&blob.ID, &blob.Hash, &blob.StorageKey, &blob.Size, &blob.KeyID, &blob.WrappedKey, &blob.KeySalt)
+		if err != nil {
+			log.Error("Error binding the blob details: %s", err)
+			return blobs, err
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+func SetBlobEncryptionKey(db *sql.DB, blobID int64, keyID string, wrappedKey string) error {
+	setBlobEncryptionKeyStatement := "UPDATE blobs SET keyid=$1, wrappedkey=$2 WHERE id=$3"
+	_, err := db.Exec(setBlobEncryptionKeyStatement, keyID, wrappedKey, blobID)
+	if err != nil {
+		log.Error("Error setting the encryption key of the blob with ID %d: %s", blobID, err)
+		return err
+	}
+	return nil
+}
+
+// SetBlobEncryptedStorageKey points a blob stored in plaintext to its encrypted copy, like SetFileEncryptedStorageKey
+func SetBlobEncryptedStorageKey(db *sql.DB, blobID int64, previousStorageKey string, storageKey string, keyID string, wrappedKey string) error {
+	setBlobEncryptedStorageKeyStatement := "UPDATE blobs SET storagekey=$1, keyid=$2, wrappedkey=$3 WHERE id=$4 AND storagekey=$5"
+	res, err := db.Exec(setBlobEncryptedStorageKeyStatement, storageKey, keyID, wrappedKey, blobID, previousStorageKey)
+	if err != nil {
+		log.Error("Error setting the encrypted storage key of the blob with ID %d: %s", blobID, err)
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		log.Error("Error retrieving the number of rows affected when setting the encrypted storage key of the blob with ID %d: %s", blobID, err)
+		return err
+	}
+	if rowsAffected != 1 {
+		errorMessage := fmt.Sprintf("There were %d rows affected, while there was 1 row expected", rowsAffected)
+		log.Error("%s", errorMessage)
+		return errors.New(errorMessage)
+	}
+	return nil
+}
+
+// CollectUnreferencedBlobs removes the blobs nobody referenced for at least gracePeriod, calling remove for their
+// content once the rows are gone. The rows are locked with SKIP LOCKED, so a blob being reused by an upload
+// in flight is never collected. It returns the number of collected blobs.
+func CollectUnreferencedBlobs(db *sql.DB, gracePeriod time.Duration, batchSize int, remove func(storageKey string) error) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction to collect the blobs: %s", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	collectBlobsStatement :=
+		"DELETE FROM blobs WHERE id IN (SELECT id FROM blobs WHERE refcount<=0 AND updatedat < now() - $1::bigint * interval '1 second' " +
+			"ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED) RETURNING storagekey"
+	rows, err := tx.Query(collectBlobsStatement, int64(gracePeriod.Seconds()), batchSize)
+	if err != nil {
+		log.Error("Error collecting the unreferenced blobs: %s", err)
+		return 0, err
+	}
+
+	var storageKeys []string
+	for rows.Next() {
+		var storageKey string
+		if err = rows.Scan(&storageKey); err != nil {
+			rows.Close()
+			log.Error("Error binding the storage key of a collected blob: %s", err)
+			return 0, err
+		}
+		storageKeys = append(storageKeys, storageKey)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("Error committing the collected blobs: %s", err)
+		return 0, err
+	}
+
+	// the content is removed after the commit: if the removal fails, the file is left behind without a row,
+	// which wastes space but never leaves a row without content
+	for _, storageKey := range storageKeys {
+		if err := remove(storageKey); err != nil {
+			log.Error("Error removing the content of the collected blob %s: %s", storageKey, err)
+		}
+	}
+	return len(storageKeys), nil
+}
@@ -0,0 +1,617 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+const (
+	CopyConflictFail      = "fail"
+	CopyConflictRename    = "rename"
+	CopyConflictOverwrite = "overwrite"
+)
+
+const (
+	CopyJobRunning = "running"
+	CopyJobDone    = "done"
+	CopyJobFailed  = "failed"
+)
+
+var (
+	INVALID_COPY_CONFLICT   = "the conflict policy must be fail, rename or overwrite"
+	NODE_COPY_NOT_SUPPORTED = "the subfolders can only be copied to a workspace, and the deeper folders under a folder of a workspace"
+	NODE_COPY_INTO_ITSELF   = "a folder can't be copied inside itself"
+	FILE_COPY_TO_WORKSPACE  = "the files are copied to the folders of a workspace, not to the workspace itself"
+	FILE_NOT_COPYABLE       = "the content of the file is not stored in a way that can be copied"
+	COPY_JOB_NOT_FOUND      = "the copy job doesn't exist"
+)
+
+// CopyOptions tell what the copies keep. Conflict is applied to the names already used in the target: fail
+// rejects the copy, rename adds a " (n)" suffix and overwrite replaces the files and merges into the folders.
+// The files whose content is encrypted with their password always keep it.
+type CopyOptions struct {
+	// Name is the name of the copy, empty keeping the name of the source
+	Name             string
+	IncludePasswords bool
+	IncludeTags      bool
+	IncludeVersions  bool
+	Conflict         string
+}
+
+// CopyJob is the copy of a folder with everything below it, made in the background for the large trees
+type CopyJob struct {
+	ID           int64     `json:"id"`
+	OwnerID      int64     `json:"ownerId"`
+	SourceNodeID int64     `json:"sourceNodeId"`
+	TargetNodeID int64     `json:"targetNodeId"`
+	ResultNodeID int64     `json:"resultNodeId"`
+	Status       string    `json:"status"`
+	TotalFiles   int64     `json:"totalFiles"`
+	CopiedFiles  int64     `json:"copiedFiles"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+func CreateCopyJobsTable(db *sql.DB) error {
+	createCopyJobsQuery :=
+		"CREATE TABLE if not exists copy_jobs (id bigserial primary key, ownerid bigint not null references users(id) on delete cascade, " +
+			"sourcenodeid bigint not null, targetnodeid bigint not null, resultnodeid bigint, status text not null, " +
+			"totalfiles bigint not null default 0, copiedfiles bigint not null default 0, error text not null default '', " +
+			"createdat timestamptz not null default now(), updatedat timestamptz not null default now());"
+	_, err := db.Exec(createCopyJobsQuery)
+	if err != nil {
+		log.Error("Error creating the copy_jobs table: %s", err)
+		return err
+	}
+
+	// the jobs run in the server process, the ones still running when it stopped won't finish
+	failInterruptedJobsStatement := "UPDATE copy_jobs SET status=$1, error=$2, updatedat=now() WHERE status=$3"
+	_, err = db.Exec(failInterruptedJobsStatement, CopyJobFailed, "the copy was interrupted by a restart of the server", CopyJobRunning)
+	if err != nil {
+		log.Error("Error failing the interrupted copy jobs: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created copy_jobs table")
+	return nil
+}
+
+func validateCopyOptions(options *CopyOptions) error {
+	switch options.Conflict {
+	case "":
+		options.Conflict = CopyConflictFail
+	case CopyConflictFail, CopyConflictRename, CopyConflictOverwrite:
+	default:
+		return errors.New(INVALID_COPY_CONFLICT)
+	}
+	return nil
+}
+
+// copyName returns the name tried for the n-th conflict, the suffix going before the extension of the files
+func copyName(name string, n int, isFile bool) string {
+	if n == 0 {
+		return name
+	}
+	extension := ""
+	if isFile {
+		extension = filepath.Ext(name)
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, extension), n, extension)
+}
+
+// ensureFileBlob locks the file and returns its blob. The files stored before the deduplication get a blob for
+// their content, like when a new version is uploaded, and 0 is returned for the ones without a stored content.
+func ensureFileBlob(tx *sql.Tx, fileID int64) (int64, error) {
+	var blobID sql.NullInt64
+	var storageKey, keyID, wrappedKey, keySalt string
+	lockFileQuery := "SELECT blobid, filepath, keyid, wrappedkey, keysalt FROM files WHERE id=$1 FOR UPDATE"
+	err := tx.QueryRow(lockFileQuery, fileID).Scan(&blobID, &storageKey, &keyID, &wrappedKey, &keySalt)
+	if err != nil {
+		log.Error("Error locking the file with ID %d: %s", fileID, err)
+		return 0, err
+	}
+	if blobID.Valid {
+		return blobID.Int64, nil
+	}
+	if !storage.IsStorageKey(storageKey) {
+		return 0, nil
+	}
+
+	insertLegacyBlobStatement :=
+		"INSERT INTO blobs(storagekey, keyid, wrappedkey, keysalt, refcount) VALUES($1, $2, $3, $4, 1) RETURNING id"
+	err = tx.QueryRow(insertLegacyBlobStatement, storageKey, keyID, wrappedKey, keySalt).Scan(&blobID.Int64)
+	if err != nil {
+		log.Error("Error adding the blob for the content of the file with ID %d: %s", fileID, err)
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE files SET blobid=$1 WHERE id=$2", blobID.Int64, fileID)
+	if err != nil {
+		log.Error("Error setting the blob of the file with ID %d: %s", fileID, err)
+		return 0, err
+	}
+	return blobID.Int64, nil
+}
+
+// claimFileName locks the node and returns the name the copy of the file gets in it, removing the file it
+// overwrites. A file is never overwritten by its own copy, which gets a suffixed name instead, and only the files
+// of the owner of the copy are overwritten.
+func claimFileName(tx *sql.Tx, nodeID int64, filename string, conflict string, sourceFileID int64, ownerID int64) (string, error) {
+	var lockedID int64
+	err := tx.QueryRow("SELECT id FROM nodes WHERE id=$1 FOR UPDATE", nodeID).Scan(&lockedID)
+	if err == sql.ErrNoRows {
+		return "", errors.New(NODE_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error locking the node %d: %s", nodeID, err)
+		return "", err
+	}
+
+	getNodeFileQuery := "SELECT id, ownerid FROM files WHERE nodeid=$1 AND filename=$2"
+	for n := 0; ; n++ {
+		candidate := copyName(filename, n, true)
+		var existingFileID, existingOwnerID int64
+		err = tx.QueryRow(getNodeFileQuery, nodeID, candidate).Scan(&existingFileID, &existingOwnerID)
+		if err == sql.ErrNoRows {
+			return candidate, nil
+		} else if err != nil {
+			log.Error("Error retrieving the file %s of the node %d: %s", candidate, nodeID, err)
+			return "", err
+		}
+
+		switch {
+		case conflict == CopyConflictFail:
+			log.Error("The node %d already has a file named %s", nodeID, candidate)
+			return "", errors.New(FILE_ALREADY_EXISTS)
+		case conflict == CopyConflictOverwrite && existingOwnerID != ownerID:
+			log.Error("The user %d can't overwrite the file %d of the user %d", ownerID, existingFileID, existingOwnerID)
+			return "", errors.New(FILE_ALREADY_EXISTS)
+		case conflict == CopyConflictOverwrite && existingFileID != sourceFileID:
+			// the content of the overwritten file is released to the blob garbage collection
+			if _, err = ensureFileBlob(tx, existingFileID); err != nil {
+				return "", err
+			}
+			if _, err = removeFiles(tx, "files.id=$1", existingFileID); err != nil {
+				return "", err
+			}
+			return candidate, nil
+		}
+	}
+}
+
+// copyFile copies the file to the node, sharing its blobs, and charges the copy to the user and to the workspace
+// of the node. It returns the id and the name of the copy.
+func copyFile(tx *sql.Tx, fileID int64, ownerID int64, target Node, filename string, options CopyOptions) (int64, string, error) {
+	blobID, err := ensureFileBlob(tx, fileID)
+	if err != nil {
+		return 0, "", err
+	} else if blobID == 0 {
+		log.Error("The file with ID %d has no stored content to copy", fileID)
+		return 0, "", errors.New(FILE_NOT_COPYABLE)
+	}
+
+	var sourceFilename, filePassword, mimeType string
+	var fileLocked, passwordEncrypted bool
+	var size, versionsSize int64
+	var label sql.NullString
+	getSourceFileQuery :=
+		"SELECT files.filename, coalesce(files.filepassword, ''), files.filelocked, blobs.keysalt <> '', files.mimetype, blobs.size, " +
+			"coalesce((SELECT sum(versionblobs.size) FROM file_versions JOIN blobs AS versionblobs ON versionblobs.id=file_versions.blobid " +
+			"WHERE file_versions.fileid=files.id), 0), files.label FROM files JOIN blobs ON blobs.id=files.blobid WHERE files.id=$1"
+	err = tx.QueryRow(getSourceFileQuery, fileID).Scan(&sourceFilename, &filePassword, &fileLocked, &passwordEncrypted,
+		&mimeType, &size, &versionsSize, &label)
+	if err != nil {
+		log.Error("Error retrieving the file with ID %d to copy: %s", fileID, err)
+		return 0, "", err
+	}
+	if len(filename) == 0 {
+		filename = sourceFilename
+	}
+	if !options.IncludePasswords && !passwordEncrypted {
+		filePassword, fileLocked = "", false
+	}
+	if !options.IncludeVersions {
+		versionsSize = 0
+	}
+
+	filename, err = claimFileName(tx, target.ID, filename, options.Conflict, fileID, ownerID)
+	if err != nil {
+		return 0, "", err
+	}
+	if err = chargeFileQuotas(tx, ownerID, target.FolderID, size+versionsSize, 1); err != nil {
+		return 0, "", err
+	}
+
+	var copyID int64
+	copyFileStatement :=
+		"INSERT INTO files(ownerid, folderid, subfolderid, nodeid, filename, filepath, filepassword, filelocked, mimetype, size, blobid, label) " +
+			"VALUES($1, $2, $3, $4, $5, '', $6, $7, $8, $9, $10, $11) RETURNING id"
+	err = tx.QueryRow(copyFileStatement, ownerID, target.FolderID, target.SubfolderID, target.ID, filename, filePassword,
+		fileLocked, mimeType, size, blobID, label).Scan(&copyID)
+	if err != nil {
+		log.Error("Error adding the copy of the file with ID %d: %s", fileID, err)
+		return 0, "", err
+	}
+	_, err = tx.Exec("UPDATE blobs SET refcount=refcount+1, updatedat=now() WHERE id=$1", blobID)
+	if err != nil {
+		log.Error("Error referencing the blob %d from the copy of the file with ID %d: %s", blobID, fileID, err)
+		return 0, "", err
+	}
+
+	if options.IncludeVersions {
+		// the versions of the copy reference the same blobs
+		copyVersionsStatement :=
+			"INSERT INTO file_versions(fileid, blobid, createdby, createdat) " +
+				"SELECT $1, blobid, createdby, createdat FROM file_versions WHERE fileid=$2 ORDER BY id"
+		_, err = tx.Exec(copyVersionsStatement, copyID, fileID)
+		if err == nil {
+			referenceVersionBlobsStatement :=
+				"UPDATE blobs SET refcount=blobs.refcount+refs.count, updatedat=now() FROM (" +
+					"SELECT blobid, count(*) AS count FROM file_versions WHERE fileid=$1 GROUP BY blobid) AS refs WHERE blobs.id=refs.blobid"
+			_, err = tx.Exec(referenceVersionBlobsStatement, copyID)
+		}
+		if err != nil {
+			log.Error("Error copying the versions of the file with ID %d: %s", fileID, err)
+			return 0, "", err
+		}
+	}
+
+	if options.IncludeTags {
+		// the metadata values are kept for the fields of the workspace of the copy
+		copyTagsStatement := "INSERT INTO file_tags(fileid, tag) SELECT $1, tag FROM file_tags WHERE fileid=$2"
+		_, err = tx.Exec(copyTagsStatement, copyID, fileID)
+		if err == nil {
+			copyMetadataStatement :=
+				"INSERT INTO file_metadata_values(fileid, fieldid, value, numbervalue, datevalue) " +
+					"SELECT $1, fieldid, value, numbervalue, datevalue FROM file_metadata_values " +
+					"WHERE fileid=$2 AND fieldid IN (SELECT id FROM metadata_fields WHERE folderid=$3)"
+			_, err = tx.Exec(copyMetadataStatement, copyID, fileID, target.FolderID)
+		}
+		if err != nil {
+			log.Error("Error copying the tags and metadata of the file with ID %d: %s", fileID, err)
+			return 0, "", err
+		}
+	}
+
+	log.Info("Successfully copied the file with ID %d to the file %d of the node %d", fileID, copyID, target.ID)
+	return copyID, filename, nil
+}
+
+// CopyFile copies the file to a folder of the tree, below a subfolder. The copy is owned by the user, shares the
+// stored content of the file and, depending on the options, its password, tags, metadata and versions. Its share
+// links, watchers and access log are not copied, and the label it inherits can't be lowered. It returns the id and
+// the name of the copy.
+func CopyFile(db *sql.DB, fileID int64, ownerID int64, target Node, options CopyOptions) (int64, string, error) {
+	if target.Depth == 0 {
+		return 0, "", errors.New(FILE_COPY_TO_WORKSPACE)
+	}
+	if err := validateCopyOptions(&options); err != nil {
+		return 0, "", err
+	}
+	if len(options.Name) > 0 {
+		if err := validateFilename(options.Name); err != nil {
+			return 0, "", err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction copying the file %d: %s", fileID, err)
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var folderID, subfolderID int64
+	err = tx.QueryRow("SELECT folderid, subfolderid FROM files WHERE id=$1", fileID).Scan(&folderID, &subfolderID)
+	if err != nil {
+		log.Error("Error retrieving the subfolder of the file with ID %d to copy: %s", fileID, err)
+		return 0, "", err
+	}
+	if err = verifyLabelNotLowered(tx, folderID, subfolderID, target.FolderID, target.SubfolderID); err != nil {
+		return 0, "", err
+	}
+
+	copyID, filename, err := copyFile(tx, fileID, ownerID, target, options.Name, options)
+	if err != nil {
+		return 0, "", err
+	}
+	return copyID, filename, tx.Commit()
+}
+
+// copyNodeName adds a copy of a folder under the parent with add, applying the conflict policy to the name, and
+// returns it. Overwriting a folder merges the copy into it.
+func copyNodeName(db *sql.DB, parent Node, name string, conflict string, add func(name string) (int64, error)) (Node, error) {
+	for n := 0; ; n++ {
+		candidate := copyName(name, n, false)
+		nodeID, err := add(candidate)
+		if err == nil {
+			return GetNode(db, nodeID)
+		} else if err.Error() != NODE_ALREADY_EXISTS || conflict == CopyConflictFail {
+			return Node{}, err
+		}
+
+		if conflict == CopyConflictOverwrite {
+			return getChildNode(db, parent.ID, candidate)
+		}
+	}
+}
+
+// getChildNode returns the child of the parent with the name
+func getChildNode(db *sql.DB, parentID int64, name string) (Node, error) {
+	getChildNodeQuery := "SELECT " + nodeColumns + " FROM nodes WHERE nodes.parentid=$1 AND nodes.name=$2"
+	node, err := scanNode(db.QueryRow(getChildNodeQuery, parentID, name))
+	if err != nil {
+		log.Error("Error retrieving the node %s under the node %d: %s", name, parentID, err)
+	}
+	return node, err
+}
+
+// copySubfolder adds the copy of the subfolder in the workspace of the target, with its label and, depending on
+// the options, its password, tags and metadata
+func copySubfolder(db *sql.DB, ownerID int64, source Node, target Node, options CopyOptions) (Node, error) {
+	return copyNodeName(db, target, options.Name, options.Conflict, func(name string) (int64, error) {
+		var subfolderID int64
+		copySubfolderStatement :=
+			"INSERT INTO subfolders(ownerid, folderid, name, password, islocked, label) " +
+				"SELECT $1, $2, $3, CASE WHEN $4 THEN password ELSE '' END, $4 AND islocked, label FROM subfolders WHERE id=$5 RETURNING id"
+		err := db.QueryRow(copySubfolderStatement, ownerID, target.FolderID, name, options.IncludePasswords, source.SubfolderID).Scan(&subfolderID)
+		if err != nil {
+			log.Error("Error adding the copy of the subfolder %d: %s", source.SubfolderID, err)
+			return 0, err
+		}
+
+		nodeID, err := addNode(db, target.ID, ownerID, name, target.FolderID, subfolderID)
+		if err != nil {
+			_, rmErr := db.Exec("DELETE FROM subfolders WHERE id=$1", subfolderID)
+			if rmErr != nil {
+				log.Error("Error removing the copy %d of the subfolder %d: %s", subfolderID, source.SubfolderID, rmErr)
+			}
+			return 0, err
+		}
+
+		if options.IncludeTags {
+			copySubfolderTagsStatement := "INSERT INTO subfolder_tags(subfolderid, tag) SELECT $1, tag FROM subfolder_tags WHERE subfolderid=$2"
+			_, err = db.Exec(copySubfolderTagsStatement, subfolderID, source.SubfolderID)
+			if err == nil {
+				copySubfolderMetadataStatement :=
+					"INSERT INTO subfolder_metadata_values(subfolderid, fieldid, value, numbervalue, datevalue) " +
+						"SELECT $1, fieldid, value, numbervalue, datevalue FROM subfolder_metadata_values " +
+						"WHERE subfolderid=$2 AND fieldid IN (SELECT id FROM metadata_fields WHERE folderid=$3)"
+				_, err = db.Exec(copySubfolderMetadataStatement, subfolderID, source.SubfolderID, target.FolderID)
+			}
+			if err != nil {
+				log.Error("Error copying the tags and metadata of the subfolder %d: %s", source.SubfolderID, err)
+				return 0, err
+			}
+		}
+		return nodeID, nil
+	})
+}
+
+// AddCopyJob checks the copy of the source node under the target, and records it as a running job with the
+// number of files to copy. Like for the moves, the label the copies inherit can't be lowered.
+func AddCopyJob(db *sql.DB, ownerID int64, source Node, target Node, options CopyOptions) (CopyJob, error) {
+	var job CopyJob
+	switch {
+	case source.Depth == 0, source.Depth == 1 && target.Depth != 0, source.Depth > 1 && target.Depth == 0:
+		return job, errors.New(NODE_COPY_NOT_SUPPORTED)
+	case strings.HasPrefix(target.Path, source.Path):
+		return job, errors.New(NODE_COPY_INTO_ITSELF)
+	}
+	if err := validateCopyOptions(&options); err != nil {
+		return job, err
+	}
+	if len(options.Name) > 0 && !IsNodeNameValid(options.Name) {
+		return job, errors.New(INVALID_NODE_NAME)
+	}
+	// the copy of a subfolder keeps its label, the deeper folders take the one of the subfolder they land in
+	sourceSubfolderID := source.SubfolderID
+	if source.Depth == 1 {
+		sourceSubfolderID = 0
+	}
+	err := verifyLabelNotLowered(db, source.FolderID, sourceSubfolderID, target.FolderID, target.SubfolderID)
+	if err != nil {
+		return job, err
+	}
+
+	filesCondition, arg := nodeFilesCondition(source)
+	var totalFiles int64
+	countFilesQuery := "SELECT count(*) FROM files WHERE " + fileHasContentCondition + " AND " + filesCondition
+	err = db.QueryRow(countFilesQuery, arg).Scan(&totalFiles)
+	if err != nil {
+		log.Error("Error counting the files of the node %d: %s", source.ID, err)
+		return job, err
+	}
+
+	addCopyJobStatement :=
+		"INSERT INTO copy_jobs(ownerid, sourcenodeid, targetnodeid, status, totalfiles) VALUES($1, $2, $3, $4, $5) " +
+			"RETURNING " + copyJobColumns
+	job, err = scanCopyJob(db.QueryRow(addCopyJobStatement, ownerID, source.ID, target.ID, CopyJobRunning, totalFiles))
+	if err != nil {
+		log.Error("Error adding the job copying the node %d under the node %d: %s", source.ID, target.ID, err)
+		return job, err
+	}
+	return job, nil
+}
+
+// copyJobColumns are the columns read by scanCopyJob
+var copyJobColumns = "id, ownerid, sourcenodeid, targetnodeid, coalesce(resultnodeid, 0), status, totalfiles, copiedfiles, " +
+	"error, createdat, updatedat"
+
+func scanCopyJob(row interface{ Scan(...interface{}) error }) (CopyJob, error) {
+	var job CopyJob
+	err := row.Scan(&job.ID, &job.OwnerID, &job.SourceNodeID, &job.TargetNodeID, &job.ResultNodeID, &job.Status,
+		&job.TotalFiles, &job.CopiedFiles, &job.Error, &job.CreatedAt, &job.UpdatedAt)
+	return job, err
+}
+
+func GetCopyJob(db *sql.DB, jobID int64) (CopyJob, error) {
+	getCopyJobQuery := "SELECT " + copyJobColumns + " FROM copy_jobs WHERE id=$1"
+	job, err := scanCopyJob(db.QueryRow(getCopyJobQuery, jobID))
+	if err == sql.ErrNoRows {
+		return job, errors.New(COPY_JOB_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error retrieving the copy job %d: %s", jobID, err)
+		return job, err
+	}
+	return job, nil
+}
+
+// RunCopyJob copies the source node under the target, recording the progress in the job after every file, and
+// returns the finished job. Every file is copied in its own transaction, so a failed job keeps what was copied
+// before the error.
+func RunCopyJob(db *sql.DB, job CopyJob, source Node, target Node, options CopyOptions) (CopyJob, error) {
+	resultNodeID, err := copyNode(db, job, source, target, options)
+
+	status, errorMessage := CopyJobDone, ""
+	if err != nil {
+		status, errorMessage = CopyJobFailed, err.Error()
+	}
+	finishCopyJobStatement :=
+		"UPDATE copy_jobs SET status=$1, error=$2, resultnodeid=$3, updatedat=now() WHERE id=$4 RETURNING " + copyJobColumns
+	job, finishErr := scanCopyJob(db.QueryRow(finishCopyJobStatement, status, errorMessage, nullableID(resultNodeID), job.ID))
+	if finishErr != nil {
+		log.Error("Error finishing the copy job %d: %s", job.ID, finishErr)
+		if err == nil {
+			err = finishErr
+		}
+	}
+	return job, err
+}
+
+// copyNode copies the node, its descendants and their files, and returns the id of the copy
+func copyNode(db *sql.DB, job CopyJob, source Node, target Node, options CopyOptions) (int64, error) {
+	if err := validateCopyOptions(&options); err != nil {
+		return 0, err
+	}
+	if len(options.Name) == 0 {
+		options.Name = source.Name
+	}
+
+	var root Node
+	var err error
+	if source.Depth == 1 {
+		root, err = copySubfolder(db, job.OwnerID, source, target, options)
+	} else {
+		root, err = copyNodeName(db, target, options.Name, options.Conflict, func(name string) (int64, error) {
+			return addNode(db, target.ID, job.OwnerID, name, target.FolderID, target.SubfolderID)
+		})
+	}
+	if err != nil {
+		return 0, err
+	} else if root.ID == source.ID {
+		// overwriting the source merges it into itself
+		return 0, errors.New(NODE_COPY_INTO_ITSELF)
+	}
+
+	// the descendants are read before copying, parents first, so the copies are never copied again
+	getDescendantsQuery := "SELECT " + nodeColumns + " FROM nodes WHERE nodes.path LIKE $1 AND nodes.id<>$2 ORDER BY nodes.depth, nodes.id"
+	rows, err := db.Query(getDescendantsQuery, source.Path+"%", source.ID)
+	if err != nil {
+		log.Error("Error retrieving the descendants of the node %d: %s", source.ID, err)
+		return root.ID, err
+	}
+	var descendants []Node
+	for rows.Next() {
+		descendant, err := scanNode(rows)
+		if err != nil {
+			rows.Close()
+			log.Error("Error reading a descendant of the node %d: %s", source.ID, err)
+			return root.ID, err
+		}
+		descendants = append(descendants, descendant)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return root.ID, err
+	}
+
+	copies := map[int64]Node{source.ID: root}
+	for _, descendant := range descendants {
+		parent, ok := copies[descendant.ParentID]
+		if !ok {
+			continue
+		}
+		copies[descendant.ID], err = copyNodeName(db, parent, descendant.Name, options.Conflict, func(name string) (int64, error) {
+			return addNode(db, parent.ID, job.OwnerID, name, root.FolderID, root.SubfolderID)
+		})
+		if err != nil {
+			return root.ID, err
+		}
+	}
+
+	filesCondition, arg := nodeFilesCondition(source)
+	getFilesQuery := "SELECT files.id, coalesce(files.nodeid, 0) FROM files WHERE " + fileHasContentCondition + " AND " +
+		filesCondition + " ORDER BY files.id"
+	rows, err = db.Query(getFilesQuery, arg)
+	if err != nil {
+		log.Error("Error retrieving the files of the node %d: %s", source.ID, err)
+		return root.ID, err
+	}
+	type sourceFile struct {
+		id     int64
+		nodeID int64
+	}
+	var files []sourceFile
+	for rows.Next() {
+		var file sourceFile
+		if err = rows.Scan(&file.id, &file.nodeID); err != nil {
+			rows.Close()
+			log.Error("Error reading a file of the node %d: %s", source.ID, err)
+			return root.ID, err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return root.ID, err
+	}
+
+	var copiedFiles int64
+	for _, file := range files {
+		// the files without a node are the ones directly in the copied subfolder
+		fileTarget, ok := copies[file.nodeID]
+		if !ok {
+			fileTarget = root
+		}
+		err = copyFileInTransaction(db, file.id, job.OwnerID, fileTarget, options)
+		if err == sql.ErrNoRows {
+			// the file was removed since the copy started
+			continue
+		} else if err != nil {
+			return root.ID, err
+		}
+
+		copiedFiles++
+		_, err = db.Exec("UPDATE copy_jobs SET copiedfiles=$1, updatedat=now() WHERE id=$2", copiedFiles, job.ID)
+		if err != nil {
+			log.Error("Error updating the progress of the copy job %d: %s", job.ID, err)
+			return root.ID, err
+		}
+	}
+
+	log.Info("Successfully copied the node %d under the node %d as the node %d", source.ID, target.ID, root.ID)
+	return root.ID, nil
+}
+
+// copyFileInTransaction copies a file of a tree to the copy of its node, keeping its name
+func copyFileInTransaction(db *sql.DB, fileID int64, ownerID int64, target Node, options CopyOptions) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction copying the file %d: %s", fileID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	_, _, err = copyFile(tx, fileID, ownerID, target, "", options)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -60,6 +60,86 @@ func InitiateDatabaseTables(db *sql.DB) {
 		log.Fatal("Error creating the folders table: %s", err)
 	}
 
+	err = CreateBlobsTable(db)
+	if err != nil {
+		log.Fatal("Error creating the blobs table: %s", err)
+	}
+
+	err = CreateFileVersionsTable(db)
+	if err != nil {
+		log.Fatal("Error creating the file_versions table: %s", err)
+	}
+
+	err = CreateQuotasTable(db)
+	if err != nil {
+		log.Fatal("Error creating the quotas table: %s", err)
+	}
+
+	err = CreateBlobContentsTable(db)
+	if err != nil {
+		log.Fatal("Error creating the blob_contents table: %s", err)
+	}
+
+	err = CreateFileMetadataTable(db)
+	if err != nil {
+		log.Fatal("Error creating the file_tags table: %s", err)
+	}
+
+	err = CreateMetadataTables(db)
+	if err != nil {
+		log.Fatal("Error creating the metadata tables: %s", err)
+	}
+
+	err = CreateLabelsTable(db)
+	if err != nil {
+		log.Fatal("Error creating the sensitivity_labels table: %s", err)
+	}
+
+	err = CreateUserMFAColumns(db)
+	if err != nil {
+		log.Fatal("Error adding the two factor authentication columns: %s", err)
+	}
+
+	err = CreateAuditEventsTable(db)
+	if err != nil {
+		log.Fatal("Error creating the audit_events table: %s", err)
+	}
+
+	err = CreateFileWatchersTable(db)
+	if err != nil {
+		log.Fatal("Error creating the file_watchers table: %s", err)
+	}
+
+	err = CreateShareLinksTable(db)
+	if err != nil {
+		log.Fatal("Error creating the share_links table: %s", err)
+	}
+
+	err = CreateNodesTable(db)
+	if err != nil {
+		log.Fatal("Error creating the nodes table: %s", err)
+	}
+
+	err = CreateCopyJobsTable(db)
+	if err != nil {
+		log.Fatal("Error creating the copy_jobs table: %s", err)
+	}
+
+	err = CreateAPITokensTable(db)
+	if err != nil {
+		log.Fatal("Error creating the api_tokens table: %s", err)
+	}
+
+	err = CreateOIDCTables(db)
+	if err != nil {
+		log.Fatal("Error creating the single sign-on tables: %s", err)
+	}
+
+	err = CreateSCIMTables(db)
+	if err != nil {
+		log.Fatal("Error creating the provisioning tables: %s", err)
+	}
+
 }
 
 func GetEnvVars() {
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/types"
+)
+
+// newTestDatabase connects to the database in TEST_DATABASE_URL and creates the tables in a schema of their own,
+// removed by the returned function. The tests are skipped when no test database is configured.
+func newTestDatabase(t *testing.T) (*sql.DB, func()) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if len(url) == 0 {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("test_%d_%d", os.Getpid(), time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	}
+
+	// the connections of the test only see the tables of its schema
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("postgres", url+separator+"search_path="+schema)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	InitiateDatabaseTables(db)
+	return db, func() {
+		db.Close()
+		cleanup()
+	}
+}
+
+// addTestUser adds an activated user, returning its id
+func addTestUser(t *testing.T, db *sql.DB, email string) int64 {
+	if _, err := AddNewUser(db, types.RegistrationData{Email: email, Password: "password"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	var userID int64
+	if err := db.QueryRow("SELECT id FROM users WHERE email=$1", email).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ActivateAccount(db, userID); err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+// addTestSubfolder adds a workspace of the user with a subfolder, returning their ids
+func addTestSubfolder(t *testing.T, db *sql.DB, userID int64, name string) (int64, int64) {
+	folderID, err := AddNewFolder(db, userID, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subfolderID, err := AddNewSubfolder(db, userID, folderID, name, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return folderID, subfolderID
+}
+
+// addTestFile adds a file of the user directly in the subfolder, returning its id
+func addTestFile(t *testing.T, db *sql.DB, userID int64, folderID int64, subfolderID int64, filename string) int64 {
+	fileID, err := AddNewFile(db, userID, folderID, subfolderID, 0, filename, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileID
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+// FileEntry is a file with its place in the tree and what is needed to open its content, read by the archives and
+// the WebDAV interface
+type FileEntry struct {
+	ID          int64
+	OwnerID     int64
+	FolderID    int64
+	SubfolderID int64
+	NodeID      int64
+	Filename    string
+	// Path is the name of the file in an archive, under the names of the folders it is in
+	Path            string
+	Size            int64
+	ModifiedAt      time.Time
+	FileLocked      bool
+	SubfolderLocked bool
+	// Blob.ID is 0 for the files stored before the deduplication
+	Blob Blob
+}
+
+// getFileEntries returns the files with a stored content matching the condition on the files table, sorted by id
+func getFileEntries(db *sql.DB, filesCondition string, args ...interface{}) ([]FileEntry, error) {
+	getFileEntriesQuery :=
+		"SELECT files.id, files.ownerid, files.folderid, files.subfolderid, coalesce(files.nodeid, 0), files.filename, files.size, " +
+			"files.modifiedat, files.filelocked, subfolders.islocked, coalesce(files.blobid, 0), coalesce(blobs.storagekey, files.filepath), " +
+			"coalesce(blobs.keyid, files.keyid), coalesce(blobs.wrappedkey, files.wrappedkey), coalesce(blobs.keysalt, files.keysalt) " +
+			"FROM files JOIN subfolders ON subfolders.id=files.subfolderid LEFT JOIN blobs ON blobs.id=files.blobid " +
+			"WHERE " + fileHasContentCondition + " AND " + filesCondition + " ORDER BY files.id"
+	rows, err := db.Query(getFileEntriesQuery, args...)
+	if err != nil {
+		log.Error("Error retrieving the files: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []FileEntry{}
+	for rows.Next() {
+		var file FileEntry
+		err = rows.Scan(&file.ID, &file.OwnerID, &file.FolderID, &file.SubfolderID, &file.NodeID, &file.Filename, &file.Size,
+			&file.ModifiedAt, &file.FileLocked, &file.SubfolderLocked, &file.Blob.ID, &file.Blob.StorageKey, &file.Blob.KeyID,
+			&file.Blob.WrappedKey, &file.Blob.KeySalt)
+		if err != nil {
+			log.Error("Error binding a file: %s", err)
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// GetNodeFileEntries returns the files directly in the node. Without the second factor, the files whose label
+// requires it are left out, like from the listings.
+func GetNodeFileEntries(db *sql.DB, nodeID int64, mfa bool) ([]FileEntry, error) {
+	filesCondition := "files.nodeid=$1"
+	if !mfa {
+		filesCondition += " AND " + fileWithoutMFALabelCondition
+	}
+	return getFileEntries(db, filesCondition, nodeID)
+}
+
+// GetNodeFileEntry returns the file with the name directly in the node, failing with sql.ErrNoRows when there is none
+func GetNodeFileEntry(db *sql.DB, nodeID int64, filename string) (FileEntry, error) {
+	files, err := getFileEntries(db, "files.nodeid=$1 AND files.filename=$2", nodeID, filename)
+	if err != nil {
+		return FileEntry{}, err
+	} else if len(files) == 0 {
+		return FileEntry{}, sql.ErrNoRows
+	}
+	return files[0], nil
+}
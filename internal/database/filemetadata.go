@@ -0,0 +1,340 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
+)
+
+var (
+	INVALID_TAG = "a tag must have between 1 and 64 characters"
+
+	mimeTypes = map[string]string{
+		".pdf":  "application/pdf",
+		".doc":  "application/msword",
+		".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		".xls":  "application/vnd.ms-excel",
+		".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		".ppt":  "application/vnd.ms-powerpoint",
+		".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	}
+
+	// contentSignatures are the first bytes of the contents of the supported extensions: the PDF header, the
+	// compound files of the legacy Office formats and the ZIP packages of the Office Open XML ones
+	contentSignatures = map[string]string{
+		".pdf":  "%PDF-",
+		".doc":  "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1",
+		".xls":  "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1",
+		".ppt":  "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1",
+		".docx": "PK\x03\x04",
+		".xlsx": "PK\x03\x04",
+		".pptx": "PK\x03\x04",
+	}
+
+	// fileSortColumns are the fields the file queries can be sorted by. The uploader comes from the joined users,
+	// coalesced so a file without one sorts first instead of breaking the keyset condition
+	fileSortColumns = map[string]sortColumn{
+		"name":     {expression: "files.filename", sqlType: "text"},
+		"size":     {expression: "files.size", sqlType: "bigint"},
+		"type":     {expression: "files.mimetype", sqlType: "text"},
+		"uploader": {expression: "coalesce(users.email, '')", sqlType: "text"},
+		"created":  {expression: "files.createdat", sqlType: "timestamptz"},
+		"modified": {expression: "files.modifiedat", sqlType: "timestamptz"},
+	}
+)
+
+// FileMetadata is a file returned by the file queries, with the folders it is in
+type FileMetadata struct {
+	FilesDetails
+	FolderID      int64
+	Workspace     string
+	SubfolderID   int64
+	CurrentFolder string
+	NodeID        int64
+	Uploader      string
+}
+
+// FileFilter selects the files returned by QueryFiles, the zero value of a field meaning no filter
+type FileFilter struct {
+	// NamePattern matches the file name, case insensitive, with * matching any characters and ? one character
+	NamePattern string
+	// Type is either a MIME type or an extension, like pdf
+	Type           string
+	UploaderID     int64
+	Tags           []string
+	MinSize        int64
+	MaxSize        int64
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	Metadata       []MetadataFilter
+	// MFA is true when the user logged in with a second factor, otherwise the files whose label requires it are left out
+	MFA bool
+	// Shared is true for the listings of the share links, which leave out the locked files and the files whose
+	// label forbids the share links
+	Shared bool
+	// UnlockedSubfolderIDs are the locked subfolders whose files are returned
+	UnlockedSubfolderIDs []int64
+	// NodeID selects the files directly in a node, the subfolder listings otherwise leaving out the files of
+	// the nodes below them
+	NodeID int64
+}
+
+func CreateFileMetadataTable(db *sql.DB) error {
+	addFileMetadataColumnsQuery :=
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS size bigint not null default 0, " +
+			"ADD COLUMN IF NOT EXISTS mimetype text not null default '', " +
+			"ADD COLUMN IF NOT EXISTS createdat timestamptz not null default now(), " +
+			"ADD COLUMN IF NOT EXISTS modifiedat timestamptz not null default now();"
+	_, err := db.Exec(addFileMetadataColumnsQuery)
+	if err != nil {
+		log.Error("Error adding the metadata columns to the files table: %s", err)
+		return err
+	}
+
+	// the files uploaded before the metadata columns get the size of their blob and the type of their extension
+	backfillSizeQuery := "UPDATE files SET size=blobs.size FROM blobs WHERE blobs.id=files.blobid AND files.size<>blobs.size"
+	_, err = db.Exec(backfillSizeQuery)
+	if err != nil {
+		log.Error("Error setting the size of the existing files: %s", err)
+		return err
+	}
+
+	for extension, mimeType := range mimeTypes {
+		backfillMimeTypeQuery := "UPDATE files SET mimetype=$1 WHERE mimetype='' AND lower(filename) LIKE $2"
+		_, err = db.Exec(backfillMimeTypeQuery, mimeType, "%"+extension)
+		if err != nil {
+			log.Error("Error setting the MIME type of the existing %s files: %s", extension, err)
+			return err
+		}
+	}
+
+	createFileTagsQuery :=
+		"CREATE TABLE if not exists file_tags (fileid bigint not null references files(id) on delete cascade, " +
+			"tag text not null, primary key (fileid, tag));"
+	_, err = db.Exec(createFileTagsQuery)
+	if err != nil {
+		log.Error("Error creating the file_tags table: %s", err)
+		return err
+	}
+
+	createFileTagsIndexQuery := "CREATE INDEX IF NOT EXISTS file_tags_tag ON file_tags (tag);"
+	_, err = db.Exec(createFileTagsIndexQuery)
+	if err != nil {
+		log.Error("Error creating the index of the file tags: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created file_tags table")
+	return nil
+}
+
+// MimeTypeForFilename returns the MIME type of the supported extensions
+func MimeTypeForFilename(filename string) string {
+	mimeType, exists := mimeTypes[strings.ToLower(filepath.Ext(filename))]
+	if !exists {
+		return "application/octet-stream"
+	}
+	return mimeType
+}
+
+// ContentSignatureLength is the number of first bytes ContentMatchesExtension needs
+const ContentSignatureLength = 8
+
+// ContentMatchesExtension tells if the first bytes of the content are the signature of the extension of the file
+func ContentMatchesExtension(filename string, head []byte) bool {
+	signature, exists := contentSignatures[strings.ToLower(filepath.Ext(filename))]
+	return exists && strings.HasPrefix(string(head), signature)
+}
+
+// normalizeTags trims and lowercases the tags, removing the duplicates
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) == 0 || len(tag) > 64 {
+			return nil, errors.New(INVALID_TAG)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized, nil
+}
+
+// SetFileTags replaces the tags of the file
+func SetFileTags(db *sql.DB, fileID int64, tags []string) ([]string, error) {
+	normalized, err := normalizeTags(tags)
+	if err != nil {
+		log.Error("Error setting the tags of the file with ID %d: %s", fileID, err)
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction to set the tags of the file with ID %d: %s", fileID, err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM file_tags WHERE fileid=$1", fileID)
+	if err != nil {
+		log.Error("Error removing the tags of the file with ID %d: %s", fileID, err)
+		return nil, err
+	}
+
+	addFileTagsStatement := "INSERT INTO file_tags(fileid, tag) SELECT $1, unnest($2::text[])"
+	_, err = tx.Exec(addFileTagsStatement, fileID, pq.Array(normalized))
+	if err != nil {
+		log.Error("Error adding the tags of the file with ID %d: %s", fileID, err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("Error committing the tags of the file with ID %d: %s", fileID, err)
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// likePattern converts a pattern using * and ? to a LIKE pattern, escaping the LIKE wildcards
+func likePattern(pattern string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%", "?", "_")
+	return replacer.Replace(pattern)
+}
+
+// fileFilterConditions returns the conditions of the filter, adding their arguments
+func fileFilterConditions(filter FileFilter, args *queryArgs) []string {
+	var conditions []string
+	if len(filter.NamePattern) > 0 {
+		pattern := filter.NamePattern
+		if !strings.ContainsAny(pattern, "*?") {
+			pattern = "*" + pattern + "*"
+		}
+		conditions = append(conditions, "files.filename ILIKE "+args.add(likePattern(pattern)))
+	}
+	if len(filter.Type) > 0 {
+		if strings.Contains(filter.Type, "/") {
+			conditions = append(conditions, "files.mimetype = "+args.add(strings.ToLower(filter.Type)))
+		} else {
+			extension := "*." + strings.TrimPrefix(strings.ToLower(filter.Type), ".")
+			conditions = append(conditions, "files.filename ILIKE "+args.add(likePattern(extension)))
+		}
+	}
+	if filter.UploaderID != 0 {
+		conditions = append(conditions, "files.ownerid = "+args.add(filter.UploaderID))
+	}
+	if len(filter.Tags) > 0 {
+		conditions = append(conditions, tagsCondition(fileMetadataTarget, "files.id", filter.Tags, args))
+	}
+	if filter.MinSize > 0 {
+		conditions = append(conditions, "files.size >= "+args.add(filter.MinSize))
+	}
+	if filter.MaxSize > 0 {
+		conditions = append(conditions, "files.size <= "+args.add(filter.MaxSize))
+	}
+	if !filter.CreatedAfter.IsZero() {
+		conditions = append(conditions, "files.createdat >= "+args.add(filter.CreatedAfter))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		conditions = append(conditions, "files.createdat < "+args.add(filter.CreatedBefore))
+	}
+	if !filter.ModifiedAfter.IsZero() {
+		conditions = append(conditions, "files.modifiedat >= "+args.add(filter.ModifiedAfter))
+	}
+	if !filter.ModifiedBefore.IsZero() {
+		conditions = append(conditions, "files.modifiedat < "+args.add(filter.ModifiedBefore))
+	}
+	if !filter.MFA {
+		conditions = append(conditions, fileWithoutMFALabelCondition)
+	}
+	if filter.Shared {
+		conditions = append(conditions, "NOT files.filelocked", fileShareableLabelCondition)
+	}
+	if filter.NodeID != 0 {
+		conditions = append(conditions, "files.nodeid = "+args.add(filter.NodeID))
+	}
+	return conditions
+}
+
+// QueryFiles returns a page of the files matching the filter, across all the workspaces. The files of the locked
+// subfolders are left out, unless the subfolders are unlocked by the filter.
+func QueryFiles(db *sql.DB, filter FileFilter, page PageRequest) ([]FileMetadata, PageInfo, error) {
+	var pageInfo PageInfo
+	query, err := newPageQuery(page, fileSortColumns, "name", "files.id")
+	if err != nil {
+		log.Error("Error reading the page request of the file query: %s", err)
+		return nil, pageInfo, err
+	}
+
+	filter.Tags, err = normalizeTags(filter.Tags)
+	if err != nil {
+		log.Error("Error reading the tags of the file query: %s", err)
+		return nil, pageInfo, err
+	}
+
+	var args queryArgs
+	conditions := fileFilterConditions(filter, &args)
+	metadataConditions, err := metadataFilterConditions(fileMetadataTarget, "files.id", filter.Metadata, &args)
+	if err != nil {
+		log.Error("Error reading the metadata filters of the file query: %s", err)
+		return nil, pageInfo, err
+	}
+	conditions = append(conditions, metadataConditions...)
+	conditions = append(conditions, "(NOT subfolders.islocked OR subfolders.id = ANY("+args.add(pq.Array(filter.UnlockedSubfolderIDs))+"))")
+
+	fromFiles := " FROM files JOIN folders ON folders.id=files.folderid JOIN subfolders ON subfolders.id=files.subfolderid " +
+		"JOIN users ON users.id=files.ownerid"
+
+	totalCountQuery := "SELECT count(*)" + fromFiles + where(conditions)
+	err = db.QueryRow(totalCountQuery, args...).Scan(&pageInfo.TotalCount)
+	if err != nil {
+		log.Error("Error counting the files matching the query: %s", err)
+		return nil, pageInfo, err
+	}
+
+	conditions = append(conditions, query.condition(&args))
+	queryFilesQuery :=
+		"SELECT files.id, files.filename, files.size, files.mimetype, files.ownerid, files.createdat, files.modifiedat, " +
+			"array(SELECT tag FROM file_tags WHERE file_tags.fileid=files.id ORDER BY tag), " +
+			metadataValuesExpression(fileMetadataTarget, "files.id") + ", files.folderid, folders.name, files.subfolderid, subfolders.name, coalesce(files.nodeid, 0), users.email, " + query.sortValue() +
+			fromFiles + where(conditions) + query.orderBy()
+	rows, err := db.Query(queryFilesQuery, args...)
+	if err != nil {
+		log.Error("Error querying the files: %s", err)
+		return nil, pageInfo, err
+	}
+	defer rows.Close()
+
+	files := []FileMetadata{}
+	var sortValues []string
+	for rows.Next() {
+		var file FileMetadata
+		var sortValue string
+		err = rows.Scan(&file.ID, &file.Name, &file.Size, &file.MimeType, &file.OwnerID, &file.CreatedAt, &file.ModifiedAt,
+			pq.Array(&file.Tags), &file.Metadata, &file.FolderID, &file.Workspace, &file.SubfolderID, &file.CurrentFolder, &file.NodeID, &file.Uploader, &sortValue)
+		if err != nil {
+			log.Error("Error binding the file details of the file query: %s", err)
+			return files, pageInfo, err
+		}
+		files = append(files, file)
+		sortValues = append(sortValues, sortValue)
+	}
+	if err = rows.Err(); err != nil {
+		return files, pageInfo, err
+	}
+
+	var count int
+	pageInfo.NextCursor, count = query.nextCursor(len(files), func(index int) (string, int64) {
+		return sortValues[index], files[index].ID
+	})
+	return files[:count], pageInfo, nil
+}
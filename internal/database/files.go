@@ -5,16 +5,34 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
 	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
 )
 
 var extensions = []string{".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx"}
 
+var (
+	FILE_ALREADY_EXISTS   = "the specific file already exists in subfolder"
+	INVALID_FILE_NAME     = "the file name is not valid"
+	UNSUPPORTED_EXTENSION = "this extension is not supported"
+	FILE_NOT_FOUND        = "the file doesn't exist"
+)
+
 type FilesDetails struct {
-	ID   int64
-	Name string
+	ID         int64
+	Name       string
+	Size       int64
+	MimeType   string
+	OwnerID    int64
+	CreatedAt  time.Time
+	ModifiedAt time.Time
+	Tags       []string
+	Metadata   MetadataValues
 }
 
 type SingleFileDetails struct {
@@ -25,6 +43,20 @@ type SingleFileDetails struct {
 	Workspace      string
 	FileLocked     bool
 	FilePassword   string
+	KeyID          string `json:"-"`
+	WrappedKey     string `json:"-"`
+	KeySalt        string `json:"-"`
+	// BlobID is 0 for the files stored before the deduplication, which are removed from the storage with their row
+	BlobID         int64  `json:"-"`
+}
+
+// StoredFile holds the details needed to locate and decrypt a file on disk
+type StoredFile struct {
+	ID         int64
+	Filename   string
+	Filepath   string
+	KeyID      string
+	WrappedKey string
 }
 
 func CreateFilesTable(db *sql.DB) error {
@@ -34,10 +66,23 @@ func CreateFilesTable(db *sql.DB) error {
 	_, err := db.Query(createFilesQuery)
 	if err != nil {
 		log.Error("Error creating the files table: %s", err)
+		return err
+	}
+
+	// the id of the master key and the data key wrapped with it, empty for the files stored before the encryption at rest.
+	// For the files encrypted with their password, keysalt holds the salt of the key derivation
+	addEncryptionColumnsQuery :=
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS keyid text not null default '', " +
+			"ADD COLUMN IF NOT EXISTS wrappedkey text not null default '', " +
+			"ADD COLUMN IF NOT EXISTS keysalt text not null default '';"
+	_, err = db.Exec(addEncryptionColumnsQuery)
+	if err != nil {
+		log.Error("Error adding the encryption columns to the files table: %s", err)
+		return err
 	}
 
 	log.Info("Successfully created files table")
-	return err
+	return nil
 }
 
 func FileExists(db *sql.DB, folderID int64, subfolderID int64, name string) (bool, error) {
@@ -71,24 +116,56 @@ func checkExtension(slice []string, str string) bool {
 	return false
 }
 
-func AddNewFile(db *sql.DB, userID int64, folderID int64, subfolderID int64, filename string, path string, filePassword string, fileLocked bool) (int64, error) {
-	fileExtension := filepath.Ext(filename)
-	//check if the extension is supported
-	isFileExtensionValid := checkExtension(extensions, fileExtension)
-
-	if !isFileExtensionValid {
+// validateFilename checks the name of a new or renamed file
+func validateFilename(filename string) error {
+	if !isFilenameValid(filename) {
+		log.Error("The file name %s is not valid", filename)
+		return errors.New(INVALID_FILE_NAME)
+	}
+	if !IsExtensionSupported(filename) {
 		log.Error("Wrong extension file")
-		return 0, errors.New("this extension is not supported")
+		return errors.New(UNSUPPORTED_EXTENSION)
+	}
+	return nil
+}
+
+// IsExtensionSupported tells if files with the extension of the filename can be uploaded
+func IsExtensionSupported(filename string) bool {
+	return checkExtension(extensions, filepath.Ext(filename))
+}
+
+// isFilenameValid rejects the names that would be misleading when the file is downloaded,
+// the name is never used to build a path on disk
+func isFilenameValid(filename string) bool {
+	if len(filename) == 0 || filename == "." || filename == ".." {
+		return false
+	}
+	return !strings.ContainsAny(filename, "/\\\x00")
+}
+
+// AddNewFile adds a file to the node, below the subfolder. A zero nodeID adds it directly in the subfolder.
+func AddNewFile(db *sql.DB, userID int64, folderID int64, subfolderID int64, nodeID int64, filename string, path string, filePassword string, fileLocked bool) (int64, error) {
+	if err := validateFilename(filename); err != nil {
+		return 0, err
+	}
+
+	if nodeID == 0 {
+		subfolderNode, gsErr := GetFolderNode(db, folderID, subfolderID)
+		if gsErr != nil {
+			return 0, gsErr
+		}
+		nodeID = subfolderNode.ID
 	}
 
-	fileAlreadyExists, gsErr := FileExists(db, folderID, subfolderID, filename)
+	existingFileID, gsErr := GetNodeFileID(db, nodeID, filename)
+	fileAlreadyExists := existingFileID != 0
 	if gsErr != nil {
 		log.Error("Error while checking if the file with the name %s exists in the subfolder with id %d", filename, subfolderID)
 		return 0, gsErr
 	}
 	if fileAlreadyExists {
 		log.Error("File %s already exists in the subfolder with ID %d", filename, subfolderID)
-		return 0, errors.New("the specific file already exists in subfolder")
+		return 0, errors.New(FILE_ALREADY_EXISTS)
 	}
 
 	var fileID int64
@@ -97,8 +174,8 @@ func AddNewFile(db *sql.DB, userID int64, folderID int64, subfolderID int64, fil
 		passHash = auth.ComputePasswordHash(filePassword)
 	}
 
-	createNewFile := "INSERT INTO files(ownerid, folderid, subfolderid, filename, filepath, filepassword, filelocked) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id;"
-	err := db.QueryRow(createNewFile, userID, folderID, subfolderID, filename, path, passHash, fileLocked).Scan(&fileID)
+	createNewFile := "INSERT INTO files(ownerid, folderid, subfolderid, nodeid, filename, filepath, filepassword, filelocked, mimetype) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id;"
+	err := db.QueryRow(createNewFile, userID, folderID, subfolderID, nodeID, filename, path, passHash, fileLocked, MimeTypeForFilename(filename)).Scan(&fileID)
 	if err != nil {
 		log.Error("Error adding the file: %s into the file database: %s", filename, err)
 		return 0, err
@@ -106,35 +183,94 @@ func AddNewFile(db *sql.DB, userID int64, folderID int64, subfolderID int64, fil
 	return fileID, nil
 }
 
-func GetAllFilesDetails(db *sql.DB, folderID int64, subfolderID int64) ([]FilesDetails, error) {
+// GetAllFilesDetails returns a page of the files of the subfolder matching the filter, sorted by any of the file query fields
+func GetAllFilesDetails(db *sql.DB, folderID int64, subfolderID int64, filter FileFilter, page PageRequest) ([]FilesDetails, PageInfo, error) {
+	var pageInfo PageInfo
+	query, err := newPageQuery(page, fileSortColumns, "name", "files.id")
+	if err != nil {
+		log.Error("Error reading the page request of the files for subfolder with id %d: %s", subfolderID, err)
+		return nil, pageInfo, err
+	}
+
+	filter.Tags, err = normalizeTags(filter.Tags)
+	if err != nil {
+		log.Error("Error reading the tags filter of the files for subfolder with id %d: %s", subfolderID, err)
+		return nil, pageInfo, err
+	}
+
+	var args queryArgs
+	conditions := []string{"files.folderid=" + args.add(folderID), "files.subfolderid=" + args.add(subfolderID)}
+	if filter.NodeID == 0 {
+		conditions = append(conditions, "files.nodeid IN (SELECT id FROM nodes WHERE nodes.subfolderid=files.subfolderid AND nodes.depth=1)")
+	}
+	conditions = append(conditions, fileFilterConditions(filter, &args)...)
+	metadataConditions, err := metadataFilterConditions(fileMetadataTarget, "files.id", filter.Metadata, &args)
+	if err != nil {
+		log.Error("Error reading the metadata filters of the files for subfolder with id %d: %s", subfolderID, err)
+		return nil, pageInfo, err
+	}
+	conditions = append(conditions, metadataConditions...)
+
+	// the files are joined with their uploaders, so they can be sorted by them, for both the count and the page
+	fromFiles := " FROM files JOIN users ON users.id=files.ownerid"
+	countFilesQuery := "SELECT count(*)" + fromFiles + where(conditions)
+	err = db.QueryRow(countFilesQuery, args...).Scan(&pageInfo.TotalCount)
+	if err != nil {
+		log.Error("Error counting the files for subfolder with id %d: %s", subfolderID, err)
+		return nil, pageInfo, err
+	}
+
+	conditions = append(conditions, query.condition(&args))
 	getAllFilesDetailsForFolderQuery :=
-		"SELECT id, filename FROM files WHERE folderid=$1 AND subfolderid=$2;"
-	rows, err := db.Query(getAllFilesDetailsForFolderQuery, folderID, subfolderID)
+		"SELECT files.id, files.filename, files.size, files.mimetype, files.ownerid, files.createdat, files.modifiedat, " +
+			"array(SELECT tag FROM file_tags WHERE file_tags.fileid=files.id ORDER BY tag), " +
+			metadataValuesExpression(fileMetadataTarget, "files.id") + ", " + query.sortValue() +
+			fromFiles + where(conditions) + query.orderBy()
+	rows, err := db.Query(getAllFilesDetailsForFolderQuery, args...)
 	if err != nil {
 		log.Error("Error getting all files for subfolder with id %d: %s", subfolderID, err)
+		return nil, pageInfo, err
 	}
 	defer rows.Close()
 
-	var allFilesDetails []FilesDetails
+	allFilesDetails := []FilesDetails{}
+	var sortValues []string
 	for rows.Next() {
-		var fileID int64
-		var name string
-
-		err = rows.Scan(&fileID, &name)
+		filesDetails := new(FilesDetails)
+		var sortValue string
+		err = rows.Scan(&filesDetails.ID, &filesDetails.Name, &filesDetails.Size, &filesDetails.MimeType, &filesDetails.OwnerID,
+			&filesDetails.CreatedAt, &filesDetails.ModifiedAt, pq.Array(&filesDetails.Tags), &filesDetails.Metadata, &sortValue)
 		if err != nil {
 			log.Error("Error binding the files details for allFilesDetails request: %s", err)
-			return allFilesDetails, err
+			return allFilesDetails, pageInfo, err
 		}
-		filesDetails := new(FilesDetails)
-		filesDetails.ID = fileID
-		filesDetails.Name = name
 		allFilesDetails = append(allFilesDetails, *filesDetails)
+		sortValues = append(sortValues, sortValue)
+	}
+	if err = rows.Err(); err != nil {
+		return allFilesDetails, pageInfo, err
 	}
 
-	return allFilesDetails, nil
+	var count int
+	pageInfo.NextCursor, count = query.nextCursor(len(allFilesDetails), func(index int) (string, int64) {
+		return sortValues[index], allFilesDetails[index].ID
+	})
+	return allFilesDetails[:count], pageInfo, nil
 }
 
 func GetFilesDetailsForFileID(db *sql.DB, fileID int64, folderID int64, subfolderID int64) (SingleFileDetails, error) {
+	var fileExists bool
+	fileExistsQuery := "SELECT EXISTS(SELECT 1 FROM files WHERE id=$1 AND folderid=$2 AND subfolderid=$3)"
+	err := db.QueryRow(fileExistsQuery, fileID, folderID, subfolderID).Scan(&fileExists)
+	if err != nil {
+		log.Error("Error checking if the file with ID %d exists: %s", fileID, err)
+		return SingleFileDetails{}, err
+	}
+	if !fileExists {
+		log.Error("There's no file with the ID %d in the subfolder %d", fileID, subfolderID)
+		return SingleFileDetails{}, errors.New(FILE_NOT_FOUND)
+	}
+
 	folderName, gsErr := GetFolderNameFromID(db, folderID)
 	if gsErr != nil {
 		log.Error("Error retriving the folderName for folderID %d", folderID)
@@ -155,7 +291,7 @@ func GetFilesDetailsForFileID(db *sql.DB, fileID int64, folderID int64, subfolde
 
 	doesFolderExist, err := FolderExists(db, folderName)
 	if err != nil {
-		log.Error("Error while checking if the folder already exists in db: %s", doesFolderExist)
+		log.Error("Error while checking if the folder already exists in db: %s", err)
 		return SingleFileDetails{}, err
 	}
 	if !doesFolderExist {
@@ -165,7 +301,7 @@ func GetFilesDetailsForFileID(db *sql.DB, fileID int64, folderID int64, subfolde
 
 	doesSubfolderExist, err := SubfolderExists(db, folderID, subfolderName)
 	if err != nil {
-		log.Error("Error while checking if the subfolder %s already exists in db: %s", subfolderID, doesSubfolderExist)
+		log.Error("Error while checking if the subfolder %d already exists in db: %s", subfolderID, err)
 		return SingleFileDetails{}, err
 	}
 	if !doesSubfolderExist {
@@ -184,7 +320,10 @@ func GetFilesDetailsForFileID(db *sql.DB, fileID int64, folderID int64, subfolde
 	}
 
 	getFilesDetailsForFileID :=
-		"SELECT ownerid, filename, filepath, filepassword, filelocked FROM files WHERE id=$1 AND folderid=$2 AND subfolderid=$3"
+		"SELECT files.ownerid, files.filename, coalesce(blobs.storagekey, files.filepath), files.filepassword, files.filelocked, " +
+			"coalesce(blobs.keyid, files.keyid), coalesce(blobs.wrappedkey, files.wrappedkey), coalesce(blobs.keysalt, files.keysalt), " +
+			"coalesce(files.blobid, 0) " +
+			"FROM files LEFT JOIN blobs ON blobs.id=files.blobid WHERE files.id=$1 AND files.folderid=$2 AND files.subfolderid=$3"
 	rows, err := db.Query(getFilesDetailsForFileID, fileID, folderID, subfolderID)
 	if err != nil {
 		log.Error("Error getting the file name and path for id %d: %s", fileID, err)
@@ -198,8 +337,12 @@ func GetFilesDetailsForFileID(db *sql.DB, fileID int64, folderID int64, subfolde
 		var ownerid int64
 		var filelocked bool
 		var filepassword string
+		var keyID string
+		var wrappedKey string
+		var keySalt string
+		var blobID int64
 
-		err = rows.Scan(&ownerid, &filename, &filepath, &filepassword, &filelocked)
+		err = rows.Scan(&ownerid, &filename, &filepath, &filepassword, &filelocked, &keyID, &wrappedKey, &keySalt, &blobID)
 		if err != nil {
 			log.Error("Error binding the files details for allFilesDetails request: %s", err)
 			return allFilesDetails, err
@@ -211,6 +354,10 @@ func GetFilesDetailsForFileID(db *sql.DB, fileID int64, folderID int64, subfolde
 		allFilesDetails.CurrentFolder = subfolderName
 		allFilesDetails.FileLocked = filelocked
 		allFilesDetails.FilePassword = filepassword
+		allFilesDetails.KeyID = keyID
+		allFilesDetails.WrappedKey = wrappedKey
+		allFilesDetails.KeySalt = keySalt
+		allFilesDetails.BlobID = blobID
 	}
 
 	return allFilesDetails, nil
@@ -241,6 +388,20 @@ func VerifyFilePassword(db *sql.DB, fileID int64, folderID int64, subfolderID in
 		return false, err
 	}
 
+	// the files encrypted with their password don't keep a hash of it, the password is correct if it unwraps the data key
+	if currentFileDetails.KeyID == encryption.PasswordKeyID {
+		_, err = encryption.UnwrapKeyWithPassword(filepassword, currentFileDetails.KeySalt, currentFileDetails.WrappedKey)
+		if err == encryption.ErrInvalidPassword {
+			log.Info("The user tried to access the file %s but the password was incorrect", currentFileDetails.Filename)
+			return false, nil
+		} else if err != nil {
+			log.Error("Error unwrapping the data key of the file %s: %s", currentFileDetails.Filename, err)
+			return false, err
+		}
+		log.Info("The provided password for file %s is correct", currentFileDetails.Filename)
+		return true, nil
+	}
+
 	// verify if the password matches
 	passHash := auth.ComputePasswordHash(filepassword)
 	if currentFileDetails.FilePassword == passHash {
@@ -253,24 +414,172 @@ func VerifyFilePassword(db *sql.DB, fileID int64, folderID int64, subfolderID in
 }
 
 func RemoveFile(db *sql.DB, fileID int64, folderID int64, ownerID int64, subfolderID int64) bool {
-	deleteFileStatement := "DELETE FROM files WHERE id=$1 AND folderid=$2 AND ownerid=$3 AND subfolderid=$4"
-	res, err := db.Exec(deleteFileStatement, fileID, folderID, ownerID, subfolderID)
+	rowsAffected, err := removeFilesReleasingBlobs(db, "files.id=$1 AND files.folderid=$2 AND files.ownerid=$3 AND files.subfolderid=$4",
+		fileID, folderID, ownerID, subfolderID)
 	if err != nil {
-		log.Error("Error removing the file with ID %d from subfolder with ID: %s", fileID, subfolderID, err)
+		log.Error("Error removing the file with ID %d from subfolder with ID %d: %s", fileID, subfolderID, err)
+		return false
+	}
+	if rowsAffected != 1 {
+		errorMessage := fmt.Sprintf("There were %d rows affected, while there was 1 row expected", rowsAffected)
+		log.Error("%s", errorMessage)
 		return false
 	}
 
+	return true
+}
+
+func SetFileEncryptionKey(db *sql.DB, fileID int64, keyID string, wrappedKey string) error {
+	setFileEncryptionKeyStatement := "UPDATE files SET keyid=$1, wrappedkey=$2, keysalt='' WHERE id=$3"
+	res, err := db.Exec(setFileEncryptionKeyStatement, keyID, wrappedKey, fileID)
+	if err != nil {
+		log.Error("Error setting the encryption key for the file with ID %d: %s", fileID, err)
+		return err
+	}
+
 	rowsAffected, err := res.RowsAffected()
 	if err != nil {
-		log.Error("Error retrieving the number of rows affected from the query to delete the file with ID %d "+
-			"from subfolder with the ID %d: %s", fileID, subfolderID, err)
-		return false
+		log.Error("Error retrieving the number of rows affected when setting the encryption key for the file with ID %d: %s", fileID, err)
+		return err
 	}
 	if rowsAffected != 1 {
 		errorMessage := fmt.Sprintf("There were %d rows affected, while there was 1 row expected", rowsAffected)
 		log.Error("%s", errorMessage)
-		return false
+		return errors.New(errorMessage)
 	}
 
-	return true
+	return nil
+}
+
+// SetFileEncryptedStorageKey points a file stored in plaintext to its encrypted copy, setting the storage key and
+// the encryption key together, so the file never refers to a content its key doesn't match. It fails when the file
+// no longer refers to the plaintext.
+func SetFileEncryptedStorageKey(db *sql.DB, fileID int64, previousStorageKey string, storageKey string, keyID string, wrappedKey string) error {
+	setFileEncryptedStorageKeyStatement :=
+		"UPDATE files SET filepath=$1, keyid=$2, wrappedkey=$3, keysalt='' WHERE id=$4 AND filepath=$5 AND blobid IS NULL"
+	res, err := db.Exec(setFileEncryptedStorageKeyStatement, storageKey, keyID, wrappedKey, fileID, previousStorageKey)
+	if err != nil {
+		log.Error("Error setting the encrypted storage key for the file with ID %d: %s", fileID, err)
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		log.Error("Error retrieving the number of rows affected when setting the encrypted storage key for the file with ID %d: %s", fileID, err)
+		return err
+	}
+	if rowsAffected != 1 {
+		errorMessage := fmt.Sprintf("There were %d rows affected, while there was 1 row expected", rowsAffected)
+		log.Error("%s", errorMessage)
+		return errors.New(errorMessage)
+	}
+
+	return nil
+}
+
+// SetFilePasswordEncrypted marks the file as encrypted with its password. The password hash is removed,
+// since it would allow checking password guesses without going through the key derivation.
+func SetFilePasswordEncrypted(db *sql.DB, fileID int64) error {
+	setFilePasswordEncryptedStatement := "UPDATE files SET filepassword='', filelocked=true WHERE id=$1"
+	res, err := db.Exec(setFilePasswordEncryptedStatement, fileID)
+	if err != nil {
+		log.Error("Error setting the password encryption for the file with ID %d: %s", fileID, err)
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		log.Error("Error retrieving the number of rows affected when setting the password encryption for the file with ID %d: %s", fileID, err)
+		return err
+	}
+	if rowsAffected != 1 {
+		errorMessage := fmt.Sprintf("There were %d rows affected, while there was 1 row expected", rowsAffected)
+		log.Error("%s", errorMessage)
+		return errors.New(errorMessage)
+	}
+
+	return nil
+}
+
+func UpdateFilePassword(db *sql.DB, fileID int64, ownerID int64, password string) error {
+	passHash := ""
+	if len(password) > 0 {
+		passHash = auth.ComputePasswordHash(password)
+	}
+
+	updateFilePasswordStatement := "UPDATE files SET filepassword=$1, filelocked=$2 WHERE id=$3 AND ownerid=$4"
+	res, err := db.Exec(updateFilePasswordStatement, passHash, len(password) > 0, fileID, ownerID)
+	if err != nil {
+		log.Error("Error updating the password of the file with ID %d: %s", fileID, err)
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		log.Error("Error retrieving the number of rows affected when updating the password of the file with ID %d: %s", fileID, err)
+		return err
+	}
+	if rowsAffected != 1 {
+		errorMessage := fmt.Sprintf("There were %d rows affected, while there was 1 row expected", rowsAffected)
+		log.Error("%s", errorMessage)
+		return errors.New(errorMessage)
+	}
+
+	return nil
+}
+
+// GetAllStoredFiles returns the location and encryption details of every file stored outside the blobs,
+// used by the maintenance commands
+func GetAllStoredFiles(db *sql.DB) ([]StoredFile, error) {
+	getAllStoredFilesQuery := "SELECT id, filename, filepath, keyid, wrappedkey FROM files WHERE blobid IS NULL ORDER BY id"
+	return getStoredFiles(db, getAllStoredFilesQuery)
+}
+
+func getStoredFiles(db *sql.DB, query string, args ...interface{}) ([]StoredFile, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Error("Error getting the stored files: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var storedFiles []StoredFile
+	for rows.Next() {
+		var storedFile StoredFile
+		err = rows.Scan(&storedFile.ID, &storedFile.Filename, &storedFile.Filepath, &storedFile.KeyID, &storedFile.WrappedKey)
+		if err != nil {
+			log.Error("Error binding the stored file details: %s", err)
+			return storedFiles, err
+		}
+		storedFiles = append(storedFiles, storedFile)
+	}
+
+	return storedFiles, rows.Err()
+}
+
+// GetStoredFilesForFolder returns the files removed by RemoveFilesFromFolder, so they can be removed from the storage.
+// The files stored as blobs are left out, their content is removed by the blob garbage collection.
+func GetStoredFilesForFolder(db *sql.DB, folderID int64, userID int64) ([]StoredFile, error) {
+	getStoredFilesForFolderQuery :=
+		"SELECT id, filename, filepath, keyid, wrappedkey FROM files WHERE folderid=$1 AND ownerid=$2 AND blobid IS NULL"
+	return getStoredFiles(db, getStoredFilesForFolderQuery, folderID, userID)
+}
+
+// GetStoredFilesForSubfolder returns the files removed by RemoveFilesFromSubfolder, so they can be removed from the storage.
+// The files stored as blobs are left out, their content is removed by the blob garbage collection.
+func GetStoredFilesForSubfolder(db *sql.DB, subfolderID int64, folderID int64, userID int64) ([]StoredFile, error) {
+	getStoredFilesForSubfolderQuery :=
+		"SELECT id, filename, filepath, keyid, wrappedkey FROM files WHERE subfolderid=$1 AND folderid=$2 AND ownerid=$3 AND blobid IS NULL"
+	return getStoredFiles(db, getStoredFilesForSubfolderQuery, subfolderID, folderID, userID)
+}
+
+// SetFileStorageKey points the file to the storage key it was moved under
+func SetFileStorageKey(db *sql.DB, fileID int64, storageKey string) error {
+	setFileStorageKeyStatement := "UPDATE files SET filepath=$1 WHERE id=$2"
+	_, err := db.Exec(setFileStorageKeyStatement, storageKey, fileID)
+	if err != nil {
+		log.Error("Error setting the storage key for the file with ID %d: %s", fileID, err)
+		return err
+	}
+	return nil
 }
@@ -11,6 +11,12 @@ import (
 var (
 	NAME_IS_EMPTY = "folder name cannot be empty"
 	FOLDER_ALREADY_EXISTS = "the folder already exists in the database"
+
+	// folderSortColumns are the fields the folders and the subfolders can be sorted by
+	folderSortColumns = map[string]sortColumn{
+		"name": {expression: "name", sqlType: "text"},
+		"id":   {expression: "id", sqlType: "bigint"},
+	}
 )
 
 type FolderDetails struct {
@@ -76,9 +82,27 @@ func AddNewFolder(db *sql.DB, userID int64, folderName string) (int64, error) {
 			addNewFolderStatement :=
 				"INSERT INTO folders(ownerId, name) VALUES($1, $2) RETURNING id;"
 
-			err := db.QueryRow(addNewFolderStatement, userID, folderName).Scan(&folderID)
+			// the folder and its node are added together, a folder without a node being missing from the tree
+			tx, err := db.Begin()
+			if err != nil {
+				log.Error("Error starting the transaction adding the folder %s: %s", folderName, err)
+				return 0, err
+			}
+			defer tx.Rollback()
+
+			err = tx.QueryRow(addNewFolderStatement, userID, folderName).Scan(&folderID)
+			if err != nil {
+				log.Error("Error adding the new folder: %s", err)
+				return 0, err
+			}
+			err = addWorkspaceNode(tx, folderID, userID, folderName)
+			if err != nil {
+				log.Error("Error adding the node of the new folder: %s", err)
+				return 0, err
+			}
+			err = tx.Commit()
 			if err != nil {
-				log.Error("Error adding the new folder: ", err)
+				log.Error("Error committing the new folder %s: %s", folderName, err)
 				return 0, err
 			}
 
@@ -91,31 +115,59 @@ func AddNewFolder(db *sql.DB, userID int64, folderName string) (int64, error) {
 	}
 }
 
-func GetAllFoldersDetails(db *sql.DB) ([]FolderDetails, error) {
+// GetAllFoldersDetails returns a page of the folders, sorted by name or id
+func GetAllFoldersDetails(db *sql.DB, page PageRequest) ([]FolderDetails, PageInfo, error) {
+	var pageInfo PageInfo
+	query, err := newPageQuery(page, folderSortColumns, "name", "folders.id")
+	if err != nil {
+		log.Error("Error reading the page request of the folders: %s", err)
+		return nil, pageInfo, err
+	}
+
+	countFoldersQuery := "SELECT count(*) FROM folders"
+	err = db.QueryRow(countFoldersQuery).Scan(&pageInfo.TotalCount)
+	if err != nil {
+		log.Error("Error counting the folders: %s", err)
+		return nil, pageInfo, err
+	}
+
+	var args queryArgs
 	getAllFoldersDetailsQuery :=
-		"SELECT id, name FROM folders"
-	rows, err := db.Query(getAllFoldersDetailsQuery)
+		"SELECT id, name, " + query.sortValue() + " FROM folders" + where([]string{query.condition(&args)}) + query.orderBy()
+	rows, err := db.Query(getAllFoldersDetailsQuery, args...)
 	if err != nil {
 		log.Error("Error getting the data for all the folders: %s", err)
+		return nil, pageInfo, err
 	}
 	defer rows.Close()
 
-	var allFolderDetails []FolderDetails
+	allFolderDetails := []FolderDetails{}
+	var sortValues []string
 	for rows.Next() {
 		var folderId int64
 		var name string
+		var sortValue string
 
-		err = rows.Scan(&folderId, &name)
+		err = rows.Scan(&folderId, &name, &sortValue)
 		if err != nil {
 			log.Error("Error binding the data for GetAllFoldersDetails request: %s", err)
-			return allFolderDetails, err
+			return allFolderDetails, pageInfo, err
 		}
 		folderDetails := new(FolderDetails)
 		folderDetails.ID = folderId
 		folderDetails.Name = name
 		allFolderDetails = append(allFolderDetails, *folderDetails)
+		sortValues = append(sortValues, sortValue)
 	}
-	return allFolderDetails, nil
+	if err = rows.Err(); err != nil {
+		return allFolderDetails, pageInfo, err
+	}
+
+	var count int
+	pageInfo.NextCursor, count = query.nextCursor(len(allFolderDetails), func(index int) (string, int64) {
+		return sortValues[index], allFolderDetails[index].ID
+	})
+	return allFolderDetails[:count], pageInfo, nil
 }
 
 func GetAllFoldersDetailsForID(db *sql.DB, folderID int64) (SingleFolderDetails, error) {
@@ -166,7 +218,7 @@ func RemoveFolder(db *sql.DB, folderID int64, ownerID int64) bool {
 	deleteFolderStatement := "DELETE FROM folders WHERE id=$1 AND ownerid=$2"
 	res, err := db.Exec(deleteFolderStatement, folderID, ownerID)
 	if err != nil {
-		log.Error("Error removing the folder with ID %d for user with ID: %s", folderID, ownerID, err)
+		log.Error("Error removing the folder with ID %d for user with ID %d: %s", folderID, ownerID, err)
 		return false
 	}
 
@@ -196,8 +248,7 @@ func RemoveSubfoldersFromFolder(db *sql.DB, folderID int64, userID int64) bool {
 }
 
 func RemoveFilesFromFolder(db *sql.DB, folderID int64, userID int64) bool {
-	deleteFilesFromFolderStatement := "DELETE FROM files WHERE folderid=$1 AND ownerid=$2"
-	_, err := db.Exec(deleteFilesFromFolderStatement, folderID, userID)
+	_, err := removeFilesReleasingBlobs(db, "files.folderid=$1 AND files.ownerid=$2", folderID, userID)
 	if err != nil {
 		log.Error("Error removing the files from folder with ID %d: %s", folderID, err)
 		return false
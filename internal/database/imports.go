@@ -0,0 +1,28 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+// AddImportedNode returns the folder with the name under the parent, adding it when there is none, so the folders
+// of an imported archive are merged with the existing ones. The returned bool tells if the folder was added.
+func AddImportedNode(db *sql.DB, ownerID int64, parent Node, name string) (Node, bool, error) {
+	if !IsNodeNameValid(name) {
+		log.Error("The imported folder name %s is not valid", name)
+		return Node{}, false, errors.New(INVALID_NODE_NAME)
+	}
+
+	nodeID, err := addNode(db, parent.ID, ownerID, name, parent.FolderID, parent.SubfolderID)
+	if err != nil && err.Error() == NODE_ALREADY_EXISTS {
+		node, err := getChildNode(db, parent.ID, name)
+		return node, false, err
+	} else if err != nil {
+		return Node{}, false, err
+	}
+
+	node, err := GetNode(db, nodeID)
+	return node, true, err
+}
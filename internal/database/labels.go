@@ -0,0 +1,202 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+const (
+	LabelFolder    = "folder"
+	LabelSubfolder = "subfolder"
+	LabelFile      = "file"
+)
+
+var (
+	UNKNOWN_LABEL = "there's no sensitivity label with this name"
+
+	// defaultLabels are created with the table, their rules can be changed by the admins
+	defaultLabels = []LabelRules{
+		{Name: "public", Level: 0},
+		{Name: "internal", Level: 1},
+		{Name: "confidential", Level: 2, ForbidPublicShare: true, Watermark: true},
+		{Name: "restricted", Level: 3, RequirePassword: true, ForbidPublicShare: true, Watermark: true, RequireMFA: true},
+	}
+
+	labelTables = map[string]string{
+		LabelFolder:    "folders",
+		LabelSubfolder: "subfolders",
+		LabelFile:      "files",
+	}
+)
+
+// LabelRules is a sensitivity label with the rules enforced on the items it applies to. An item gets the label with
+// the highest level among its own label and the labels of its subfolder and workspace, so a label set on a workspace
+// or a subfolder can't be lowered on the items inside it. The items without labels have no rules.
+type LabelRules struct {
+	Name              string `json:"name"`
+	Level             int    `json:"level"`
+	RequirePassword   bool   `json:"requirePassword"`
+	ForbidPublicShare bool   `json:"forbidPublicShare"`
+	Watermark         bool   `json:"watermark"`
+	RequireMFA        bool   `json:"requireMfa"`
+}
+
+func CreateLabelsTable(db *sql.DB) error {
+	createLabelsQuery :=
+		"CREATE TABLE if not exists sensitivity_labels (name text primary key, level int not null, " +
+			"requirepassword bool not null default false, forbidpublicshare bool not null default false, " +
+			"watermark bool not null default false, requiremfa bool not null default false);"
+	_, err := db.Exec(createLabelsQuery)
+	if err != nil {
+		log.Error("Error creating the sensitivity_labels table: %s", err)
+		return err
+	}
+
+	for _, label := range defaultLabels {
+		addLabelStatement :=
+			"INSERT INTO sensitivity_labels(name, level, requirepassword, forbidpublicshare, watermark, requiremfa) " +
+				"VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT (name) DO NOTHING"
+		_, err = db.Exec(addLabelStatement, label.Name, label.Level, label.RequirePassword, label.ForbidPublicShare,
+			label.Watermark, label.RequireMFA)
+		if err != nil {
+			log.Error("Error adding the sensitivity label %s: %s", label.Name, err)
+			return err
+		}
+	}
+
+	for _, table := range []string{"folders", "subfolders", "files"} {
+		addLabelColumnQuery := fmt.Sprintf(
+			"ALTER TABLE %s ADD COLUMN IF NOT EXISTS label text references sensitivity_labels(name) on update cascade;", table)
+		_, err = db.Exec(addLabelColumnQuery)
+		if err != nil {
+			log.Error("Error adding the label column to the %s table: %s", table, err)
+			return err
+		}
+	}
+
+	log.Info("Successfully created sensitivity_labels table")
+	return nil
+}
+
+func GetLabels(db *sql.DB) ([]LabelRules, error) {
+	getLabelsQuery := "SELECT name, level, requirepassword, forbidpublicshare, watermark, requiremfa FROM sensitivity_labels ORDER BY level"
+	rows, err := db.Query(getLabelsQuery)
+	if err != nil {
+		log.Error("Error getting the sensitivity labels: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []LabelRules{}
+	for rows.Next() {
+		var label LabelRules
+		err = rows.Scan(&label.Name, &label.Level, &label.RequirePassword, &label.ForbidPublicShare, &label.Watermark, &label.RequireMFA)
+		if err != nil {
+			log.Error("Error binding the sensitivity labels: %s", err)
+			return labels, err
+		}
+		labels = append(labels, label)
+	}
+	return labels, rows.Err()
+}
+
+// GetLabel returns the rules of the label, an empty name returning the rules of the unlabeled items
+func GetLabel(db *sql.DB, name string) (LabelRules, error) {
+	var label LabelRules
+	if len(name) == 0 {
+		return label, nil
+	}
+	getLabelQuery := "SELECT name, level, requirepassword, forbidpublicshare, watermark, requiremfa FROM sensitivity_labels WHERE name=$1"
+	err := db.QueryRow(getLabelQuery, name).Scan(&label.Name, &label.Level, &label.RequirePassword, &label.ForbidPublicShare,
+		&label.Watermark, &label.RequireMFA)
+	if err == sql.ErrNoRows {
+		return label, errors.New(UNKNOWN_LABEL)
+	} else if err != nil {
+		log.Error("Error getting the sensitivity label %s: %s", name, err)
+		return label, err
+	}
+	return label, nil
+}
+
+// SetLabelRules changes the rules of an existing label
+func SetLabelRules(db *sql.DB, label LabelRules) error {
+	setLabelRulesStatement :=
+		"UPDATE sensitivity_labels SET level=$2, requirepassword=$3, forbidpublicshare=$4, watermark=$5, requiremfa=$6 WHERE name=$1"
+	res, err := db.Exec(setLabelRulesStatement, label.Name, label.Level, label.RequirePassword, label.ForbidPublicShare,
+		label.Watermark, label.RequireMFA)
+	if err != nil {
+		log.Error("Error setting the rules of the sensitivity label %s: %s", label.Name, err)
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New(UNKNOWN_LABEL)
+	}
+	return nil
+}
+
+// SetLabel sets the label of a workspace, subfolder or file, an empty name removing it
+func SetLabel(db *sql.DB, kind string, id int64, name string) error {
+	var label interface{}
+	if len(name) > 0 {
+		if _, err := GetLabel(db, name); err != nil {
+			return err
+		}
+		label = name
+	}
+
+	setLabelStatement := fmt.Sprintf("UPDATE %s SET label=$2 WHERE id=$1", labelTables[kind])
+	_, err := db.Exec(setLabelStatement, id, label)
+	if err != nil {
+		log.Error("Error setting the label of the %s with ID %d: %s", kind, id, err)
+		return err
+	}
+	return nil
+}
+
+// GetEffectiveLabel returns the label enforced on the item, the highest among the labels of the workspace, of the
+// subfolder and of the file, and whether the item is protected by a password. A zero subfolderID or fileID selects
+// the workspace or the subfolder itself.
+func GetEffectiveLabel(db *sql.DB, folderID int64, subfolderID int64, fileID int64) (LabelRules, bool, error) {
+	var label LabelRules
+	var locked bool
+	var name sql.NullString
+	getEffectiveLabelQuery :=
+		"SELECT coalesce(files.filelocked, false) OR coalesce(subfolders.islocked, false), " +
+			"(SELECT name FROM sensitivity_labels WHERE name IN (folders.label, subfolders.label, files.label) ORDER BY level DESC LIMIT 1) " +
+			"FROM folders LEFT JOIN subfolders ON subfolders.id=$2 AND subfolders.folderid=folders.id " +
+			"LEFT JOIN files ON files.id=$3 AND files.subfolderid=subfolders.id WHERE folders.id=$1"
+	err := db.QueryRow(getEffectiveLabelQuery, folderID, subfolderID, fileID).Scan(&locked, &name)
+	if err != nil {
+		log.Error("Error getting the label of the file %d in the subfolder %d of the folder %d: %s", fileID, subfolderID, folderID, err)
+		return label, locked, err
+	}
+
+	label, err = GetLabel(db, name.String)
+	return label, locked, err
+}
+
+// withoutLabelRuleCondition selects the items whose effective label, the highest of the labels, doesn't have
+// the rule, a boolean column of the sensitivity_labels table
+func withoutLabelRuleCondition(rule string, labels ...string) string {
+	return "NOT coalesce((SELECT sensitivity_labels." + rule + " FROM sensitivity_labels WHERE sensitivity_labels.name IN (" +
+		strings.Join(labels, ", ") + ") ORDER BY sensitivity_labels.level DESC LIMIT 1), false)"
+}
+
+// the labels of a file and of its parents, in any query selecting from the files table
+var fileLabels = []string{"files.label",
+	"(SELECT subfolders.label FROM subfolders WHERE subfolders.id=files.subfolderid)",
+	"(SELECT folders.label FROM folders WHERE folders.id=files.folderid)"}
+
+// fileWithoutMFALabelCondition selects the files whose effective label doesn't require a second factor
+var fileWithoutMFALabelCondition = withoutLabelRuleCondition("requiremfa", fileLabels...)
+
+// fileShareableLabelCondition selects the files whose effective label doesn't forbid the public share links
+var fileShareableLabelCondition = withoutLabelRuleCondition("forbidpublicshare", fileLabels...)
@@ -0,0 +1,482 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
+)
+
+const (
+	MetadataText   = "text"
+	MetadataNumber = "number"
+	MetadataDate   = "date"
+	MetadataEnum   = "enum"
+
+	metadataDateLayout   = "2006-01-02"
+	maxMetadataTextValue = 1024
+)
+
+var (
+	INVALID_METADATA_FIELD        = "the metadata field needs a name of lowercase letters, digits, - and _, and a type of text, number, date or enum with options"
+	METADATA_FIELD_ALREADY_EXISTS = "the workspace already has a metadata field with this name"
+	UNKNOWN_METADATA_FIELD        = "the workspace has no metadata field with this name"
+	INVALID_METADATA_VALUE        = "the value does not match the type of its metadata field"
+	INVALID_METADATA_FILTER       = "the metadata range filters must be numbers or dates (YYYY-MM-DD)"
+	METADATA_ITEMS_NOT_OWNED      = "the edited files and subfolders must be in the workspace and owned by the user"
+
+	metadataFieldName = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+)
+
+// IsMetadataError returns true for the errors caused by invalid metadata fields, values or filters
+func IsMetadataError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.Error() {
+	case INVALID_METADATA_FIELD, METADATA_FIELD_ALREADY_EXISTS, UNKNOWN_METADATA_FIELD, INVALID_METADATA_VALUE,
+		INVALID_METADATA_FILTER, INVALID_TAG:
+		return true
+	}
+	return false
+}
+
+// MetadataField is a typed field of the metadata schema of a workspace, the enum fields having a list of options
+type MetadataField struct {
+	ID      int64
+	Name    string
+	Type    string
+	Options []string
+}
+
+// MetadataValues maps the names of the metadata fields to the values of a file or a subfolder
+type MetadataValues map[string]string
+
+// Scan reads the JSON object built by the listing queries
+func (values *MetadataValues) Scan(src interface{}) error {
+	raw, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into the metadata values", src)
+	}
+	*values = MetadataValues{}
+	return json.Unmarshal(raw, values)
+}
+
+// ItemMetadata holds the tags and the metadata values of a file or a subfolder
+type ItemMetadata struct {
+	Tags   []string
+	Values MetadataValues
+}
+
+// MetadataEdit changes the metadata of files and subfolders. Tags replaces all the tags when it is not nil,
+// while AddTags and RemoveTags change them. A nil value removes the field from the items.
+type MetadataEdit struct {
+	Tags       []string
+	AddTags    []string
+	RemoveTags []string
+	Values     map[string]*string
+}
+
+// MetadataFilter selects the items having the field, with a value equal to Value, case insensitive, or
+// between Min and Max, which are compared as numbers or as dates
+type MetadataFilter struct {
+	Field string
+	Value string
+	Min   string
+	Max   string
+}
+
+// metadataTarget holds the tables keeping the metadata of the files or of the subfolders
+type metadataTarget struct {
+	itemTable   string
+	valuesTable string
+	tagsTable   string
+	idColumn    string
+}
+
+var (
+	fileMetadataTarget      = metadataTarget{itemTable: "files", valuesTable: "file_metadata_values", tagsTable: "file_tags", idColumn: "fileid"}
+	subfolderMetadataTarget = metadataTarget{itemTable: "subfolders", valuesTable: "subfolder_metadata_values", tagsTable: "subfolder_tags", idColumn: "subfolderid"}
+)
+
+func CreateMetadataTables(db *sql.DB) error {
+	createMetadataFieldsQuery :=
+		"CREATE TABLE if not exists metadata_fields (id serial primary key, " +
+			"folderid bigint not null references folders(id) on delete cascade, name text not null, type text not null, " +
+			"options text[] not null default '{}', unique (folderid, name));"
+	_, err := db.Exec(createMetadataFieldsQuery)
+	if err != nil {
+		log.Error("Error creating the metadata_fields table: %s", err)
+		return err
+	}
+
+	// the number and date values are also kept typed, so the range filters can compare them
+	for _, target := range []metadataTarget{fileMetadataTarget, subfolderMetadataTarget} {
+		createMetadataValuesQuery := fmt.Sprintf(
+			"CREATE TABLE if not exists %[1]s (%[2]s bigint not null references %[3]s(id) on delete cascade, "+
+				"fieldid bigint not null references metadata_fields(id) on delete cascade, value text not null, "+
+				"numbervalue double precision, datevalue date, primary key (%[2]s, fieldid));",
+			target.valuesTable, target.idColumn, target.itemTable)
+		_, err = db.Exec(createMetadataValuesQuery)
+		if err != nil {
+			log.Error("Error creating the %s table: %s", target.valuesTable, err)
+			return err
+		}
+
+		createMetadataValuesIndexQuery := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %[1]s_field ON %[1]s (fieldid);", target.valuesTable)
+		_, err = db.Exec(createMetadataValuesIndexQuery)
+		if err != nil {
+			log.Error("Error creating the index of the %s table: %s", target.valuesTable, err)
+			return err
+		}
+	}
+
+	createSubfolderTagsQuery :=
+		"CREATE TABLE if not exists subfolder_tags (subfolderid bigint not null references subfolders(id) on delete cascade, " +
+			"tag text not null, primary key (subfolderid, tag));"
+	_, err = db.Exec(createSubfolderTagsQuery)
+	if err != nil {
+		log.Error("Error creating the subfolder_tags table: %s", err)
+		return err
+	}
+
+	createSubfolderTagsIndexQuery := "CREATE INDEX IF NOT EXISTS subfolder_tags_tag ON subfolder_tags (tag);"
+	_, err = db.Exec(createSubfolderTagsIndexQuery)
+	if err != nil {
+		log.Error("Error creating the index of the subfolder tags: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created the metadata tables")
+	return nil
+}
+
+// GetMetadataFields returns the metadata schema of the workspace
+func GetMetadataFields(db *sql.DB, folderID int64) ([]MetadataField, error) {
+	getMetadataFieldsQuery := "SELECT id, name, type, options FROM metadata_fields WHERE folderid=$1 ORDER BY name"
+	rows, err := db.Query(getMetadataFieldsQuery, folderID)
+	if err != nil {
+		log.Error("Error getting the metadata fields of the folder with ID %d: %s", folderID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := []MetadataField{}
+	for rows.Next() {
+		var field MetadataField
+		err = rows.Scan(&field.ID, &field.Name, &field.Type, pq.Array(&field.Options))
+		if err != nil {
+			log.Error("Error binding the metadata fields of the folder with ID %d: %s", folderID, err)
+			return fields, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, rows.Err()
+}
+
+// AddMetadataField adds a field to the metadata schema of the workspace
+func AddMetadataField(db *sql.DB, folderID int64, field MetadataField) (int64, error) {
+	field.Name = strings.ToLower(strings.TrimSpace(field.Name))
+	if !metadataFieldName.MatchString(field.Name) {
+		return 0, errors.New(INVALID_METADATA_FIELD)
+	}
+
+	options := []string{}
+	switch field.Type {
+	case MetadataText, MetadataNumber, MetadataDate:
+		if len(field.Options) > 0 {
+			return 0, errors.New(INVALID_METADATA_FIELD)
+		}
+	case MetadataEnum:
+		seen := map[string]bool{}
+		for _, option := range field.Options {
+			option = strings.TrimSpace(option)
+			if len(option) == 0 || len(option) > maxMetadataTextValue || seen[strings.ToLower(option)] {
+				return 0, errors.New(INVALID_METADATA_FIELD)
+			}
+			seen[strings.ToLower(option)] = true
+			options = append(options, option)
+		}
+		if len(options) == 0 {
+			return 0, errors.New(INVALID_METADATA_FIELD)
+		}
+	default:
+		return 0, errors.New(INVALID_METADATA_FIELD)
+	}
+
+	var fieldID int64
+	addMetadataFieldStatement :=
+		"INSERT INTO metadata_fields(folderid, name, type, options) VALUES($1, $2, $3, $4) " +
+			"ON CONFLICT (folderid, name) DO NOTHING RETURNING id"
+	err := db.QueryRow(addMetadataFieldStatement, folderID, field.Name, field.Type, pq.Array(options)).Scan(&fieldID)
+	if err == sql.ErrNoRows {
+		return 0, errors.New(METADATA_FIELD_ALREADY_EXISTS)
+	} else if err != nil {
+		log.Error("Error adding the metadata field %s to the folder with ID %d: %s", field.Name, folderID, err)
+		return 0, err
+	}
+	return fieldID, nil
+}
+
+// RemoveMetadataField removes the field from the schema of the workspace, along with its values
+func RemoveMetadataField(db *sql.DB, folderID int64, fieldID int64) error {
+	removeMetadataFieldStatement := "DELETE FROM metadata_fields WHERE id=$1 AND folderid=$2"
+	res, err := db.Exec(removeMetadataFieldStatement, fieldID, folderID)
+	if err != nil {
+		log.Error("Error removing the metadata field with ID %d: %s", fieldID, err)
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New(UNKNOWN_METADATA_FIELD)
+	}
+	return nil
+}
+
+// metadataValue validates the value against the type of the field, returning its canonical text and its typed value
+func metadataValue(field MetadataField, value string) (string, interface{}, interface{}, error) {
+	value = strings.TrimSpace(value)
+	switch field.Type {
+	case MetadataNumber:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", nil, nil, errors.New(INVALID_METADATA_VALUE)
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), number, nil, nil
+	case MetadataDate:
+		date, err := time.Parse(metadataDateLayout, value)
+		if err != nil {
+			return "", nil, nil, errors.New(INVALID_METADATA_VALUE)
+		}
+		return date.Format(metadataDateLayout), nil, date, nil
+	case MetadataEnum:
+		for _, option := range field.Options {
+			if strings.EqualFold(option, value) {
+				return option, nil, nil, nil
+			}
+		}
+		return "", nil, nil, errors.New(INVALID_METADATA_VALUE)
+	}
+	if len(value) == 0 || len(value) > maxMetadataTextValue {
+		return "", nil, nil, errors.New(INVALID_METADATA_VALUE)
+	}
+	return value, nil, nil, nil
+}
+
+// getItemMetadata returns the tags and the values of the item
+func getItemMetadata(db *sql.DB, target metadataTarget, itemID int64) (ItemMetadata, error) {
+	metadata := ItemMetadata{Tags: []string{}, Values: MetadataValues{}}
+
+	getTagsQuery := fmt.Sprintf("SELECT array(SELECT tag FROM %s WHERE %s=$1 ORDER BY tag)", target.tagsTable, target.idColumn)
+	err := db.QueryRow(getTagsQuery, itemID).Scan(pq.Array(&metadata.Tags))
+	if err != nil {
+		log.Error("Error getting the tags from %s for the ID %d: %s", target.tagsTable, itemID, err)
+		return metadata, err
+	}
+
+	getValuesQuery := "SELECT " + metadataValuesExpression(target, "$1")
+	err = db.QueryRow(getValuesQuery, itemID).Scan(&metadata.Values)
+	if err != nil {
+		log.Error("Error getting the values from %s for the ID %d: %s", target.valuesTable, itemID, err)
+		return metadata, err
+	}
+	return metadata, nil
+}
+
+func GetFileMetadata(db *sql.DB, fileID int64) (ItemMetadata, error) {
+	return getItemMetadata(db, fileMetadataTarget, fileID)
+}
+
+func GetSubfolderMetadata(db *sql.DB, subfolderID int64) (ItemMetadata, error) {
+	return getItemMetadata(db, subfolderMetadataTarget, subfolderID)
+}
+
+// metadataValuesExpression selects the values of the item as a JSON object, scanned by MetadataValues
+func metadataValuesExpression(target metadataTarget, itemID string) string {
+	return fmt.Sprintf("(SELECT coalesce(json_object_agg(metadata_fields.name, %[1]s.value), '{}') FROM %[1]s "+
+		"JOIN metadata_fields ON metadata_fields.id=%[1]s.fieldid WHERE %[1]s.%[2]s=%[3]s)",
+		target.valuesTable, target.idColumn, itemID)
+}
+
+// EditMetadata applies the edit to the files and subfolders of the workspace, all of them being owned by the user.
+// The edit is applied to all the items or to none of them.
+func EditMetadata(db *sql.DB, folderID int64, userID int64, fileIDs []int64, subfolderIDs []int64, edit MetadataEdit) error {
+	var err error
+	if edit.Tags != nil {
+		if edit.Tags, err = normalizeTags(edit.Tags); err != nil {
+			return err
+		}
+	}
+	if edit.AddTags, err = normalizeTags(edit.AddTags); err != nil {
+		return err
+	}
+	if edit.RemoveTags, err = normalizeTags(edit.RemoveTags); err != nil {
+		return err
+	}
+
+	fields, err := GetMetadataFields(db, folderID)
+	if err != nil {
+		return err
+	}
+	fieldsByName := map[string]MetadataField{}
+	for _, field := range fields {
+		fieldsByName[field.Name] = field
+	}
+	for name, value := range edit.Values {
+		field, exists := fieldsByName[strings.ToLower(name)]
+		if !exists {
+			log.Error("The folder with ID %d has no metadata field %s", folderID, name)
+			return errors.New(UNKNOWN_METADATA_FIELD)
+		}
+		if value != nil {
+			if _, _, _, err = metadataValue(field, *value); err != nil {
+				log.Error("The value %s is not valid for the %s field %s", *value, field.Type, name)
+				return err
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction to edit the metadata in the folder with ID %d: %s", folderID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, item := range []struct {
+		target metadataTarget
+		ids    []int64
+	}{{fileMetadataTarget, fileIDs}, {subfolderMetadataTarget, subfolderIDs}} {
+		if len(item.ids) == 0 {
+			continue
+		}
+		err = editItemsMetadata(tx, item.target, folderID, userID, item.ids, edit, fieldsByName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error("Error committing the metadata edit in the folder with ID %d: %s", folderID, err)
+		return err
+	}
+	return nil
+}
+
+func editItemsMetadata(tx *sql.Tx, target metadataTarget, folderID int64, userID int64, ids []int64, edit MetadataEdit,
+	fieldsByName map[string]MetadataField) error {
+	// the items are locked, so they can't be removed before their metadata is written
+	var ownedCount int
+	countOwnedItemsQuery := fmt.Sprintf(
+		"SELECT count(*) FROM (SELECT id FROM %s WHERE id = ANY($1) AND folderid=$2 AND ownerid=$3 FOR UPDATE) owned",
+		target.itemTable)
+	err := tx.QueryRow(countOwnedItemsQuery, pq.Array(ids), folderID, userID).Scan(&ownedCount)
+	if err != nil {
+		log.Error("Error checking the owner of the items from %s: %s", target.itemTable, err)
+		return err
+	}
+	uniqueIDs := map[int64]bool{}
+	for _, id := range ids {
+		uniqueIDs[id] = true
+	}
+	if ownedCount != len(uniqueIDs) {
+		log.Error("The user %d tried to edit the metadata of %s not owned in the folder with ID %d", userID, target.itemTable, folderID)
+		return errors.New(METADATA_ITEMS_NOT_OWNED)
+	}
+
+	if edit.Tags != nil {
+		removeTagsStatement := fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1)", target.tagsTable, target.idColumn)
+		if _, err = tx.Exec(removeTagsStatement, pq.Array(ids)); err != nil {
+			log.Error("Error removing the tags from %s: %s", target.tagsTable, err)
+			return err
+		}
+	}
+	if len(edit.RemoveTags) > 0 {
+		removeTagsStatement := fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1) AND tag = ANY($2)", target.tagsTable, target.idColumn)
+		if _, err = tx.Exec(removeTagsStatement, pq.Array(ids), pq.Array(edit.RemoveTags)); err != nil {
+			log.Error("Error removing the tags from %s: %s", target.tagsTable, err)
+			return err
+		}
+	}
+	addedTags := append(append([]string{}, edit.Tags...), edit.AddTags...)
+	if len(addedTags) > 0 {
+		addTagsStatement := fmt.Sprintf("INSERT INTO %[1]s(%[2]s, tag) SELECT item, tag FROM unnest($1::bigint[]) item, "+
+			"unnest($2::text[]) tag ON CONFLICT (%[2]s, tag) DO NOTHING", target.tagsTable, target.idColumn)
+		if _, err = tx.Exec(addTagsStatement, pq.Array(ids), pq.Array(addedTags)); err != nil {
+			log.Error("Error adding the tags to %s: %s", target.tagsTable, err)
+			return err
+		}
+	}
+
+	for name, value := range edit.Values {
+		field := fieldsByName[strings.ToLower(name)]
+		if value == nil {
+			removeValueStatement := fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1) AND fieldid=$2", target.valuesTable, target.idColumn)
+			if _, err = tx.Exec(removeValueStatement, pq.Array(ids), field.ID); err != nil {
+				log.Error("Error removing the %s values from %s: %s", field.Name, target.valuesTable, err)
+				return err
+			}
+			continue
+		}
+
+		text, number, date, _ := metadataValue(field, *value)
+		setValueStatement := fmt.Sprintf("INSERT INTO %[1]s(%[2]s, fieldid, value, numbervalue, datevalue) "+
+			"SELECT item, $2, $3, $4, $5 FROM unnest($1::bigint[]) item ON CONFLICT (%[2]s, fieldid) "+
+			"DO UPDATE SET value=excluded.value, numbervalue=excluded.numbervalue, datevalue=excluded.datevalue",
+			target.valuesTable, target.idColumn)
+		if _, err = tx.Exec(setValueStatement, pq.Array(ids), field.ID, text, number, date); err != nil {
+			log.Error("Error setting the %s values in %s: %s", field.Name, target.valuesTable, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// metadataFilterConditions returns the conditions of the metadata filters, the item id expression being files.id
+// or subfolders.id
+func metadataFilterConditions(target metadataTarget, itemID string, filters []MetadataFilter, args *queryArgs) ([]string, error) {
+	var conditions []string
+	for _, filter := range filters {
+		comparisons := []string{"metadata_fields.name = " + args.add(strings.ToLower(filter.Field))}
+		if len(filter.Value) > 0 {
+			comparisons = append(comparisons, fmt.Sprintf("lower(%s.value) = lower(%s)", target.valuesTable, args.add(strings.TrimSpace(filter.Value))))
+		}
+		for _, bound := range []struct {
+			value    string
+			operator string
+		}{{filter.Min, ">="}, {filter.Max, "<="}} {
+			if len(bound.value) == 0 {
+				continue
+			}
+			if number, err := strconv.ParseFloat(bound.value, 64); err == nil {
+				comparisons = append(comparisons, fmt.Sprintf("%s.numbervalue %s %s::double precision", target.valuesTable, bound.operator, args.add(number)))
+			} else if date, err := time.Parse(metadataDateLayout, bound.value); err == nil {
+				comparisons = append(comparisons, fmt.Sprintf("%s.datevalue %s %s::date", target.valuesTable, bound.operator, args.add(date)))
+			} else {
+				return nil, errors.New(INVALID_METADATA_FILTER)
+			}
+		}
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM %[1]s JOIN metadata_fields ON metadata_fields.id=%[1]s.fieldid "+
+			"WHERE %[1]s.%[2]s=%[3]s AND %[4]s)", target.valuesTable, target.idColumn, itemID, strings.Join(comparisons, " AND ")))
+	}
+	return conditions, nil
+}
+
+// tagsCondition selects the items having every tag
+func tagsCondition(target metadataTarget, itemID string, tags []string, args *queryArgs) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("(SELECT count(*) FROM %[1]s WHERE %[1]s.%[2]s=%[3]s AND %[1]s.tag = ANY(%[4]s)) = %[5]d",
+		target.tagsTable, target.idColumn, itemID, args.add(pq.Array(tags)), len(tags))
+}
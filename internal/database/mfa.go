@@ -0,0 +1,107 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+var (
+	MFA_ALREADY_ENABLED = "the two factor authentication is already enabled"
+	MFA_NOT_SET_UP      = "the two factor authentication was not set up"
+)
+
+// UserMFA holds the TOTP secret of the user, LastStep being the time step of the last accepted code
+type UserMFA struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func CreateUserMFAColumns(db *sql.DB) error {
+	addUserMFAColumnsQuery :=
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS mfasecret text not null default '', " +
+			"ADD COLUMN IF NOT EXISTS mfaenabled bool not null default false, " +
+			"ADD COLUMN IF NOT EXISTS mfalaststep bigint not null default 0;"
+	_, err := db.Exec(addUserMFAColumnsQuery)
+	if err != nil {
+		log.Error("Error adding the two factor authentication columns to the users table: %s", err)
+		return err
+	}
+
+	log.Info("Successfully added the two factor authentication columns to the users table")
+	return nil
+}
+
+func GetUserMFA(db *sql.DB, userID int64) (UserMFA, error) {
+	var mfa UserMFA
+	getUserMFAQuery := "SELECT mfasecret, mfaenabled, mfalaststep FROM users WHERE id=$1"
+	err := db.QueryRow(getUserMFAQuery, userID).Scan(&mfa.Secret, &mfa.Enabled, &mfa.LastStep)
+	if err != nil {
+		log.Error("Error getting the two factor authentication of the user %d: %s", userID, err)
+		return mfa, err
+	}
+	return mfa, nil
+}
+
+// SetUserMFASecret stores a new secret, not enabled until a code generated with it is verified
+func SetUserMFASecret(db *sql.DB, userID int64, secret string) error {
+	setUserMFASecretStatement := "UPDATE users SET mfasecret=$2, mfalaststep=0 WHERE id=$1 AND NOT mfaenabled"
+	res, err := db.Exec(setUserMFASecretStatement, userID, secret)
+	if err != nil {
+		log.Error("Error setting the two factor authentication secret of the user %d: %s", userID, err)
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New(MFA_ALREADY_ENABLED)
+	}
+	return nil
+}
+
+// UseMFAStep records the time step of an accepted code, returning false if a code of the same or of a later
+// step was already used, so every code is accepted only once
+func UseMFAStep(db *sql.DB, userID int64, step int64) (bool, error) {
+	useMFAStepStatement := "UPDATE users SET mfalaststep=$2 WHERE id=$1 AND mfalaststep < $2"
+	res, err := db.Exec(useMFAStepStatement, userID, step)
+	if err != nil {
+		log.Error("Error recording the two factor authentication code of the user %d: %s", userID, err)
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+func EnableUserMFA(db *sql.DB, userID int64) error {
+	enableUserMFAStatement := "UPDATE users SET mfaenabled=true WHERE id=$1 AND mfasecret<>''"
+	res, err := db.Exec(enableUserMFAStatement, userID)
+	if err != nil {
+		log.Error("Error enabling the two factor authentication of the user %d: %s", userID, err)
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New(MFA_NOT_SET_UP)
+	}
+	return nil
+}
+
+func DisableUserMFA(db *sql.DB, userID int64) error {
+	disableUserMFAStatement := "UPDATE users SET mfaenabled=false, mfasecret='', mfalaststep=0 WHERE id=$1"
+	_, err := db.Exec(disableUserMFAStatement, userID)
+	if err != nil {
+		log.Error("Error disabling the two factor authentication of the user %d: %s", userID, err)
+		return err
+	}
+	return nil
+}
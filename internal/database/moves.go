@@ -0,0 +1,436 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+var (
+	NODE_MOVE_NOT_SUPPORTED = "the subfolders can only be moved to another workspace, and the deeper folders under a folder of a workspace"
+	NODE_MOVE_INTO_ITSELF   = "a folder can't be moved inside itself"
+	FILE_MOVE_TO_WORKSPACE  = "the files are moved to the folders of a workspace, not to the workspace itself"
+	NODE_MOVE_OUT_OF_LOCKED = "a folder can't be moved out of a subfolder locked with a password"
+	LABEL_LOWERED           = "the items can't be moved or copied to a folder with a lower sensitivity label"
+)
+
+// verifyLabelNotLowered refuses to move or copy the items of a subfolder to another one when the label they inherit
+// from the workspace and the subfolder gets a lower level there, which would loosen its rules. A zero subfolderID
+// selects the workspace alone, for the subfolders which keep their own label.
+func verifyLabelNotLowered(db interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, sourceFolderID int64, sourceSubfolderID int64, targetFolderID int64, targetSubfolderID int64) error {
+	inheritedLevelQuery :=
+		"SELECT coalesce(max(level), -1) FROM sensitivity_labels WHERE name IN " +
+			"((SELECT label FROM folders WHERE id=$1), (SELECT label FROM subfolders WHERE id=$2))"
+	var sourceLevel, targetLevel int
+	err := db.QueryRow(inheritedLevelQuery, sourceFolderID, sourceSubfolderID).Scan(&sourceLevel)
+	if err == nil {
+		err = db.QueryRow(inheritedLevelQuery, targetFolderID, targetSubfolderID).Scan(&targetLevel)
+	}
+	if err != nil {
+		log.Error("Error comparing the labels of the subfolder %d and of the subfolder %d: %s", sourceSubfolderID, targetSubfolderID, err)
+		return err
+	}
+	if sourceLevel > targetLevel {
+		log.Error("The label of the subfolder %d is higher than the label of the subfolder %d", sourceSubfolderID, targetSubfolderID)
+		return errors.New(LABEL_LOWERED)
+	}
+	return nil
+}
+
+// lockNodeFiles locks the node until the end of the transaction, so two files can't get the same name in it
+func lockNodeFiles(tx *sql.Tx, nodeID int64, filename string, exceptFileID int64) error {
+	lockNodeQuery := "SELECT id FROM nodes WHERE id=$1 FOR UPDATE"
+	var lockedID int64
+	err := tx.QueryRow(lockNodeQuery, nodeID).Scan(&lockedID)
+	if err == sql.ErrNoRows {
+		return errors.New(NODE_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error locking the node %d: %s", nodeID, err)
+		return err
+	}
+
+	var nameTaken bool
+	nameTakenQuery := "SELECT EXISTS(SELECT 1 FROM files WHERE nodeid=$1 AND filename=$2 AND id<>$3)"
+	err = tx.QueryRow(nameTakenQuery, nodeID, filename, exceptFileID).Scan(&nameTaken)
+	if err != nil {
+		log.Error("Error checking the name %s in the node %d: %s", filename, nodeID, err)
+		return err
+	}
+	if nameTaken {
+		log.Error("The node %d already has a file named %s", nodeID, filename)
+		return errors.New(FILE_ALREADY_EXISTS)
+	}
+	return nil
+}
+
+// RenameFile renames the file, keeping it in its folder. The content is stored under a generated key, so only
+// the database changes.
+func RenameFile(db *sql.DB, fileID int64, filename string) error {
+	if err := validateFilename(filename); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction renaming the file %d: %s", fileID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var nodeID sql.NullInt64
+	err = tx.QueryRow("SELECT nodeid FROM files WHERE id=$1", fileID).Scan(&nodeID)
+	if err != nil {
+		log.Error("Error retrieving the node of the file %d: %s", fileID, err)
+		return err
+	}
+	if err = lockNodeFiles(tx, nodeID.Int64, filename, fileID); err != nil {
+		return err
+	}
+
+	renameFileStatement := "UPDATE files SET filename=$1, mimetype=$2 WHERE id=$3"
+	_, err = tx.Exec(renameFileStatement, filename, MimeTypeForFilename(filename), fileID)
+	if err != nil {
+		log.Error("Error renaming the file %d: %s", fileID, err)
+		return err
+	}
+
+	log.Info("Successfully renamed the file %d to %s", fileID, filename)
+	return tx.Commit()
+}
+
+// RenameNode renames a folder of the tree, and the workspace or the subfolder it stands for. The unique index of
+// the nodes rejects the names already used in the parent.
+func RenameNode(db *sql.DB, node Node, name string) error {
+	if !IsNodeNameValid(name) {
+		return errors.New(INVALID_NODE_NAME)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction renaming the node %d: %s", node.ID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = renameNode(tx, node, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// renameNode is RenameNode inside a transaction
+func renameNode(tx *sql.Tx, node Node, name string) error {
+	_, err := tx.Exec("UPDATE nodes SET name=$1 WHERE id=$2", name, node.ID)
+	if isNodeNameUniqueViolation(err) {
+		log.Error("The parent of the node %d already has a child named %s", node.ID, name)
+		return errors.New(NODE_ALREADY_EXISTS)
+	} else if err != nil {
+		log.Error("Error renaming the node %d: %s", node.ID, err)
+		return err
+	}
+	if err = renameNodeFolder(tx, node, name); err != nil {
+		return err
+	}
+
+	log.Info("Successfully renamed the node %d to %s", node.ID, name)
+	return nil
+}
+
+// renameNodeFolder renames the workspace or the subfolder the node stands for
+func renameNodeFolder(tx *sql.Tx, node Node, name string) error {
+	var err error
+	switch node.Depth {
+	case 0:
+		_, err = tx.Exec("UPDATE folders SET name=$1 WHERE id=$2", name, node.FolderID)
+	case 1:
+		_, err = tx.Exec("UPDATE subfolders SET name=$1 WHERE id=$2", name, node.SubfolderID)
+	}
+	if err != nil {
+		log.Error("Error renaming the folder of the node %d: %s", node.ID, err)
+		return err
+	}
+	return nil
+}
+
+// moveFilesWorkspace moves the files matching the condition to another workspace: their usage moves between the
+// workspace quotas, failing when the target goes over its limits, and their metadata values for fields the
+// target workspace doesn't have are removed
+func moveFilesWorkspace(tx *sql.Tx, folderID int64, filesCondition string, args ...interface{}) error {
+	movedUsageQuery := fmt.Sprintf(
+		"SELECT files.folderid, sum(%s), count(*) FROM files LEFT JOIN blobs ON blobs.id=files.blobid "+
+			"WHERE %s AND %s AND files.folderid<>%d GROUP BY files.folderid ORDER BY files.folderid",
+		fileUsageExpression, fileHasContentCondition, filesCondition, folderID)
+	rows, err := tx.Query(movedUsageQuery, args...)
+	if err != nil {
+		log.Error("Error computing the usage of the moved files: %s", err)
+		return err
+	}
+
+	type movedUsage struct {
+		folderID int64
+		bytes    int64
+		files    int64
+	}
+	var moved []movedUsage
+	for rows.Next() {
+		var usage movedUsage
+		if err = rows.Scan(&usage.folderID, &usage.bytes, &usage.files); err != nil {
+			rows.Close()
+			log.Error("Error binding the usage of the moved files: %s", err)
+			return err
+		}
+		moved = append(moved, usage)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, usage := range moved {
+		if err = chargeQuota(tx, WorkspaceQuotaScope, folderID, usage.bytes, usage.files); err != nil {
+			return err
+		}
+		if err = chargeQuota(tx, WorkspaceQuotaScope, usage.folderID, -usage.bytes, -usage.files); err != nil {
+			return err
+		}
+	}
+
+	removeMetadataStatement := fmt.Sprintf(
+		"DELETE FROM file_metadata_values WHERE fileid IN (SELECT files.id FROM files WHERE %s) "+
+			"AND fieldid NOT IN (SELECT id FROM metadata_fields WHERE folderid=%d)", filesCondition, folderID)
+	_, err = tx.Exec(removeMetadataStatement, args...)
+	if err != nil {
+		log.Error("Error removing the metadata values of the moved files: %s", err)
+		return err
+	}
+	return nil
+}
+
+// MoveFile moves the file to a folder of the tree, below a subfolder. Its password, versions, labels and share
+// links stay with it, and its name must be free in the target. The label it inherits can't be lowered.
+func MoveFile(db *sql.DB, fileID int64, target Node) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction moving the file %d: %s", fileID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = moveFile(tx, fileID, target, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MoveAndRenameFile is MoveFile also renaming the file, in the same transaction, the new name being the one
+// which must be free in the target
+func MoveAndRenameFile(db *sql.DB, fileID int64, target Node, filename string) error {
+	if err := validateFilename(filename); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction moving the file %d: %s", fileID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = moveFile(tx, fileID, target, filename); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// moveFile is MoveFile inside a transaction, giving the file the name when it isn't empty
+func moveFile(tx *sql.Tx, fileID int64, target Node, filename string) error {
+	if target.Depth == 0 {
+		return errors.New(FILE_MOVE_TO_WORKSPACE)
+	}
+
+	var currentFilename string
+	var folderID, subfolderID int64
+	err := tx.QueryRow("SELECT filename, folderid, subfolderid FROM files WHERE id=$1", fileID).Scan(&currentFilename, &folderID, &subfolderID)
+	if err != nil {
+		log.Error("Error retrieving the file %d: %s", fileID, err)
+		return err
+	}
+	if len(filename) == 0 {
+		filename = currentFilename
+	}
+	if err = verifyLabelNotLowered(tx, folderID, subfolderID, target.FolderID, target.SubfolderID); err != nil {
+		return err
+	}
+	if err = lockNodeFiles(tx, target.ID, filename, fileID); err != nil {
+		return err
+	}
+
+	if err = moveFilesWorkspace(tx, target.FolderID, "files.id=$1", fileID); err != nil {
+		return err
+	}
+
+	// the MIME type only follows a new name, the one of the uploads being kept
+	moveFileStatement :=
+		"UPDATE files SET folderid=$1, subfolderid=$2, nodeid=$3, mimetype=CASE WHEN filename=$4 THEN mimetype ELSE $5 END, " +
+			"filename=$4 WHERE id=$6"
+	_, err = tx.Exec(moveFileStatement, target.FolderID, target.SubfolderID, target.ID, filename, MimeTypeForFilename(filename), fileID)
+	if err != nil {
+		log.Error("Error moving the file %d to the node %d: %s", fileID, target.ID, err)
+		return err
+	}
+
+	moveShareLinksStatement := "UPDATE share_links SET folderid=$1, subfolderid=$2 WHERE fileid=$3"
+	_, err = tx.Exec(moveShareLinksStatement, target.FolderID, target.SubfolderID, fileID)
+	if err != nil {
+		log.Error("Error moving the share links of the file %d: %s", fileID, err)
+		return err
+	}
+
+	log.Info("Successfully moved the file %d to the node %d", fileID, target.ID)
+	return nil
+}
+
+// MoveNode moves a folder of the tree under another one, with everything below it. The subfolders move to
+// another workspace, taking their password, metadata and share links with them, and the deeper folders move
+// under any folder of a workspace, their files following the subfolder they land in. The files of the other users
+// can be below the node, so the deeper folders can't leave a locked subfolder, and the label the items inherit
+// can't be lowered.
+func MoveNode(db *sql.DB, node Node, target Node) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction moving the node %d: %s", node.ID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = moveNode(tx, node, target, node.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MoveAndRenameNode is MoveNode also renaming the node, in the same transaction, the new name being the one
+// which must be free in the target
+func MoveAndRenameNode(db *sql.DB, node Node, target Node, name string) error {
+	if !IsNodeNameValid(name) {
+		return errors.New(INVALID_NODE_NAME)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction moving the node %d: %s", node.ID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = moveNode(tx, node, target, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// moveNode is MoveNode inside a transaction, giving the node the name
+func moveNode(tx *sql.Tx, node Node, target Node, name string) error {
+	switch {
+	case node.Depth == 0, node.Depth == 1 && target.Depth != 0, node.Depth > 1 && target.Depth == 0:
+		return errors.New(NODE_MOVE_NOT_SUPPORTED)
+	case strings.HasPrefix(target.Path, node.Path):
+		return errors.New(NODE_MOVE_INTO_ITSELF)
+	case node.ParentID == target.ID && name == node.Name:
+		return nil
+	case node.ParentID == target.ID:
+		return renameNode(tx, node, name)
+	}
+
+	// a subfolder keeps its own password and label, the deeper folders take the ones of the subfolder they land in
+	sourceSubfolderID := node.SubfolderID
+	if node.Depth == 1 {
+		sourceSubfolderID = 0
+	} else if node.SubfolderID != target.SubfolderID {
+		var sourceLocked bool
+		err := tx.QueryRow("SELECT islocked FROM subfolders WHERE id=$1", node.SubfolderID).Scan(&sourceLocked)
+		if err != nil {
+			log.Error("Error checking the lock of the subfolder %d: %s", node.SubfolderID, err)
+			return err
+		}
+		if sourceLocked {
+			log.Error("The node %d can't leave the locked subfolder %d", node.ID, node.SubfolderID)
+			return errors.New(NODE_MOVE_OUT_OF_LOCKED)
+		}
+	}
+	err := verifyLabelNotLowered(tx, node.FolderID, sourceSubfolderID, target.FolderID, target.SubfolderID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE nodes SET parentid=$1, name=$2 WHERE id=$3", target.ID, name, node.ID)
+	if isNodeNameUniqueViolation(err) {
+		log.Error("The node %d already has a child named %s", target.ID, name)
+		return errors.New(NODE_ALREADY_EXISTS)
+	} else if err != nil {
+		log.Error("Error moving the node %d under the node %d: %s", node.ID, target.ID, err)
+		return err
+	}
+	if name != node.Name {
+		if err = renameNodeFolder(tx, node, name); err != nil {
+			return err
+		}
+	}
+
+	// the subfolder keeps its id, the deeper folders take the subfolder of the target
+	subfolderID := target.SubfolderID
+	if node.Depth == 1 {
+		subfolderID = node.SubfolderID
+	}
+	newPath := fmt.Sprintf("%s%d/", target.Path, node.ID)
+	moveSubtreeStatement :=
+		"UPDATE nodes SET path=$1 || substr(path, $2), depth=depth+$3, folderid=$4, subfolderid=$5 WHERE path LIKE $6"
+	_, err = tx.Exec(moveSubtreeStatement, newPath, len(node.Path)+1, target.Depth+1-node.Depth, target.FolderID,
+		subfolderID, node.Path+"%")
+	if err != nil {
+		log.Error("Error moving the descendants of the node %d: %s", node.ID, err)
+		return err
+	}
+
+	filesCondition := "files.nodeid IN (SELECT id FROM nodes WHERE path LIKE $1)"
+	if err = moveFilesWorkspace(tx, target.FolderID, filesCondition, newPath+"%"); err != nil {
+		return err
+	}
+
+	// the statements take the path of the moved nodes, the workspace and the subfolder of the target
+	moveFilesStatements := []string{
+		"UPDATE share_links SET folderid=$2, subfolderid=$3 WHERE fileid IN (SELECT files.id FROM files WHERE " + filesCondition + ")",
+		"UPDATE files SET folderid=$2, subfolderid=$3 WHERE " + filesCondition,
+	}
+	for _, moveFilesStatement := range moveFilesStatements {
+		_, err = tx.Exec(moveFilesStatement, newPath+"%", target.FolderID, subfolderID)
+		if err != nil {
+			log.Error("Error moving the files of the node %d: %s", node.ID, err)
+			return err
+		}
+	}
+
+	// the subfolder itself, its share links and its metadata move to the target workspace
+	if node.Depth == 1 {
+		moveSubfolderStatements := []string{
+			"UPDATE subfolders SET folderid=$1 WHERE id=$2",
+			"UPDATE share_links SET folderid=$1 WHERE subfolderid=$2 AND fileid IS NULL",
+			"DELETE FROM subfolder_metadata_values WHERE subfolderid=$2 AND fieldid NOT IN (SELECT id FROM metadata_fields WHERE folderid=$1)",
+		}
+		for _, moveSubfolderStatement := range moveSubfolderStatements {
+			_, err = tx.Exec(moveSubfolderStatement, target.FolderID, subfolderID)
+			if err != nil {
+				log.Error("Error moving the subfolder %d to the folder %d: %s", subfolderID, target.FolderID, err)
+				return err
+			}
+		}
+	}
+
+	log.Info("Successfully moved the node %d under the node %d", node.ID, target.ID)
+	return nil
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// addTestNode adds a folder of the user under the node, returning it
+func addTestNode(t *testing.T, db *sql.DB, ownerID int64, parent Node, name string) Node {
+	nodeID, err := AddNode(db, ownerID, parent, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := GetNode(db, nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// getTestSubfolderNode returns the node of the subfolder
+func getTestSubfolderNode(t *testing.T, db *sql.DB, folderID int64, subfolderID int64) Node {
+	node, err := GetFolderNode(db, folderID, subfolderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestMoveNodeKeepsThePasswordOfItsFiles(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ownerID := addTestUser(t, db, "owner@example.com")
+	otherUserID := addTestUser(t, db, "other@example.com")
+	folderID, err := AddNewFolder(db, ownerID, "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockedSubfolderID, err := AddNewSubfolder(db, ownerID, folderID, "locked", "subfolder password", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockedNode := getTestSubfolderNode(t, db, folderID, lockedSubfolderID)
+	publicFolderID, publicSubfolderID := addTestSubfolder(t, db, ownerID, "public")
+	publicNode := getTestSubfolderNode(t, db, publicFolderID, publicSubfolderID)
+
+	drafts := addTestNode(t, db, ownerID, lockedNode, "drafts")
+	if _, err = AddNewFile(db, otherUserID, folderID, lockedSubfolderID, drafts.ID, "other.pdf", "", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file of the other user would lose the password of the subfolder
+	if err = MoveNode(db, drafts, publicNode); errorText(err) != NODE_MOVE_OUT_OF_LOCKED {
+		t.Fatalf("moving a folder out of a locked subfolder returned %v, want %s", err, NODE_MOVE_OUT_OF_LOCKED)
+	}
+	inside := addTestNode(t, db, ownerID, lockedNode, "inside")
+	if err = MoveNode(db, drafts, inside); err != nil {
+		t.Fatalf("moving a folder inside its locked subfolder returned %v", err)
+	}
+}
+
+func TestMovesDontLowerTheInheritedLabel(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ownerID := addTestUser(t, db, "owner@example.com")
+	confidentialFolderID, confidentialSubfolderID := addTestSubfolder(t, db, ownerID, "confidential")
+	if err := SetLabel(db, LabelSubfolder, confidentialSubfolderID, "confidential"); err != nil {
+		t.Fatal(err)
+	}
+	confidentialNode := getTestSubfolderNode(t, db, confidentialFolderID, confidentialSubfolderID)
+	publicFolderID, publicSubfolderID := addTestSubfolder(t, db, ownerID, "public")
+	publicNode := getTestSubfolderNode(t, db, publicFolderID, publicSubfolderID)
+
+	archive := addTestNode(t, db, ownerID, confidentialNode, "archive")
+	if err := MoveNode(db, archive, publicNode); errorText(err) != LABEL_LOWERED {
+		t.Fatalf("moving a folder out of a confidential subfolder returned %v, want %s", err, LABEL_LOWERED)
+	}
+	fileID := addTestFile(t, db, ownerID, confidentialFolderID, confidentialSubfolderID, "report.pdf")
+	if err := MoveFile(db, fileID, publicNode); errorText(err) != LABEL_LOWERED {
+		t.Fatalf("moving a file out of a confidential subfolder returned %v, want %s", err, LABEL_LOWERED)
+	}
+
+	// the subfolders keep their own label, only the one of the workspace is inherited
+	confidentialSubfolderNode := getTestSubfolderNode(t, db, confidentialFolderID, confidentialSubfolderID)
+	publicWorkspace, err := GetFolderNode(db, publicNode.FolderID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = MoveNode(db, confidentialSubfolderNode, publicWorkspace); err != nil {
+		t.Fatalf("moving a confidential subfolder to an unlabeled workspace returned %v", err)
+	}
+	if err = SetLabel(db, LabelFolder, confidentialFolderID, "internal"); err != nil {
+		t.Fatal(err)
+	}
+	internalSubfolderID, err := AddNewSubfolder(db, ownerID, confidentialFolderID, "internal", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internalSubfolderNode := getTestSubfolderNode(t, db, confidentialFolderID, internalSubfolderID)
+	if err = MoveNode(db, internalSubfolderNode, publicWorkspace); errorText(err) != LABEL_LOWERED {
+		t.Fatalf("moving a subfolder out of an internal workspace returned %v, want %s", err, LABEL_LOWERED)
+	}
+}
+
+func TestMoveAndRenameChecksTheNewName(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ownerID := addTestUser(t, db, "owner@example.com")
+	folderID, subfolderID := addTestSubfolder(t, db, ownerID, "reports")
+	targetFolderID, targetSubfolderID := addTestSubfolder(t, db, ownerID, "target")
+	targetNode := getTestSubfolderNode(t, db, targetFolderID, targetSubfolderID)
+	fileID := addTestFile(t, db, ownerID, folderID, subfolderID, "report.pdf")
+	addTestFile(t, db, ownerID, targetFolderID, targetSubfolderID, "report.pdf")
+	addTestFile(t, db, ownerID, targetFolderID, targetSubfolderID, "taken.pdf")
+
+	// the file stays where it is when its new name is taken in the target
+	if err := MoveAndRenameFile(db, fileID, targetNode, "taken.pdf"); errorText(err) != FILE_ALREADY_EXISTS {
+		t.Fatalf("moving a file to a taken name returned %v, want %s", err, FILE_ALREADY_EXISTS)
+	}
+	fileDetails, err := GetFilesDetailsForFileID(db, fileID, folderID, subfolderID)
+	if err != nil {
+		t.Fatalf("the file left its subfolder: %v", err)
+	}
+	if fileDetails.Filename != "report.pdf" {
+		t.Fatalf("the file was renamed to %s", fileDetails.Filename)
+	}
+
+	// only the new name must be free, not the current one
+	if err = MoveAndRenameFile(db, fileID, targetNode, "moved.pdf"); err != nil {
+		t.Fatalf("moving a file to a free name returned %v", err)
+	}
+	if fileDetails, err = GetFilesDetailsForFileID(db, fileID, targetFolderID, targetSubfolderID); err != nil {
+		t.Fatal(err)
+	} else if fileDetails.Filename != "moved.pdf" {
+		t.Fatalf("the moved file is named %s, want moved.pdf", fileDetails.Filename)
+	}
+
+	drafts := addTestNode(t, db, ownerID, getTestSubfolderNode(t, db, folderID, subfolderID), "drafts")
+	addTestNode(t, db, ownerID, targetNode, "taken")
+	addTestNode(t, db, ownerID, targetNode, "drafts")
+	if err = MoveAndRenameNode(db, drafts, targetNode, "taken"); errorText(err) != NODE_ALREADY_EXISTS {
+		t.Fatalf("moving a folder to a taken name returned %v, want %s", err, NODE_ALREADY_EXISTS)
+	}
+	if err = MoveAndRenameNode(db, drafts, targetNode, "archive"); err != nil {
+		t.Fatalf("moving a folder to a free name returned %v", err)
+	}
+	moved, err := GetNode(db, drafts.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ParentID != targetNode.ID || moved.Name != "archive" {
+		t.Fatalf("the moved folder is %s under the node %d", moved.Name, moved.ParentID)
+	}
+}
@@ -0,0 +1,424 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
+)
+
+var (
+	NODE_NOT_FOUND              = "the folder doesn't exist"
+	NODE_ALREADY_EXISTS         = "a folder with this name already exists in the parent folder"
+	INVALID_NODE_NAME           = "the folder name can't be empty nor contain slashes"
+	NODE_PASSWORD_NOT_SUPPORTED = "only the folders of a workspace can be locked with a password"
+	NODE_IS_WORKSPACE           = "the files are uploaded in the folders of a workspace, not in the workspace itself"
+)
+
+// Node is a folder of the tree. The roots are the workspaces, stored in the folders table, and their children the
+// subfolders, stored in the subfolders table, so the two-level routes keep working. The deeper folders only exist
+// as nodes, and every node keeps the ids of its workspace and of the subfolder it is in, which hold the quotas,
+// the metadata schema, the labels and the password lock of everything below them.
+type Node struct {
+	ID       int64  `json:"id"`
+	ParentID int64  `json:"parentId"`
+	OwnerID  int64  `json:"ownerId"`
+	Name     string `json:"name"`
+	// Path holds the ids of the node and of its ancestors, like /1/4/9/
+	Path        string    `json:"path"`
+	Depth       int       `json:"depth"`
+	FolderID    int64     `json:"folderId"`
+	SubfolderID int64     `json:"subfolderId"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func CreateNodesTable(db *sql.DB) error {
+	createNodesQuery :=
+		"CREATE TABLE if not exists nodes (id bigserial primary key, parentid bigint references nodes(id) on delete cascade, " +
+			"ownerid bigint not null, name text not null, path text not null, depth int not null, " +
+			"folderid bigint not null references folders(id) on delete cascade, " +
+			"subfolderid bigint references subfolders(id) on delete cascade, createdat timestamptz not null default now());"
+	_, err := db.Exec(createNodesQuery)
+	if err != nil {
+		log.Error("Error creating the nodes table: %s", err)
+		return err
+	}
+
+	createNodesIndexesQuery :=
+		"CREATE UNIQUE INDEX IF NOT EXISTS nodes_parent_name ON nodes (coalesce(parentid, 0), name); " +
+			"CREATE INDEX IF NOT EXISTS nodes_path ON nodes (path text_pattern_ops); " +
+			"CREATE INDEX IF NOT EXISTS nodes_subfolder ON nodes (subfolderid, depth);"
+	_, err = db.Exec(createNodesIndexesQuery)
+	if err != nil {
+		log.Error("Error creating the indexes of the nodes: %s", err)
+		return err
+	}
+
+	// the files keep their workspace and subfolder, the node is the folder they are directly in
+	addNodeToFilesQuery :=
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS nodeid bigint references nodes(id) on delete set null; " +
+			"CREATE INDEX IF NOT EXISTS files_node ON files (nodeid);"
+	_, err = db.Exec(addNodeToFilesQuery)
+	if err != nil {
+		log.Error("Error adding the node column to the files table: %s", err)
+		return err
+	}
+
+	err = migrateFoldersToNodes(db)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Successfully created nodes table")
+	return nil
+}
+
+// migrateFoldersToNodes adds the nodes of the workspaces and of the subfolders created before the tree, and moves
+// their files in them. The paths need the ids, so they are set after the nodes are inserted, in the same transaction
+// so a failed migration doesn't leave nodes without paths.
+func migrateFoldersToNodes(db *sql.DB) error {
+	migrationStatements := []string{
+		"INSERT INTO nodes(ownerid, name, path, depth, folderid) SELECT folders.ownerid, folders.name, '', 0, folders.id " +
+			"FROM folders WHERE NOT EXISTS (SELECT 1 FROM nodes WHERE nodes.folderid=folders.id AND nodes.depth=0)",
+		"UPDATE nodes SET path='/' || id || '/' WHERE depth=0 AND path=''",
+		"INSERT INTO nodes(parentid, ownerid, name, path, depth, folderid, subfolderid) " +
+			"SELECT roots.id, subfolders.ownerid, subfolders.name, '', 1, subfolders.folderid, subfolders.id " +
+			"FROM subfolders JOIN nodes roots ON roots.folderid=subfolders.folderid AND roots.depth=0 " +
+			"WHERE NOT EXISTS (SELECT 1 FROM nodes WHERE nodes.subfolderid=subfolders.id AND nodes.depth=1)",
+		"UPDATE nodes SET path=parents.path || nodes.id || '/' FROM nodes parents WHERE parents.id=nodes.parentid AND nodes.path=''",
+		"UPDATE files SET nodeid=nodes.id FROM nodes WHERE files.nodeid IS NULL AND nodes.subfolderid=files.subfolderid AND nodes.depth=1",
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction migrating the folders to nodes: %s", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, migrationStatement := range migrationStatements {
+		_, err = tx.Exec(migrationStatement)
+		if err != nil {
+			log.Error("Error migrating the folders and the subfolders to nodes: %s", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nodeColumns are the columns read by scanNode
+var nodeColumns = "nodes.id, coalesce(nodes.parentid, 0), nodes.ownerid, nodes.name, nodes.path, nodes.depth, " +
+	"nodes.folderid, coalesce(nodes.subfolderid, 0), nodes.createdat"
+
+func scanNode(row interface{ Scan(...interface{}) error }) (Node, error) {
+	var node Node
+	err := row.Scan(&node.ID, &node.ParentID, &node.OwnerID, &node.Name, &node.Path, &node.Depth, &node.FolderID,
+		&node.SubfolderID, &node.CreatedAt)
+	return node, err
+}
+
+// isNodeNameUniqueViolation tells if the error comes from a sibling with the same name
+func isNodeNameUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505" && pqErr.Constraint == "nodes_parent_name"
+}
+
+// addNode inserts a node under the parent, a zero parentID adding a root, with the path built from its new id. It
+// runs on the database or in the transaction adding the folder of the node.
+func addNode(db interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, parentID int64, ownerID int64, name string, folderID int64, subfolderID int64) (int64, error) {
+	addNodeStatement :=
+		"INSERT INTO nodes(id, parentid, ownerid, name, path, depth, folderid, subfolderid) " +
+			"SELECT newnode.id, parents.id, $2, $3, coalesce(parents.path, '/') || newnode.id || '/', coalesce(parents.depth + 1, 0), $4, $5 " +
+			"FROM (SELECT nextval(pg_get_serial_sequence('nodes', 'id')) AS id) newnode LEFT JOIN nodes parents ON parents.id=$1 " +
+			"RETURNING id"
+	var nodeID int64
+	err := db.QueryRow(addNodeStatement, parentID, ownerID, name, folderID, nullableID(subfolderID)).Scan(&nodeID)
+	if isNodeNameUniqueViolation(err) {
+		log.Error("The node %d already has a child named %s", parentID, name)
+		return 0, errors.New(NODE_ALREADY_EXISTS)
+	} else if err != nil {
+		log.Error("Error adding the node %s under the node %d: %s", name, parentID, err)
+		return 0, err
+	}
+	return nodeID, nil
+}
+
+// addWorkspaceNode adds the root node of a new workspace, in the transaction adding the workspace
+func addWorkspaceNode(tx *sql.Tx, folderID int64, ownerID int64, name string) error {
+	_, err := addNode(tx, 0, ownerID, name, folderID, 0)
+	return err
+}
+
+// addSubfolderNode adds the node of a new subfolder under the node of its workspace, in the transaction adding the
+// subfolder
+func addSubfolderNode(tx *sql.Tx, folderID int64, subfolderID int64, ownerID int64, name string) error {
+	workspaceNode, err := getFolderNode(tx, folderID, 0)
+	if err != nil {
+		return err
+	}
+	_, err = addNode(tx, workspaceNode.ID, ownerID, name, folderID, subfolderID)
+	return err
+}
+
+// IsNodeNameValid tells if the name can be addressed in a path of names
+func IsNodeNameValid(name string) bool {
+	return isFilenameValid(name)
+}
+
+// AddNode adds a folder under a node below the subfolders, the workspaces and the subfolders being added with
+// AddNewFolder and AddNewSubfolder
+func AddNode(db *sql.DB, ownerID int64, parent Node, name string) (int64, error) {
+	if !IsNodeNameValid(name) {
+		log.Error("The node name %s is not valid", name)
+		return 0, errors.New(INVALID_NODE_NAME)
+	}
+	nodeID, err := addNode(db, parent.ID, ownerID, name, parent.FolderID, parent.SubfolderID)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Info("Successfully created the node %s under the node %d", name, parent.ID)
+	return nodeID, nil
+}
+
+// GetNode returns the node with the id
+func GetNode(db *sql.DB, nodeID int64) (Node, error) {
+	getNodeQuery := "SELECT " + nodeColumns + " FROM nodes WHERE nodes.id=$1"
+	node, err := scanNode(db.QueryRow(getNodeQuery, nodeID))
+	if err == sql.ErrNoRows {
+		log.Error("There's no node with the ID %d", nodeID)
+		return node, errors.New(NODE_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error retrieving the node with the ID %d: %s", nodeID, err)
+		return node, err
+	}
+	return node, nil
+}
+
+// GetFolderNode returns the node of a subfolder of the workspace, or of the workspace itself for a zero subfolderID
+func GetFolderNode(db *sql.DB, folderID int64, subfolderID int64) (Node, error) {
+	return getFolderNode(db, folderID, subfolderID)
+}
+
+// getFolderNode returns the node of the subfolder on the database or in a transaction
+func getFolderNode(db interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, folderID int64, subfolderID int64) (Node, error) {
+	getFolderNodeQuery := "SELECT " + nodeColumns + " FROM nodes WHERE nodes.folderid=$1 AND nodes.depth=0"
+	args := []interface{}{folderID}
+	if subfolderID != 0 {
+		getFolderNodeQuery = "SELECT " + nodeColumns + " FROM nodes WHERE nodes.folderid=$1 AND nodes.subfolderid=$2 AND nodes.depth=1"
+		args = append(args, subfolderID)
+	}
+	node, err := scanNode(db.QueryRow(getFolderNodeQuery, args...))
+	if err == sql.ErrNoRows {
+		log.Error("There's no node for the subfolder %d of the folder %d", subfolderID, folderID)
+		return node, errors.New(NODE_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error retrieving the node of the subfolder %d of the folder %d: %s", subfolderID, folderID, err)
+		return node, err
+	}
+	return node, nil
+}
+
+// GetNodeAncestors returns the ancestors of the node, from its workspace to its parent
+func GetNodeAncestors(db *sql.DB, node Node) ([]Node, error) {
+	getNodeAncestorsQuery :=
+		"SELECT " + nodeColumns + " FROM nodes WHERE nodes.id = ANY(string_to_array(trim(both '/' from $1), '/')::bigint[]) " +
+			"AND nodes.id<>$2 ORDER BY nodes.depth"
+	rows, err := db.Query(getNodeAncestorsQuery, node.Path, node.ID)
+	if err != nil {
+		log.Error("Error retrieving the ancestors of the node %d: %s", node.ID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ancestors := []Node{}
+	for rows.Next() {
+		ancestor, err := scanNode(rows)
+		if err != nil {
+			log.Error("Error reading an ancestor of the node %d: %s", node.ID, err)
+			return ancestors, err
+		}
+		ancestors = append(ancestors, ancestor)
+	}
+	return ancestors, rows.Err()
+}
+
+// GetChildNodes returns a page of the children of the node, sorted by name or id. A zero parentID returns the
+// workspaces.
+func GetChildNodes(db *sql.DB, parentID int64, page PageRequest) ([]Node, PageInfo, error) {
+	var pageInfo PageInfo
+	query, err := newPageQuery(page, folderSortColumns, "name", "nodes.id")
+	if err != nil {
+		log.Error("Error reading the page request of the children of the node %d: %s", parentID, err)
+		return nil, pageInfo, err
+	}
+
+	var args queryArgs
+	conditions := []string{"coalesce(nodes.parentid, 0)=" + args.add(parentID)}
+	countChildNodesQuery := "SELECT count(*) FROM nodes" + where(conditions)
+	err = db.QueryRow(countChildNodesQuery, args...).Scan(&pageInfo.TotalCount)
+	if err != nil {
+		log.Error("Error counting the children of the node %d: %s", parentID, err)
+		return nil, pageInfo, err
+	}
+
+	conditions = append(conditions, query.condition(&args))
+	getChildNodesQuery := "SELECT " + nodeColumns + ", " + query.sortValue() + " FROM nodes" + where(conditions) + query.orderBy()
+	rows, err := db.Query(getChildNodesQuery, args...)
+	if err != nil {
+		log.Error("Error retrieving the children of the node %d: %s", parentID, err)
+		return nil, pageInfo, err
+	}
+	defer rows.Close()
+
+	children := []Node{}
+	var sortValues []string
+	for rows.Next() {
+		var child Node
+		var sortValue string
+		err = rows.Scan(&child.ID, &child.ParentID, &child.OwnerID, &child.Name, &child.Path, &child.Depth, &child.FolderID,
+			&child.SubfolderID, &child.CreatedAt, &sortValue)
+		if err != nil {
+			log.Error("Error reading a child of the node %d: %s", parentID, err)
+			return children, pageInfo, err
+		}
+		children = append(children, child)
+		sortValues = append(sortValues, sortValue)
+	}
+	if err = rows.Err(); err != nil {
+		return children, pageInfo, err
+	}
+
+	var count int
+	pageInfo.NextCursor, count = query.nextCursor(len(children), func(index int) (string, int64) {
+		return sortValues[index], children[index].ID
+	})
+	return children[:count], pageInfo, nil
+}
+
+// GetAllChildNodes returns all the children of the node sorted by name, the workspaces for a zero parentID
+func GetAllChildNodes(db *sql.DB, parentID int64) ([]Node, error) {
+	getAllChildNodesQuery := "SELECT " + nodeColumns + " FROM nodes WHERE coalesce(nodes.parentid, 0)=$1 ORDER BY nodes.name"
+	rows, err := db.Query(getAllChildNodesQuery, parentID)
+	if err != nil {
+		log.Error("Error retrieving the children of the node %d: %s", parentID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	children := []Node{}
+	for rows.Next() {
+		child, err := scanNode(rows)
+		if err != nil {
+			log.Error("Error reading a child of the node %d: %s", parentID, err)
+			return children, err
+		}
+		children = append(children, child)
+	}
+	return children, rows.Err()
+}
+
+// ResolveNodePath returns the node at the path of names, the first name being the workspace
+func ResolveNodePath(db *sql.DB, names []string) (Node, error) {
+	var node Node
+	if len(names) == 0 {
+		return node, errors.New(NODE_NOT_FOUND)
+	}
+
+	getChildNodeQuery := "SELECT " + nodeColumns + " FROM nodes WHERE coalesce(nodes.parentid, 0)=$1 AND nodes.name=$2"
+	for _, name := range names {
+		child, err := scanNode(db.QueryRow(getChildNodeQuery, node.ID, name))
+		if err == sql.ErrNoRows {
+			return node, errors.New(NODE_NOT_FOUND)
+		} else if err != nil {
+			log.Error("Error resolving %s under the node %d: %s", name, node.ID, err)
+			return node, err
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// GetNodeFileID returns the id of the file with the name directly in the node, or 0 when there is none
+func GetNodeFileID(db *sql.DB, nodeID int64, filename string) (int64, error) {
+	var fileID int64
+	getNodeFileQuery := "SELECT id FROM files WHERE nodeid=$1 AND filename=$2"
+	err := db.QueryRow(getNodeFileQuery, nodeID, filename).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		log.Error("Error retrieving the file %s of the node %d: %s", filename, nodeID, err)
+		return 0, err
+	}
+	return fileID, nil
+}
+
+// nodeFilesCondition selects the files of the node and of its descendants
+func nodeFilesCondition(node Node) (string, interface{}) {
+	switch node.Depth {
+	case 0:
+		return "files.folderid=$1", node.FolderID
+	case 1:
+		return "files.subfolderid=$1", node.SubfolderID
+	default:
+		return "files.nodeid IN (SELECT id FROM nodes WHERE path LIKE $1)", node.Path + "%"
+	}
+}
+
+// GetStoredFilesForNode returns the files removed by RemoveNode, so they can be removed from the storage.
+// The files stored as blobs are left out, their content is removed by the blob garbage collection.
+func GetStoredFilesForNode(db *sql.DB, node Node) ([]StoredFile, error) {
+	filesCondition, arg := nodeFilesCondition(node)
+	getStoredFilesForNodeQuery := "SELECT id, filename, filepath, keyid, wrappedkey FROM files WHERE blobid IS NULL AND " + filesCondition
+	return getStoredFiles(db, getStoredFilesForNodeQuery, arg)
+}
+
+// RemoveNode removes the node with its descendants and their files. The workspaces and the subfolders are removed
+// from their tables, their nodes following them.
+func RemoveNode(db *sql.DB, node Node) error {
+	filesCondition, arg := nodeFilesCondition(node)
+	_, err := removeFilesReleasingBlobs(db, filesCondition, arg)
+	if err != nil {
+		log.Error("Error removing the files of the node %d: %s", node.ID, err)
+		return err
+	}
+
+	var removeNodeStatements []string
+	switch node.Depth {
+	case 0:
+		removeNodeStatements = []string{"DELETE FROM subfolders WHERE folderid=$1", "DELETE FROM folders WHERE id=$1"}
+		arg = node.FolderID
+	case 1:
+		removeNodeStatements = []string{"DELETE FROM subfolders WHERE id=$1"}
+		arg = node.SubfolderID
+	default:
+		removeNodeStatements = []string{"DELETE FROM nodes WHERE path LIKE $1"}
+	}
+	for _, removeNodeStatement := range removeNodeStatements {
+		_, err = db.Exec(removeNodeStatement, arg)
+		if err != nil {
+			log.Error("Error removing the node %d: %s", node.ID, err)
+			return err
+		}
+	}
+
+	log.Info("Successfully removed the node %d", node.ID)
+	return nil
+}
+
+// SplitNodePath splits a path of names, ignoring the empty segments
+func SplitNodePath(path string) []string {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,192 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/types"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+// OIDCLoginLifetime is how long the user has to log in with the identity provider
+const OIDCLoginLifetime = 10 * time.Minute
+
+var (
+	OIDC_LOGIN_NOT_FOUND      = "the single sign-on login doesn't exist or expired"
+	OIDC_EMAIL_NOT_VERIFIED   = "the identity provider didn't verify the email of the account"
+	OIDC_EMAIL_ALREADY_LINKED = "the account of the email is linked to another identity of the identity provider"
+)
+
+// OIDCIdentity is the user of the identity provider, identified by its issuer and subject
+type OIDCIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+func CreateOIDCTables(db *sql.DB) error {
+	// the logins started with the identity provider, each one used once by the redirect back from it
+	createOIDCLoginsQuery :=
+		"CREATE TABLE if not exists oidc_logins (state text primary key, nonce text not null, verifier text not null, " +
+			"createdat timestamptz not null default now());"
+	_, err := db.Exec(createOIDCLoginsQuery)
+	if err != nil {
+		log.Error("Error creating the oidc_logins table: %s", err)
+		return err
+	}
+
+	createUserIdentitiesQuery :=
+		"CREATE TABLE if not exists user_identities (id bigserial primary key, issuer text not null, subject text not null, " +
+			"userid bigint not null references users(id) on delete cascade, email text not null, " +
+			"createdat timestamptz not null default now(), lastloginat timestamptz not null default now(), " +
+			"unique (issuer, subject));"
+	_, err = db.Exec(createUserIdentitiesQuery)
+	if err != nil {
+		log.Error("Error creating the user_identities table: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created oidc_logins and user_identities tables")
+	return nil
+}
+
+// AddOIDCLogin stores the login started with the identity provider, removing the expired ones
+func AddOIDCLogin(db *sql.DB, state string, nonce string, verifier string) error {
+	removeExpiredLoginsStatement := "DELETE FROM oidc_logins WHERE createdat < $1"
+	_, err := db.Exec(removeExpiredLoginsStatement, time.Now().Add(-OIDCLoginLifetime))
+	if err != nil {
+		log.Error("Error removing the expired single sign-on logins: %s", err)
+		return err
+	}
+
+	addOIDCLoginStatement := "INSERT INTO oidc_logins(state, nonce, verifier) VALUES($1, $2, $3)"
+	_, err = db.Exec(addOIDCLoginStatement, state, nonce, verifier)
+	if err != nil {
+		log.Error("Error adding the single sign-on login: %s", err)
+		return err
+	}
+	return nil
+}
+
+// TakeOIDCLogin removes the login of the state and returns its nonce and PKCE verifier, so a state is only used
+// once
+func TakeOIDCLogin(db *sql.DB, state string) (string, string, error) {
+	takeOIDCLoginStatement := "DELETE FROM oidc_logins WHERE state=$1 RETURNING nonce, verifier, createdat"
+	var nonce, verifier string
+	var createdAt time.Time
+	err := db.QueryRow(takeOIDCLoginStatement, state).Scan(&nonce, &verifier, &createdAt)
+	if err == sql.ErrNoRows || (err == nil && time.Since(createdAt) > OIDCLoginLifetime) {
+		return "", "", errors.New(OIDC_LOGIN_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error retrieving the single sign-on login: %s", err)
+		return "", "", err
+	}
+	return nonce, verifier, nil
+}
+
+// ProvisionOIDCUser returns the user of the identity, and true if the account was created. The identities seen
+// for the first time are linked to the account with their email, or get a new activated account. Both need the
+// email to be verified by the identity provider.
+func ProvisionOIDCUser(db *sql.DB, identity OIDCIdentity) (types.User, bool, error) {
+	var user types.User
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction provisioning the user %s: %s", identity.Email, err)
+		return user, false, err
+	}
+	defer tx.Rollback()
+
+	getIdentityUserQuery := "SELECT users.id, users.email, users.isactivated, users.isadmin FROM user_identities " +
+		"JOIN users ON users.id=user_identities.userid WHERE user_identities.issuer=$1 AND user_identities.subject=$2"
+	err = tx.QueryRow(getIdentityUserQuery, identity.Issuer, identity.Subject).Scan(&user.ID, &user.Email,
+		&user.IsActivated, &user.IsAdmin)
+	if err == nil {
+		_, err = tx.Exec("UPDATE user_identities SET lastloginat=now() WHERE issuer=$1 AND subject=$2",
+			identity.Issuer, identity.Subject)
+		if err != nil {
+			log.Error("Error recording the login of the user %d: %s", user.ID, err)
+			return user, false, err
+		}
+		return user, false, tx.Commit()
+	} else if err != sql.ErrNoRows {
+		log.Error("Error retrieving the user of the identity %s: %s", identity.Subject, err)
+		return user, false, err
+	}
+
+	if !identity.EmailVerified || len(identity.Email) == 0 {
+		return user, false, errors.New(OIDC_EMAIL_NOT_VERIFIED)
+	}
+
+	created := false
+	user.Email = identity.Email
+	var isDeactivated bool
+	getUserQuery := "SELECT id, isactivated, isadmin, isdeactivated FROM users WHERE email=$1 FOR UPDATE"
+	err = tx.QueryRow(getUserQuery, identity.Email).Scan(&user.ID, &user.IsActivated, &user.IsAdmin, &isDeactivated)
+	if err == sql.ErrNoRows {
+		// the account has no usable password, its user logging in with the identity provider
+		secret := make([]byte, 48)
+		if _, err = io.ReadFull(rand.Reader, secret); err != nil {
+			return user, false, err
+		}
+		addUserStatement := "INSERT INTO users(email, passhash, isactivated, activationtoken) VALUES($1, $2, true, $3) RETURNING id"
+		err = tx.QueryRow(addUserStatement, identity.Email, auth.ComputePasswordHash(hex.EncodeToString(secret[:32])),
+			hex.EncodeToString(secret[32:])).Scan(&user.ID)
+		if err != nil {
+			log.Error("Error adding the user %s of the identity provider: %s", identity.Email, err)
+			return user, false, err
+		}
+		user.IsActivated = true
+		created = true
+	} else if err != nil {
+		log.Error("Error retrieving the user %s: %s", identity.Email, err)
+		return user, false, err
+	} else {
+		var linkedIdentities int
+		countIdentitiesQuery := "SELECT count(*) FROM user_identities WHERE userid=$1 AND issuer=$2"
+		err = tx.QueryRow(countIdentitiesQuery, user.ID, identity.Issuer).Scan(&linkedIdentities)
+		if err != nil {
+			log.Error("Error counting the identities of the user %d: %s", user.ID, err)
+			return user, false, err
+		}
+		if linkedIdentities > 0 {
+			return user, false, errors.New(OIDC_EMAIL_ALREADY_LINKED)
+		}
+		// the identity provider verified the email, like the activation link would, but the accounts deactivated
+		// by the provisioning stay so
+		if !user.IsActivated && !isDeactivated {
+			_, err = tx.Exec("UPDATE users SET isactivated=true WHERE id=$1", user.ID)
+			if err != nil {
+				log.Error("Error activating the account %d linked to the identity provider: %s", user.ID, err)
+				return user, false, err
+			}
+			user.IsActivated = true
+		}
+	}
+
+	addIdentityStatement := "INSERT INTO user_identities(issuer, subject, userid, email) VALUES($1, $2, $3, $4)"
+	_, err = tx.Exec(addIdentityStatement, identity.Issuer, identity.Subject, user.ID, identity.Email)
+	if err != nil {
+		log.Error("Error linking the identity %s to the user %d: %s", identity.Subject, user.ID, err)
+		return user, false, err
+	}
+
+	log.Info("Linked the identity %s of %s to the user %d", identity.Subject, identity.Issuer, user.ID)
+	return user, created, tx.Commit()
+}
+
+// SetUserRoles sets the admin and the auditor roles of the user
+func SetUserRoles(db *sql.DB, userID int64, isAdmin bool, isAuditor bool) error {
+	setUserRolesStatement := "UPDATE users SET isadmin=$1, isauditor=$2 WHERE id=$3"
+	_, err := db.Exec(setUserRolesStatement, isAdmin, isAuditor, userID)
+	if err != nil {
+		log.Error("Error setting the roles of the user %d: %s", userID, err)
+		return err
+	}
+	return nil
+}
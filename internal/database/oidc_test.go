@@ -0,0 +1,64 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOIDCLoginStateIsUsedOnce(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	if err := AddOIDCLogin(db, "state", "nonce", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+
+	nonce, verifier, err := TakeOIDCLogin(db, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != "nonce" || verifier != "verifier" {
+		t.Fatalf("the state returned the nonce %s and the verifier %s", nonce, verifier)
+	}
+	if _, _, err = TakeOIDCLogin(db, "state"); errorText(err) != OIDC_LOGIN_NOT_FOUND {
+		t.Fatalf("the state used twice returned %v, want %s", err, OIDC_LOGIN_NOT_FOUND)
+	}
+	if _, _, err = TakeOIDCLogin(db, "unknown state"); errorText(err) != OIDC_LOGIN_NOT_FOUND {
+		t.Fatalf("an unknown state returned %v, want %s", err, OIDC_LOGIN_NOT_FOUND)
+	}
+
+	if err = AddOIDCLogin(db, "expired state", "nonce", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+	createdAt := time.Now().Add(-OIDCLoginLifetime - time.Minute)
+	if _, err = db.Exec("UPDATE oidc_logins SET createdat=$1 WHERE state=$2", createdAt, "expired state"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = TakeOIDCLogin(db, "expired state"); errorText(err) != OIDC_LOGIN_NOT_FOUND {
+		t.Fatalf("an expired state returned %v, want %s", err, OIDC_LOGIN_NOT_FOUND)
+	}
+}
+
+func TestProvisionOIDCUserNeedsAVerifiedEmail(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	userID := addTestUser(t, db, "owner@example.com")
+	identity := OIDCIdentity{Issuer: "https://issuer.example.com", Subject: "owner", Email: "owner@example.com"}
+
+	// an unverified email would let anyone at the provider take the account over
+	if _, _, err := ProvisionOIDCUser(db, identity); errorText(err) != OIDC_EMAIL_NOT_VERIFIED {
+		t.Fatalf("an unverified email returned %v, want %s", err, OIDC_EMAIL_NOT_VERIFIED)
+	}
+	identity.EmailVerified = true
+	user, created, err := ProvisionOIDCUser(db, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || user.ID != userID {
+		t.Fatalf("the identity got the user %d, created %v, want the user %d", user.ID, created, userID)
+	}
+
+	other := OIDCIdentity{Issuer: identity.Issuer, Subject: "other", Email: identity.Email, EmailVerified: true}
+	if _, _, err = ProvisionOIDCUser(db, other); errorText(err) != OIDC_EMAIL_ALREADY_LINKED {
+		t.Fatalf("another identity with the email returned %v, want %s", err, OIDC_EMAIL_ALREADY_LINKED)
+	}
+}
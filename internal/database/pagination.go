@@ -0,0 +1,187 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+var (
+	INVALID_CURSOR     = "the cursor is not valid"
+	INVALID_SORT       = "the listing can't be sorted by this field"
+	INVALID_ORDER      = "the order must be asc or desc"
+	INVALID_PAGE_LIMIT = "the limit must be a number between 1 and 200"
+)
+
+// PageRequest selects a page of a listing. The cursor is the NextCursor of the previous page, empty for the first one.
+type PageRequest struct {
+	Limit  int
+	Cursor string
+	Sort   string
+	Order  string
+}
+
+// PageInfo is returned with every page, NextCursor being empty on the last page
+type PageInfo struct {
+	NextCursor string `json:"nextCursor"`
+	TotalCount int64  `json:"totalCount"`
+}
+
+// IsPaginationError returns true for the errors caused by an invalid page request
+func IsPaginationError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.Error() {
+	case INVALID_CURSOR, INVALID_SORT, INVALID_ORDER, INVALID_PAGE_LIMIT:
+		return true
+	}
+	return false
+}
+
+// sortColumn is a field a listing can be sorted by, sqlType being used to cast the cursor value back.
+// The expression must not be NULL, a NULL value making the keyset condition NULL and skipping the rows after it,
+// so the nullable columns are wrapped in coalesce.
+type sortColumn struct {
+	expression string
+	sqlType    string
+}
+
+// cursor holds the sort value and the id of the last row of a page, the rows being sorted by both
+// so the next page starts right after it even when several rows have the same sort value
+type cursor struct {
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+func encodeCursor(value string, id int64) string {
+	encoded, _ := json.Marshal(cursor{Value: value, ID: id})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeCursor(encoded string) (cursor, error) {
+	var decoded cursor
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return decoded, errors.New(INVALID_CURSOR)
+	}
+	if err = json.Unmarshal(raw, &decoded); err != nil {
+		return decoded, errors.New(INVALID_CURSOR)
+	}
+	return decoded, nil
+}
+
+// queryArgs collects the arguments of a query built from optional parts, returning their placeholders
+type queryArgs []interface{}
+
+func (args *queryArgs) add(value interface{}) string {
+	*args = append(*args, value)
+	return fmt.Sprintf("$%d", len(*args))
+}
+
+// pageQuery holds the parts of a listing query computed from the page request
+type pageQuery struct {
+	limit       int
+	sort        sortColumn
+	descending  bool
+	idColumn    string
+	afterCursor *cursor
+}
+
+// newPageQuery validates the page request against the columns the listing can be sorted by
+func newPageQuery(request PageRequest, columns map[string]sortColumn, defaultSort string, idColumn string) (pageQuery, error) {
+	query := pageQuery{limit: request.Limit, idColumn: idColumn}
+	if query.limit == 0 {
+		query.limit = DefaultPageLimit
+	}
+	if query.limit < 0 || query.limit > MaxPageLimit {
+		return query, errors.New(INVALID_PAGE_LIMIT)
+	}
+
+	sortName := request.Sort
+	if len(sortName) == 0 {
+		sortName = defaultSort
+	}
+	sort, exists := columns[sortName]
+	if !exists {
+		return query, errors.New(INVALID_SORT)
+	}
+	query.sort = sort
+
+	switch strings.ToLower(request.Order) {
+	case "", "asc":
+		query.descending = false
+	case "desc":
+		query.descending = true
+	default:
+		return query, errors.New(INVALID_ORDER)
+	}
+
+	if len(request.Cursor) > 0 {
+		afterCursor, err := decodeCursor(request.Cursor)
+		if err != nil {
+			return query, err
+		}
+		query.afterCursor = &afterCursor
+	}
+	return query, nil
+}
+
+// condition returns the keyset condition selecting the rows after the cursor, or an empty string on the first page
+func (query pageQuery) condition(args *queryArgs) string {
+	if query.afterCursor == nil {
+		return ""
+	}
+	operator := ">"
+	if query.descending {
+		operator = "<"
+	}
+	value := fmt.Sprintf("%s::%s", args.add(query.afterCursor.Value), query.sort.sqlType)
+	id := args.add(query.afterCursor.ID)
+	return fmt.Sprintf("(%[1]s %[2]s %[3]s OR (%[1]s = %[3]s AND %[4]s %[2]s %[5]s))",
+		query.sort.expression, operator, value, query.idColumn, id)
+}
+
+// sortValue is the select expression returning the sort value of a row as text, to build the next cursor
+func (query pageQuery) sortValue() string {
+	return fmt.Sprintf("(%s)::text", query.sort.expression)
+}
+
+// orderBy returns the ORDER BY and LIMIT clauses, one more row than the limit being read to know if there's a next page
+func (query pageQuery) orderBy() string {
+	direction := "ASC"
+	if query.descending {
+		direction = "DESC"
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT %d", query.sort.expression, direction, query.idColumn, direction, query.limit+1)
+}
+
+// nextCursor returns the cursor of the next page if more rows than the limit were read, and the number of rows to keep
+func (query pageQuery) nextCursor(rowCount int, lastSortValue func(index int) (string, int64)) (string, int) {
+	if rowCount <= query.limit {
+		return "", rowCount
+	}
+	value, id := lastSortValue(query.limit - 1)
+	return encodeCursor(value, id), query.limit
+}
+
+// where joins the non empty conditions
+func where(conditions []string) string {
+	var nonEmpty []string
+	for _, condition := range conditions {
+		if len(condition) > 0 {
+			nonEmpty = append(nonEmpty, condition)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(nonEmpty, " AND ")
+}
@@ -0,0 +1,248 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+const (
+	UserQuotaScope      = "user"
+	WorkspaceQuotaScope = "workspace"
+)
+
+var (
+	USER_QUOTA_EXCEEDED      = "the upload would exceed the storage quota of the user"
+	WORKSPACE_QUOTA_EXCEEDED = "the upload would exceed the storage quota of the workspace"
+	INVALID_QUOTA_LIMIT      = "the quota limits cannot be negative"
+)
+
+// Quota holds the usage of a user or a workspace, and its limits. A nil limit means unlimited.
+type Quota struct {
+	Scope     string
+	ScopeID   int64
+	UsedBytes int64
+	UsedFiles int64
+	MaxBytes  *int64
+	MaxFiles  *int64
+}
+
+// IsQuotaExceeded returns true for the errors returned when an upload would go over a quota
+func IsQuotaExceeded(err error) bool {
+	return err != nil && (err.Error() == USER_QUOTA_EXCEEDED || err.Error() == WORKSPACE_QUOTA_EXCEEDED)
+}
+
+func CreateQuotasTable(db *sql.DB) error {
+	// the usage counts the content of the files and of their versions, even when the blobs are shared,
+	// so it doesn't depend on what other users uploaded
+	createQuotasQuery :=
+		"CREATE TABLE if not exists quotas (scope text not null, scopeid bigint not null, usedbytes bigint not null default 0, " +
+			"usedfiles bigint not null default 0, maxbytes bigint, maxfiles bigint, primary key (scope, scopeid));"
+	_, err := db.Exec(createQuotasQuery)
+	if err != nil {
+		log.Error("Error creating the quotas table: %s", err)
+		return err
+	}
+
+	// the usage of the files stored before the quotas is computed once, the rows existing already are kept
+	initialUsageQuery :=
+		"INSERT INTO quotas(scope, scopeid, usedbytes, usedfiles) " +
+			"SELECT $1::text, files.ownerid, sum(%[1]s), count(*) FROM files LEFT JOIN blobs ON blobs.id=files.blobid WHERE %[2]s GROUP BY files.ownerid " +
+			"UNION ALL SELECT $2::text, files.folderid, sum(%[1]s), count(*) FROM files LEFT JOIN blobs ON blobs.id=files.blobid WHERE %[2]s GROUP BY files.folderid " +
+			"ON CONFLICT (scope, scopeid) DO NOTHING"
+	_, err = db.Exec(fmt.Sprintf(initialUsageQuery, fileUsageExpression, fileHasContentCondition), UserQuotaScope, WorkspaceQuotaScope)
+	if err != nil {
+		log.Error("Error computing the initial usage of the quotas: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created quotas table")
+	return nil
+}
+
+// fileHasContentCondition leaves out the files added but whose content was not stored yet, which count for nothing
+const fileHasContentCondition = "(files.blobid IS NOT NULL OR files.filepath <> '')"
+
+// fileUsageExpression is the number of bytes a file row counts for, its content and its versions
+const fileUsageExpression = "coalesce(blobs.size, 0) + coalesce((SELECT sum(versionblobs.size) FROM file_versions " +
+	"JOIN blobs AS versionblobs ON versionblobs.id=file_versions.blobid WHERE file_versions.fileid=files.id), 0)"
+
+// chargeQuota adds the bytes and files to the usage of the scope, inside the transaction changing the files.
+// When the usage grows over the limit it returns the error of the scope, and the transaction must be rolled back.
+func chargeQuota(tx *sql.Tx, scope string, scopeID int64, bytes int64, files int64) error {
+	chargeQuotaStatement :=
+		"INSERT INTO quotas(scope, scopeid, usedbytes, usedfiles) VALUES($1, $2, $3, $4) " +
+			"ON CONFLICT (scope, scopeid) DO UPDATE SET usedbytes=quotas.usedbytes+excluded.usedbytes, usedfiles=quotas.usedfiles+excluded.usedfiles " +
+			"RETURNING usedbytes, usedfiles, maxbytes, maxfiles"
+	var usedBytes, usedFiles int64
+	var maxBytes, maxFiles sql.NullInt64
+	err := tx.QueryRow(chargeQuotaStatement, scope, scopeID, bytes, files).Scan(&usedBytes, &usedFiles, &maxBytes, &maxFiles)
+	if err != nil {
+		log.Error("Error updating the usage of the %s with ID %d: %s", scope, scopeID, err)
+		return err
+	}
+
+	// releasing space never fails, even if the limit was lowered under the current usage
+	exceeded := (bytes > 0 && maxBytes.Valid && usedBytes > maxBytes.Int64) || (files > 0 && maxFiles.Valid && usedFiles > maxFiles.Int64)
+	if !exceeded {
+		return nil
+	}
+
+	log.Error("The %s with ID %d would use %d bytes in %d files, over its quota", scope, scopeID, usedBytes, usedFiles)
+	if scope == UserQuotaScope {
+		return errors.New(USER_QUOTA_EXCEEDED)
+	}
+	return errors.New(WORKSPACE_QUOTA_EXCEEDED)
+}
+
+// chargeFileQuotas charges both the owner of the file and its workspace, always in this order so concurrent
+// transactions lock the quota rows the same way
+func chargeFileQuotas(tx *sql.Tx, ownerID int64, folderID int64, bytes int64, files int64) error {
+	if bytes == 0 && files == 0 {
+		return nil
+	}
+	err := chargeQuota(tx, UserQuotaScope, ownerID, bytes, files)
+	if err != nil {
+		return err
+	}
+	return chargeQuota(tx, WorkspaceQuotaScope, folderID, bytes, files)
+}
+
+// releaseFilesQuotas removes the usage of the files matching the condition, before they are deleted
+func releaseFilesQuotas(tx *sql.Tx, filesCondition string, args ...interface{}) error {
+	releasedUsageQuery := fmt.Sprintf(
+		"SELECT files.ownerid, files.folderid, sum(%s), count(*) FROM files LEFT JOIN blobs ON blobs.id=files.blobid "+
+			"WHERE %s AND %s GROUP BY files.ownerid, files.folderid ORDER BY files.ownerid, files.folderid",
+		fileUsageExpression, fileHasContentCondition, filesCondition)
+	rows, err := tx.Query(releasedUsageQuery, args...)
+	if err != nil {
+		log.Error("Error computing the usage of the removed files: %s", err)
+		return err
+	}
+
+	type releasedUsage struct {
+		ownerID  int64
+		folderID int64
+		bytes    int64
+		files    int64
+	}
+	var released []releasedUsage
+	for rows.Next() {
+		var usage releasedUsage
+		if err = rows.Scan(&usage.ownerID, &usage.folderID, &usage.bytes, &usage.files); err != nil {
+			rows.Close()
+			log.Error("Error binding the usage of the removed files: %s", err)
+			return err
+		}
+		released = append(released, usage)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, usage := range released {
+		if err = chargeFileQuotas(tx, usage.ownerID, usage.folderID, -usage.bytes, -usage.files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckQuota returns the quota error if adding the bytes and files would exceed the quota of the user or of
+// the workspace. It lets the uploads fail before their content is written, the limits being enforced again
+// when the content is attached to the file.
+func CheckQuota(db *sql.DB, userID int64, folderID int64, bytes int64, files int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction to check the quotas: %s", err)
+		return err
+	}
+	// nothing is changed, the transaction is only used to check the usage with the charge applied
+	defer tx.Rollback()
+
+	return chargeFileQuotas(tx, userID, folderID, bytes, files)
+}
+
+func GetQuota(db *sql.DB, scope string, scopeID int64) (Quota, error) {
+	getQuotaQuery := "SELECT usedbytes, usedfiles, maxbytes, maxfiles FROM quotas WHERE scope=$1 AND scopeid=$2"
+	quota := Quota{Scope: scope, ScopeID: scopeID}
+	var maxBytes, maxFiles sql.NullInt64
+	err := db.QueryRow(getQuotaQuery, scope, scopeID).Scan(&quota.UsedBytes, &quota.UsedFiles, &maxBytes, &maxFiles)
+	if err == sql.ErrNoRows {
+		// nothing was uploaded yet and no limits were set
+		return quota, nil
+	} else if err != nil {
+		log.Error("Error getting the quota of the %s with ID %d: %s", scope, scopeID, err)
+		return quota, err
+	}
+
+	if maxBytes.Valid {
+		quota.MaxBytes = &maxBytes.Int64
+	}
+	if maxFiles.Valid {
+		quota.MaxFiles = &maxFiles.Int64
+	}
+	return quota, nil
+}
+
+// GetWorkspaceQuotasForOwner returns the quotas of the workspaces owned by the user
+func GetWorkspaceQuotasForOwner(db *sql.DB, userID int64) ([]Quota, error) {
+	getWorkspaceQuotasQuery :=
+		"SELECT folders.id, coalesce(quotas.usedbytes, 0), coalesce(quotas.usedfiles, 0), quotas.maxbytes, quotas.maxfiles FROM folders " +
+			"LEFT JOIN quotas ON quotas.scope=$1 AND quotas.scopeid=folders.id WHERE folders.ownerid=$2 ORDER BY folders.id"
+	rows, err := db.Query(getWorkspaceQuotasQuery, WorkspaceQuotaScope, userID)
+	if err != nil {
+		log.Error("Error getting the workspace quotas of the user with ID %d: %s", userID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var quotas []Quota
+	for rows.Next() {
+		quota := Quota{Scope: WorkspaceQuotaScope}
+		var maxBytes, maxFiles sql.NullInt64
+		err = rows.Scan(&quota.ScopeID, &quota.UsedBytes, &quota.UsedFiles, &maxBytes, &maxFiles)
+		if err != nil {
+			log.Error("Error binding the workspace quota details: %s", err)
+			return quotas, err
+		}
+		if maxBytes.Valid {
+			quota.MaxBytes = &maxBytes.Int64
+		}
+		if maxFiles.Valid {
+			quota.MaxFiles = &maxFiles.Int64
+		}
+		quotas = append(quotas, quota)
+	}
+	return quotas, rows.Err()
+}
+
+// SetQuotaLimits replaces the limits of the user or workspace, nil removing a limit
+func SetQuotaLimits(db *sql.DB, scope string, scopeID int64, maxBytes *int64, maxFiles *int64) error {
+	if (maxBytes != nil && *maxBytes < 0) || (maxFiles != nil && *maxFiles < 0) {
+		log.Error("The quota limits of the %s with ID %d cannot be negative", scope, scopeID)
+		return errors.New(INVALID_QUOTA_LIMIT)
+	}
+
+	setQuotaLimitsStatement :=
+		"INSERT INTO quotas(scope, scopeid, maxbytes, maxfiles) VALUES($1, $2, $3, $4) " +
+			"ON CONFLICT (scope, scopeid) DO UPDATE SET maxbytes=excluded.maxbytes, maxfiles=excluded.maxfiles"
+	_, err := db.Exec(setQuotaLimitsStatement, scope, scopeID, nullableInt64(maxBytes), nullableInt64(maxFiles))
+	if err != nil {
+		log.Error("Error setting the quota limits of the %s with ID %d: %s", scope, scopeID, err)
+		return err
+	}
+
+	log.Info("Successfully set the quota limits of the %s with ID %d", scope, scopeID)
+	return nil
+}
+
+func nullableInt64(value *int64) sql.NullInt64 {
+	if value == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *value, Valid: true}
+}
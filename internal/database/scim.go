@@ -0,0 +1,527 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
+)
+
+// SCIMMaxResults bounds the resources of a page of a SCIM list
+const SCIMMaxResults = 200
+
+var (
+	SCIM_USER_NOT_FOUND       = "the user doesn't exist"
+	SCIM_GROUP_NOT_FOUND      = "the group doesn't exist"
+	SCIM_GROUP_ALREADY_EXISTS = "a group with the name already exists"
+	SCIM_MEMBER_NOT_FOUND     = "a member of the group is not a user"
+	SCIM_INVALID_FILTER       = "the filter compares an attribute which can't be filtered"
+	USER_DEACTIVATED          = "the account was deactivated by the provisioning"
+)
+
+// SCIMFilter is a condition of a SCIM filter, the attribute being equal to the value
+type SCIMFilter struct {
+	Attribute string
+	Value     string
+}
+
+// SCIMUser is a user as the identity provider provisions it. The userName of the provider is the email.
+type SCIMUser struct {
+	ID          int64
+	Email       string
+	ExternalID  string
+	DisplayName string
+	GivenName   string
+	FamilyName  string
+	Active      bool
+}
+
+// SCIMMember is a user in a group
+type SCIMMember struct {
+	UserID int64
+	Email  string
+}
+
+// SCIMGroup is a group of users provisioned by the identity provider
+type SCIMGroup struct {
+	ID          int64
+	DisplayName string
+	ExternalID  string
+	Members     []SCIMMember
+}
+
+// the conditions of the filterable attributes, the lowercase attribute names of SCIM mapping to the SQL
+// conditions with the placeholder of the value
+var (
+	scimUserFilters = map[string]string{
+		"id":           "users.id::text = %s",
+		"username":     "lower(users.email) = lower(%s)",
+		"emails":       "lower(users.email) = lower(%s)",
+		"emails.value": "lower(users.email) = lower(%s)",
+		"externalid":   "users.externalid = %s",
+		"displayname":  "lower(users.displayname) = lower(%s)",
+		"active":       "users.isactivated::text = lower(%s)",
+	}
+	scimGroupFilters = map[string]string{
+		"id":            "user_groups.id::text = %s",
+		"displayname":   "lower(user_groups.displayname) = lower(%s)",
+		"externalid":    "user_groups.externalid = %s",
+		"members":       "EXISTS (SELECT 1 FROM group_members WHERE group_members.groupid=user_groups.id AND group_members.userid::text = %s)",
+		"members.value": "EXISTS (SELECT 1 FROM group_members WHERE group_members.groupid=user_groups.id AND group_members.userid::text = %s)",
+	}
+)
+
+func CreateSCIMTables(db *sql.DB) error {
+	// the deactivated accounts can't be activated again by the activation link or the single sign-on, only by the
+	// provisioning, and the deprovisioned ones are hidden from it while keeping their documents
+	addSCIMColumnsQuery := "ALTER TABLE users ADD COLUMN IF NOT EXISTS externalid text not null default '', " +
+		"ADD COLUMN IF NOT EXISTS displayname text not null default '', ADD COLUMN IF NOT EXISTS givenname text not null default '', " +
+		"ADD COLUMN IF NOT EXISTS familyname text not null default '', ADD COLUMN IF NOT EXISTS isdeactivated bool not null default false, " +
+		"ADD COLUMN IF NOT EXISTS isdeprovisioned bool not null default false"
+	_, err := db.Exec(addSCIMColumnsQuery)
+	if err != nil {
+		log.Error("Error adding the provisioning columns to the users table: %s", err)
+		return err
+	}
+
+	createGroupsQuery :=
+		"CREATE TABLE if not exists user_groups (id bigserial primary key, displayname text not null, " +
+			"externalid text not null default '', createdat timestamptz not null default now());"
+	_, err = db.Exec(createGroupsQuery)
+	if err != nil {
+		log.Error("Error creating the user_groups table: %s", err)
+		return err
+	}
+	createGroupsIndexQuery := "CREATE UNIQUE INDEX if not exists user_groups_displayname ON user_groups (lower(displayname))"
+	_, err = db.Exec(createGroupsIndexQuery)
+	if err != nil {
+		log.Error("Error creating the index of the user_groups table: %s", err)
+		return err
+	}
+
+	createGroupMembersQuery :=
+		"CREATE TABLE if not exists group_members (groupid bigint not null references user_groups(id) on delete cascade, " +
+			"userid bigint not null references users(id) on delete cascade, primary key (groupid, userid));"
+	_, err = db.Exec(createGroupMembersQuery)
+	if err != nil {
+		log.Error("Error creating the group_members table: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created user_groups and group_members tables")
+	return nil
+}
+
+// scimConditions returns the SQL conditions of the filters, their values being added to the arguments
+func scimConditions(filters []SCIMFilter, conditions map[string]string, args []interface{}) ([]string, []interface{}, error) {
+	var sqlConditions []string
+	for _, filter := range filters {
+		condition, found := conditions[strings.ToLower(filter.Attribute)]
+		if !found {
+			return nil, nil, errors.New(SCIM_INVALID_FILTER)
+		}
+		args = append(args, filter.Value)
+		sqlConditions = append(sqlConditions, fmt.Sprintf(condition, fmt.Sprintf("$%d", len(args))))
+	}
+	return sqlConditions, args, nil
+}
+
+const scimUserColumns = "users.id, users.email, users.externalid, users.displayname, users.givenname, users.familyname, users.isactivated"
+
+func scanSCIMUser(row interface{ Scan(...interface{}) error }) (SCIMUser, error) {
+	var user SCIMUser
+	err := row.Scan(&user.ID, &user.Email, &user.ExternalID, &user.DisplayName, &user.GivenName, &user.FamilyName, &user.Active)
+	return user, err
+}
+
+// GetSCIMUsers returns a page of the users matching the filters, ordered by id, and the number of users matching
+// them. The deprovisioned users are left out.
+func GetSCIMUsers(db *sql.DB, filters []SCIMFilter, offset int, limit int) ([]SCIMUser, int, error) {
+	conditions, args, err := scimConditions(filters, scimUserFilters, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	where := strings.Join(append([]string{"NOT users.isdeprovisioned"}, conditions...), " AND ")
+
+	var total int
+	err = db.QueryRow("SELECT count(*) FROM users WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		log.Error("Error counting the provisioned users: %s", err)
+		return nil, 0, err
+	}
+
+	getSCIMUsersQuery := fmt.Sprintf("SELECT %s FROM users WHERE %s ORDER BY users.id LIMIT $%d OFFSET $%d",
+		scimUserColumns, where, len(args)+1, len(args)+2)
+	rows, err := db.Query(getSCIMUsersQuery, append(args, limit, offset)...)
+	if err != nil {
+		log.Error("Error retrieving the provisioned users: %s", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []SCIMUser{}
+	for rows.Next() {
+		user, err := scanSCIMUser(rows)
+		if err != nil {
+			log.Error("Error reading a provisioned user: %s", err)
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+// GetSCIMUser returns the user with the id, unless it was deprovisioned
+func GetSCIMUser(db *sql.DB, userID int64) (SCIMUser, error) {
+	getSCIMUserQuery := "SELECT " + scimUserColumns + " FROM users WHERE users.id=$1 AND NOT users.isdeprovisioned"
+	user, err := scanSCIMUser(db.QueryRow(getSCIMUserQuery, userID))
+	if err == sql.ErrNoRows {
+		return user, errors.New(SCIM_USER_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error retrieving the provisioned user %d: %s", userID, err)
+	}
+	return user, err
+}
+
+// emailIsTaken returns true if another user than the one with the id has the email
+func emailIsTaken(tx *sql.Tx, email string, userID int64) (bool, error) {
+	var taken bool
+	emailIsTakenQuery := "SELECT EXISTS (SELECT 1 FROM users WHERE lower(email)=lower($1) AND id<>$2)"
+	err := tx.QueryRow(emailIsTakenQuery, email, userID).Scan(&taken)
+	if err != nil {
+		log.Error("Error checking if the email %s is taken: %s", email, err)
+	}
+	return taken, err
+}
+
+// AddSCIMUser adds the user, activated unless the provider sends it inactive, and returns its id. The user logs in
+// with the password, when there's one, or with the single sign-on. A deprovisioned user with the email is
+// provisioned again, with its documents.
+func AddSCIMUser(db *sql.DB, user SCIMUser, password string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction provisioning the user %s: %s", user.Email, err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	getDeprovisionedUserQuery := "SELECT id FROM users WHERE lower(email)=lower($1) AND isdeprovisioned ORDER BY id LIMIT 1"
+	err = tx.QueryRow(getDeprovisionedUserQuery, user.Email).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Error retrieving the deprovisioned user %s: %s", user.Email, err)
+		return 0, err
+	}
+	taken, err := emailIsTaken(tx, user.Email, userID)
+	if err != nil {
+		return 0, err
+	} else if taken {
+		return 0, errors.New(ERROR_USER_ALREADY_EXISTS)
+	}
+
+	if userID != 0 {
+		reprovisionUserStatement := "UPDATE users SET email=$1, externalid=$2, displayname=$3, givenname=$4, familyname=$5, " +
+			"isactivated=$6, isdeactivated=NOT $6, isdeprovisioned=false WHERE id=$7"
+		_, err = tx.Exec(reprovisionUserStatement, user.Email, user.ExternalID, user.DisplayName, user.GivenName,
+			user.FamilyName, user.Active, userID)
+		if err != nil {
+			log.Error("Error provisioning again the user %d: %s", userID, err)
+			return 0, err
+		}
+	} else {
+		// without a password, the account gets one nobody knows, until it is reset
+		secret := make([]byte, 48)
+		if _, err = io.ReadFull(rand.Reader, secret); err != nil {
+			return 0, err
+		}
+		if len(password) == 0 {
+			password = hex.EncodeToString(secret[:32])
+		}
+		addUserStatement := "INSERT INTO users(email, passhash, activationtoken, externalid, displayname, givenname, " +
+			"familyname, isactivated, isdeactivated) VALUES($1, $2, $3, $4, $5, $6, $7, $8, NOT $8) RETURNING id"
+		err = tx.QueryRow(addUserStatement, user.Email, auth.ComputePasswordHash(password), hex.EncodeToString(secret[32:]),
+			user.ExternalID, user.DisplayName, user.GivenName, user.FamilyName, user.Active).Scan(&userID)
+		if err != nil {
+			log.Error("Error provisioning the user %s: %s", user.Email, err)
+			return 0, err
+		}
+	}
+
+	log.Info("Provisioned the user %d with the email %s", userID, user.Email)
+	return userID, tx.Commit()
+}
+
+// UpdateSCIMUser replaces the attributes of the user. Deactivating the user refuses its logins, its API tokens and
+// the refresh of its sessions.
+func UpdateSCIMUser(db *sql.DB, user SCIMUser) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction updating the provisioned user %d: %s", user.ID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	taken, err := emailIsTaken(tx, user.Email, user.ID)
+	if err != nil {
+		return err
+	} else if taken {
+		return errors.New(ERROR_USER_ALREADY_EXISTS)
+	}
+
+	updateUserStatement := "UPDATE users SET email=$1, externalid=$2, displayname=$3, givenname=$4, familyname=$5, " +
+		"isactivated=$6, isdeactivated=NOT $6 WHERE id=$7 AND NOT isdeprovisioned"
+	result, err := tx.Exec(updateUserStatement, user.Email, user.ExternalID, user.DisplayName, user.GivenName,
+		user.FamilyName, user.Active, user.ID)
+	if err != nil {
+		log.Error("Error updating the provisioned user %d: %s", user.ID, err)
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return errors.New(SCIM_USER_NOT_FOUND)
+	}
+	return tx.Commit()
+}
+
+// DeprovisionSCIMUser deactivates the user and removes it from its groups. The account and its documents are
+// kept, the user being provisioned again if the provider adds it back.
+func DeprovisionSCIMUser(db *sql.DB, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction deprovisioning the user %d: %s", userID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	deprovisionUserStatement := "UPDATE users SET isactivated=false, isdeactivated=true, isdeprovisioned=true " +
+		"WHERE id=$1 AND NOT isdeprovisioned"
+	result, err := tx.Exec(deprovisionUserStatement, userID)
+	if err != nil {
+		log.Error("Error deprovisioning the user %d: %s", userID, err)
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return errors.New(SCIM_USER_NOT_FOUND)
+	}
+	_, err = tx.Exec("DELETE FROM group_members WHERE userid=$1", userID)
+	if err != nil {
+		log.Error("Error removing the deprovisioned user %d from its groups: %s", userID, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// getGroupMembers returns the members of the groups by the id of their group
+func getGroupMembers(db *sql.DB, groupIDs []int64) (map[int64][]SCIMMember, error) {
+	getGroupMembersQuery := "SELECT group_members.groupid, users.id, users.email FROM group_members " +
+		"JOIN users ON users.id=group_members.userid WHERE group_members.groupid = ANY($1) ORDER BY users.id"
+	rows, err := db.Query(getGroupMembersQuery, pq.Array(groupIDs))
+	if err != nil {
+		log.Error("Error retrieving the members of the groups: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := map[int64][]SCIMMember{}
+	for rows.Next() {
+		var groupID int64
+		var member SCIMMember
+		if err = rows.Scan(&groupID, &member.UserID, &member.Email); err != nil {
+			log.Error("Error reading a member of the groups: %s", err)
+			return nil, err
+		}
+		members[groupID] = append(members[groupID], member)
+	}
+	return members, rows.Err()
+}
+
+// GetSCIMGroups returns a page of the groups matching the filters, ordered by id, and the number of groups matching
+// them. The members are only read when they are needed.
+func GetSCIMGroups(db *sql.DB, filters []SCIMFilter, offset int, limit int, withMembers bool) ([]SCIMGroup, int, error) {
+	conditions, args, err := scimConditions(filters, scimGroupFilters, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	where := "true"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	err = db.QueryRow("SELECT count(*) FROM user_groups WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		log.Error("Error counting the groups: %s", err)
+		return nil, 0, err
+	}
+
+	getSCIMGroupsQuery := fmt.Sprintf("SELECT user_groups.id, user_groups.displayname, user_groups.externalid FROM user_groups "+
+		"WHERE %s ORDER BY user_groups.id LIMIT $%d OFFSET $%d", where, len(args)+1, len(args)+2)
+	rows, err := db.Query(getSCIMGroupsQuery, append(args, limit, offset)...)
+	if err != nil {
+		log.Error("Error retrieving the groups: %s", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	groups := []SCIMGroup{}
+	var groupIDs []int64
+	for rows.Next() {
+		var group SCIMGroup
+		if err = rows.Scan(&group.ID, &group.DisplayName, &group.ExternalID); err != nil {
+			log.Error("Error reading a group: %s", err)
+			return nil, 0, err
+		}
+		groups = append(groups, group)
+		groupIDs = append(groupIDs, group.ID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if withMembers && len(groups) > 0 {
+		members, err := getGroupMembers(db, groupIDs)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i := range groups {
+			groups[i].Members = members[groups[i].ID]
+		}
+	}
+	return groups, total, nil
+}
+
+// GetSCIMGroup returns the group with the id
+func GetSCIMGroup(db *sql.DB, groupID int64, withMembers bool) (SCIMGroup, error) {
+	groups, _, err := GetSCIMGroups(db, []SCIMFilter{{Attribute: "id", Value: fmt.Sprint(groupID)}}, 0, 1, withMembers)
+	if err != nil {
+		return SCIMGroup{}, err
+	} else if len(groups) == 0 {
+		return SCIMGroup{}, errors.New(SCIM_GROUP_NOT_FOUND)
+	}
+	return groups[0], nil
+}
+
+// setGroupMembers makes the members of the group exactly the users, which must be provisioned
+func setGroupMembers(tx *sql.Tx, groupID int64, members []SCIMMember) error {
+	userIDs := make([]int64, 0, len(members))
+	for _, member := range members {
+		userIDs = append(userIDs, member.UserID)
+	}
+
+	var missingUsers int
+	countMissingUsersQuery := "SELECT count(*) FROM unnest($1::bigint[]) AS member(id) " +
+		"WHERE NOT EXISTS (SELECT 1 FROM users WHERE users.id=member.id AND NOT users.isdeprovisioned)"
+	err := tx.QueryRow(countMissingUsersQuery, pq.Array(userIDs)).Scan(&missingUsers)
+	if err != nil {
+		log.Error("Error checking the members of the group %d: %s", groupID, err)
+		return err
+	}
+	if missingUsers > 0 {
+		return errors.New(SCIM_MEMBER_NOT_FOUND)
+	}
+
+	_, err = tx.Exec("DELETE FROM group_members WHERE groupid=$1 AND NOT (userid = ANY($2))", groupID, pq.Array(userIDs))
+	if err != nil {
+		log.Error("Error removing the members of the group %d: %s", groupID, err)
+		return err
+	}
+	addMembersStatement := "INSERT INTO group_members(groupid, userid) SELECT $1::bigint, unnest($2::bigint[]) ON CONFLICT DO NOTHING"
+	_, err = tx.Exec(addMembersStatement, groupID, pq.Array(userIDs))
+	if err != nil {
+		log.Error("Error adding the members of the group %d: %s", groupID, err)
+		return err
+	}
+	return nil
+}
+
+// groupNameIsTaken returns true if another group than the one with the id has the name
+func groupNameIsTaken(tx *sql.Tx, displayName string, groupID int64) (bool, error) {
+	var taken bool
+	groupNameIsTakenQuery := "SELECT EXISTS (SELECT 1 FROM user_groups WHERE lower(displayname)=lower($1) AND id<>$2)"
+	err := tx.QueryRow(groupNameIsTakenQuery, displayName, groupID).Scan(&taken)
+	if err != nil {
+		log.Error("Error checking if the group name %s is taken: %s", displayName, err)
+	}
+	return taken, err
+}
+
+// AddSCIMGroup adds the group with its members and returns its id
+func AddSCIMGroup(db *sql.DB, group SCIMGroup) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction adding the group %s: %s", group.DisplayName, err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	taken, err := groupNameIsTaken(tx, group.DisplayName, 0)
+	if err != nil {
+		return 0, err
+	} else if taken {
+		return 0, errors.New(SCIM_GROUP_ALREADY_EXISTS)
+	}
+
+	var groupID int64
+	addGroupStatement := "INSERT INTO user_groups(displayname, externalid) VALUES($1, $2) RETURNING id"
+	err = tx.QueryRow(addGroupStatement, group.DisplayName, group.ExternalID).Scan(&groupID)
+	if err != nil {
+		log.Error("Error adding the group %s: %s", group.DisplayName, err)
+		return 0, err
+	}
+	if err = setGroupMembers(tx, groupID, group.Members); err != nil {
+		return 0, err
+	}
+
+	log.Info("Provisioned the group %d named %s", groupID, group.DisplayName)
+	return groupID, tx.Commit()
+}
+
+// UpdateSCIMGroup replaces the name, the external id and the members of the group
+func UpdateSCIMGroup(db *sql.DB, group SCIMGroup) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Error starting the transaction updating the group %d: %s", group.ID, err)
+		return err
+	}
+	defer tx.Rollback()
+
+	taken, err := groupNameIsTaken(tx, group.DisplayName, group.ID)
+	if err != nil {
+		return err
+	} else if taken {
+		return errors.New(SCIM_GROUP_ALREADY_EXISTS)
+	}
+
+	updateGroupStatement := "UPDATE user_groups SET displayname=$1, externalid=$2 WHERE id=$3"
+	result, err := tx.Exec(updateGroupStatement, group.DisplayName, group.ExternalID, group.ID)
+	if err != nil {
+		log.Error("Error updating the group %d: %s", group.ID, err)
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return errors.New(SCIM_GROUP_NOT_FOUND)
+	}
+	if err = setGroupMembers(tx, group.ID, group.Members); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveSCIMGroup removes the group, its members keeping their accounts
+func RemoveSCIMGroup(db *sql.DB, groupID int64) error {
+	result, err := db.Exec("DELETE FROM user_groups WHERE id=$1", groupID)
+	if err != nil {
+		log.Error("Error removing the group %d: %s", groupID, err)
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return errors.New(SCIM_GROUP_NOT_FOUND)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
+)
+
+// SearchHit is a file matching a search, with the fragments of its content matching the query
+type SearchHit struct {
+	FileID        int64
+	Filename      string
+	FolderID      int64
+	Workspace     string
+	SubfolderID   int64
+	CurrentFolder string
+	Rank          float64
+	Snippet       string
+}
+
+// PendingBlob is a blob whose text was not extracted yet, with the name of a file referencing it
+// so its format is known
+type PendingBlob struct {
+	Blob
+	Filename string
+}
+
+func CreateBlobContentsTable(db *sql.DB) error {
+	// the text is extracted once per blob, the files sharing the content share the index entry.
+	// The content is indexed with both the English and the Romanian dictionaries, plus the simple one for exact words
+	createBlobContentsQuery :=
+		"CREATE TABLE if not exists blob_contents (blobid bigint primary key references blobs(id) on delete cascade, " +
+			"content text not null, searchvector tsvector not null);"
+	_, err := db.Exec(createBlobContentsQuery)
+	if err != nil {
+		log.Error("Error creating the blob_contents table: %s", err)
+		return err
+	}
+
+	createSearchIndexQuery := "CREATE INDEX IF NOT EXISTS blob_contents_searchvector ON blob_contents USING gin(searchvector);"
+	_, err = db.Exec(createSearchIndexQuery)
+	if err != nil {
+		log.Error("Error creating the search index: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created blob_contents table")
+	return nil
+}
+
+// SetBlobContent indexes the text extracted from the blob, an empty text marking a blob that has no text
+func SetBlobContent(db *sql.DB, blobID int64, content string) error {
+	setBlobContentStatement :=
+		"INSERT INTO blob_contents(blobid, content, searchvector) " +
+			"VALUES($1, $2, to_tsvector('english', $2) || to_tsvector('romanian', $2) || to_tsvector('simple', $2)) " +
+			"ON CONFLICT (blobid) DO UPDATE SET content=excluded.content, searchvector=excluded.searchvector"
+	_, err := db.Exec(setBlobContentStatement, blobID, content)
+	if err != nil {
+		log.Error("Error indexing the content of the blob with ID %d: %s", blobID, err)
+		return err
+	}
+	return nil
+}
+
+// GetPendingBlobs returns the blobs of the current files that were not indexed yet. The blobs encrypted
+// with a file password are never indexed, the server can't read them.
+func GetPendingBlobs(db *sql.DB, limit int) ([]PendingBlob, error) {
+	getPendingBlobsQuery :=
+		"SELECT blobs.id, blobs.storagekey, blobs.size, blobs.keyid, blobs.wrappedkey, " +
+			"(SELECT files.filename FROM files WHERE files.blobid=blobs.id LIMIT 1) FROM blobs " +
+			"WHERE blobs.keyid<>$1 AND EXISTS (SELECT 1 FROM files WHERE files.blobid=blobs.id) " +
+			"AND NOT EXISTS (SELECT 1 FROM blob_contents WHERE blob_contents.blobid=blobs.id) ORDER BY blobs.id LIMIT $2"
+	rows, err := db.Query(getPendingBlobsQuery, encryption.PasswordKeyID, limit)
+	if err != nil {
+		log.Error("Error getting the blobs to index: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pendingBlobs []PendingBlob
+	for rows.Next() {
+		var pendingBlob PendingBlob
+		err = rows.Scan(&pendingBlob.ID, &pendingBlob.StorageKey, &pendingBlob.Size, &pendingBlob.KeyID,
+			&pendingBlob.WrappedKey, &pendingBlob.Filename)
+		if err != nil {
+			log.Error("Error binding the details of a blob to index: %s", err)
+			return pendingBlobs, err
+		}
+		pendingBlobs = append(pendingBlobs, pendingBlob)
+	}
+	return pendingBlobs, rows.Err()
+}
+
+// SearchFiles returns the files whose name or content match the query, best matches first. The locked files
+// and the files of locked subfolders are left out, unless they are in the unlocked lists.
+func SearchFiles(db *sql.DB, query string, unlockedFileIDs []int64, unlockedSubfolderIDs []int64, mfa bool, limit int) ([]SearchHit, error) {
+	// the files whose label requires a second factor are only searched when the user logged in with it
+	labelCondition := ""
+	if !mfa {
+		labelCondition = "AND " + fileWithoutMFALabelCondition + " "
+	}
+
+	// the snippets are only computed for the returned hits, ts_headline reads the whole content
+	searchFilesQuery :=
+		"WITH searched AS (SELECT websearch_to_tsquery('english', $1) || websearch_to_tsquery('romanian', $1) || " +
+			"websearch_to_tsquery('simple', $1) AS query), " +
+			"hits AS (SELECT files.id, files.filename, files.folderid, folders.name AS workspace, files.subfolderid, " +
+			"subfolders.name AS currentfolder, files.blobid, " +
+			"ts_rank(setweight(to_tsvector('simple', files.filename), 'A') || coalesce(blob_contents.searchvector, ''::tsvector), searched.query) AS rank " +
+			"FROM files CROSS JOIN searched " +
+			"JOIN folders ON folders.id=files.folderid " +
+			"JOIN subfolders ON subfolders.id=files.subfolderid " +
+			"LEFT JOIN blob_contents ON blob_contents.blobid=files.blobid " +
+			"WHERE (blob_contents.searchvector @@ searched.query OR to_tsvector('simple', files.filename) @@ searched.query) " +
+			"AND (NOT files.filelocked OR files.id = ANY($2)) " +
+			"AND (NOT subfolders.islocked OR subfolders.id = ANY($3)) " + labelCondition +
+			"ORDER BY rank DESC, files.id LIMIT $4) " +
+			"SELECT hits.id, hits.filename, hits.folderid, hits.workspace, hits.subfolderid, hits.currentfolder, hits.rank, " +
+			"coalesce(ts_headline('simple', blob_contents.content, searched.query, 'MaxFragments=2, MinWords=5, MaxWords=20'), '') " +
+			"FROM hits CROSS JOIN searched LEFT JOIN blob_contents ON blob_contents.blobid=hits.blobid ORDER BY hits.rank DESC, hits.id"
+	rows, err := db.Query(searchFilesQuery, query, pq.Array(unlockedFileIDs), pq.Array(unlockedSubfolderIDs), limit)
+	if err != nil {
+		log.Error("Error searching the files for %s: %s", query, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := []SearchHit{}
+	for rows.Next() {
+		var hit SearchHit
+		err = rows.Scan(&hit.FileID, &hit.Filename, &hit.FolderID, &hit.Workspace, &hit.SubfolderID, &hit.CurrentFolder,
+			&hit.Rank, &hit.Snippet)
+		if err != nil {
+			log.Error("Error binding the search hit: %s", err)
+			return hits, err
+		}
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
@@ -0,0 +1,307 @@
+package database
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+// the modes of the share links
+const (
+	ShareLinkRead   = "read"
+	ShareLinkUpload = "upload"
+)
+
+var (
+	SHARE_LINK_NOT_FOUND          = "the share link doesn't exist or was revoked"
+	SHARE_LINK_EXPIRED            = "the share link expired"
+	SHARE_LINK_LIMIT_REACHED      = "the share link reached its download limit"
+	SHARE_LINK_PASSWORD_REQUIRED  = "shareLinkPasswordRequired"
+	INVALID_SHARE_LINK            = "the share link is not valid"
+	SHARE_LINK_UPLOAD_TO_FILE     = "only the links of a subfolder can be upload-only"
+	SHARE_LINK_EXPIRY_IN_THE_PAST = "the expiry of the share link must be in the future"
+	SHARE_LINK_UPLOAD_LIMIT       = "the file request reached its file count or size limit"
+	SHARE_LINK_UPLOADER_REQUIRED  = "the name and the email of the uploader are required"
+)
+
+// ShareLink gives access without an account to a file, or to the files of a subfolder. A zero FileID means the
+// link is for the subfolder, and the nil ExpiresAt and MaxDownloads mean the link never expires and has no limit.
+// The upload-only links are file requests, MaxFiles and MaxBytes capping what can be uploaded through them.
+type ShareLink struct {
+	ID           int64      `json:"id"`
+	OwnerID      int64      `json:"ownerId"`
+	FolderID     int64      `json:"folderId"`
+	SubfolderID  int64      `json:"subfolderId"`
+	FileID       int64      `json:"fileId,omitempty"`
+	Mode         string     `json:"mode"`
+	HasPassword  bool       `json:"hasPassword"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	MaxDownloads *int64     `json:"maxDownloads"`
+	Downloads    int64      `json:"downloads"`
+	// RequireUploader asks the uploaders of a file request for their name and email
+	RequireUploader bool      `json:"requireUploader"`
+	MaxFiles        *int64    `json:"maxFiles"`
+	MaxBytes        *int64    `json:"maxBytes"`
+	UploadedFiles   int64     `json:"uploadedFiles"`
+	UploadedBytes   int64     `json:"uploadedBytes"`
+	Revoked         bool      `json:"revoked"`
+	CreatedAt       time.Time `json:"createdAt"`
+	passHash        string
+}
+
+func CreateShareLinksTable(db *sql.DB) error {
+	// only the hash of the token is stored, the link can't be rebuilt from the database
+	createShareLinksQuery :=
+		"CREATE TABLE if not exists share_links (id bigserial primary key, tokenhash text not null unique, " +
+			"ownerid bigint not null references users(id) on delete cascade, folderid bigint not null, " +
+			"subfolderid bigint not null references subfolders(id) on delete cascade, " +
+			"fileid bigint references files(id) on delete cascade, mode text not null, passhash text not null default '', " +
+			"expiresat timestamptz, maxdownloads bigint, downloads bigint not null default 0, " +
+			"revoked bool not null default false, createdat timestamptz not null default now());"
+	_, err := db.Exec(createShareLinksQuery)
+	if err != nil {
+		log.Error("Error creating the share_links table: %s", err)
+		return err
+	}
+
+	addFileRequestColumnsQuery :=
+		"ALTER TABLE share_links ADD COLUMN IF NOT EXISTS requireuploader bool not null default false, " +
+			"ADD COLUMN IF NOT EXISTS maxfiles bigint, ADD COLUMN IF NOT EXISTS maxbytes bigint, " +
+			"ADD COLUMN IF NOT EXISTS uploadedfiles bigint not null default 0, ADD COLUMN IF NOT EXISTS uploadedbytes bigint not null default 0;"
+	_, err = db.Exec(addFileRequestColumnsQuery)
+	if err != nil {
+		log.Error("Error adding the file request columns to the share_links table: %s", err)
+		return err
+	}
+
+	createShareLinkUploadsQuery :=
+		"CREATE TABLE if not exists share_link_uploads (linkid bigint not null references share_links(id) on delete cascade, " +
+			"fileid bigint not null references files(id) on delete cascade, uploadername text not null default '', " +
+			"uploaderemail text not null default '', createdat timestamptz not null default now(), primary key (linkid, fileid));"
+	_, err = db.Exec(createShareLinkUploadsQuery)
+	if err != nil {
+		log.Error("Error creating the share_link_uploads table: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created share_links table")
+	return nil
+}
+
+// FileRequestUpload is a file uploaded through a file request, with the details given by the uploader
+type FileRequestUpload struct {
+	FileID        int64     `json:"fileId"`
+	Filename      string    `json:"filename"`
+	UploaderName  string    `json:"uploaderName"`
+	UploaderEmail string    `json:"uploaderEmail"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+const shareLinkColumns = "id, ownerid, folderid, subfolderid, coalesce(fileid, 0), mode, passhash, expiresat, " +
+	"maxdownloads, downloads, requireuploader, maxfiles, maxbytes, uploadedfiles, uploadedbytes, revoked, createdat"
+
+func scanShareLink(row interface{ Scan(...interface{}) error }) (ShareLink, error) {
+	var link ShareLink
+	var expiresAt sql.NullTime
+	var maxDownloads, maxFiles, maxBytes sql.NullInt64
+	err := row.Scan(&link.ID, &link.OwnerID, &link.FolderID, &link.SubfolderID, &link.FileID, &link.Mode, &link.passHash,
+		&expiresAt, &maxDownloads, &link.Downloads, &link.RequireUploader, &maxFiles, &maxBytes, &link.UploadedFiles,
+		&link.UploadedBytes, &link.Revoked, &link.CreatedAt)
+	if expiresAt.Valid {
+		link.ExpiresAt = &expiresAt.Time
+	}
+	if maxDownloads.Valid {
+		link.MaxDownloads = &maxDownloads.Int64
+	}
+	if maxFiles.Valid {
+		link.MaxFiles = &maxFiles.Int64
+	}
+	if maxBytes.Valid {
+		link.MaxBytes = &maxBytes.Int64
+	}
+	link.HasPassword = len(link.passHash) > 0
+	return link, err
+}
+
+// AddShareLink stores the link, identified by the hash of its token, and returns its id
+func AddShareLink(db *sql.DB, link ShareLink, token string, password string) (int64, error) {
+	if link.Mode != ShareLinkRead && link.Mode != ShareLinkUpload {
+		return 0, errors.New(INVALID_SHARE_LINK)
+	}
+	if link.Mode == ShareLinkUpload && link.FileID != 0 {
+		return 0, errors.New(SHARE_LINK_UPLOAD_TO_FILE)
+	}
+	if (link.MaxDownloads != nil && *link.MaxDownloads < 1) || (link.MaxFiles != nil && *link.MaxFiles < 1) ||
+		(link.MaxBytes != nil && *link.MaxBytes < 1) {
+		return 0, errors.New(INVALID_SHARE_LINK)
+	}
+	if link.Mode != ShareLinkUpload && (link.RequireUploader || link.MaxFiles != nil || link.MaxBytes != nil) {
+		// the upload limits only apply to the file requests
+		return 0, errors.New(INVALID_SHARE_LINK)
+	}
+	if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+		return 0, errors.New(SHARE_LINK_EXPIRY_IN_THE_PAST)
+	}
+
+	passHash := ""
+	if len(password) > 0 {
+		passHash = auth.ComputePasswordHash(password)
+	}
+	addShareLinkStatement :=
+		"INSERT INTO share_links(tokenhash, ownerid, folderid, subfolderid, fileid, mode, passhash, expiresat, maxdownloads, " +
+			"requireuploader, maxfiles, maxbytes) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id"
+	var linkID int64
+	err := db.QueryRow(addShareLinkStatement, auth.ComputePasswordHash(token), link.OwnerID, link.FolderID, link.SubfolderID,
+		nullableID(link.FileID), link.Mode, passHash, link.ExpiresAt, link.MaxDownloads, link.RequireUploader,
+		link.MaxFiles, link.MaxBytes).Scan(&linkID)
+	if err != nil {
+		log.Error("Error adding the share link of the user %d: %s", link.OwnerID, err)
+		return 0, err
+	}
+	return linkID, nil
+}
+
+// GetShareLinks returns the links created by the user, the newest first
+func GetShareLinks(db *sql.DB, ownerID int64) ([]ShareLink, error) {
+	getShareLinksQuery := "SELECT " + shareLinkColumns + " FROM share_links WHERE ownerid=$1 ORDER BY id DESC"
+	rows, err := db.Query(getShareLinksQuery, ownerID)
+	if err != nil {
+		log.Error("Error retrieving the share links of the user %d: %s", ownerID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			log.Error("Error reading the share link of the user %d: %s", ownerID, err)
+			return links, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// RevokeShareLink disables the link, only its owner can revoke it
+func RevokeShareLink(db *sql.DB, linkID int64, ownerID int64) error {
+	revokeShareLinkStatement := "UPDATE share_links SET revoked=true WHERE id=$1 AND ownerid=$2"
+	result, err := db.Exec(revokeShareLinkStatement, linkID, ownerID)
+	if err != nil {
+		log.Error("Error revoking the share link %d: %s", linkID, err)
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return errors.New(SHARE_LINK_NOT_FOUND)
+	}
+	return nil
+}
+
+// GetShareLinkForToken returns the link of the token if it can still be used. When the link has a password, the
+// password must match, SHARE_LINK_PASSWORD_REQUIRED being returned otherwise.
+func GetShareLinkForToken(db *sql.DB, token string, password string) (ShareLink, error) {
+	getShareLinkQuery := "SELECT " + shareLinkColumns + " FROM share_links WHERE tokenhash=$1"
+	link, err := scanShareLink(db.QueryRow(getShareLinkQuery, auth.ComputePasswordHash(token)))
+	if err == sql.ErrNoRows || (err == nil && link.Revoked) {
+		return link, errors.New(SHARE_LINK_NOT_FOUND)
+	} else if err != nil {
+		log.Error("Error retrieving the share link: %s", err)
+		return link, err
+	}
+
+	if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+		return link, errors.New(SHARE_LINK_EXPIRED)
+	}
+	if link.HasPassword &&
+		subtle.ConstantTimeCompare([]byte(auth.ComputePasswordHash(password)), []byte(link.passHash)) != 1 {
+		log.Error("The password of the share link %d is missing or not correct", link.ID)
+		return link, errors.New(SHARE_LINK_PASSWORD_REQUIRED)
+	}
+	return link, nil
+}
+
+// UseShareLinkDownload counts a download of the link, returning SHARE_LINK_LIMIT_REACHED when its limit was reached
+func UseShareLinkDownload(db *sql.DB, linkID int64) error {
+	useShareLinkDownloadStatement :=
+		"UPDATE share_links SET downloads=downloads+1 WHERE id=$1 AND (maxdownloads IS NULL OR downloads < maxdownloads)"
+	result, err := db.Exec(useShareLinkDownloadStatement, linkID)
+	if err != nil {
+		log.Error("Error counting the download of the share link %d: %s", linkID, err)
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return errors.New(SHARE_LINK_LIMIT_REACHED)
+	}
+	return nil
+}
+
+// ReserveShareLinkUpload counts the upload against the limits of the file request before the file is stored,
+// returning SHARE_LINK_UPLOAD_LIMIT when it would go over them
+func ReserveShareLinkUpload(db *sql.DB, linkID int64, size int64) error {
+	reserveShareLinkUploadStatement :=
+		"UPDATE share_links SET uploadedfiles=uploadedfiles+1, uploadedbytes=uploadedbytes+$2 WHERE id=$1 " +
+			"AND (maxfiles IS NULL OR uploadedfiles < maxfiles) AND (maxbytes IS NULL OR uploadedbytes+$2 <= maxbytes)"
+	result, err := db.Exec(reserveShareLinkUploadStatement, linkID, size)
+	if err != nil {
+		log.Error("Error counting the upload of the share link %d: %s", linkID, err)
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return errors.New(SHARE_LINK_UPLOAD_LIMIT)
+	}
+	return nil
+}
+
+// ReleaseShareLinkUpload gives back what ReserveShareLinkUpload counted, when the file couldn't be stored
+func ReleaseShareLinkUpload(db *sql.DB, linkID int64, size int64) error {
+	releaseShareLinkUploadStatement :=
+		"UPDATE share_links SET uploadedfiles=greatest(uploadedfiles-1, 0), uploadedbytes=greatest(uploadedbytes-$2, 0) WHERE id=$1"
+	_, err := db.Exec(releaseShareLinkUploadStatement, linkID, size)
+	if err != nil {
+		log.Error("Error releasing the upload of the share link %d: %s", linkID, err)
+	}
+	return err
+}
+
+// AddShareLinkUpload records the file uploaded through the file request, with the details of the uploader
+func AddShareLinkUpload(db *sql.DB, linkID int64, fileID int64, uploaderName string, uploaderEmail string) error {
+	addShareLinkUploadStatement :=
+		"INSERT INTO share_link_uploads(linkid, fileid, uploadername, uploaderemail) VALUES($1, $2, $3, $4)"
+	_, err := db.Exec(addShareLinkUploadStatement, linkID, fileID, uploaderName, uploaderEmail)
+	if err != nil {
+		log.Error("Error recording the upload of the file %d through the share link %d: %s", fileID, linkID, err)
+	}
+	return err
+}
+
+// GetShareLinkUploads returns the files uploaded through the file request, the newest first. Only the owner of the
+// link can read them.
+func GetShareLinkUploads(db *sql.DB, linkID int64, ownerID int64) ([]FileRequestUpload, error) {
+	getShareLinkUploadsQuery :=
+		"SELECT share_link_uploads.fileid, files.filename, share_link_uploads.uploadername, share_link_uploads.uploaderemail, " +
+			"share_link_uploads.createdat FROM share_link_uploads JOIN share_links ON share_links.id=share_link_uploads.linkid " +
+			"JOIN files ON files.id=share_link_uploads.fileid WHERE share_link_uploads.linkid=$1 AND share_links.ownerid=$2 " +
+			"ORDER BY share_link_uploads.createdat DESC"
+	rows, err := db.Query(getShareLinkUploadsQuery, linkID, ownerID)
+	if err != nil {
+		log.Error("Error retrieving the uploads of the share link %d: %s", linkID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []FileRequestUpload{}
+	for rows.Next() {
+		var upload FileRequestUpload
+		err = rows.Scan(&upload.FileID, &upload.Filename, &upload.UploaderName, &upload.UploaderEmail, &upload.CreatedAt)
+		if err != nil {
+			log.Error("Error reading the upload of the share link %d: %s", linkID, err)
+			return uploads, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
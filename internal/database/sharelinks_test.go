@@ -0,0 +1,126 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// errorText returns the message of the error, empty for nil, to compare it with the error variables
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestShareLinkTokenIsOnlyStoredHashed(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ownerID := addTestUser(t, db, "owner@example.com")
+	folderID, subfolderID := addTestSubfolder(t, db, ownerID, "shared")
+
+	token := "share-link-token"
+	link := ShareLink{OwnerID: ownerID, FolderID: folderID, SubfolderID: subfolderID, Mode: ShareLinkRead}
+	linkID, err := AddShareLink(db, link, token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokenHash string
+	if err = db.QueryRow("SELECT tokenhash FROM share_links WHERE id=$1", linkID).Scan(&tokenHash); err != nil {
+		t.Fatal(err)
+	}
+	if tokenHash == token {
+		t.Fatal("the token of the share link is stored as is")
+	}
+
+	found, err := GetShareLinkForToken(db, token, "")
+	if err != nil || found.ID != linkID {
+		t.Fatalf("the token found the link %d, %v, want the link %d", found.ID, err, linkID)
+	}
+	// the stored hash doesn't work as a token
+	if _, err = GetShareLinkForToken(db, tokenHash, ""); errorText(err) != SHARE_LINK_NOT_FOUND {
+		t.Fatalf("the hash of the token returned %v, want %s", err, SHARE_LINK_NOT_FOUND)
+	}
+}
+
+func TestShareLinkPasswordExpiryAndRevocation(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ownerID := addTestUser(t, db, "owner@example.com")
+	otherUserID := addTestUser(t, db, "other@example.com")
+	folderID, subfolderID := addTestSubfolder(t, db, ownerID, "shared")
+
+	link := ShareLink{OwnerID: ownerID, FolderID: folderID, SubfolderID: subfolderID, Mode: ShareLinkRead}
+	linkID, err := AddShareLink(db, link, "protected", "link password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"", "wrong password"} {
+		if _, err = GetShareLinkForToken(db, "protected", password); errorText(err) != SHARE_LINK_PASSWORD_REQUIRED {
+			t.Fatalf("the password %q returned %v, want %s", password, err, SHARE_LINK_PASSWORD_REQUIRED)
+		}
+	}
+	if _, err = GetShareLinkForToken(db, "protected", "link password"); err != nil {
+		t.Fatalf("the password of the link returned %v", err)
+	}
+
+	// only the owner revokes the link
+	if err = RevokeShareLink(db, linkID, otherUserID); errorText(err) != SHARE_LINK_NOT_FOUND {
+		t.Fatalf("revoking the link of another user returned %v, want %s", err, SHARE_LINK_NOT_FOUND)
+	}
+	if err = RevokeShareLink(db, linkID, ownerID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetShareLinkForToken(db, "protected", "link password"); errorText(err) != SHARE_LINK_NOT_FOUND {
+		t.Fatalf("the revoked link returned %v, want %s", err, SHARE_LINK_NOT_FOUND)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	link.ExpiresAt = &past
+	if _, err = AddShareLink(db, link, "expired", ""); errorText(err) != SHARE_LINK_EXPIRY_IN_THE_PAST {
+		t.Fatalf("adding an expired link returned %v, want %s", err, SHARE_LINK_EXPIRY_IN_THE_PAST)
+	}
+	future := time.Now().Add(time.Hour)
+	link.ExpiresAt = &future
+	expiringLinkID, err := AddShareLink(db, link, "expiring", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("UPDATE share_links SET expiresat=$1 WHERE id=$2", past, expiringLinkID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetShareLinkForToken(db, "expiring", ""); errorText(err) != SHARE_LINK_EXPIRED {
+		t.Fatalf("the expired link returned %v, want %s", err, SHARE_LINK_EXPIRED)
+	}
+}
+
+func TestShareLinkDownloadLimit(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	ownerID := addTestUser(t, db, "owner@example.com")
+	folderID, subfolderID := addTestSubfolder(t, db, ownerID, "shared")
+	fileID := addTestFile(t, db, ownerID, folderID, subfolderID, "report.pdf")
+
+	maxDownloads := int64(2)
+	link := ShareLink{OwnerID: ownerID, FolderID: folderID, SubfolderID: subfolderID, FileID: fileID,
+		Mode: ShareLinkRead, MaxDownloads: &maxDownloads}
+	linkID, err := AddShareLink(db, link, "limited", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for download := 1; download <= 2; download++ {
+		if err = UseShareLinkDownload(db, linkID); err != nil {
+			t.Fatalf("the download %d returned %v", download, err)
+		}
+	}
+	if err = UseShareLinkDownload(db, linkID); errorText(err) != SHARE_LINK_LIMIT_REACHED {
+		t.Fatalf("the download over the limit returned %v, want %s", err, SHARE_LINK_LIMIT_REACHED)
+	}
+
+	// the file requests are links of a subfolder
+	link.Mode, link.MaxDownloads = ShareLinkUpload, nil
+	if _, err = AddShareLink(db, link, "upload", ""); errorText(err) != SHARE_LINK_UPLOAD_TO_FILE {
+		t.Fatalf("adding an upload link to a file returned %v, want %s", err, SHARE_LINK_UPLOAD_TO_FILE)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	//"github.com/CosminMocanu97/dissertationBackend/internal/types"
 	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
 	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/lib/pq"
 )
 
 var (
@@ -24,6 +25,14 @@ var (
 type SubfolderDetails struct {
 	ID int64
 	Name string
+	Tags []string
+	Metadata MetadataValues
+}
+
+// SubfolderFilter selects the subfolders of a listing, by their tags and metadata values
+type SubfolderFilter struct {
+	Tags     []string
+	Metadata []MetadataFilter
 }
 
 type SingleSubfolderDetails struct {
@@ -93,9 +102,27 @@ func AddNewSubfolder(db *sql.DB, userID int64, folderID int64, subfolderName str
 			addNewFolderStatement :=
 				"INSERT INTO subfolders(ownerId, folderId, name, password, isLocked) VALUES($1, $2, $3, $4, $5) RETURNING id;"
 
-			err := db.QueryRow(addNewFolderStatement, userID, folderID, subfolderName, passHash, isLocked).Scan(&subfolderID)
+			// the subfolder and its node are added together, a subfolder without a node being missing from the tree
+			tx, err := db.Begin()
 			if err != nil {
-				log.Error("Error adding the new subfolder: ", err)
+				log.Error("Error starting the transaction adding the subfolder %s: %s", subfolderName, err)
+				return 0, err
+			}
+			defer tx.Rollback()
+
+			err = tx.QueryRow(addNewFolderStatement, userID, folderID, subfolderName, passHash, isLocked).Scan(&subfolderID)
+			if err != nil {
+				log.Error("Error adding the new subfolder: %s", err)
+				return 0, err
+			}
+			err = addSubfolderNode(tx, folderID, subfolderID, userID, subfolderName)
+			if err != nil {
+				log.Error("Error adding the node of the new subfolder: %s", err)
+				return 0, err
+			}
+			err = tx.Commit()
+			if err != nil {
+				log.Error("Error committing the new subfolder %s: %s", subfolderName, err)
 				return 0, err
 			}
 
@@ -108,31 +135,80 @@ func AddNewSubfolder(db *sql.DB, userID int64, folderID int64, subfolderName str
 	}
 }
 
-func GetAllSubFoldersDetails(db *sql.DB, folderID int64) ([]SubfolderDetails, error) {
+// GetAllSubFoldersDetails returns a page of the subfolders of the folder matching the filter, sorted by name or id
+func GetAllSubFoldersDetails(db *sql.DB, folderID int64, filter SubfolderFilter, page PageRequest) ([]SubfolderDetails, PageInfo, error) {
+	var pageInfo PageInfo
+	query, err := newPageQuery(page, folderSortColumns, "name", "id")
+	if err != nil {
+		log.Error("Error reading the page request of the subfolders for folderID %d: %s", folderID, err)
+		return nil, pageInfo, err
+	}
+
+	filter.Tags, err = normalizeTags(filter.Tags)
+	if err != nil {
+		log.Error("Error reading the tags filter of the subfolders for folderID %d: %s", folderID, err)
+		return nil, pageInfo, err
+	}
+
+	var args queryArgs
+	conditions := []string{"folderid=" + args.add(folderID), tagsCondition(subfolderMetadataTarget, "subfolders.id", filter.Tags, &args)}
+	metadataConditions, err := metadataFilterConditions(subfolderMetadataTarget, "subfolders.id", filter.Metadata, &args)
+	if err != nil {
+		log.Error("Error reading the metadata filters of the subfolders for folderID %d: %s", folderID, err)
+		return nil, pageInfo, err
+	}
+	conditions = append(conditions, metadataConditions...)
+
+	countSubfoldersQuery := "SELECT count(*) FROM subfolders" + where(conditions)
+	err = db.QueryRow(countSubfoldersQuery, args...).Scan(&pageInfo.TotalCount)
+	if err != nil {
+		log.Error("Error counting the subfolders for folderID %d: %s", folderID, err)
+		return nil, pageInfo, err
+	}
+
+	conditions = append(conditions, query.condition(&args))
 	getAllSubfoldersDetailsQuery :=
-		"SELECT id, name FROM subfolders where folderid=$1"
-	rows, err := db.Query(getAllSubfoldersDetailsQuery, folderID)
+		"SELECT id, name, array(SELECT tag FROM subfolder_tags WHERE subfolder_tags.subfolderid=subfolders.id ORDER BY tag), " +
+			metadataValuesExpression(subfolderMetadataTarget, "subfolders.id") + ", " + query.sortValue() +
+			" FROM subfolders" + where(conditions) + query.orderBy()
+	rows, err := db.Query(getAllSubfoldersDetailsQuery, args...)
 	if err != nil {
 		log.Error("Error getting the data for all the subfolders for folderID %d: %s", folderID, err)
+		return nil, pageInfo, err
 	}
 	defer rows.Close()
 
-	var allSubfolderDetails []SubfolderDetails
+	allSubfolderDetails := []SubfolderDetails{}
+	var sortValues []string
 	for rows.Next() {
 		var subfolderID int64
 		var name string
+		var tags []string
+		var metadata MetadataValues
+		var sortValue string
 
-		err = rows.Scan(&subfolderID, &name)
+		err = rows.Scan(&subfolderID, &name, pq.Array(&tags), &metadata, &sortValue)
 		if err != nil {
 			log.Error("Error binding the data for GetAllSubFoldersDetails request: %s", err)
-			return allSubfolderDetails, err
+			return allSubfolderDetails, pageInfo, err
 		}
 		subfolderDetails := new(SubfolderDetails)
 		subfolderDetails.ID = subfolderID
 		subfolderDetails.Name = name
+		subfolderDetails.Tags = tags
+		subfolderDetails.Metadata = metadata
 		allSubfolderDetails = append(allSubfolderDetails, *subfolderDetails)
+		sortValues = append(sortValues, sortValue)
+	}
+	if err = rows.Err(); err != nil {
+		return allSubfolderDetails, pageInfo, err
 	}
-	return allSubfolderDetails, nil
+
+	var count int
+	pageInfo.NextCursor, count = query.nextCursor(len(allSubfolderDetails), func(index int) (string, int64) {
+		return sortValues[index], allSubfolderDetails[index].ID
+	})
+	return allSubfolderDetails[:count], pageInfo, nil
 }
 
 func GetAllSubfolderDetailsForID(db *sql.DB, subfolderID int64, folderID int64) (SingleSubfolderDetails, error) {
@@ -149,7 +225,7 @@ func GetAllSubfolderDetailsForID(db *sql.DB, subfolderID int64, folderID int64)
 
 	doesFolderExist, err := FolderExists(db, folderName)
 	if err != nil {
-		log.Error("Error while checking if the folder already exists in db: %s", doesFolderExist)
+		log.Error("Error while checking if the folder already exists in db: %s", err)
 		return SingleSubfolderDetails{}, err
 	}
 	if !doesFolderExist {
@@ -159,7 +235,7 @@ func GetAllSubfolderDetailsForID(db *sql.DB, subfolderID int64, folderID int64)
 
 	doesSubfolderExist, err := SubfolderExists(db, folderID, subfolderName)
 	if err != nil {
-		log.Error("Error while checking if the subfolder already exists in db: %s", doesSubfolderExist)
+		log.Error("Error while checking if the subfolder already exists in db: %s", err)
 		return SingleSubfolderDetails{}, err
 	}
 	if !doesSubfolderExist {
@@ -237,7 +313,7 @@ func RemoveSubfolder(db *sql.DB, subfolderID int64, folderID int64, ownerID int6
 	deleteFolderStatement := "DELETE FROM subfolders WHERE id=$1 AND folderid=$2 AND ownerid=$3"
 	res, err := db.Exec(deleteFolderStatement, subfolderID, folderID, ownerID)
 	if err != nil {
-		log.Error("Error removing the subfolder with ID %d from folder with ID: %s", subfolderID, folderID, err)
+		log.Error("Error removing the subfolder with ID %d from folder with ID %d: %s", subfolderID, folderID, err)
 		return false
 	}
 	rowsAffected, err := res.RowsAffected()
@@ -256,8 +332,7 @@ func RemoveSubfolder(db *sql.DB, subfolderID int64, folderID int64, ownerID int6
 }
 
 func RemoveFilesFromSubfolder(db *sql.DB, subfolderID int64, folderID int64, userID int64) bool {
-	deleteFilesFromFolderStatement := "DELETE FROM files WHERE subfolderid=$1 AND folderid=$2 AND ownerid=$3"
-	_, err := db.Exec(deleteFilesFromFolderStatement, subfolderID, folderID, userID)
+	_, err := removeFilesReleasingBlobs(db, "files.subfolderid=$1 AND files.folderid=$2 AND files.ownerid=$3", subfolderID, folderID, userID)
 	if err != nil {
 		log.Error("Error removing the files from folder with ID %d: %s", folderID, err)
 		return false
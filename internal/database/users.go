@@ -47,7 +47,7 @@ func AddNewUser(db *sql.DB, registrationData types.RegistrationData, activationT
 
 			_, err := db.Exec(addUserStatement, registrationData.Email, passHash, activationToken)
 			if err != nil {
-				log.Error("Error adding a new user: ", err)
+				log.Error("Error adding a new user: %s", err)
 				return false, err
 			}
 
@@ -179,14 +179,30 @@ func UserIsActivated(db *sql.DB, email string) (bool, error) {
 	return true, nil
 }
 
+func UserIsAdmin(db *sql.DB, userID int64) (bool, error) {
+	userIsAdminQuery := "SELECT isadmin FROM users WHERE id=$1"
+	var isAdmin bool
+	row := db.QueryRow(userIsAdminQuery, userID)
+	err := row.Scan(&isAdmin)
+	if err != nil {
+		log.Error("Error checking if the user with ID %d is an admin: %s", userID, err)
+		return false, err
+	}
+	return isAdmin, nil
+}
+
+// ActivateAccount activates the account, unless the provisioning deactivated it
 func ActivateAccount(db *sql.DB, userID int64) error {
 	activateAccountQuery :=
-		"UPDATE users SET isactivated=true WHERE id=$1"
-	_, err := db.Exec(activateAccountQuery, userID)
+		"UPDATE users SET isactivated=true WHERE id=$1 AND NOT isdeactivated"
+	res, err := db.Exec(activateAccountQuery, userID)
 	if err != nil {
 		log.Error("Error activating the account for ID %d: %s", userID, err)
 		return err
 	}
+	if rowsAffected, err := res.RowsAffected(); err == nil && rowsAffected == 0 {
+		return errors.New(USER_DEACTIVATED)
+	}
 	return nil
 }
 
@@ -249,3 +265,13 @@ func UpdatePassword(db *sql.DB, userId int64, activationToken string, newPasswor
 
 	return nil
 }
+
+// GetUserEmailForID returns the email of the user
+func GetUserEmailForID(db *sql.DB, userID int64) (string, error) {
+	var email string
+	err := db.QueryRow("SELECT email FROM users WHERE id=$1", userID).Scan(&email)
+	if err != nil {
+		log.Error("Error retrieving the email of the user %d: %s", userID, err)
+	}
+	return email, err
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+// FileAccess is a view or a download of a file, read from the audit log
+type FileAccess struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UserID    int64     `json:"userId"`
+	Email     string    `json:"email"`
+	Action    string    `json:"action"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+}
+
+var fileAccessSortColumns = map[string]sortColumn{
+	"createdAt": {expression: "audit_events.createdat", sqlType: "timestamptz"},
+}
+
+func CreateFileWatchersTable(db *sql.DB) error {
+	createFileWatchersQuery :=
+		"CREATE TABLE if not exists file_watchers (fileid bigint not null references files(id) on delete cascade, " +
+			"userid bigint not null references users(id) on delete cascade, primary key (fileid, userid));"
+	_, err := db.Exec(createFileWatchersQuery)
+	if err != nil {
+		log.Error("Error creating the file_watchers table: %s", err)
+		return err
+	}
+
+	// the time of the last notification sent to the watcher, to limit the emails about the same file
+	addNotifiedAtColumnQuery := "ALTER TABLE file_watchers ADD COLUMN IF NOT EXISTS notifiedat timestamptz"
+	_, err = db.Exec(addNotifiedAtColumnQuery)
+	if err != nil {
+		log.Error("Error adding the notification time to the file_watchers table: %s", err)
+		return err
+	}
+
+	log.Info("Successfully created file_watchers table")
+	return nil
+}
+
+// SetFileWatch subscribes or unsubscribes the user to the notifications sent when the file is accessed
+func SetFileWatch(db *sql.DB, fileID int64, userID int64, watch bool) error {
+	setFileWatchStatement := "DELETE FROM file_watchers WHERE fileid=$1 AND userid=$2"
+	if watch {
+		setFileWatchStatement = "INSERT INTO file_watchers(fileid, userid) VALUES($1, $2) ON CONFLICT DO NOTHING"
+	}
+	_, err := db.Exec(setFileWatchStatement, fileID, userID)
+	if err != nil {
+		log.Error("Error changing the watch of the user %d on the file %d: %s", userID, fileID, err)
+		return err
+	}
+	return nil
+}
+
+// FileIsWatched returns true if the user watches the file
+func FileIsWatched(db *sql.DB, fileID int64, userID int64) (bool, error) {
+	fileIsWatchedQuery := "SELECT EXISTS(SELECT 1 FROM file_watchers WHERE fileid=$1 AND userid=$2)"
+	var isWatched bool
+	err := db.QueryRow(fileIsWatchedQuery, fileID, userID).Scan(&isWatched)
+	if err != nil {
+		log.Error("Error checking if the user %d watches the file %d: %s", userID, fileID, err)
+		return false, err
+	}
+	return isWatched, nil
+}
+
+// ClaimFileWatcherNotifications returns the emails of the users watching the file, except the one accessing it,
+// that weren't notified about it during the last interval, marking them as notified
+func ClaimFileWatcherNotifications(db *sql.DB, fileID int64, exceptUserID int64, interval time.Duration) ([]string, error) {
+	claimFileWatcherNotificationsStatement :=
+		"UPDATE file_watchers SET notifiedat=now() FROM users WHERE users.id=file_watchers.userid " +
+			"AND file_watchers.fileid=$1 AND file_watchers.userid<>$2 " +
+			"AND (file_watchers.notifiedat IS NULL OR file_watchers.notifiedat <= now() - $3::bigint * interval '1 second') " +
+			"RETURNING users.email"
+	rows, err := db.Query(claimFileWatcherNotificationsStatement, fileID, exceptUserID, int64(interval.Seconds()))
+	if err != nil {
+		log.Error("Error retrieving the watchers of the file %d: %s", fileID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			log.Error("Error reading the watcher of the file %d: %s", fileID, err)
+			return emails, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// GetFileAccessLog returns a page of the successful views and downloads of the file, with the emails of the users
+func GetFileAccessLog(db *sql.DB, fileID int64, page PageRequest) ([]FileAccess, PageInfo, error) {
+	var pageInfo PageInfo
+	query, err := newPageQuery(page, fileAccessSortColumns, "createdAt", "audit_events.id")
+	if err != nil {
+		log.Error("Error reading the page request of the access log of the file %d: %s", fileID, err)
+		return nil, pageInfo, err
+	}
+
+	var args queryArgs
+	conditions := []string{
+		"audit_events.targettype=" + args.add(AuditTargetFile),
+		"audit_events.targetid=" + args.add(fileID),
+		"audit_events.action IN (" + args.add(AuditRead) + ", " + args.add(AuditDownload) + ")",
+		"audit_events.result=" + args.add(AuditSuccess),
+	}
+	fromAuditEvents := " FROM audit_events LEFT JOIN users ON users.id=audit_events.actorid"
+	countFileAccessQuery := "SELECT count(*)" + fromAuditEvents + where(conditions)
+	err = db.QueryRow(countFileAccessQuery, args...).Scan(&pageInfo.TotalCount)
+	if err != nil {
+		log.Error("Error counting the accesses of the file %d: %s", fileID, err)
+		return nil, pageInfo, err
+	}
+
+	conditions = append(conditions, query.condition(&args))
+	getFileAccessLogQuery :=
+		"SELECT audit_events.id, audit_events.createdat, coalesce(audit_events.actorid, 0), coalesce(users.email, ''), " +
+			"audit_events.action, audit_events.ip, audit_events.useragent, " + query.sortValue() +
+			fromAuditEvents + where(conditions) + query.orderBy()
+	rows, err := db.Query(getFileAccessLogQuery, args...)
+	if err != nil {
+		log.Error("Error retrieving the access log of the file %d: %s", fileID, err)
+		return nil, pageInfo, err
+	}
+	defer rows.Close()
+
+	accesses := []FileAccess{}
+	var sortValues []string
+	for rows.Next() {
+		var access FileAccess
+		var sortValue string
+		err = rows.Scan(&access.ID, &access.CreatedAt, &access.UserID, &access.Email, &access.Action, &access.IP,
+			&access.UserAgent, &sortValue)
+		if err != nil {
+			log.Error("Error reading the access of the file %d: %s", fileID, err)
+			return accesses, pageInfo, err
+		}
+		access.CreatedAt = access.CreatedAt.UTC()
+		accesses = append(accesses, access)
+		sortValues = append(sortValues, sortValue)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Error reading the access log of the file %d: %s", fileID, err)
+		return accesses, pageInfo, err
+	}
+
+	var keep int
+	pageInfo.NextCursor, keep = query.nextCursor(len(accesses), func(index int) (string, int64) {
+		return sortValues[index], accesses[index].ID
+	})
+	return accesses[:keep], pageInfo, nil
+}
@@ -0,0 +1,346 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+const (
+	// KeySize is the size of both the master keys and the per file data keys (AES-256)
+	KeySize = 32
+)
+
+var (
+	ErrUnknownMasterKey = errors.New("the master key used to wrap the data key is not available")
+	ErrInvalidMasterKey = errors.New("the master key must be 32 bytes long")
+)
+
+// KeyManager wraps and unwraps the per file data keys with master keys.
+// The master key used for new files is the current one, the older keys are only kept for unwrapping,
+// so rotating the master key doesn't require re-encrypting the content, only re-wrapping the data keys.
+type KeyManager interface {
+	CurrentKeyID() string
+	WrapKey(dataKey []byte) (keyID string, wrappedKey string, err error)
+	UnwrapKey(keyID string, wrappedKey string) ([]byte, error)
+}
+
+// GenerateDataKey returns a new random AES-256 key
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// wrapWithKey seals the data key with the master key, binding the key id as additional data
+func wrapWithKey(masterKey []byte, keyID string, dataKey []byte) (string, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, dataKey, []byte(keyID))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func unwrapWithKey(masterKey []byte, keyID string, wrappedKey string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("the wrapped key is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(keyID))
+}
+
+// StaticKeyManager holds the master keys provided through the configuration
+type StaticKeyManager struct {
+	currentKeyID string
+	keys         map[string][]byte
+}
+
+// NewStaticKeyManager returns a key manager wrapping with the key currentKeyID
+func NewStaticKeyManager(currentKeyID string, keys map[string][]byte) (*StaticKeyManager, error) {
+	for keyID, key := range keys {
+		if len(key) != KeySize {
+			log.Error("The master key %s has %d bytes", keyID, len(key))
+			return nil, ErrInvalidMasterKey
+		}
+	}
+	if _, exists := keys[currentKeyID]; !exists {
+		log.Error("The current master key %s is not part of the configured keys", currentKeyID)
+		return nil, ErrUnknownMasterKey
+	}
+	return &StaticKeyManager{
+		currentKeyID: currentKeyID,
+		keys:         keys,
+	}, nil
+}
+
+// ParseMasterKeys parses a list of master keys in the form "<key_id>:<base64_key>,<key_id>:<base64_key>"
+func ParseMasterKeys(rawKeys string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, rawKey := range strings.Split(rawKeys, ",") {
+		rawKey = strings.TrimSpace(rawKey)
+		if len(rawKey) == 0 {
+			continue
+		}
+		split := strings.SplitN(rawKey, ":", 2)
+		if len(split) != 2 || len(split[0]) == 0 {
+			return nil, fmt.Errorf("the master key entry %q is not in the form <key_id>:<base64_key>", split[0])
+		}
+		key, err := base64.StdEncoding.DecodeString(split[1])
+		if err != nil {
+			return nil, fmt.Errorf("the master key %s is not valid base64: %s", split[0], err)
+		}
+		keys[split[0]] = key
+	}
+	return keys, nil
+}
+
+func (manager *StaticKeyManager) CurrentKeyID() string {
+	return manager.currentKeyID
+}
+
+func (manager *StaticKeyManager) WrapKey(dataKey []byte) (string, string, error) {
+	wrappedKey, err := wrapWithKey(manager.keys[manager.currentKeyID], manager.currentKeyID, dataKey)
+	return manager.currentKeyID, wrappedKey, err
+}
+
+func (manager *StaticKeyManager) UnwrapKey(keyID string, wrappedKey string) ([]byte, error) {
+	masterKey, exists := manager.keys[keyID]
+	if !exists {
+		return nil, ErrUnknownMasterKey
+	}
+	return unwrapWithKey(masterKey, keyID, wrappedKey)
+}
+
+type keyRing struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LocalKMS is a stand-in for a key management service, keeping the master keys in a key ring file
+// that should live outside of the storage folder. The ring is loaded again when the file changes, so the keys
+// rotated by the rewrap command are used by the running server.
+type LocalKMS struct {
+	mu   sync.RWMutex
+	path string
+	ring keyRing
+	// file is the key ring file the ring was loaded from, Rotate replaces it with a new one
+	file os.FileInfo
+}
+
+// NewLocalKMS loads the key ring from path, creating it with a first master key if it doesn't exist
+func NewLocalKMS(path string) (*LocalKMS, error) {
+	kms := &LocalKMS{path: path}
+
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		log.Info("There is no key ring at %s, creating a new one", path)
+		kms.ring.Keys = make(map[string]string)
+		if _, err := kms.Rotate(); err != nil {
+			return nil, err
+		}
+		return kms, nil
+	}
+
+	if err = kms.load(); err != nil {
+		return nil, err
+	}
+	return kms, nil
+}
+
+// load reads the key ring file, keeping the loaded ring when it fails. The caller holds the write lock.
+func (kms *LocalKMS) load() error {
+	info, err := os.Stat(kms.path)
+	if err != nil {
+		log.Error("Error reading the key ring %s: %s", kms.path, err)
+		return err
+	}
+	content, err := ioutil.ReadFile(kms.path)
+	if err != nil {
+		log.Error("Error reading the key ring %s: %s", kms.path, err)
+		return err
+	}
+
+	var ring keyRing
+	err = json.Unmarshal(content, &ring)
+	if err != nil {
+		log.Error("Error parsing the key ring %s: %s", kms.path, err)
+		return err
+	}
+	if _, exists := ring.Keys[ring.Current]; !exists {
+		log.Error("The current master key %s is not part of the key ring %s", ring.Current, kms.path)
+		return ErrUnknownMasterKey
+	}
+	kms.ring = ring
+	kms.file = info
+	return nil
+}
+
+// refresh loads the key ring again if the file changed since it was loaded
+func (kms *LocalKMS) refresh() {
+	info, err := os.Stat(kms.path)
+	if err != nil {
+		log.Error("Error checking the key ring %s: %s", kms.path, err)
+		return
+	}
+
+	kms.mu.RLock()
+	changed := kms.file == nil || !os.SameFile(info, kms.file) || !info.ModTime().Equal(kms.file.ModTime())
+	kms.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	kms.mu.Lock()
+	defer kms.mu.Unlock()
+	if err = kms.load(); err == nil {
+		log.Info("Loaded the key ring %s again, the current key is %s", kms.path, kms.ring.Current)
+	}
+}
+
+// Rotate generates a new master key and makes it the current one, returning its id. The key ring is loaded
+// first, so the keys added by another process are kept, and replaced at once, so it's never read half written.
+func (kms *LocalKMS) Rotate() (string, error) {
+	kms.mu.Lock()
+	defer kms.mu.Unlock()
+
+	if len(kms.ring.Keys) > 0 {
+		if err := kms.load(); err != nil {
+			return "", err
+		}
+	}
+
+	masterKey, err := GenerateDataKey()
+	if err != nil {
+		return "", err
+	}
+	keyID := fmt.Sprintf("local-%d", len(kms.ring.Keys)+1)
+	kms.ring.Keys[keyID] = base64.StdEncoding.EncodeToString(masterKey)
+	previousKeyID := kms.ring.Current
+	kms.ring.Current = keyID
+
+	content, err := json.MarshalIndent(kms.ring, "", "  ")
+	if err == nil {
+		err = writeFileAtomically(kms.path, content)
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(kms.path)
+	}
+	if err != nil {
+		log.Error("Error saving the key ring %s: %s", kms.path, err)
+		delete(kms.ring.Keys, keyID)
+		kms.ring.Current = previousKeyID
+		return "", err
+	}
+	kms.file = info
+
+	log.Info("Rotated the master key, the current key is %s", keyID)
+	return keyID, nil
+}
+
+// writeFileAtomically writes the content to a temporary file next to path and renames it over path
+func writeFileAtomically(path string, content []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (kms *LocalKMS) masterKey(keyID string) ([]byte, error) {
+	encodedKey, exists := kms.ring.Keys[keyID]
+	if !exists {
+		return nil, ErrUnknownMasterKey
+	}
+	return base64.StdEncoding.DecodeString(encodedKey)
+}
+
+func (kms *LocalKMS) CurrentKeyID() string {
+	kms.refresh()
+	kms.mu.RLock()
+	defer kms.mu.RUnlock()
+	return kms.ring.Current
+}
+
+func (kms *LocalKMS) WrapKey(dataKey []byte) (string, string, error) {
+	kms.refresh()
+	kms.mu.RLock()
+	defer kms.mu.RUnlock()
+
+	keyID := kms.ring.Current
+	masterKey, err := kms.masterKey(keyID)
+	if err != nil {
+		return "", "", err
+	}
+	wrappedKey, err := wrapWithKey(masterKey, keyID, dataKey)
+	return keyID, wrappedKey, err
+}
+
+func (kms *LocalKMS) UnwrapKey(keyID string, wrappedKey string) ([]byte, error) {
+	kms.refresh()
+	kms.mu.RLock()
+	defer kms.mu.RUnlock()
+
+	masterKey, err := kms.masterKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapWithKey(masterKey, keyID, wrappedKey)
+}
+
+// NewKeyManagerFromEnv builds the key manager from the MASTER_KEYS and MASTER_KEY_ID variables,
+// falling back to the local KMS key ring at KMS_KEYRING_PATH
+func NewKeyManagerFromEnv() (KeyManager, error) {
+	rawKeys := os.Getenv("MASTER_KEYS")
+	if len(rawKeys) > 0 {
+		keys, err := ParseMasterKeys(rawKeys)
+		if err != nil {
+			log.Error("Error parsing the MASTER_KEYS variable: %s", err)
+			return nil, err
+		}
+		return NewStaticKeyManager(os.Getenv("MASTER_KEY_ID"), keys)
+	}
+
+	keyRingPath := os.Getenv("KMS_KEYRING_PATH")
+	if len(keyRingPath) == 0 {
+		return nil, errors.New("neither MASTER_KEYS nor KMS_KEYRING_PATH are set")
+	}
+	return NewLocalKMS(keyRingPath)
+}
@@ -0,0 +1,48 @@
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalKMSLoadsTheRotatedKeys(t *testing.T) {
+	folder, err := ioutil.TempDir("", "kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	path := filepath.Join(folder, "keyring.json")
+
+	server, err := NewLocalKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rewrap command rotates the key with its own copy of the key ring
+	command, err := NewLocalKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKeyID, err := command.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey := bytes.Repeat([]byte{1}, KeySize)
+	keyID, wrappedKey, err := command.WrapKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrappedKey, err := server.UnwrapKey(keyID, wrappedKey)
+	if err != nil {
+		t.Fatalf("unwrapping with the rotated key %s returned %v", keyID, err)
+	}
+	if !bytes.Equal(unwrappedKey, dataKey) {
+		t.Fatal("the unwrapped key is not the wrapped one")
+	}
+	if currentKeyID := server.CurrentKeyID(); currentKeyID != rotatedKeyID {
+		t.Fatalf("the current key is %s, want the rotated key %s", currentKeyID, rotatedKeyID)
+	}
+}
@@ -0,0 +1,60 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// PasswordKeyID marks the files whose data key is wrapped with a key derived from the file password
+	// instead of a master key, so the server can't decrypt them without the password
+	PasswordKeyID = "password"
+
+	saltSize = 16
+
+	// Argon2id parameters, following the recommendations from RFC 9106 for memory constrained environments
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+var (
+	ErrInvalidPassword = errors.New("the password can't decrypt the file")
+)
+
+func derivePasswordKey(password string, salt []byte) []byte {
+	return argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, KeySize)
+}
+
+// WrapKeyWithPassword wraps the data key with a key derived from the password and a new random salt.
+// It returns the base64 encoded salt and the wrapped key.
+func WrapKeyWithPassword(password string, dataKey []byte) (string, string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", "", err
+	}
+
+	wrappedKey, err := wrapWithKey(derivePasswordKey(password, salt), PasswordKeyID, dataKey)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(salt), wrappedKey, nil
+}
+
+// UnwrapKeyWithPassword returns ErrInvalidPassword if the password is not the one used to wrap the data key
+func UnwrapKeyWithPassword(password string, encodedSalt string, wrappedKey string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := unwrapWithKey(derivePasswordKey(password, salt), PasswordKeyID, wrappedKey)
+	if err != nil {
+		return nil, ErrInvalidPassword
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,224 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// ChunkSize is the amount of plaintext sealed in every AES-GCM chunk
+	ChunkSize = 64 * 1024
+
+	streamMagic      = "DMSENC01"
+	noncePrefixSize  = 7
+	headerSize       = len(streamMagic) + 4 + noncePrefixSize
+	lastChunkFlag    = 1
+	regularChunkFlag = 0
+)
+
+var (
+	ErrInvalidStreamHeader = errors.New("the encrypted stream has an invalid header")
+	ErrTruncatedStream     = errors.New("the encrypted stream was truncated")
+)
+
+// the nonce of every chunk is built as noncePrefix || counter || lastChunkFlag, so chunks can't be
+// reordered, dropped or cut from the end of the stream without the authentication failing
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = lastChunkFlag
+	} else {
+		nonce[11] = regularChunkFlag
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptingWriter seals everything written to it in chunks of ChunkSize bytes.
+// Close must be called to write the final chunk, it doesn't close the underlying writer.
+type EncryptingWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	buffer  []byte
+	counter uint32
+	closed  bool
+}
+
+// NewEncryptingWriter writes the stream header to dst and returns a writer sealing the content with key
+func NewEncryptingWriter(dst io.Writer, key []byte) (*EncryptingWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, streamMagic...)
+	chunkSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkSize, ChunkSize)
+	header = append(header, chunkSize...)
+	header = append(header, prefix...)
+
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &EncryptingWriter{
+		dst:    dst,
+		aead:   aead,
+		header: header,
+		prefix: prefix,
+		buffer: make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+func (w *EncryptingWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write on a closed encrypting writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// a full buffer is only flushed when more data arrives, so the last chunk is always sealed by Close
+		if len(w.buffer) == ChunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buffer[len(w.buffer):ChunkSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *EncryptingWriter) flush(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter, last), w.buffer, w.header)
+	if _, err := w.dst.Write(sealed); err != nil {
+		return err
+	}
+	w.counter++
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+// Close seals the last (possibly empty) chunk
+func (w *EncryptingWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+// DecryptingReader opens a stream produced by EncryptingWriter
+type DecryptingReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	sealed  []byte
+	plain   *bytes.Reader
+	counter uint32
+	done    bool
+}
+
+// NewDecryptingReader reads the stream header from src and returns a reader for the plaintext
+func NewDecryptingReader(src io.Reader, key []byte) (*DecryptingReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, ErrInvalidStreamHeader
+	}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return nil, ErrInvalidStreamHeader
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(streamMagic):])
+	if chunkSize != ChunkSize {
+		return nil, ErrInvalidStreamHeader
+	}
+
+	return &DecryptingReader{
+		src:    src,
+		aead:   aead,
+		header: header,
+		prefix: header[len(streamMagic)+4:],
+		// read one byte more than a sealed chunk, to know if the current chunk is the last one
+		sealed: make([]byte, 0, ChunkSize+aead.Overhead()+1),
+		plain:  bytes.NewReader(nil),
+	}, nil
+}
+
+func (r *DecryptingReader) Read(p []byte) (int, error) {
+	for r.plain.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	return r.plain.Read(p)
+}
+
+func (r *DecryptingReader) nextChunk() error {
+	sealedChunkSize := ChunkSize + r.aead.Overhead()
+
+	// fill the buffer up to a sealed chunk plus one byte of look ahead
+	n, err := io.ReadFull(r.src, r.sealed[len(r.sealed):cap(r.sealed)])
+	r.sealed = r.sealed[:len(r.sealed)+n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := len(r.sealed) <= sealedChunkSize
+	chunk := r.sealed
+	if !last {
+		chunk = r.sealed[:sealedChunkSize]
+	}
+	if len(chunk) < r.aead.Overhead() {
+		return ErrTruncatedStream
+	}
+
+	plain, err := r.aead.Open(nil, chunkNonce(r.prefix, r.counter, last), chunk, r.header)
+	if err != nil {
+		return err
+	}
+
+	r.counter++
+	r.plain.Reset(plain)
+	if last {
+		r.done = true
+		r.sealed = r.sealed[:0]
+	} else {
+		// keep the look ahead byte for the next chunk
+		remaining := copy(r.sealed, r.sealed[sealedChunkSize:])
+		r.sealed = r.sealed[:remaining]
+	}
+	return nil
+}
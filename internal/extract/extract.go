@@ -0,0 +1,58 @@
+package extract
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// MaxTextSize caps the extracted text, a tsvector can't hold more than 1MB of lexemes and positions
+	MaxTextSize = 512 * 1024
+
+	// maxPartSize caps what is decompressed from one part of an office document, against zip bombs
+	maxPartSize = 64 * 1024 * 1024
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("the text can't be extracted from this file format")
+)
+
+// Text returns the plain text of the document, picking the format from the extension of its name.
+// The result is truncated to MaxTextSize.
+func Text(r io.ReaderAt, size int64, filename string) (string, error) {
+	var text string
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".pdf":
+		text, err = pdfText(r, size)
+	case ".docx":
+		text, err = docxText(r, size)
+	case ".xlsx":
+		text, err = xlsxText(r, size)
+	case ".pptx":
+		text, err = pptxText(r, size)
+	default:
+		return "", ErrUnsupportedFormat
+	}
+	if err != nil {
+		return "", err
+	}
+	return truncate(text, MaxTextSize), nil
+}
+
+// truncate cuts the text to at most size bytes, without splitting a UTF-8 sequence
+func truncate(text string, size int) string {
+	if len(text) <= size {
+		return text
+	}
+	for size > 0 && !isRuneStart(text[size]) {
+		size--
+	}
+	return text[:size]
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
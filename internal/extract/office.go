@@ -0,0 +1,146 @@
+package extract
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	slidePartName     = regexp.MustCompile(`^ppt/slides/slide(\d+)\.xml$`)
+	worksheetPartName = regexp.MustCompile(`^xl/worksheets/sheet(\d+)\.xml$`)
+)
+
+// xmlText collects the character data of the elements named textElement, starting a new line
+// after each element named lineElement. The names are compared without their namespace.
+func xmlText(r io.Reader, textElement string, lineElement string, builder *strings.Builder) error {
+	decoder := xml.NewDecoder(r)
+	inText := 0
+	for builder.Len() < MaxTextSize {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			if element.Name.Local == textElement {
+				inText++
+			}
+		case xml.EndElement:
+			if element.Name.Local == textElement && inText > 0 {
+				inText--
+			} else if element.Name.Local == lineElement {
+				builder.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText > 0 {
+				builder.Write(element)
+			}
+		}
+	}
+	return nil
+}
+
+// zipPartText extracts the text of one part of an office document
+func zipPartText(file *zip.File, textElement string, lineElement string, builder *strings.Builder) error {
+	part, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	return xmlText(io.LimitReader(part, maxPartSize), textElement, lineElement, builder)
+}
+
+// numberedParts returns the parts matching the pattern, ordered by the number in their name
+func numberedParts(files []*zip.File, pattern *regexp.Regexp) []*zip.File {
+	type numberedPart struct {
+		number int
+		file   *zip.File
+	}
+	var parts []numberedPart
+	for _, file := range files {
+		match := pattern.FindStringSubmatch(file.Name)
+		if match == nil {
+			continue
+		}
+		number, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		parts = append(parts, numberedPart{number: number, file: file})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].number < parts[j].number
+	})
+
+	sorted := make([]*zip.File, 0, len(parts))
+	for _, part := range parts {
+		sorted = append(sorted, part.file)
+	}
+	return sorted
+}
+
+func docxText(r io.ReaderAt, size int64) (string, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	for _, file := range archive.File {
+		if file.Name == "word/document.xml" {
+			err = zipPartText(file, "t", "p", &builder)
+			break
+		}
+	}
+	return builder.String(), err
+}
+
+func pptxText(r io.ReaderAt, size int64) (string, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	for _, slide := range numberedParts(archive.File, slidePartName) {
+		if err = zipPartText(slide, "t", "p", &builder); err != nil {
+			return "", err
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String(), nil
+}
+
+// xlsxText returns the shared strings, which hold the text cells of every sheet, followed by the inline
+// strings of the sheets. The numbers are left out, they are rarely searched for.
+func xlsxText(r io.ReaderAt, size int64) (string, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	for _, file := range archive.File {
+		if file.Name == "xl/sharedStrings.xml" {
+			if err = zipPartText(file, "t", "si", &builder); err != nil {
+				return "", err
+			}
+			break
+		}
+	}
+	for _, sheet := range numberedParts(archive.File, worksheetPartName) {
+		if err = zipPartText(sheet, "t", "is", &builder); err != nil {
+			return "", err
+		}
+	}
+	return builder.String(), nil
+}
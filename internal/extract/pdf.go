@@ -0,0 +1,38 @@
+package extract
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+func pdfText(r io.ReaderAt, size int64) (text string, err error) {
+	// the parser panics on some malformed documents
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("the pdf document is malformed: %v", recovered)
+		}
+	}()
+
+	reader, err := pdf.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	for pageNumber := 1; pageNumber <= reader.NumPage() && builder.Len() < MaxTextSize; pageNumber++ {
+		page := reader.Page(pageNumber)
+		if page.V.IsNull() {
+			continue
+		}
+		pageText, err := page.GetPlainText(nil)
+		if err != nil {
+			return "", err
+		}
+		builder.WriteString(pageText)
+		builder.WriteString("\n")
+	}
+	return builder.String(), nil
+}
@@ -0,0 +1,286 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// clockSkew is the difference allowed between the clocks of the server and of the provider
+	clockSkew = time.Minute
+	// keysRefreshInterval limits how often the keys are fetched again for the tokens signed with an unknown key
+	keysRefreshInterval = time.Minute
+)
+
+// signingAlgorithms are the asymmetric algorithms accepted for the ID tokens, the symmetric ones and none being
+// refused
+var signingAlgorithms = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// IDToken is the identity of the user sent by the provider
+type IDToken struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+	// MFA is true when the provider logged the user in with several factors
+	MFA bool
+}
+
+// audience is the aud claim, a string or an array of strings
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+// flexibleBool is a boolean claim, which some providers send as a string
+type flexibleBool bool
+
+func (value *flexibleBool) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*value = flexibleBool(text == "true")
+		return nil
+	}
+	return json.Unmarshal(data, (*bool)(value))
+}
+
+type idTokenClaims struct {
+	Issuer          string       `json:"iss"`
+	Subject         string       `json:"sub"`
+	Audience        audience     `json:"aud"`
+	AuthorizedParty string       `json:"azp"`
+	ExpiresAt       int64        `json:"exp"`
+	IssuedAt        int64        `json:"iat"`
+	Nonce           string       `json:"nonce"`
+	Email           string       `json:"email"`
+	EmailVerified   flexibleBool `json:"email_verified"`
+	AMR             []string     `json:"amr"`
+}
+
+// Valid checks the times of the token, the other claims depending on the provider and the login
+func (claims *idTokenClaims) Valid() error {
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.Add(-clockSkew).Unix() > claims.ExpiresAt {
+		return errors.New("the token expired")
+	}
+	if now.Add(clockSkew).Unix() < claims.IssuedAt {
+		return errors.New("the token was issued in the future")
+	}
+	return nil
+}
+
+// VerifyIDToken checks the signature and the claims of the ID token, and that it was issued for the login
+func (provider *Provider) VerifyIDToken(rawToken string, login Login) (IDToken, error) {
+	document, err := provider.discover()
+	if err != nil {
+		return IDToken{}, err
+	}
+
+	var claims idTokenClaims
+	_, err = jwt.ParseWithClaims(rawToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		if !signingAlgorithms[token.Method.Alg()] {
+			return nil, fmt.Errorf("the signing algorithm %s is not accepted", token.Method.Alg())
+		}
+		keyID, _ := token.Header["kid"].(string)
+		return provider.key(document, keyID)
+	})
+	if err != nil {
+		log.Error("Error verifying the ID token: %s", err)
+		return IDToken{}, ErrInvalidIDToken
+	}
+
+	if claims.Issuer != document.Issuer || len(claims.Subject) == 0 {
+		log.Error("The ID token was issued by %s for the subject %s", claims.Issuer, claims.Subject)
+		return IDToken{}, ErrInvalidIDToken
+	}
+	if !containsAny(claims.Audience, []string{provider.Config.ClientID}) ||
+		(len(claims.Audience) > 1 && claims.AuthorizedParty != provider.Config.ClientID) {
+		log.Error("The ID token was issued for %v", claims.Audience)
+		return IDToken{}, ErrInvalidIDToken
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(login.Nonce)) != 1 {
+		log.Error("The nonce of the ID token doesn't match the login")
+		return IDToken{}, ErrInvalidIDToken
+	}
+
+	return IDToken{
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Groups:        provider.groups(rawToken),
+		MFA:           containsAny(claims.AMR, []string{"mfa"}),
+	}, nil
+}
+
+// groups returns the groups of the verified token, from the configured claim, which can be an array or a single
+// group
+func (provider *Provider) groups(rawToken string) []string {
+	parts := strings.Split(rawToken, ".")
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return nil
+	}
+	var claims map[string]json.RawMessage
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+	claim, found := claims[provider.Config.GroupsClaim]
+	if !found {
+		return nil
+	}
+
+	var groups []string
+	if err = json.Unmarshal(claim, &groups); err != nil {
+		var group string
+		if err = json.Unmarshal(claim, &group); err != nil {
+			log.Error("The %s claim of the ID token is not a list of groups", provider.Config.GroupsClaim)
+			return nil
+		}
+		groups = []string{group}
+	}
+	return groups
+}
+
+// key returns the public key with the id, fetching the keys of the provider again when it is unknown, as the
+// providers rotate their keys
+func (provider *Provider) key(document metadata, keyID string) (interface{}, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	key := findKey(provider.keys, keyID)
+	if key == nil && time.Since(provider.keysFetchedAt) >= keysRefreshInterval {
+		keys, err := provider.fetchKeys(document)
+		if err != nil {
+			return nil, err
+		}
+		provider.keys = keys
+		provider.keysFetchedAt = time.Now()
+		key = findKey(keys, keyID)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("the signing key %s is unknown", keyID)
+	}
+	return key, nil
+}
+
+// findKey returns the key with the id, or the only key for the tokens without a key id
+func findKey(keys map[string]interface{}, keyID string) interface{} {
+	if len(keyID) == 0 && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return keys[keyID]
+}
+
+// jsonWebKey is a public key of the JWKS of the provider
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// fetchKeys returns the signing keys of the provider by their ids, the keys which can't be read being left out
+func (provider *Provider) fetchKeys(document metadata) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := provider.getJSON(document.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, webKey := range set.Keys {
+		if webKey.Use != "" && webKey.Use != "sig" {
+			continue
+		}
+		key, err := webKey.publicKey()
+		if err != nil {
+			log.Error("Error reading the key %s of the identity provider: %s", webKey.KeyID, err)
+			continue
+		}
+		keys[webKey.KeyID] = key
+	}
+	return keys, nil
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("the key is missing a parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (webKey jsonWebKey) publicKey() (interface{}, error) {
+	switch webKey.KeyType {
+	case "RSA":
+		n, err := decodeInt(webKey.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(webKey.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("the RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, found := curves[webKey.Curve]
+		if !found {
+			return nil, fmt.Errorf("the curve %s is not supported", webKey.Curve)
+		}
+		x, err := decodeInt(webKey.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(webKey.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("the key type %s is not supported", webKey.KeyType)
+}
@@ -0,0 +1,324 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+const (
+	// requestTimeout bounds the requests to the identity provider, which are made while the user waits
+	requestTimeout = 10 * time.Second
+	// maxResponseSize bounds the responses of the identity provider read in memory
+	maxResponseSize = 1024 * 1024
+	// randomSize is the size of the states, the nonces and the PKCE verifiers, before their encoding
+	randomSize = 32
+
+	defaultScopes      = "openid email profile"
+	defaultGroupsClaim = "groups"
+)
+
+var (
+	ErrProviderUnavailable = errors.New("the identity provider can't be reached")
+	ErrPKCENotSupported    = errors.New("the identity provider doesn't support PKCE with S256")
+	ErrCodeRejected        = errors.New("the identity provider rejected the authorization code")
+	ErrInvalidIDToken      = errors.New("the ID token is not valid")
+)
+
+// Config is the client registered at the identity provider, with the mapping of its groups to the roles
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the page of the frontend receiving the authorization code
+	RedirectURL string
+	Scopes      []string
+	// GroupsClaim is the claim of the ID token holding the groups of the user
+	GroupsClaim   string
+	AdminGroups   []string
+	AuditorGroups []string
+}
+
+// ConfigFromEnv returns the configuration of the OIDC_* variables, false when OIDC_ISSUER is missing and the
+// single sign-on is disabled
+func ConfigFromEnv() (Config, bool) {
+	config := Config{
+		Issuer:        os.Getenv("OIDC_ISSUER"),
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:        strings.Fields(os.Getenv("OIDC_SCOPES")),
+		GroupsClaim:   os.Getenv("OIDC_GROUPS_CLAIM"),
+		AdminGroups:   splitList(os.Getenv("OIDC_ADMIN_GROUPS")),
+		AuditorGroups: splitList(os.Getenv("OIDC_AUDITOR_GROUPS")),
+	}
+	if len(config.Issuer) == 0 {
+		return config, false
+	}
+	if len(config.ClientID) == 0 || len(config.RedirectURL) == 0 {
+		log.Fatal("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are needed with OIDC_ISSUER")
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = strings.Fields(defaultScopes)
+	}
+	if len(config.GroupsClaim) == 0 {
+		config.GroupsClaim = defaultGroupsClaim
+	}
+	return config, true
+}
+
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// MapsRoles returns true when groups are mapped to the roles, the roles of the users being then set from their
+// groups at every login
+func (config Config) MapsRoles() bool {
+	return len(config.AdminGroups) > 0 || len(config.AuditorGroups) > 0
+}
+
+// Roles returns the roles of the groups
+func (config Config) Roles(groups []string) (bool, bool) {
+	return containsAny(groups, config.AdminGroups), containsAny(groups, config.AuditorGroups)
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, value := range values {
+		for _, wantedValue := range wanted {
+			if value == wantedValue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// metadata is the part of the discovery document of the provider used by the login
+type metadata struct {
+	Issuer                   string   `json:"issuer"`
+	AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	JWKSURI                  string   `json:"jwks_uri"`
+	CodeChallengeMethods     []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Provider logs the users in with the identity provider of the configuration. Its discovery document and its
+// keys are fetched on the first login, so the server starts while the provider is down.
+type Provider struct {
+	Config Config
+	client *http.Client
+
+	mutex         sync.Mutex
+	metadata      *metadata
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+func NewProvider(config Config) *Provider {
+	return &Provider{
+		Config: config,
+		client: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Login is a login started with the provider, kept by the server until the provider redirects the user back
+type Login struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+func randomString() (string, error) {
+	value := make([]byte, randomSize)
+	if _, err := io.ReadFull(rand.Reader, value); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(value), nil
+}
+
+// NewLogin returns the random state, nonce and PKCE verifier of a new login
+func NewLogin() (Login, error) {
+	var login Login
+	var err error
+	if login.State, err = randomString(); err != nil {
+		return login, err
+	}
+	if login.Nonce, err = randomString(); err != nil {
+		return login, err
+	}
+	login.Verifier, err = randomString()
+	return login, err
+}
+
+// codeChallenge returns the S256 challenge of the PKCE verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// getJSON decodes the JSON response of a GET request to the provider
+func (provider *Provider) getJSON(address string, value interface{}) error {
+	response, err := provider.client.Get(address)
+	if err != nil {
+		log.Error("Error requesting %s from the identity provider: %s", address, err)
+		return ErrProviderUnavailable
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		log.Error("The identity provider responded to %s with %d", address, response.StatusCode)
+		return ErrProviderUnavailable
+	}
+	if err = json.NewDecoder(io.LimitReader(response.Body, maxResponseSize)).Decode(value); err != nil {
+		log.Error("Error decoding the response of the identity provider to %s: %s", address, err)
+		return ErrProviderUnavailable
+	}
+	return nil
+}
+
+// discover returns the discovery document of the provider, fetched once
+func (provider *Provider) discover() (metadata, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.metadata != nil {
+		return *provider.metadata, nil
+	}
+
+	var document metadata
+	address := strings.TrimSuffix(provider.Config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := provider.getJSON(address, &document); err != nil {
+		return document, err
+	}
+	// the ID tokens are checked against the issuer, which must be the configured one
+	if document.Issuer != provider.Config.Issuer {
+		log.Error("The identity provider %s announces the issuer %s", provider.Config.Issuer, document.Issuer)
+		return document, ErrProviderUnavailable
+	}
+	if len(document.AuthorizationEndpoint) == 0 || len(document.TokenEndpoint) == 0 || len(document.JWKSURI) == 0 {
+		log.Error("The discovery document of %s is missing endpoints", provider.Config.Issuer)
+		return document, ErrProviderUnavailable
+	}
+	// the providers not listing the challenge methods are trusted to support S256
+	if len(document.CodeChallengeMethods) > 0 && !containsAny(document.CodeChallengeMethods, []string{"S256"}) {
+		return document, ErrPKCENotSupported
+	}
+
+	provider.metadata = &document
+	return document, nil
+}
+
+// AuthCodeURL returns the address of the provider the user is sent to, to log in
+func (provider *Provider) AuthCodeURL(login Login) (string, error) {
+	document, err := provider.discover()
+	if err != nil {
+		return "", err
+	}
+
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", provider.Config.ClientID)
+	values.Set("redirect_uri", provider.Config.RedirectURL)
+	values.Set("scope", strings.Join(provider.Config.Scopes, " "))
+	values.Set("state", login.State)
+	values.Set("nonce", login.Nonce)
+	values.Set("code_challenge", codeChallenge(login.Verifier))
+	values.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(document.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return document.AuthorizationEndpoint + separator + values.Encode(), nil
+}
+
+// tokenResponse is the response of the token endpoint, only the ID token being used
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange sends the authorization code with the PKCE verifier of the login to the provider, and returns the ID
+// token of the user
+func (provider *Provider) Exchange(code string, login Login) (string, error) {
+	document, err := provider.discover()
+	if err != nil {
+		return "", err
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("code", code)
+	values.Set("redirect_uri", provider.Config.RedirectURL)
+	values.Set("code_verifier", login.Verifier)
+	values.Set("client_id", provider.Config.ClientID)
+	// the confidential clients authenticate with the basic authentication, unless the provider only takes the
+	// secret in the form
+	useBasicAuth := len(document.TokenEndpointAuthMethods) == 0 ||
+		containsAny(document.TokenEndpointAuthMethods, []string{"client_secret_basic"})
+	if len(provider.Config.ClientSecret) > 0 && !useBasicAuth {
+		values.Set("client_secret", provider.Config.ClientSecret)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, document.TokenEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		log.Error("Error creating the token request: %s", err)
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if len(provider.Config.ClientSecret) > 0 && useBasicAuth {
+		request.SetBasicAuth(url.QueryEscape(provider.Config.ClientID), url.QueryEscape(provider.Config.ClientSecret))
+	}
+
+	response, err := provider.client.Do(request)
+	if err != nil {
+		log.Error("Error exchanging the authorization code: %s", err)
+		return "", ErrProviderUnavailable
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxResponseSize))
+	if err != nil {
+		log.Error("Error reading the token response: %s", err)
+		return "", ErrProviderUnavailable
+	}
+
+	var tokens tokenResponse
+	err = json.Unmarshal(body, &tokens)
+	if response.StatusCode == http.StatusBadRequest || response.StatusCode == http.StatusUnauthorized {
+		log.Error("The identity provider rejected the authorization code: %s %s", tokens.Error, tokens.ErrorDescription)
+		return "", ErrCodeRejected
+	} else if response.StatusCode != http.StatusOK || err != nil {
+		log.Error("The identity provider responded to the token request with %d: %s", response.StatusCode, err)
+		return "", ErrProviderUnavailable
+	}
+	if len(tokens.IDToken) == 0 {
+		log.Error("The token response has no ID token")
+		return "", ErrInvalidIDToken
+	}
+	return tokens.IDToken, nil
+}
+
+// String describes the provider in the logs
+func (provider *Provider) String() string {
+	return fmt.Sprintf("%s (client %s)", provider.Config.Issuer, provider.Config.ClientID)
+}
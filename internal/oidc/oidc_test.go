@@ -0,0 +1,270 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	testClientID = "dissertation"
+	testKeyID    = "test"
+)
+
+// testProvider is an identity provider for the tests, giving the ID token of a code only for the PKCE verifier
+// of its challenge
+type testProvider struct {
+	server           *httptest.Server
+	key              *rsa.PrivateKey
+	challengeMethods []string
+
+	mutex      sync.Mutex
+	challenges map[string]string
+	idTokens   map[string]string
+}
+
+// newTestProvider starts a provider announcing the challenge methods, returning it with a client of it
+func newTestProvider(t *testing.T, challengeMethods ...string) (*testProvider, *Provider) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{key: key, challengeMethods: challengeMethods, challenges: map[string]string{}, idTokens: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                           p.server.URL,
+			"authorization_endpoint":           p.server.URL + "/authorize",
+			"token_endpoint":                   p.server.URL + "/token",
+			"jwks_uri":                         p.server.URL + "/jwks",
+			"code_challenge_methods_supported": p.challengeMethods,
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": testKeyID,
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", p.handleToken)
+	p.server = httptest.NewServer(mux)
+
+	return p, NewProvider(Config{Issuer: p.server.URL, ClientID: testClientID, RedirectURL: "https://app.example.com/callback",
+		Scopes: []string{"openid", "email"}, GroupsClaim: defaultGroupsClaim})
+}
+
+// handleToken gives the ID token of the code once, for the verifier of the challenge sent with the code
+func (p *testProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	code := r.PostFormValue("code")
+	challenge, found := p.challenges[code]
+	if !found || codeChallenge(r.PostFormValue("code_verifier")) != challenge || r.PostFormValue("client_id") != testClientID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	delete(p.challenges, code)
+	json.NewEncoder(w).Encode(map[string]string{"id_token": p.idTokens[code]})
+}
+
+// authorize logs the user in at the address returned by AuthCodeURL, returning the code of the ID token with the
+// claims and the nonce sent in the address
+func (p *testProvider) authorize(t *testing.T, authURL string, claims jwt.MapClaims) string {
+	address, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := address.Query()
+	claims["nonce"] = query.Get("nonce")
+	code := query.Get("state") + "-code"
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.challenges[code] = query.Get("code_challenge")
+	p.idTokens[code] = p.sign(t, claims)
+	return code
+}
+
+// sign returns the ID token with the claims, signed with the key of the provider
+func (p *testProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = testKeyID
+	rawToken, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rawToken
+}
+
+// claims returns valid claims of an ID token of the provider for the nonce
+func (p *testProvider) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            p.server.URL,
+		"sub":            "subject",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+	}
+}
+
+func TestAuthCodeURLSendsTheStateNonceAndChallenge(t *testing.T) {
+	p, provider := newTestProvider(t, "S256")
+	defer p.server.Close()
+	login, err := NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherLogin, err := NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.State == otherLogin.State || login.Nonce == otherLogin.Nonce || login.Verifier == otherLogin.Verifier {
+		t.Fatal("two logins share their random values")
+	}
+
+	authURL, err := provider.AuthCodeURL(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := address.Query()
+	if query.Get("state") != login.State || query.Get("nonce") != login.Nonce {
+		t.Fatalf("the address %s doesn't carry the state and the nonce of the login", authURL)
+	}
+	// only the challenge leaves the server, the verifier being sent with the code
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") != codeChallenge(login.Verifier) {
+		t.Fatalf("the address %s doesn't carry the S256 challenge of the verifier", authURL)
+	}
+	if query.Get("code_verifier") != "" || query.Get("code_challenge") == login.Verifier {
+		t.Fatalf("the address %s gives the verifier away", authURL)
+	}
+}
+
+func TestDiscoveryNeedsS256(t *testing.T) {
+	p, provider := newTestProvider(t, "plain")
+	defer p.server.Close()
+	login, err := NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.AuthCodeURL(login); err != ErrPKCENotSupported {
+		t.Fatalf("a provider without S256 returned %v, want %v", err, ErrPKCENotSupported)
+	}
+}
+
+func TestExchangeNeedsTheVerifierOfTheLogin(t *testing.T) {
+	p, provider := newTestProvider(t, "S256")
+	defer p.server.Close()
+	login, err := NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := p.authorize(t, authURL, p.claims(""))
+
+	// a stolen code can't be exchanged without the verifier, which stays on the server
+	otherLogin, err := NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.Exchange(code, otherLogin); err != ErrCodeRejected {
+		t.Fatalf("the code with another verifier returned %v, want %v", err, ErrCodeRejected)
+	}
+	rawToken, err := provider.Exchange(code, login)
+	if err != nil {
+		t.Fatalf("the code with its verifier returned %v", err)
+	}
+	idToken, err := provider.VerifyIDToken(rawToken, login)
+	if err != nil {
+		t.Fatalf("the ID token of the login returned %v", err)
+	}
+	if idToken.Subject != "subject" || idToken.Email != "user@example.com" || !idToken.EmailVerified {
+		t.Fatalf("the ID token returned %+v", idToken)
+	}
+	if _, err = provider.Exchange(code, login); err != ErrCodeRejected {
+		t.Fatalf("the code used twice returned %v, want %v", err, ErrCodeRejected)
+	}
+}
+
+func TestVerifyIDTokenChecksTheNonceAndTheClaims(t *testing.T) {
+	p, provider := newTestProvider(t, "S256")
+	defer p.server.Close()
+	login, err := NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = provider.VerifyIDToken(p.sign(t, p.claims(login.Nonce)), login); err != nil {
+		t.Fatalf("a valid ID token returned %v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		change func(claims jwt.MapClaims)
+	}{
+		{"another nonce", func(claims jwt.MapClaims) { claims["nonce"] = "other nonce" }},
+		{"no nonce", func(claims jwt.MapClaims) { delete(claims, "nonce") }},
+		{"another issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://issuer.example.com" }},
+		{"another audience", func(claims jwt.MapClaims) { claims["aud"] = "other client" }},
+		{"several audiences without azp", func(claims jwt.MapClaims) { claims["aud"] = []string{testClientID, "other client"} }},
+		{"no subject", func(claims jwt.MapClaims) { delete(claims, "sub") }},
+		{"an expiry in the past", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"no expiry", func(claims jwt.MapClaims) { delete(claims, "exp") }},
+	} {
+		claims := p.claims(login.Nonce)
+		test.change(claims)
+		if _, err = provider.VerifyIDToken(p.sign(t, claims), login); err != ErrInvalidIDToken {
+			t.Errorf("an ID token with %s returned %v, want %v", test.name, err, ErrInvalidIDToken)
+		}
+	}
+
+	// the tokens must be signed with a key of the provider
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, p.claims(login.Nonce)).SignedString([]byte(testClientID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsignedToken, err := jwt.NewWithClaims(jwt.SigningMethodNone, p.claims(login.Nonce)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyToken := jwt.NewWithClaims(jwt.SigningMethodRS256, p.claims(login.Nonce))
+	otherKeyToken.Header["kid"] = testKeyID
+	otherKeyRawToken, err := otherKeyToken.SignedString(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, rawToken := range map[string]string{"HS256": hmacToken, "none": unsignedToken, "another key": otherKeyRawToken} {
+		if _, err = provider.VerifyIDToken(rawToken, login); err != ErrInvalidIDToken {
+			t.Errorf("an ID token signed with %s returned %v, want %v", name, err, ErrInvalidIDToken)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package search
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/extract"
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+const (
+	// MaxIndexedFileSize is the largest document whose text is extracted, the document being read in memory
+	MaxIndexedFileSize = 50 * 1024 * 1024
+
+	batchSize = 20
+)
+
+// Indexer extracts the text of the stored blobs in the background and indexes it for the search
+type Indexer struct {
+	Database *sql.DB
+	Storage  *storage.Store
+	wake     chan struct{}
+}
+
+func NewIndexer(db *sql.DB, store *storage.Store) *Indexer {
+	return &Indexer{
+		Database: db,
+		Storage:  store,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Notify makes the indexer look for new blobs now instead of waiting for the next interval
+func (indexer *Indexer) Notify() {
+	select {
+	case indexer.wake <- struct{}{}:
+	default:
+		// a run is already pending
+	}
+}
+
+// Run indexes the pending blobs every interval, or when notified, and never returns
+func (indexer *Indexer) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := indexer.IndexPending(); err != nil {
+			log.Error("Error indexing the pending blobs: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-indexer.wake:
+		}
+	}
+}
+
+// IndexPending indexes all the blobs that were not indexed yet, and returns their number
+func (indexer *Indexer) IndexPending() (int, error) {
+	indexed := 0
+	for {
+		pendingBlobs, err := database.GetPendingBlobs(indexer.Database, batchSize)
+		if err != nil {
+			return indexed, err
+		}
+
+		for _, pendingBlob := range pendingBlobs {
+			// a blob whose text can't be extracted is indexed without content, so it is not retried forever
+			text, err := indexer.extractText(pendingBlob)
+			if err != nil {
+				log.Error("Error extracting the text of the blob with ID %d (%s): %s", pendingBlob.ID, pendingBlob.Filename, err)
+			}
+			if err = database.SetBlobContent(indexer.Database, pendingBlob.ID, text); err != nil {
+				return indexed, err
+			}
+			indexed++
+		}
+
+		if len(pendingBlobs) < batchSize {
+			return indexed, nil
+		}
+	}
+}
+
+func (indexer *Indexer) extractText(pendingBlob database.PendingBlob) (string, error) {
+	if pendingBlob.Size > MaxIndexedFileSize {
+		log.Info("The blob with ID %d is too large to be indexed", pendingBlob.ID)
+		return "", nil
+	}
+
+	file, err := indexer.Storage.Open(pendingBlob.StorageKey, pendingBlob.KeyID, pendingBlob.WrappedKey)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// the office documents are zip archives and the pdf parser seeks through the file, both need random access
+	content, err := ioutil.ReadAll(io.LimitReader(file, MaxIndexedFileSize))
+	if err != nil {
+		return "", err
+	}
+
+	text, err := extract.Text(bytes.NewReader(content), int64(len(content)), pendingBlob.Filename)
+	if err == extract.ErrUnsupportedFormat {
+		return "", nil
+	}
+	return text, err
+}
@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+)
+
+const (
+	DefaultRoot = "/home/cosminel/DissertationAppFolders/"
+)
+
+var (
+	ErrFileNotEncrypted  = errors.New("the file is not encrypted")
+	ErrPasswordEncrypted = errors.New("the file is encrypted with its password and can't be re-wrapped")
+	ErrInvalidStorageKey = errors.New("the storage key is not valid")
+
+	storageKeyFormat = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// Store writes the documents on disk encrypted with a per file data key (envelope encryption),
+// the wrapped data key being kept by the caller alongside the file details.
+// The files are stored under opaque generated keys, the names given by the users only live in the database.
+// The same content uploaded several times is stored once, as a blob shared by all the files referencing it.
+type Store struct {
+	Root string
+	Keys encryption.KeyManager
+}
+
+func NewStore(root string, keys encryption.KeyManager) *Store {
+	return &Store{
+		Root: root,
+		Keys: keys,
+	}
+}
+
+// RootFromEnv returns the folder holding the stored files, from the STORAGE_PATH variable
+func RootFromEnv() string {
+	root := os.Getenv("STORAGE_PATH")
+	if len(root) == 0 {
+		root = DefaultRoot
+	}
+	return root
+}
+
+// NewStorageKey returns a random key identifying a file on disk
+func NewStorageKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		log.Error("Error generating a storage key: %s", err)
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// IsStorageKey returns false for the file paths stored before the files were keyed by ids
+func IsStorageKey(key string) bool {
+	return storageKeyFormat.MatchString(key)
+}
+
+// path maps the key to <root>/<first 2 chars>/<next 2 chars>/<key>, so no folder grows too large
+func (store *Store) path(key string) (string, error) {
+	if !IsStorageKey(key) {
+		log.Error("The storage key %s is not valid", key)
+		return "", ErrInvalidStorageKey
+	}
+	return filepath.Join(store.Root, key[0:2], key[2:4], key), nil
+}
+
+// TempBlob is a file written in the temporary folder of the store, waiting to be placed under a storage key
+type TempBlob struct {
+	Path string
+	// Hash is the hex encoded SHA-256 of the plaintext, empty for the files encrypted with their password,
+	// which can't be deduplicated since their data key is only known to the password holders
+	Hash       string
+	Size       int64
+	KeyID      string
+	WrappedKey string
+	KeySalt    string
+}
+
+func (store *Store) tempFolder() string {
+	return filepath.Join(store.Root, "tmp")
+}
+
+// writeEncrypted streams src into a temporary file, encrypted with dataKey, computing the plaintext hash on the way
+func (store *Store) writeEncrypted(src io.Reader, dataKey []byte) (string, string, int64, error) {
+	if err := os.MkdirAll(store.tempFolder(), 0700); err != nil {
+		log.Error("Error creating the temporary folder of the storage: %s", err)
+		return "", "", 0, err
+	}
+
+	tmpFile, err := ioutil.TempFile(store.tempFolder(), "upload-*")
+	if err != nil {
+		log.Error("Error creating a temporary file: %s", err)
+		return "", "", 0, err
+	}
+	tmpPath := tmpFile.Name()
+	defer tmpFile.Close()
+
+	hasher := sha256.New()
+	size, err := func() (int64, error) {
+		encryptingWriter, err := encryption.NewEncryptingWriter(tmpFile, dataKey)
+		if err != nil {
+			return 0, err
+		}
+		size, err := io.Copy(encryptingWriter, io.TeeReader(src, hasher))
+		if err != nil {
+			return 0, err
+		}
+		if err = encryptingWriter.Close(); err != nil {
+			return 0, err
+		}
+		if err = tmpFile.Sync(); err != nil {
+			return 0, err
+		}
+		return size, tmpFile.Close()
+	}()
+	if err != nil {
+		log.Error("Error writing the encrypted content to %s: %s", tmpPath, err)
+		os.Remove(tmpPath)
+		return "", "", 0, err
+	}
+
+	return tmpPath, hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// WriteBlob encrypts the content of src with a new data key into a temporary file. The data key is wrapped with
+// a key derived from password when one is provided, otherwise with the current master key.
+func (store *Store) WriteBlob(src io.Reader, password string) (TempBlob, error) {
+	dataKey, err := encryption.GenerateDataKey()
+	if err != nil {
+		log.Error("Error generating a data key: %s", err)
+		return TempBlob{}, err
+	}
+
+	var blob TempBlob
+	if len(password) > 0 {
+		blob.KeyID = encryption.PasswordKeyID
+		blob.KeySalt, blob.WrappedKey, err = encryption.WrapKeyWithPassword(password, dataKey)
+	} else {
+		blob.KeyID, blob.WrappedKey, err = store.Keys.WrapKey(dataKey)
+	}
+	if err != nil {
+		log.Error("Error wrapping the data key: %s", err)
+		return TempBlob{}, err
+	}
+
+	blob.Path, blob.Hash, blob.Size, err = store.writeEncrypted(src, dataKey)
+	if err != nil {
+		return TempBlob{}, err
+	}
+	if len(password) > 0 {
+		blob.Hash = ""
+	}
+
+	log.Info("Successfully wrote %d encrypted bytes to %s", blob.Size, blob.Path)
+	return blob, nil
+}
+
+// Place moves the temporary blob under its storage key
+func (store *Store) Place(blob TempBlob, key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Error("Error creating the folder for %s: %s", path, err)
+		return err
+	}
+	if err = os.Rename(blob.Path, path); err != nil {
+		log.Error("Error moving the blob %s to %s: %s", blob.Path, path, err)
+		return err
+	}
+	return nil
+}
+
+// Discard removes a temporary blob that wasn't placed, because its content was already stored or the upload failed
+func (store *Store) Discard(blob TempBlob) {
+	err := os.Remove(blob.Path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Error removing the temporary blob %s: %s", blob.Path, err)
+	}
+}
+
+// RemoveStaleTemporaryFiles removes the temporary files of the uploads that were interrupted
+func (store *Store) RemoveStaleTemporaryFiles(olderThan time.Duration) (int, error) {
+	entries, err := ioutil.ReadDir(store.tempFolder())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		log.Error("Error listing the temporary folder of the storage: %s", err)
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || time.Since(entry.ModTime()) < olderThan {
+			continue
+		}
+		if err := os.Remove(filepath.Join(store.tempFolder(), entry.Name())); err != nil {
+			log.Error("Error removing the stale temporary file %s: %s", entry.Name(), err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+type decryptingFile struct {
+	io.Reader
+	file *os.File
+}
+
+func (f *decryptingFile) Close() error {
+	return f.file.Close()
+}
+
+// OpenWithPassword returns a reader with the plaintext of a blob written with a password.
+// It returns encryption.ErrInvalidPassword when the password is wrong.
+func (store *Store) OpenWithPassword(key string, salt string, wrappedKey string, password string) (io.ReadCloser, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := encryption.UnwrapKeyWithPassword(password, salt, wrappedKey)
+	if err != nil {
+		log.Error("Error unwrapping the data key of %s with the file password: %s", path, err)
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Error("Error opening the file %s: %s", path, err)
+		return nil, err
+	}
+
+	decryptingReader, err := encryption.NewDecryptingReader(file, dataKey)
+	if err != nil {
+		log.Error("Error initialising the decryption for %s: %s", path, err)
+		file.Close()
+		return nil, err
+	}
+	return &decryptingFile{Reader: decryptingReader, file: file}, nil
+}
+
+// Reencrypt encrypts the content of a blob written with a password again, with a new data key, into a temporary file.
+// The data key is wrapped with a key derived from newPassword, or with the current master key when it is empty.
+// It returns encryption.ErrInvalidPassword when oldPassword is wrong.
+func (store *Store) Reencrypt(key string, salt string, wrappedKey string, oldPassword string, newPassword string) (TempBlob, error) {
+	plaintext, err := store.OpenWithPassword(key, salt, wrappedKey, oldPassword)
+	if err != nil {
+		return TempBlob{}, err
+	}
+	defer plaintext.Close()
+	return store.WriteBlob(plaintext, newPassword)
+}
+
+// Open returns a reader with the plaintext of the file stored under key.
+// Files written before the encryption at rest was enabled have no key id and are read as they are.
+func (store *Store) Open(key string, keyID string, wrappedKey string) (io.ReadCloser, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Error("Error opening the file %s: %s", path, err)
+		return nil, err
+	}
+	if len(keyID) == 0 {
+		return file, nil
+	}
+	if keyID == encryption.PasswordKeyID {
+		file.Close()
+		return nil, encryption.ErrInvalidPassword
+	}
+
+	dataKey, err := store.Keys.UnwrapKey(keyID, wrappedKey)
+	if err != nil {
+		log.Error("Error unwrapping the data key of %s with the master key %s: %s", path, keyID, err)
+		file.Close()
+		return nil, err
+	}
+
+	decryptingReader, err := encryption.NewDecryptingReader(file, dataKey)
+	if err != nil {
+		log.Error("Error initialising the decryption for %s: %s", path, err)
+		file.Close()
+		return nil, err
+	}
+	return &decryptingFile{Reader: decryptingReader, file: file}, nil
+}
+
+// Rewrap unwraps the data key and wraps it again with the current master key, without touching the content
+func (store *Store) Rewrap(keyID string, wrappedKey string) (string, string, error) {
+	if len(keyID) == 0 {
+		return "", "", ErrFileNotEncrypted
+	}
+	if keyID == encryption.PasswordKeyID {
+		return "", "", ErrPasswordEncrypted
+	}
+	dataKey, err := store.Keys.UnwrapKey(keyID, wrappedKey)
+	if err != nil {
+		log.Error("Error unwrapping the data key with the master key %s: %s", keyID, err)
+		return "", "", err
+	}
+	return store.Keys.WrapKey(dataKey)
+}
+
+// Encrypt encrypts a file that was stored in plaintext before the encryption at rest under a new storage key.
+// The commit function records the new key with the key wrapping the data key. The plaintext is only removed once
+// the commit succeeded, otherwise the encrypted copy is removed and the plaintext stays in use.
+func (store *Store) Encrypt(key string, commit func(newKey string, keyID string, wrappedKey string) error) (string, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Error("Error opening the file %s: %s", path, err)
+		return "", err
+	}
+	blob, err := store.WriteBlob(file, "")
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	newKey, err := NewStorageKey()
+	if err != nil {
+		store.Discard(blob)
+		return "", err
+	}
+	if err = store.Place(blob, newKey); err != nil {
+		store.Discard(blob)
+		return "", err
+	}
+	if err = commit(newKey, blob.KeyID, blob.WrappedKey); err != nil {
+		store.Remove(newKey)
+		return "", err
+	}
+
+	// the plaintext is no longer referenced, a failure only leaves it behind
+	store.Remove(key)
+	return newKey, nil
+}
+
+// Import moves a file stored at a path built from user supplied names under a new storage key.
+// The commit function records the key, if it fails the file is moved back to its previous path.
+func (store *Store) Import(oldPath string, commit func(key string) error) (string, error) {
+	key, err := NewStorageKey()
+	if err != nil {
+		return "", err
+	}
+	path, err := store.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Error("Error creating the folder for %s: %s", path, err)
+		return "", err
+	}
+	if err = os.Rename(oldPath, path); err != nil {
+		log.Error("Error moving the file %s to %s: %s", oldPath, path, err)
+		return "", err
+	}
+
+	if err = commit(key); err != nil {
+		if renameErr := os.Rename(path, oldPath); renameErr != nil {
+			log.Error("Error moving the file %s back to %s: %s", path, oldPath, renameErr)
+		}
+		return "", err
+	}
+	return key, nil
+}
+
+func (store *Store) Remove(key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		log.Error("Error removing the file %s: %s", path, err)
+	}
+	return err
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+)
+
+// newTestStore returns a store in a temporary folder, removed by the returned function
+func newTestStore(t *testing.T) (*Store, func()) {
+	root, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := encryption.NewStaticKeyManager("test", map[string][]byte{"test": bytes.Repeat([]byte{7}, 32)})
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return NewStore(root, keys), func() { os.RemoveAll(root) }
+}
+
+// writeTestBlob stores the content under a new storage key, the way a file version is stored
+func writeTestBlob(t *testing.T, store *Store, content []byte, password string) (string, TempBlob) {
+	blob, err := store.WriteBlob(bytes.NewReader(content), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewStorageKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Place(blob, key); err != nil {
+		t.Fatal(err)
+	}
+	return key, blob
+}
+
+func TestReencryptWithNewPassword(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	content := bytes.Repeat([]byte("previous version "), 10000)
+	key, blob := writeTestBlob(t, store, content, "old password")
+
+	reencrypted, err := store.Reencrypt(key, blob.KeySalt, blob.WrappedKey, "old password", "new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := NewStorageKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Place(reencrypted, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if reencrypted.KeyID != encryption.PasswordKeyID || len(reencrypted.Hash) > 0 {
+		t.Fatalf("the re-encrypted blob has the key id %q and the hash %q, want a password encrypted blob", reencrypted.KeyID, reencrypted.Hash)
+	}
+
+	_, err = store.OpenWithPassword(newKey, reencrypted.KeySalt, reencrypted.WrappedKey, "old password")
+	if err != encryption.ErrInvalidPassword {
+		t.Fatalf("opening with the old password returned %v, want %v", err, encryption.ErrInvalidPassword)
+	}
+
+	file, err := store.OpenWithPassword(newKey, reencrypted.KeySalt, reencrypted.WrappedKey, "new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	plaintext, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, content) {
+		t.Fatalf("read %d bytes with the new password, want the %d bytes written", len(plaintext), len(content))
+	}
+}
+
+func TestReencryptWithoutPassword(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	content := []byte("previous version")
+	key, blob := writeTestBlob(t, store, content, "old password")
+
+	if _, err := store.Reencrypt(key, blob.KeySalt, blob.WrappedKey, "wrong password", ""); err != encryption.ErrInvalidPassword {
+		t.Fatalf("re-encrypting with a wrong password returned %v, want %v", err, encryption.ErrInvalidPassword)
+	}
+
+	reencrypted, err := store.Reencrypt(key, blob.KeySalt, blob.WrappedKey, "old password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := NewStorageKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Place(reencrypted, newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := store.Open(newKey, reencrypted.KeyID, reencrypted.WrappedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	plaintext, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, content) {
+		t.Fatalf("read %q with the master key, want %q", plaintext, content)
+	}
+}
+
+// writePlaintext stores the content the way the files were stored before the encryption at rest
+func writePlaintext(t *testing.T, store *Store, content []byte) string {
+	key, err := NewStorageKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := store.path(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptKeepsThePlaintextUntilCommitted(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	content := []byte("stored before the encryption at rest")
+	key := writePlaintext(t, store, content)
+
+	var failedKey string
+	_, err := store.Encrypt(key, func(newKey string, keyID string, wrappedKey string) error {
+		failedKey = newKey
+		return errors.New("commit failed")
+	})
+	if err == nil {
+		t.Fatal("encrypting with a failing commit returned no error")
+	}
+	if failedKey == key {
+		t.Fatalf("the encrypted copy was written under the key %s of the plaintext", key)
+	}
+	if _, err = store.Open(failedKey, "", ""); !os.IsNotExist(err) {
+		t.Fatalf("opening the copy of the failed commit returned %v, want a missing file", err)
+	}
+	path, err := store.path(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(plaintext, content) {
+		t.Fatalf("read %q, %v after the failed commit, want the plaintext %q", plaintext, err, content)
+	}
+
+	var committedKeyID, committedWrappedKey string
+	newKey, err := store.Encrypt(key, func(newKey string, keyID string, wrappedKey string) error {
+		committedKeyID, committedWrappedKey = keyID, wrappedKey
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the plaintext is still stored after the commit: %v", err)
+	}
+
+	file, err := store.Open(newKey, committedKeyID, committedWrappedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decrypted, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, content) {
+		t.Fatalf("read %q from the encrypted copy, want %q", decrypted, content)
+	}
+}
@@ -9,6 +9,8 @@ type Email struct {
 type LoginCredentials struct {
 	Email    string `form:"email"`
 	Password string `form:"password"`
+	// Code is the current code of the authenticator app, required when the two factor authentication is enabled
+	Code     string `form:"code"`
 }
 
 type LoginResponse struct {
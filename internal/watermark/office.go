@@ -0,0 +1,163 @@
+package watermark
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+)
+
+const (
+	contentTypesPart     = "[Content_Types].xml"
+	packageRelationships = "_rels/.rels"
+	customPropertiesPart = "docProps/custom.xml"
+
+	// maxRewrittenPartSize caps the parts read in memory to be changed
+	maxRewrittenPartSize = 16 * 1024 * 1024
+
+	customPropertiesContentType = "application/vnd.openxmlformats-officedocument.custom-properties+xml"
+	customPropertiesRelType     = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/custom-properties"
+	customPropertyFormatID      = "{D5CDD505-2E9C-101B-9397-08002B2CF9AE}"
+	watermarkPropertyName       = "Watermark"
+)
+
+var (
+	customPropertyID       = regexp.MustCompile(`pid="(\d+)"`)
+	watermarkPropertyValue = regexp.MustCompile(`(<property[^>]*name="` + watermarkPropertyName + `"[^>]*>\s*<vt:lpwstr>)[^<]*(</vt:lpwstr>)`)
+)
+
+// stampOffice copies the package, adding the watermark as a custom document property. The package gets the
+// custom properties part, with its content type and relationship, when it doesn't have one.
+func stampOffice(w io.Writer, r io.ReaderAt, size int64, text string) error {
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return ErrUnsupportedFormat
+	}
+
+	var escapedText bytes.Buffer
+	if err = xml.EscapeText(&escapedText, []byte(text)); err != nil {
+		return err
+	}
+
+	hasCustomProperties := false
+	for _, file := range reader.File {
+		if file.Name == customPropertiesPart {
+			hasCustomProperties = true
+		}
+	}
+
+	writer := zip.NewWriter(w)
+	for _, file := range reader.File {
+		var rewrite func([]byte) []byte
+		switch {
+		case file.Name == customPropertiesPart:
+			rewrite = func(part []byte) []byte { return addWatermarkProperty(part, escapedText.String()) }
+		case file.Name == contentTypesPart && !hasCustomProperties:
+			rewrite = addCustomPropertiesContentType
+		case file.Name == packageRelationships && !hasCustomProperties:
+			rewrite = addCustomPropertiesRelationship
+		}
+		if err = copyPart(writer, file, rewrite); err != nil {
+			return err
+		}
+	}
+
+	if !hasCustomProperties {
+		part, err := writer.Create(customPropertiesPart)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(part, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+"\n"+
+			`<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/custom-properties" `+
+			`xmlns:vt="http://schemas.openxmlformats.org/officeDocument/2006/docPropsVTypes">%s</Properties>`,
+			watermarkProperty(2, escapedText.String()))
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// copyPart copies the part to the new package, changing its content first when rewrite is set
+func copyPart(writer *zip.Writer, file *zip.File, rewrite func([]byte) []byte) error {
+	part, err := writer.CreateHeader(&zip.FileHeader{
+		Name:     file.Name,
+		Method:   file.Method,
+		Modified: file.Modified,
+	})
+	if err != nil {
+		return err
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if rewrite == nil {
+		_, err = io.Copy(part, src)
+		return err
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(src, maxRewrittenPartSize+1))
+	if err != nil {
+		return err
+	}
+	if len(content) > maxRewrittenPartSize {
+		return ErrUnsupportedFormat
+	}
+	_, err = part.Write(rewrite(content))
+	return err
+}
+
+func watermarkProperty(pid int, escapedText string) string {
+	return fmt.Sprintf(`<property fmtid="%s" pid="%d" name="%s"><vt:lpwstr>%s</vt:lpwstr></property>`,
+		customPropertyFormatID, pid, watermarkPropertyName, escapedText)
+}
+
+// addWatermarkProperty replaces the watermark of an already watermarked document, or adds a property after
+// the existing ones, with the next free pid
+func addWatermarkProperty(part []byte, escapedText string) []byte {
+	if watermarkPropertyValue.Match(part) {
+		return watermarkPropertyValue.ReplaceAll(part, []byte("${1}"+escapeReplacement(escapedText)+"${2}"))
+	}
+
+	pid := 2
+	for _, match := range customPropertyID.FindAllSubmatch(part, -1) {
+		if value, err := strconv.Atoi(string(match[1])); err == nil && value >= pid {
+			pid = value + 1
+		}
+	}
+	return insertBefore(part, "</Properties>", watermarkProperty(pid, escapedText))
+}
+
+func addCustomPropertiesContentType(part []byte) []byte {
+	return insertBefore(part, "</Types>",
+		`<Override PartName="/`+customPropertiesPart+`" ContentType="`+customPropertiesContentType+`"/>`)
+}
+
+func addCustomPropertiesRelationship(part []byte) []byte {
+	return insertBefore(part, "</Relationships>",
+		`<Relationship Id="rIdWatermark" Type="`+customPropertiesRelType+`" Target="`+customPropertiesPart+`"/>`)
+}
+
+// insertBefore inserts the element before the closing tag of the root element
+func insertBefore(part []byte, closingTag string, element string) []byte {
+	index := bytes.LastIndex(part, []byte(closingTag))
+	if index < 0 {
+		return part
+	}
+	result := make([]byte, 0, len(part)+len(element))
+	result = append(result, part[:index]...)
+	result = append(result, element...)
+	return append(result, part[index:]...)
+}
+
+// escapeReplacement escapes the $ signs of a regexp replacement
+func escapeReplacement(text string) string {
+	return string(bytes.Replace([]byte(text), []byte("$"), []byte("$$"), -1))
+}
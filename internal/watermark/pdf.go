@@ -0,0 +1,146 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
+)
+
+const (
+	// pdfTailSize is read from the end of the document to find the startxref keyword
+	pdfTailSize = 2048
+	// pdfMaxXrefSize caps what is read to find the trailer after the last cross-reference section
+	pdfMaxXrefSize = 8 * 1024 * 1024
+)
+
+var (
+	pdfStartXref = regexp.MustCompile(`startxref\s+(\d+)`)
+	pdfSize      = regexp.MustCompile(`/Size\s+(\d+)`)
+	pdfRoot      = regexp.MustCompile(`/Root\s+(\d+\s+\d+\s+R)`)
+	pdfID        = regexp.MustCompile(`/ID\s*\[([^\]]*)\]`)
+)
+
+// stampPDF appends an incremental update to the document, with a new document information dictionary holding
+// the watermark. The original bytes are left untouched, the update replaces the previous information dictionary.
+func stampPDF(w io.Writer, r io.ReaderAt, size int64, text string) error {
+	trailer, prevXref, err := readPDFTrailer(r, size)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(trailer, []byte("/Encrypt")) {
+		// the strings of an encrypted document must be encrypted too
+		return ErrUnsupportedFormat
+	}
+
+	sizeMatch := pdfSize.FindSubmatch(trailer)
+	rootMatch := pdfRoot.FindSubmatch(trailer)
+	if sizeMatch == nil || rootMatch == nil {
+		return ErrUnsupportedFormat
+	}
+	infoObject, err := strconv.ParseInt(string(sizeMatch[1]), 10, 64)
+	if err != nil {
+		return ErrUnsupportedFormat
+	}
+
+	if _, err = io.Copy(w, io.NewSectionReader(r, 0, size)); err != nil {
+		return err
+	}
+
+	var update bytes.Buffer
+	update.WriteString("\n")
+	infoOffset := size + int64(update.Len())
+	fmt.Fprintf(&update, "%d 0 obj\n<< /Watermark %s >>\nendobj\n", infoObject, pdfTextString(text))
+
+	xrefOffset := size + int64(update.Len())
+	fmt.Fprintf(&update, "xref\n%d 1\n%010d 00000 n \n", infoObject, infoOffset)
+	fmt.Fprintf(&update, "trailer\n<< /Size %d /Root %s /Info %d 0 R /Prev %d", infoObject+1, rootMatch[1], infoObject, prevXref)
+	if idMatch := pdfID.FindSubmatch(trailer); idMatch != nil {
+		fmt.Fprintf(&update, " /ID [%s]", idMatch[1])
+	}
+	fmt.Fprintf(&update, " >>\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+
+	_, err = w.Write(update.Bytes())
+	return err
+}
+
+// readPDFTrailer returns the dictionary of the last trailer, or of the last cross-reference stream,
+// and the offset of the last cross-reference section
+func readPDFTrailer(r io.ReaderAt, size int64) ([]byte, int64, error) {
+	tailSize := int64(pdfTailSize)
+	if size < tailSize {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := r.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	matches := pdfStartXref.FindAllSubmatch(tail, -1)
+	if len(matches) == 0 {
+		return nil, 0, ErrUnsupportedFormat
+	}
+	prevXref, err := strconv.ParseInt(string(matches[len(matches)-1][1]), 10, 64)
+	if err != nil || prevXref >= size {
+		return nil, 0, ErrUnsupportedFormat
+	}
+
+	sectionSize := size - prevXref
+	if sectionSize > pdfMaxXrefSize {
+		sectionSize = pdfMaxXrefSize
+	}
+	section := make([]byte, sectionSize)
+	if _, err = r.ReadAt(section, prevXref); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	// a classic cross-reference table is followed by the trailer, a cross-reference stream has the trailer entries
+	// in the dictionary of the stream
+	start := 0
+	if bytes.HasPrefix(section, []byte("xref")) {
+		start = bytes.Index(section, []byte("trailer"))
+		if start < 0 {
+			return nil, 0, ErrUnsupportedFormat
+		}
+	}
+	dictionary := pdfDictionary(section[start:])
+	if dictionary == nil {
+		return nil, 0, ErrUnsupportedFormat
+	}
+	return dictionary, prevXref, nil
+}
+
+// pdfDictionary returns the first dictionary of the data, with the nested dictionaries
+func pdfDictionary(data []byte) []byte {
+	start := bytes.Index(data, []byte("<<"))
+	if start < 0 {
+		return nil
+	}
+	depth := 0
+	for index := start; index < len(data)-1; index++ {
+		switch {
+		case data[index] == '<' && data[index+1] == '<':
+			depth++
+			index++
+		case data[index] == '>' && data[index+1] == '>':
+			depth--
+			index++
+			if depth == 0 {
+				return data[start : index+1]
+			}
+		}
+	}
+	return nil
+}
+
+// pdfTextString encodes the text as a UTF-16 hex string, which needs no escaping
+func pdfTextString(text string) string {
+	encoded := []byte{0xFE, 0xFF}
+	for _, unit := range utf16.Encode([]rune(text)) {
+		encoded = append(encoded, byte(unit>>8), byte(unit))
+	}
+	return "<" + hex.EncodeToString(encoded) + ">"
+}
@@ -0,0 +1,34 @@
+package watermark
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("the file format can't be watermarked")
+)
+
+// Stamp writes a copy of the document carrying the watermark text in its document properties, so every copy
+// can be traced back to the download it came from. The format is picked from the extension of the name,
+// the PDF and the office open XML documents being supported.
+func Stamp(w io.Writer, r io.ReaderAt, size int64, filename string, text string) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".pdf":
+		return stampPDF(w, r, size, text)
+	case ".docx", ".xlsx", ".pptx":
+		return stampOffice(w, r, size, text)
+	}
+	return ErrUnsupportedFormat
+}
+
+// Supported returns true if the documents with this name can be watermarked
+func Supported(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".pdf", ".docx", ".xlsx", ".pptx":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// apiTokenKey holds the API token of the request in the context, when it was authenticated with one
+	apiTokenKey = "apiToken"
+	// defaultAPITokenLifetime is the expiry of the tokens created without one
+	defaultAPITokenLifetime = 30 * 24 * time.Hour
+)
+
+var (
+	apiTokenCantManageTokens = "the API tokens can't manage the API tokens or the two factor authentication, a login is needed"
+	apiTokenScopeMissing     = "the API token doesn't have the scope needed for this request"
+	apiTokenUserNotActivated = "the account of the API token is not activated"
+)
+
+// apiTokenReadMethods are the methods allowed with the read scope, the other ones needing the write scope
+var apiTokenReadMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// NewAPIToken is the body of the requests creating an API token, a nil ExpiresAt expiring it in 30 days
+type NewAPIToken struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// generateAPITokenSecret returns a random secret, prefixed so the API tokens are told apart from the JWTs
+func generateAPITokenSecret() (string, error) {
+	secret := make([]byte, shareTokenSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", err
+	}
+	return database.APITokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// isAPITokenSecret returns the secret of an Authorization header holding an API token, with or without the
+// Bearer scheme
+func isAPITokenSecret(header string) (string, bool) {
+	secret := strings.TrimPrefix(header, "Bearer ")
+	return secret, strings.HasPrefix(secret, database.APITokenPrefix)
+}
+
+// getAPITokenClaims returns the claims of the user of the API token, or why it can't be used. The tokens don't
+// carry the second factor, so the items whose label requires it can't be reached with them.
+func (s *Service) getAPITokenClaims(c *gin.Context, secret string) (*auth.AuthCustomClaims, string) {
+	token, user, err := database.GetAPITokenForSecret(s.Database, secret)
+	if err != nil && (err.Error() == database.API_TOKEN_NOT_FOUND || err.Error() == database.API_TOKEN_EXPIRED) {
+		log.Error("Error authenticating a request with an API token: %s", err)
+		return nil, err.Error()
+	} else if err != nil {
+		return nil, http.StatusText(http.StatusInternalServerError)
+	} else if !user.IsActivated {
+		return nil, apiTokenUserNotActivated
+	}
+
+	c.Set(apiTokenKey, token)
+	return &auth.AuthCustomClaims{Id: user.ID, Email: user.Email, IsActivated: true}, ""
+}
+
+// getRequestAPIToken returns the API token the request was authenticated with, false for the JWTs
+func getRequestAPIToken(c *gin.Context) (database.APIToken, bool) {
+	value, exists := c.Get(apiTokenKey)
+	if !exists {
+		return database.APIToken{}, false
+	}
+	return value.(database.APIToken), true
+}
+
+// verifyAPITokenScope responds with 403 and returns false when the request was authenticated with an API token
+// without the scope
+func verifyAPITokenScope(c *gin.Context, scope string) bool {
+	token, isAPIToken := getRequestAPIToken(c)
+	if isAPIToken && !token.HasScope(scope) {
+		log.Error("The API token %d doesn't have the %s scope for %s %s", token.ID, scope, c.Request.Method, c.Request.URL.Path)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": apiTokenScopeMissing,
+		})
+		return false
+	}
+	return true
+}
+
+// verifyAPITokenMethodScope checks the API token of the request has the scope of its method
+func verifyAPITokenMethodScope(c *gin.Context) bool {
+	if apiTokenReadMethods[c.Request.Method] {
+		return verifyAPITokenScope(c, database.APITokenRead)
+	}
+	return verifyAPITokenScope(c, database.APITokenWrite)
+}
+
+// verifyLoginSession responds with 403 and returns false when the request was authenticated with an API token,
+// so a leaked token can't be used to create more of them or to change the login of the account
+func verifyLoginSession(c *gin.Context) bool {
+	if _, isAPIToken := getRequestAPIToken(c); isAPIToken {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": apiTokenCantManageTokens,
+		})
+		return false
+	}
+	return true
+}
+
+// respondAPITokenError returns true, after responding, if the error is caused by the API token
+func respondAPITokenError(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.Error() {
+	case database.API_TOKEN_NOT_FOUND:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case database.API_TOKEN_NAME_IS_EMPTY, database.INVALID_API_TOKEN_SCOPE, database.API_TOKEN_EXPIRY_NOT_VALID:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
+
+// HandlePostAPIToken creates an API token for the user. Its secret is only in this response, the database
+// keeping its hash.
+func (s *Service) HandlePostAPIToken(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !verifyLoginSession(c) {
+		return
+	}
+
+	var newToken NewAPIToken
+	err = c.BindJSON(&newToken)
+	if err != nil {
+		log.Error("Error %s binding the JSON of the new API token", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	token := database.APIToken{
+		UserID:    claims.Id,
+		Name:      newToken.Name,
+		Scopes:    newToken.Scopes,
+		ExpiresAt: time.Now().Add(defaultAPITokenLifetime),
+	}
+	if newToken.ExpiresAt != nil {
+		token.ExpiresAt = *newToken.ExpiresAt
+	}
+
+	secret, err := generateAPITokenSecret()
+	if err != nil {
+		log.Error("Error generating the secret of the API token: %s", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	tokenID, err := database.AddAPIToken(s.Database, token, secret)
+	if respondAPITokenError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	token, err = database.GetAPIToken(s.Database, tokenID, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	setAuditTarget(c, tokenID)
+	log.Info("The user %d created the API token %d", claims.Id, tokenID)
+	c.JSON(http.StatusOK, gin.H{
+		"token":  token,
+		"secret": secret,
+	})
+}
+
+// HandleGetAPITokens returns the API tokens of the user, without their secrets
+func (s *Service) HandleGetAPITokens(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !verifyLoginSession(c) {
+		return
+	}
+
+	tokens, err := database.GetAPITokens(s.Database, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tokens": tokens,
+	})
+}
+
+// HandleRemoveAPIToken revokes an API token of the user, the requests using it being refused from then on
+func (s *Service) HandleRemoveAPIToken(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !verifyLoginSession(c) {
+		return
+	}
+
+	tokenID, err := getIntParameterFromRequest(c, "token_id")
+	if err != nil {
+		return
+	}
+
+	err = database.RevokeAPIToken(s.Database, tokenID, claims.Id)
+	if respondAPITokenError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("The user %d revoked the API token %d", claims.Id, tokenID)
+	c.Status(http.StatusOK)
+}
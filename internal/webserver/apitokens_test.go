@@ -0,0 +1,121 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/gin-gonic/gin"
+)
+
+// addAPIToken creates an API token with the scopes through the route, returning its id and its secret
+func (s *testService) addAPIToken(t *testing.T, token string, scopes ...string) (int64, string) {
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := s.serve(http.MethodPost, "/tokens", token, strings.NewReader(fmt.Sprintf(`{"name": "script", "scopes": %s}`, scopesJSON)))
+	expectStatus(t, response, http.StatusOK, "creating an API token")
+	var created struct {
+		Token  database.APIToken `json:"token"`
+		Secret string            `json:"secret"`
+	}
+	if err = json.Unmarshal(response.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created.Token.ID, created.Secret
+}
+
+func TestAPITokenMethodScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, test := range []struct {
+		method  string
+		scopes  []string
+		allowed bool
+	}{
+		{http.MethodGet, []string{database.APITokenRead}, true},
+		{"PROPFIND", []string{database.APITokenRead}, true},
+		{http.MethodPost, []string{database.APITokenRead}, false},
+		{http.MethodDelete, []string{database.APITokenRead}, false},
+		{"MOVE", []string{database.APITokenRead}, false},
+		{http.MethodPut, []string{database.APITokenWrite}, true},
+		{http.MethodGet, []string{database.APITokenWrite}, true},
+		{http.MethodDelete, []string{database.APITokenAdmin}, true},
+	} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(test.method, "/user", nil)
+		c.Set(apiTokenKey, database.APIToken{ID: 1, Scopes: test.scopes})
+		if allowed := verifyAPITokenMethodScope(c); allowed != test.allowed {
+			t.Errorf("%s with the scopes %v was allowed %v, want %v", test.method, test.scopes, allowed, test.allowed)
+		} else if !allowed && recorder.Code != http.StatusForbidden {
+			t.Errorf("%s with the scopes %v got %d, want %d", test.method, test.scopes, recorder.Code, http.StatusForbidden)
+		}
+	}
+
+	// the requests authenticated with a JWT have no scope to check
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodDelete, "/user", nil)
+	if !verifyAPITokenMethodScope(c) {
+		t.Fatal("a request without an API token was refused")
+	}
+}
+
+func TestVerifyLoginSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if !verifyLoginSession(c) {
+		t.Fatal("a request without an API token was refused")
+	}
+
+	recorder := httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(recorder)
+	c.Set(apiTokenKey, database.APIToken{ID: 1, Scopes: []string{database.APITokenAdmin}})
+	if verifyLoginSession(c) {
+		t.Fatal("a request with an admin API token was allowed")
+	}
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("a request with an API token got %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+}
+
+func TestAPITokensCantManageTheLogin(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	_, token := s.addUser(t, "owner@example.com")
+	readTokenID, readSecret := s.addAPIToken(t, token, database.APITokenRead)
+	_, adminSecret := s.addAPIToken(t, token, database.APITokenAdmin)
+
+	for _, secret := range []string{readSecret, "Bearer " + readSecret} {
+		response := s.serve(http.MethodGet, "/user", secret, nil)
+		expectStatus(t, response, http.StatusOK, "reading with a read API token")
+	}
+	response := s.serve(http.MethodPost, "/new_folder", readSecret, strings.NewReader(`{"name": "scripts"}`))
+	expectStatus(t, response, http.StatusForbidden, "writing with a read API token")
+	response = s.serve(http.MethodPost, "/new_folder", adminSecret, strings.NewReader(`{"name": "scripts"}`))
+	expectStatus(t, response, http.StatusOK, "writing with an admin API token")
+
+	// not even an admin token creates tokens or changes the second factor
+	for _, request := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/tokens"},
+		{http.MethodGet, "/tokens"},
+		{http.MethodDelete, "/tokens/" + itoa(readTokenID)},
+		{http.MethodPost, "/mfa/setup"},
+		{http.MethodPost, "/mfa/disable"},
+	} {
+		response = s.serve(request.method, request.path, adminSecret, strings.NewReader(`{"name": "more", "scopes": ["admin"]}`))
+		expectStatus(t, response, http.StatusForbidden, request.method+" "+request.path+" with an API token")
+	}
+
+	response = s.serve(http.MethodDelete, "/tokens/"+itoa(readTokenID), token, nil)
+	expectStatus(t, response, http.StatusOK, "revoking an API token")
+	response = s.serve(http.MethodGet, "/user", readSecret, nil)
+	expectStatus(t, response, http.StatusUnauthorized, "reading with a revoked API token")
+}
@@ -0,0 +1,332 @@
+package webserver
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxArchiveSelection caps the number of files selected for an archive
+	maxArchiveSelection = 1000
+	// archiveManifestName is the entry written after the files, listing them with their checksums
+	archiveManifestName = "manifest.json"
+	// selectionArchiveName is the name of the archives of a selection of files
+	selectionArchiveName = "files"
+)
+
+// the reasons the files are left out of an archive
+var (
+	tooManyArchiveFiles     = "an archive can't select more than 1000 files"
+	emptyArchiveSelection   = "the archive needs at least one file"
+	archiveFileNotFound     = "the file doesn't exist"
+	archiveFileLocked       = "the file is locked with a password, an unlock grant for it is needed"
+	archiveSubfolderLocked  = "the subfolder of the file is locked with a password, an unlock grant for it is needed"
+	archiveFileEncrypted    = "the file is encrypted with its password and can only be downloaded on its own"
+	archiveFileNotReadable  = "the file could not be read"
+	archiveLabelCheckFailed = "Error retrieving the sensitivity label"
+)
+
+// ArchiveSelection is the body of the requests for an archive of files picked by their ids
+type ArchiveSelection struct {
+	Files []int64 `json:"files"`
+}
+
+// ArchiveManifest is the manifest.json entry of the archives
+type ArchiveManifest struct {
+	CreatedAt time.Time             `json:"createdAt"`
+	CreatedBy string                `json:"createdBy"`
+	Files     []ArchiveManifestFile `json:"files"`
+	Skipped   []ArchiveSkippedFile  `json:"skipped"`
+}
+
+// ArchiveManifestFile is a file of the archive, with the SHA-256 of its content as written in the archive
+type ArchiveManifestFile struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArchiveSkippedFile is a file left out of the archive, with the reason
+type ArchiveSkippedFile struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// archiveEntry is a file allowed in the archive, with the label deciding if it is watermarked
+type archiveEntry struct {
+	file  database.FileEntry
+	label database.LabelRules
+}
+
+// HandleGetFolderArchive streams a ZIP archive of a workspace
+func (s *Service) HandleGetFolderArchive(c *gin.Context) {
+	s.handleNodeArchive(c, func() (database.Node, bool) {
+		return s.getFolderNodeFromRequest(c, false)
+	})
+}
+
+// HandleGetSubfolderArchive streams a ZIP archive of a subfolder
+func (s *Service) HandleGetSubfolderArchive(c *gin.Context) {
+	s.handleNodeArchive(c, func() (database.Node, bool) {
+		return s.getFolderNodeFromRequest(c, true)
+	})
+}
+
+// HandleGetNodeArchive streams a ZIP archive of a folder of the tree
+func (s *Service) HandleGetNodeArchive(c *gin.Context) {
+	s.handleNodeArchive(c, func() (database.Node, bool) {
+		return s.getNode(c)
+	})
+}
+
+// handleNodeArchive streams a ZIP archive of the files of the node returned by getNode and of its descendants,
+// each one under the folders it is in
+func (s *Service) handleNodeArchive(c *gin.Context, getNode func() (database.Node, bool)) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	node, ok := getNode()
+	if !ok {
+		return
+	}
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: node.FolderID, SubfolderID: node.SubfolderID}, labelActionRead, false)
+	if !allowed {
+		return
+	}
+
+	files, err := database.GetNodeArchiveFiles(s.Database, node)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	s.sendArchive(c, claims, node.Name, files, nil)
+}
+
+// HandlePostArchive streams a ZIP archive of the files selected by their ids, the files missing or left out being
+// listed in the manifest
+func (s *Service) HandlePostArchive(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var selection ArchiveSelection
+	err = c.BindJSON(&selection)
+	if err != nil {
+		log.Error("Error %s binding the JSON of the archive request", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if len(selection.Files) == 0 || len(selection.Files) > maxArchiveSelection {
+		errorMessage := emptyArchiveSelection
+		if len(selection.Files) > 0 {
+			errorMessage = tooManyArchiveFiles
+		}
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	files, err := database.GetSelectedArchiveFiles(s.Database, selection.Files)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	found := map[int64]bool{}
+	for _, file := range files {
+		found[file.ID] = true
+	}
+	var skipped []ArchiveSkippedFile
+	for _, fileID := range selection.Files {
+		if !found[fileID] {
+			// the missing file is only reported once
+			found[fileID] = true
+			skipped = append(skipped, ArchiveSkippedFile{ID: fileID, Reason: archiveFileNotFound})
+		}
+	}
+	s.sendArchive(c, claims, selectionArchiveName, files, skipped)
+}
+
+// checkArchiveFile returns why the file is left out of the archive, or its label when it can be written. The locked
+// files and subfolders need the unlock grants of the user, and the rules of the labels must allow the download.
+func (s *Service) checkArchiveFile(claims *auth.AuthCustomClaims, file database.FileEntry, unlockedFiles map[int64]bool,
+	unlockedSubfolders map[int64]bool) (database.LabelRules, string, error) {
+	switch {
+	case file.SubfolderLocked && !unlockedSubfolders[file.SubfolderID]:
+		return database.LabelRules{}, archiveSubfolderLocked, nil
+	case file.FileLocked && !unlockedFiles[file.ID]:
+		return database.LabelRules{}, archiveFileLocked, nil
+	case file.Blob.KeyID == encryption.PasswordKeyID:
+		return database.LabelRules{}, archiveFileEncrypted, nil
+	}
+
+	target := labelTarget{FolderID: file.FolderID, SubfolderID: file.SubfolderID, FileID: file.ID}
+	label, denial, err := s.checkLabelRules(claims, target, labelActionDownload, false)
+	if err != nil {
+		return label, "", err
+	} else if denial != nil {
+		return label, denial.message, nil
+	}
+	return label, "", nil
+}
+
+// sendArchive checks the files, then streams the archive of the allowed ones followed by its manifest. The archive
+// is written straight to the response, in ZIP64 when it gets too large for the ZIP records, so once the first
+// file is sent the errors can only cut the archive short.
+func (s *Service) sendArchive(c *gin.Context, claims *auth.AuthCustomClaims, name string, files []database.FileEntry,
+	skipped []ArchiveSkippedFile) {
+	unlockedFileIDs, unlockedSubfolderIDs := getUnlockedIDs(c, claims.Id)
+	unlockedFiles := map[int64]bool{}
+	for _, fileID := range unlockedFileIDs {
+		unlockedFiles[fileID] = true
+	}
+	unlockedSubfolders := map[int64]bool{}
+	for _, subfolderID := range unlockedSubfolderIDs {
+		unlockedSubfolders[subfolderID] = true
+	}
+
+	var entries []archiveEntry
+	for _, file := range files {
+		label, reason, err := s.checkArchiveFile(claims, file, unlockedFiles, unlockedSubfolders)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": archiveLabelCheckFailed,
+			})
+			return
+		}
+		if len(reason) != 0 {
+			skipped = append(skipped, ArchiveSkippedFile{ID: file.ID, Name: file.Path, Reason: reason})
+			continue
+		}
+		entries = append(entries, archiveEntry{file: file, label: label})
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	manifest := ArchiveManifest{
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: claims.Email,
+		Files:     []ArchiveManifestFile{},
+		Skipped:   skipped,
+	}
+	if manifest.Skipped == nil {
+		manifest.Skipped = []ArchiveSkippedFile{}
+	}
+	archive := zip.NewWriter(c.Writer)
+	for _, entry := range entries {
+		manifestFile, reason, err := s.writeArchiveEntry(archive, claims, entry)
+		if err != nil {
+			log.Error("Error writing the file %d to the archive %s, the archive is cut short: %s", entry.file.ID, name, err)
+			return
+		}
+		if len(reason) != 0 {
+			manifest.Skipped = append(manifest.Skipped, ArchiveSkippedFile{ID: entry.file.ID, Name: entry.file.Path, Reason: reason})
+			continue
+		}
+		manifest.Files = append(manifest.Files, manifestFile)
+	}
+
+	manifestWriter, err := archive.CreateHeader(&zip.FileHeader{Name: archiveManifestName, Method: zip.Deflate, Modified: manifest.CreatedAt})
+	if err == nil {
+		encoder := json.NewEncoder(manifestWriter)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(manifest)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		log.Error("Error writing the manifest of the archive %s, the archive is cut short: %s", name, err)
+		return
+	}
+
+	// each file gets its own download event, so its access log shows it was downloaded in the archive
+	for _, manifestFile := range manifest.Files {
+		err = database.RecordAuditEvent(s.Database, database.AuditEvent{
+			ActorID:    claims.Id,
+			Action:     database.AuditDownload,
+			TargetType: database.AuditTargetFile,
+			TargetID:   manifestFile.ID,
+			IP:         c.ClientIP(),
+			UserAgent:  c.Request.UserAgent(),
+			Result:     database.AuditSuccess,
+		})
+		if err != nil {
+			log.Error("Error recording the download of the file %d in an archive: %s", manifestFile.ID, err)
+		}
+		s.notifyFileWatchers(claims.Id, claims.Email, manifestFile.ID, manifestFile.Name, database.AuditDownload)
+	}
+	log.Info("Successfully sent the archive %s with %d files, leaving out %d, to the user %d", name, len(manifest.Files),
+		len(manifest.Skipped), claims.Id)
+}
+
+// writeArchiveEntry writes the file to the archive, stamped with a watermark when its label requires one. The files
+// that can't be opened or stamped are left out before their entry is started, returning the reason.
+func (s *Service) writeArchiveEntry(archive *zip.Writer, claims *auth.AuthCustomClaims, entry archiveEntry) (ArchiveManifestFile, string, error) {
+	manifestFile := ArchiveManifestFile{ID: entry.file.ID, Name: entry.file.Path}
+	file, err := s.Storage.Open(entry.file.Blob.StorageKey, entry.file.Blob.KeyID, entry.file.Blob.WrappedKey)
+	if err != nil {
+		log.Error("Error opening the file %d for an archive: %s", entry.file.ID, err)
+		return manifestFile, archiveFileNotReadable, nil
+	}
+	defer file.Close()
+
+	var content io.Reader = file
+	if entry.label.Watermark {
+		stamped, err := stampWatermark(claims.Email, entry.file.Filename, file)
+		if err == errWatermarkRead {
+			return manifestFile, archiveFileNotReadable, nil
+		} else if err != nil {
+			return manifestFile, labelRequiresWatermark, nil
+		}
+		content = stamped
+	}
+
+	entryWriter, err := archive.CreateHeader(&zip.FileHeader{Name: entry.file.Path, Method: zip.Deflate, Modified: entry.file.ModifiedAt})
+	if err != nil {
+		return manifestFile, "", err
+	}
+	checksum := sha256.New()
+	manifestFile.Size, err = io.Copy(io.MultiWriter(entryWriter, checksum), content)
+	if err != nil {
+		return manifestFile, "", err
+	}
+	manifestFile.SHA256 = hex.EncodeToString(checksum.Sum(nil))
+	return manifestFile, "", nil
+}
@@ -0,0 +1,405 @@
+package webserver
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+// the context keys set by the handlers when the actor or the target of the audit event is not in the request
+const (
+	auditActorKey      = "auditActor"
+	auditTargetKey     = "auditTarget"
+	auditTargetTypeKey = "auditTargetType"
+	auditActionKey     = "auditAction"
+)
+
+// setAuditActor records the user performing the action, for the requests made without a JWT
+func setAuditActor(c *gin.Context, userID int64) {
+	c.Set(auditActorKey, userID)
+}
+
+// setAuditTarget records the target of the action, for the items created by the request
+func setAuditTarget(c *gin.Context, targetID int64) {
+	c.Set(auditTargetKey, targetID)
+}
+
+// setAuditAction replaces the action and the target of the route, for the routes serving several kinds of items
+func setAuditAction(c *gin.Context, action string, targetType string, targetID int64) {
+	c.Set(auditActionKey, action)
+	c.Set(auditTargetTypeKey, targetType)
+	c.Set(auditTargetKey, targetID)
+}
+
+// auditResult classifies the response status of the audited request
+func auditResult(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return database.AuditSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return database.AuditDenied
+	default:
+		return database.AuditFailure
+	}
+}
+
+// Audit records the action in the audit log once the request is handled. The target id is read from the
+// targetParam parameter of the route, unless the handler sets it, and the actor from the JWT claims.
+func (s *Service) Audit(action string, targetType string, targetParam string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		event := database.AuditEvent{
+			Action:     action,
+			TargetType: targetType,
+			IP:         c.ClientIP(),
+			UserAgent:  c.Request.UserAgent(),
+			Result:     auditResult(c.Writer.Status()),
+		}
+		if actorID, exists := c.Get(auditActorKey); exists {
+			event.ActorID = actorID.(int64)
+		} else if claims, exists := c.Get("claims"); exists {
+			// the claims are only set when the JWT was valid
+			event.ActorID = claims.(*auth.AuthCustomClaims).Id
+		}
+		if overriddenAction, exists := c.Get(auditActionKey); exists {
+			event.Action = overriddenAction.(string)
+			event.TargetType = c.GetString(auditTargetTypeKey)
+		}
+		if targetID, exists := c.Get(auditTargetKey); exists {
+			event.TargetID = targetID.(int64)
+		} else if len(targetParam) != 0 {
+			// the response is already sent, a parameter that is not a valid id is recorded as an unknown target
+			event.TargetID, _ = strconv.ParseInt(c.Param(targetParam), 10, 64)
+		} else if targetType == database.AuditTargetUser {
+			event.TargetID = event.ActorID
+		}
+
+		err := database.RecordAuditEvent(s.Database, event)
+		if err != nil {
+			log.Error("Error recording the audit event %s on the %s %d: %s", event.Action, event.TargetType, event.TargetID, err)
+		}
+	}
+}
+
+// the formats the audit log can be exported to
+const (
+	auditExportCSV   = "csv"
+	auditExportJSONL = "jsonl"
+)
+
+var auditCSVHeader = []string{"id", "createdAt", "actorId", "action", "targetType", "targetId", "ip", "userAgent", "result", "prevHash", "hash"}
+
+type AuditorRole struct {
+	Auditor bool `json:"auditor"`
+}
+
+// verifyAuditor returns true if the user can read the audit log, otherwise it responds with 403
+func (s *Service) verifyAuditor(c *gin.Context, claims *auth.AuthCustomClaims) bool {
+	isAuditor, err := database.UserIsAuditor(s.Database, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return false
+	}
+	if !isAuditor {
+		log.Error("The user %d tried to read the audit log", claims.Id)
+		c.Status(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// getAuditFilter reads the actor, target_type, target_id, action, result, from and to query parameters,
+// the time range being given in RFC 3339
+func getAuditFilter(c *gin.Context) (database.AuditFilter, error) {
+	filter := database.AuditFilter{
+		TargetType: c.Query("target_type"),
+		Action:     c.Query("action"),
+		Result:     c.Query("result"),
+	}
+	var err error
+	invalidFilter := errors.New(database.INVALID_AUDIT_FILTER)
+	if rawActor := c.Query("actor"); len(rawActor) > 0 {
+		if filter.ActorID, err = strconv.ParseInt(rawActor, 10, 64); err != nil {
+			return filter, invalidFilter
+		}
+	}
+	if rawTarget := c.Query("target_id"); len(rawTarget) > 0 {
+		if filter.TargetID, err = strconv.ParseInt(rawTarget, 10, 64); err != nil {
+			return filter, invalidFilter
+		}
+	}
+	if rawFrom := c.Query("from"); len(rawFrom) > 0 {
+		if filter.From, err = time.Parse(time.RFC3339, rawFrom); err != nil {
+			return filter, invalidFilter
+		}
+	}
+	if rawTo := c.Query("to"); len(rawTo) > 0 {
+		if filter.To, err = time.Parse(time.RFC3339, rawTo); err != nil {
+			return filter, invalidFilter
+		}
+	}
+	return filter, nil
+}
+
+// getAuditPageRequest reads the page request, the newest events coming first by default
+func getAuditPageRequest(c *gin.Context) (database.PageRequest, error) {
+	page, err := getPageRequest(c)
+	if len(page.Order) == 0 {
+		page.Order = "desc"
+	}
+	return page, err
+}
+
+// HandleGetAudit returns a page of the audit log, or exports every matching event when the format is csv or jsonl.
+// Only the admins and the auditors can read it.
+func (s *Service) HandleGetAudit(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !s.verifyAuditor(c, claims) {
+		return
+	}
+
+	filter, err := getAuditFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	format := c.Query("format")
+	switch format {
+	case auditExportCSV, auditExportJSONL:
+		s.exportAudit(c, claims, filter, format)
+		return
+	case "":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "the format must be csv or jsonl",
+		})
+		return
+	}
+
+	page, err := getAuditPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+	events, pageInfo, err := database.QueryAuditEvents(s.Database, filter, page)
+	if respondPaginationError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("The user %d read %d audit events", claims.Id, len(events))
+	c.JSON(http.StatusOK, gin.H{
+		"events":     events,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
+	})
+}
+
+// exportAudit streams the events as they are read. Once the first row is sent the status can't change anymore,
+// so an error only stops the export.
+func (s *Service) exportAudit(c *gin.Context, claims *auth.AuthCustomClaims, filter database.AuditFilter, format string) {
+	c.Header("Content-Disposition", "attachment; filename=audit."+format)
+	if format == auditExportCSV {
+		c.Header("Content-Type", "text/csv")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+
+	var export func(database.AuditEvent) error
+	var flush func() error
+	if format == auditExportCSV {
+		writer := csv.NewWriter(c.Writer)
+		if err := writer.Write(auditCSVHeader); err != nil {
+			return
+		}
+		export = func(event database.AuditEvent) error {
+			return writer.Write([]string{
+				strconv.FormatInt(event.ID, 10),
+				event.CreatedAt.Format(time.RFC3339Nano),
+				strconv.FormatInt(event.ActorID, 10),
+				event.Action,
+				event.TargetType,
+				strconv.FormatInt(event.TargetID, 10),
+				event.IP,
+				event.UserAgent,
+				event.Result,
+				event.PrevHash,
+				event.Hash,
+			})
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	} else {
+		encoder := json.NewEncoder(c.Writer)
+		export = func(event database.AuditEvent) error {
+			return encoder.Encode(event)
+		}
+		flush = func() error { return nil }
+	}
+
+	exported := 0
+	err := database.ExportAuditEvents(s.Database, filter, func(event database.AuditEvent) error {
+		if err := export(event); err != nil {
+			return err
+		}
+		exported++
+		// the rows are flushed regularly, so the export doesn't wait for the whole log
+		if exported%500 == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		log.Error("Error exporting the audit log for the user %d: %s", claims.Id, err)
+		return
+	}
+	log.Info("The user %d exported %d audit events as %s", claims.Id, exported, format)
+}
+
+// HandlePostAuditor grants or revokes the auditor role, only the admins can change it
+func (s *Service) HandlePostAuditor(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !s.verifyAdmin(c, claims) {
+		return
+	}
+
+	userID, err := getIntParameterFromRequest(c, "user_id")
+	if err != nil {
+		return
+	}
+	var role AuditorRole
+	err = c.BindJSON(&role)
+	if err != nil {
+		log.Error("Error %s binding the JSON for HandlePostAuditor request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	err = database.SetUserAuditor(s.Database, userID, role.Auditor)
+	if err == sql.ErrNoRows {
+		c.Status(http.StatusNotFound)
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("The admin %d set the auditor role of the user %d to %t", claims.Id, userID, role.Auditor)
+	c.JSON(http.StatusOK, gin.H{
+		"auditor": role.Auditor,
+	})
+}
+
+// HandleGetFileActivity returns a page of the audit events of a file, only its owner can read them
+func (s *Service) HandleGetFileActivity(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	fileID, ok := s.getOwnedFileID(c, claims.Id)
+	if !ok {
+		return
+	}
+
+	page, err := getAuditPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+	filter := database.AuditFilter{TargetType: database.AuditTargetFile, TargetID: fileID}
+	events, pageInfo, err := database.QueryAuditEvents(s.Database, filter, page)
+	if respondPaginationError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully retrieved the activity of the file %d for the user %d", fileID, claims.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"events":     events,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
+	})
+}
+
+// HandleGetVerifyAudit verifies the hash chain of the audit log, only the admins and the auditors can verify it
+func (s *Service) HandleGetVerifyAudit(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !s.verifyAuditor(c, claims) {
+		return
+	}
+
+	verification, err := database.VerifyAuditChain(s.Database)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("The user %d verified %d audit events, the chain is valid: %t", claims.Id, verification.Events, verification.Valid)
+	c.JSON(http.StatusOK, verification)
+}
@@ -0,0 +1,221 @@
+package webserver
+
+import (
+	"net/http"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchItems caps the number of items of a batch
+const maxBatchItems = 1000
+
+var tooManyBatchItems = "a batch can't have more than 1000 items"
+
+// BatchRequest is the body of the batch requests: the operation, the files and subfolders it applies to, and its
+// target, tags or password. With atomic set, either every item is changed or none is.
+type BatchRequest struct {
+	Operation  string     `json:"operation"`
+	Files      []int64    `json:"files"`
+	Subfolders []int64    `json:"subfolders"`
+	Target     MoveTarget `json:"target"`
+	AddTags    []string   `json:"addTags"`
+	RemoveTags []string   `json:"removeTags"`
+	Password   string     `json:"password"`
+	Atomic     bool       `json:"atomic"`
+}
+
+// BatchItemResult is the outcome of the batch for one of its items, with the status its own request would get
+type BatchItemResult struct {
+	Type   string `json:"type"`
+	ID     int64  `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchErrorStatus returns the status of the result of an item failing with the error
+func batchErrorStatus(err error) int {
+	if database.IsQuotaExceeded(err) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if status := nodeErrorStatus(err); status != 0 {
+		return status
+	}
+	switch err.Error() {
+	case database.BATCH_ITEM_NOT_FOUND:
+		return http.StatusNotFound
+	case database.BATCH_ITEM_NOT_OWNED, database.METADATA_ITEMS_NOT_OWNED:
+		return http.StatusForbidden
+	case database.ITEM_ALREADY_LOCKED:
+		return http.StatusConflict
+	case database.BATCH_ITEM_NOT_APPLIED:
+		return http.StatusFailedDependency
+	}
+	return http.StatusInternalServerError
+}
+
+// checkBatchItem checks the user can apply the operation to the item, returning the refused result otherwise.
+// Like their own requests, the moves need an item readable where it is, and must be allowed by the label of the
+// target like the uploads of the item.
+func (s *Service) checkBatchItem(c *gin.Context, claims *auth.AuthCustomClaims, operation database.BatchOperation,
+	item database.BatchItem, found bool) *BatchItemResult {
+	if !found {
+		return &BatchItemResult{Status: http.StatusNotFound, Error: database.BATCH_ITEM_NOT_FOUND}
+	}
+	if item.OwnerID != claims.Id {
+		log.Error("The user %d can't change the item %d of the user %d in a batch", claims.Id, item.ID, item.OwnerID)
+		return &BatchItemResult{Status: http.StatusForbidden, Error: database.BATCH_ITEM_NOT_OWNED}
+	}
+	if operation.Operation != database.BatchMove {
+		return nil
+	}
+
+	source := labelTarget{FolderID: item.FolderID, SubfolderID: item.SubfolderID}
+	if !item.IsSubfolder {
+		source.FileID = item.ID
+	}
+	denial, err := s.checkSourceRules(c, claims, source)
+	if err != nil {
+		return &BatchItemResult{Status: http.StatusInternalServerError, Error: http.StatusText(http.StatusInternalServerError)}
+	} else if denial != nil {
+		return &BatchItemResult{Status: denial.status, Error: denial.message}
+	}
+
+	target := labelTarget{FolderID: operation.Target.FolderID, SubfolderID: operation.Target.SubfolderID}
+	_, denial, err = s.checkLabelRules(claims, target, labelActionUpload, item.Locked)
+	if err != nil {
+		return &BatchItemResult{Status: http.StatusInternalServerError, Error: http.StatusText(http.StatusInternalServerError)}
+	} else if denial != nil {
+		return &BatchItemResult{Status: denial.status, Error: denial.message}
+	}
+	return nil
+}
+
+// HandlePostBatch applies an operation to several files and subfolders of the user: delete, move to the target,
+// tag or lock with a password. Every item is checked, and the response holds the result of each of them.
+func (s *Service) HandlePostBatch(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var batchRequest BatchRequest
+	err = c.BindJSON(&batchRequest)
+	if err != nil {
+		log.Error("Error %s binding the JSON of the batch request", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if len(batchRequest.Files)+len(batchRequest.Subfolders) > maxBatchItems {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": tooManyBatchItems,
+		})
+		return
+	}
+
+	operation := database.BatchOperation{
+		Operation:  batchRequest.Operation,
+		AddTags:    batchRequest.AddTags,
+		RemoveTags: batchRequest.RemoveTags,
+		Password:   batchRequest.Password,
+	}
+	err = database.PrepareBatchOperation(&operation)
+	if respondMetadataError(c, err) {
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if operation.Operation == database.BatchMove {
+		var ok bool
+		operation.Target, ok = s.getTargetNode(c, batchRequest.Target)
+		if !ok {
+			return
+		}
+	}
+
+	files, subfolders, err := database.GetBatchItems(s.Database, batchRequest.Files, batchRequest.Subfolders)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	// the files come first, so the files of a deleted subfolder are deleted before it. The repeated ids are
+	// only applied once
+	var results []BatchItemResult
+	var items []database.BatchItem
+	var itemResults []int
+	allowed := true
+	for _, batchItems := range []struct {
+		itemType string
+		ids      []int64
+		found    map[int64]database.BatchItem
+	}{{"file", batchRequest.Files, files}, {"subfolder", batchRequest.Subfolders, subfolders}} {
+		seen := map[int64]bool{}
+		for _, id := range batchItems.ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			item, found := batchItems.found[id]
+			result := BatchItemResult{Type: batchItems.itemType, ID: id, Status: http.StatusOK}
+			if refused := s.checkBatchItem(c, claims, operation, item, found); refused != nil {
+				result.Status, result.Error = refused.Status, refused.Error
+				allowed = false
+			} else {
+				items = append(items, item)
+				itemResults = append(itemResults, len(results))
+			}
+			results = append(results, result)
+		}
+	}
+
+	if batchRequest.Atomic && !allowed {
+		for _, i := range itemResults {
+			results[i].Status, results[i].Error = http.StatusFailedDependency, database.BATCH_ITEM_NOT_APPLIED
+		}
+		c.JSON(http.StatusOK, gin.H{"results": results, "applied": 0})
+		return
+	}
+
+	itemErrors, err := database.ApplyBatch(s.Database, claims.Id, operation, items, batchRequest.Atomic)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	var applied int
+	for i, itemErr := range itemErrors {
+		result := &results[itemResults[i]]
+		if itemErr == nil {
+			applied++
+			continue
+		}
+		result.Status = batchErrorStatus(itemErr)
+		result.Error = itemErr.Error()
+		if result.Status == http.StatusInternalServerError {
+			result.Error = http.StatusText(http.StatusInternalServerError)
+		}
+	}
+
+	log.Info("Successfully applied the %s batch to %d of its %d items", operation.Operation, applied, len(results))
+	if operation.Operation == database.BatchDelete {
+		setAuditAction(c, database.AuditDelete, database.AuditTargetFile, 0)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+		"applied": applied,
+	})
+}
@@ -0,0 +1,75 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+)
+
+// batchResults returns the status of every item of the batch response, by id
+func batchResults(t *testing.T, body string) map[int64]int {
+	var response struct {
+		Results []BatchItemResult `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[int64]int{}
+	for _, result := range response.Results {
+		statuses[result.ID] = result.Status
+	}
+	return statuses
+}
+
+func TestBatchMoveChecksOwnerSourceAndLabels(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, token := s.addUser(t, "owner@example.com")
+	otherUserID, _ := s.addUser(t, "other@example.com")
+	folderID, subfolderID := s.addSubfolder(t, ownerID, "reports", "")
+	lockedFolderID, lockedSubfolderID := s.addSubfolder(t, ownerID, "locked", "subfolder password")
+	confidentialFolderID, confidentialSubfolderID := s.addSubfolder(t, ownerID, "confidential", "")
+	restrictedFolderID, restrictedSubfolderID := s.addSubfolder(t, ownerID, "restricted", "")
+	targetFolderID, targetSubfolderID := s.addSubfolder(t, ownerID, "target", "")
+	s.setLabel(t, database.LabelSubfolder, confidentialSubfolderID, "confidential")
+	s.setLabel(t, database.LabelSubfolder, restrictedSubfolderID, "restricted")
+
+	fileID := s.addFile(t, ownerID, folderID, subfolderID, "report.pdf", "%PDF-1.4", "")
+	otherFileID := s.addFile(t, otherUserID, folderID, subfolderID, "other.pdf", "%PDF-1.4", "")
+	inLockedFileID := s.addFile(t, ownerID, lockedFolderID, lockedSubfolderID, "locked.pdf", "%PDF-1.4", "")
+	confidentialFileID := s.addFile(t, ownerID, confidentialFolderID, confidentialSubfolderID, "confidential.pdf", "%PDF-1.4", "")
+	restrictedFileID := s.addFile(t, ownerID, restrictedFolderID, restrictedSubfolderID, "restricted.pdf", "%PDF-1.4", "file password")
+
+	body := fmt.Sprintf(`{"operation": "move", "files": [%d, %d, %d, %d, %d], "target": {"folderId": %d, "subfolderId": %d}}`,
+		fileID, otherFileID, inLockedFileID, confidentialFileID, restrictedFileID, targetFolderID, targetSubfolderID)
+	response := s.serve(http.MethodPost, "/batch", token, strings.NewReader(body))
+	expectStatus(t, response, http.StatusOK, "moving a batch of files")
+
+	expected := map[int64]int{
+		fileID:             http.StatusOK,
+		otherFileID:        http.StatusForbidden,
+		inLockedFileID:     http.StatusUnauthorized,
+		confidentialFileID: http.StatusForbidden,
+		restrictedFileID:   http.StatusForbidden,
+	}
+	statuses := batchResults(t, response.Body.String())
+	for id, status := range expected {
+		if statuses[id] != status {
+			t.Errorf("the file %d of the batch got %d, want %d", id, statuses[id], status)
+		}
+	}
+
+	// the grant of the locked subfolder lets its file go
+	body = fmt.Sprintf(`{"operation": "move", "files": [%d], "target": {"folderId": %d, "subfolderId": %d}}`,
+		inLockedFileID, targetFolderID, targetSubfolderID)
+	response = s.serve(http.MethodPost, "/batch", token, strings.NewReader(body),
+		unlockGrantsHeader, subfolderGrant(t, ownerID, lockedSubfolderID))
+	expectStatus(t, response, http.StatusOK, "moving a batch with an unlock grant")
+	if status := batchResults(t, response.Body.String())[inLockedFileID]; status != http.StatusOK {
+		t.Fatalf("the file of the unlocked subfolder got %d", status)
+	}
+}
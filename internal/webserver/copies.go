@@ -0,0 +1,229 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+// copyInlineFiles is the number of files up to which a folder is copied before responding, the larger trees
+// being copied in the background
+const copyInlineFiles = 50
+
+// CopyRequest is the body of the copy requests, the target being given like for the moves
+type CopyRequest struct {
+	MoveTarget
+	Name             string `json:"name"`
+	IncludePasswords bool   `json:"includePasswords"`
+	IncludeTags      bool   `json:"includeTags"`
+	IncludeVersions  bool   `json:"includeVersions"`
+	Conflict         string `json:"conflict"`
+}
+
+func (copyRequest CopyRequest) options() database.CopyOptions {
+	return database.CopyOptions{
+		Name:             copyRequest.Name,
+		IncludePasswords: copyRequest.IncludePasswords,
+		IncludeTags:      copyRequest.IncludeTags,
+		IncludeVersions:  copyRequest.IncludeVersions,
+		Conflict:         copyRequest.Conflict,
+	}
+}
+
+// getCopyRequest reads the copy request and its target from the body of the request
+func (s *Service) getCopyRequest(c *gin.Context) (CopyRequest, database.Node, bool) {
+	var copyRequest CopyRequest
+	err := c.BindJSON(&copyRequest)
+	if err != nil {
+		log.Error("Error %s binding the JSON of the copy request", err)
+		c.Status(http.StatusBadRequest)
+		return copyRequest, database.Node{}, false
+	}
+	target, ok := s.getTargetNode(c, copyRequest.MoveTarget)
+	return copyRequest, target, ok
+}
+
+// HandlePostCopyFile copies a file to a folder, only its owner can copy it. The file must be readable where it is,
+// unlocked when the copy doesn't keep its password, and the label of the target must allow the copy to be uploaded
+// there.
+func (s *Service) HandlePostCopyFile(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	fileID, fileDetails, ok := s.getOwnedFile(c, claims.Id)
+	if !ok {
+		return
+	}
+	copyRequest, target, ok := s.getCopyRequest(c)
+	if !ok {
+		return
+	}
+	source := fileSource(c, fileID)
+	if !s.enforceSourceRules(c, claims, source) {
+		return
+	}
+	if !copyRequest.IncludePasswords && !s.verifyFileUnlocked(c, claims, fileID, source.FolderID, source.SubfolderID, fileDetails) {
+		return
+	}
+
+	// the content encrypted with the password of the file can't be copied without it
+	copyLocked := fileDetails.FileLocked && (copyRequest.IncludePasswords || len(fileDetails.KeySalt) > 0)
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: target.FolderID, SubfolderID: target.SubfolderID}, labelActionUpload, copyLocked)
+	if !allowed {
+		return
+	}
+
+	copyID, filename, err := database.CopyFile(s.Database, fileID, claims.Id, target, copyRequest.options())
+	if respondNodeError(c, err) || respondQuotaExceeded(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully copied the file %d to the file %d", fileID, copyID)
+	setAuditTarget(c, copyID)
+	c.JSON(http.StatusCreated, gin.H{
+		"fileId":      copyID,
+		"filename":    filename,
+		"folderId":    target.FolderID,
+		"subfolderId": target.SubfolderID,
+		"nodeId":      target.ID,
+	})
+}
+
+// HandlePostCopySubfolder copies a subfolder with everything below it to a workspace
+func (s *Service) HandlePostCopySubfolder(c *gin.Context) {
+	s.handleCopyNode(c, func() (database.Node, bool) {
+		return s.getFolderNodeFromRequest(c, true)
+	})
+}
+
+// HandlePostCopyNode copies a folder of the tree with everything below it under another one
+func (s *Service) HandlePostCopyNode(c *gin.Context) {
+	s.handleCopyNode(c, func() (database.Node, bool) {
+		return s.getNode(c)
+	})
+}
+
+// handleCopyNode copies the node returned by getNode, only its owner can copy it, and it must be readable where it
+// is. The small trees are copied before responding with 201, the larger ones in the background, responding with
+// 202 and the job to poll.
+func (s *Service) handleCopyNode(c *gin.Context, getNode func() (database.Node, bool)) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	node, ok := getNode()
+	if !ok || !verifyNodeOwner(c, claims, node) {
+		return
+	}
+	copyRequest, target, ok := s.getCopyRequest(c)
+	if !ok {
+		return
+	}
+	if !s.enforceSourceRules(c, claims, labelTarget{FolderID: node.FolderID, SubfolderID: node.SubfolderID}) {
+		return
+	}
+
+	var copyLocked bool
+	if node.Depth == 1 && copyRequest.IncludePasswords {
+		subfolderDetails, err := database.GetAllSubfolderDetailsForID(s.Database, node.SubfolderID, node.FolderID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		copyLocked = subfolderDetails.IsLocked
+	}
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: target.FolderID, SubfolderID: target.SubfolderID}, labelActionUpload, copyLocked)
+	if !allowed {
+		return
+	}
+
+	options := copyRequest.options()
+	job, err := database.AddCopyJob(s.Database, claims.Id, node, target, options)
+	if respondNodeError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if job.TotalFiles > copyInlineFiles {
+		log.Info("Copying the node %d under the node %d in the job %d", node.ID, target.ID, job.ID)
+		go database.RunCopyJob(s.Database, job, node, target, options)
+		c.Header("Location", fmt.Sprintf("/copy-jobs/%d", job.ID))
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+
+	job, err = database.RunCopyJob(s.Database, job, node, target, options)
+	if respondNodeError(c, err) || respondQuotaExceeded(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully copied the node %d under the node %d", node.ID, target.ID)
+	setAuditAction(c, database.AuditCreate, database.AuditTargetNode, job.ResultNodeID)
+	c.JSON(http.StatusCreated, job)
+}
+
+// HandleGetCopyJob returns the progress of a copy job of the user
+func (s *Service) HandleGetCopyJob(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	jobID, err := getIntParameterFromRequest(c, "job_id")
+	if err != nil {
+		return
+	}
+
+	job, err := database.GetCopyJob(s.Database, jobID)
+	if respondNodeError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if job.OwnerID != claims.Id {
+		log.Error("The user %d can't read the copy job %d of the user %d", claims.Id, job.ID, job.OwnerID)
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
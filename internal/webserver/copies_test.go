@@ -0,0 +1,104 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+)
+
+// copyBody is the JSON body of a copy to the subfolder with the conflict policy
+func copyBody(folderID int64, subfolderID int64, conflict string) *strings.Reader {
+	return strings.NewReader(fmt.Sprintf(`{"folderId": %d, "subfolderId": %d, "conflict": %q}`, folderID, subfolderID, conflict))
+}
+
+func TestCopyFileNeedsAnUnlockedSource(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, token := s.addUser(t, "owner@example.com")
+	lockedFolderID, lockedSubfolderID := s.addSubfolder(t, ownerID, "locked", "subfolder password")
+	folderID, subfolderID := s.addSubfolder(t, ownerID, "reports", "")
+	targetFolderID, targetSubfolderID := s.addSubfolder(t, ownerID, "target", "")
+	inLockedFileID := s.addFile(t, ownerID, lockedFolderID, lockedSubfolderID, "report.pdf", "%PDF-1.4", "")
+	lockedFileID := s.addFile(t, ownerID, folderID, subfolderID, "locked.pdf", "%PDF-1.4", "file password")
+
+	path := "/user/" + itoa(lockedFolderID) + "/" + itoa(lockedSubfolderID) + "/" + itoa(inLockedFileID) + "/copy"
+	response := s.serve(http.MethodPost, path, token, copyBody(targetFolderID, targetSubfolderID, "fail"))
+	expectStatus(t, response, http.StatusUnauthorized, "copying a file out of a locked subfolder without its grant")
+	response = s.serve(http.MethodPost, path, token, copyBody(targetFolderID, targetSubfolderID, "fail"),
+		unlockGrantsHeader, subfolderGrant(t, ownerID, lockedSubfolderID))
+	expectStatus(t, response, http.StatusCreated, "copying a file out of an unlocked subfolder")
+
+	// the copy without the password of the file would give its content away
+	path = "/user/" + itoa(folderID) + "/" + itoa(subfolderID) + "/" + itoa(lockedFileID) + "/copy"
+	response = s.serve(http.MethodPost, path, token, copyBody(targetFolderID, targetSubfolderID, "fail"))
+	expectStatus(t, response, http.StatusUnauthorized, "copying a locked file without its password")
+	response = s.serve(http.MethodPost, path, token, copyBody(targetFolderID, targetSubfolderID, "fail"),
+		filePasswordHeader, "file password")
+	expectStatus(t, response, http.StatusCreated, "copying a locked file with its password")
+}
+
+func TestCopyDoesntOverwriteTheFilesOfOtherUsers(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, token := s.addUser(t, "owner@example.com")
+	otherUserID, _ := s.addUser(t, "other@example.com")
+	folderID, subfolderID := s.addSubfolder(t, ownerID, "reports", "")
+	targetFolderID, targetSubfolderID := s.addSubfolder(t, ownerID, "target", "")
+	fileID := s.addFile(t, ownerID, folderID, subfolderID, "report.pdf", "%PDF-1.4 owner", "")
+	otherFileID := s.addFile(t, otherUserID, targetFolderID, targetSubfolderID, "report.pdf", "%PDF-1.4 other", "")
+
+	path := "/user/" + itoa(folderID) + "/" + itoa(subfolderID) + "/" + itoa(fileID) + "/copy"
+	response := s.serve(http.MethodPost, path, token, copyBody(targetFolderID, targetSubfolderID, database.CopyConflictOverwrite))
+	expectStatus(t, response, http.StatusConflict, "overwriting the file of another user with a copy")
+	if _, err := database.GetFilesDetailsForFileID(s.Database, otherFileID, targetFolderID, targetSubfolderID); err != nil {
+		t.Fatalf("the file of the other user is gone: %v", err)
+	}
+
+	ownFileID := s.addFile(t, ownerID, targetFolderID, targetSubfolderID, "own.pdf", "%PDF-1.4 own", "")
+	response = s.serve(http.MethodPost, path, token, strings.NewReader(fmt.Sprintf(
+		`{"folderId": %d, "subfolderId": %d, "name": "own.pdf", "conflict": "overwrite"}`, targetFolderID, targetSubfolderID)))
+	expectStatus(t, response, http.StatusCreated, "overwriting a file of the user with a copy")
+	if _, err := database.GetFilesDetailsForFileID(s.Database, ownFileID, targetFolderID, targetSubfolderID); errorMessage(err) != database.FILE_NOT_FOUND {
+		t.Fatalf("the overwritten file returned %v, want %s", err, database.FILE_NOT_FOUND)
+	}
+}
+
+func TestCopyKeepsTheRulesOfTheSourceLabel(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, token := s.addUser(t, "owner@example.com")
+	restrictedFolderID, restrictedSubfolderID := s.addSubfolder(t, ownerID, "restricted", "")
+	confidentialFolderID, confidentialSubfolderID := s.addSubfolder(t, ownerID, "confidential", "")
+	publicFolderID, publicSubfolderID := s.addSubfolder(t, ownerID, "public", "")
+	s.setLabel(t, database.LabelSubfolder, restrictedSubfolderID, "restricted")
+	s.setLabel(t, database.LabelSubfolder, confidentialSubfolderID, "confidential")
+	s.addFile(t, ownerID, restrictedFolderID, restrictedSubfolderID, "restricted.pdf", "%PDF-1.4", "file password")
+	confidentialFileID := s.addFile(t, ownerID, confidentialFolderID, confidentialSubfolderID, "confidential.pdf", "%PDF-1.4", "")
+
+	restrictedNode, err := database.GetFolderNode(s.Database, restrictedFolderID, restrictedSubfolderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicWorkspace, err := database.GetFolderNode(s.Database, publicFolderID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := s.serve(http.MethodPost, "/nodes/"+itoa(restrictedNode.ID)+"/copy", token,
+		strings.NewReader(fmt.Sprintf(`{"nodeId": %d}`, publicWorkspace.ID)))
+	expectStatus(t, response, http.StatusForbidden, "copying a restricted subfolder without the second factor")
+
+	path := "/user/" + itoa(confidentialFolderID) + "/" + itoa(confidentialSubfolderID) + "/" + itoa(confidentialFileID) + "/copy"
+	response = s.serve(http.MethodPost, path, token, copyBody(publicFolderID, publicSubfolderID, "fail"))
+	expectStatus(t, response, http.StatusForbidden, "copying a confidential file to an unlabeled subfolder")
+}
+
+// errorMessage returns the message of the error, empty for nil
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
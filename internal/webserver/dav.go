@@ -0,0 +1,1028 @@
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// davPrefix is where the WebDAV interface of the tree is mounted
+	davPrefix = "/dav"
+	// davAuthenticate asks the WebDAV clients for the basic authentication
+	davAuthenticate = `Basic realm="WebDAV", charset="UTF-8"`
+)
+
+var (
+	davCredentialsMissing   = "the WebDAV requests need the basic authentication or a JWT"
+	davInvalidCredentials   = "the credentials are not valid"
+	davAccountNotActivated  = "the account is not activated"
+	davMFARequiresToken     = "the accounts with the two factor authentication need an API token as their WebDAV password"
+	davInfiniteDepth        = "only the listings of depth 0 or 1 are supported"
+	davRootNotChangeable    = "the root of the WebDAV tree lists the workspaces and can't be changed"
+	davNotOwned             = "only the owner can remove, rename or move the item"
+	davSubfolderLocked      = "the subfolder is locked with a password, an unlock grant for it is needed"
+	davFileLocked           = "the file is locked with a password, an unlock grant for it is needed"
+	davInvalidFilePassword  = "the password of the file, sent in the X-File-Password header, is not correct"
+	davFolderHasNoContent   = "the folders have no content, only their files can be written"
+	davUploadInterrupted    = "the upload was interrupted before the end of the file"
+	errDavUploadInterrupted = errors.New(davUploadInterrupted)
+)
+
+// AuthorizeDAV authenticates the WebDAV requests, with the email and the password of the account or an API token
+// in the basic authentication, which the file managers can send, or with the JWT or the API token of the other
+// routes. The accounts with the two factor authentication can't use their password, as the file managers can't
+// ask for the code, and need an API token. The API tokens need the scope of the method.
+func (s *Service) AuthorizeDAV() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, message := s.getDAVClaims(c)
+		if claims == nil {
+			c.Header("WWW-Authenticate", davAuthenticate)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": message,
+			})
+			return
+		}
+		if !verifyAPITokenMethodScope(c) {
+			return
+		}
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// getDAVClaims returns the claims of the user authenticated by the request, or why it couldn't be authenticated
+func (s *Service) getDAVClaims(c *gin.Context) (*auth.AuthCustomClaims, string) {
+	email, password, hasBasicAuth := c.Request.BasicAuth()
+	if secret, isAPIToken := isAPITokenSecret(c.GetHeader("Authorization")); isAPIToken && !hasBasicAuth {
+		return s.getAPITokenClaims(c, secret)
+	}
+	if _, isAPIToken := isAPITokenSecret(password); isAPIToken && hasBasicAuth {
+		claims, message := s.getAPITokenClaims(c, password)
+		if claims != nil && !strings.EqualFold(claims.Email, email) {
+			log.Error("The API token of the user %d was sent with the email %s", claims.Id, email)
+			return nil, davInvalidCredentials
+		}
+		return claims, message
+	}
+	if !hasBasicAuth {
+		tokenString := c.GetHeader("Authorization")
+		if len(tokenString) == 0 {
+			return nil, davCredentialsMissing
+		}
+		token, err := auth.JWTAuthService().ValidateToken(tokenString)
+		if err != nil || !token.Valid {
+			log.Error("Error validating the JWT of a WebDAV request: %s", err)
+			return nil, davInvalidCredentials
+		}
+		claims := token.Claims.(*auth.AuthCustomClaims)
+		if !claims.IsActivated {
+			return nil, davAccountNotActivated
+		}
+		return claims, ""
+	}
+
+	isActivated, err := database.UserIsActivated(s.Database, email)
+	if err != nil {
+		return nil, davInvalidCredentials
+	} else if !isActivated {
+		return nil, davAccountNotActivated
+	}
+	isAuthenticated, err := database.VerifyLoginCredentials(s.Database, email, password)
+	if err != nil || !isAuthenticated {
+		log.Error("The WebDAV credentials of the user %s are not valid", email)
+		return nil, davInvalidCredentials
+	}
+	user, err := database.GetUserDetailsForEmail(s.Database, email)
+	if err != nil {
+		return nil, davInvalidCredentials
+	}
+	mfa, err := database.GetUserMFA(s.Database, user.ID)
+	if err != nil {
+		return nil, davInvalidCredentials
+	} else if mfa.Enabled {
+		log.Error("The user %d has the two factor authentication and can't use the password for WebDAV", user.ID)
+		return nil, davMFARequiresToken
+	}
+	return &auth.AuthCustomClaims{Id: user.ID, Email: user.Email, IsActivated: true}, ""
+}
+
+// HandleDAV serves the WebDAV interface of the tree: the root lists the workspaces, and below them the paths are
+// the names of the folders and of the files, like the /tree routes. The x/net/webdav handler does the protocol,
+// on a file system checking the permissions of the user like the other routes.
+func (s *Service) HandleDAV(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	fs := &davFileSystem{
+		s:                  s,
+		c:                  c,
+		claims:             claims,
+		unlockedFiles:      map[int64]bool{},
+		unlockedSubfolders: map[int64]bool{},
+		lockedSubfolders:   map[int64]bool{},
+	}
+	unlockedFileIDs, unlockedSubfolderIDs := getUnlockedIDs(c, claims.Id)
+	for _, fileID := range unlockedFileIDs {
+		fs.unlockedFiles[fileID] = true
+	}
+	for _, subfolderID := range unlockedSubfolderIDs {
+		fs.unlockedSubfolders[subfolderID] = true
+	}
+
+	// the listings are checked before the handler starts the multistatus response, which can't change its status
+	// once a folder can't be listed
+	if c.Request.Method == "PROPFIND" {
+		depth := c.GetHeader("Depth")
+		if depth != "0" && depth != "1" {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": davInfiniteDepth,
+			})
+			return
+		}
+		item, err := fs.resolve(database.SplitNodePath(c.Param("path")))
+		if err == nil && depth == "1" && !item.root && !item.isFile {
+			err = fs.checkListing(item.node)
+		}
+		if err != nil && fs.status != 0 {
+			c.JSON(fs.status, gin.H{
+				"error": fs.message,
+			})
+			return
+		}
+	}
+
+	if c.Request.Body != nil {
+		c.Request.Body = davBody{ReadCloser: c.Request.Body, fs: fs}
+	}
+	handler := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: fs,
+		LockSystem: s.davLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Error("Error serving the WebDAV %s request for %s: %s", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	handler.ServeHTTP(&davResponseWriter{ResponseWriter: c.Writer, fs: fs}, c.Request)
+}
+
+// davResponseWriter replaces the error statuses of the webdav handler, which only knows the errors of the os
+// package, with the status and the message recorded by the file system
+type davResponseWriter struct {
+	gin.ResponseWriter
+	fs *davFileSystem
+	// discard drops what the handler writes after the status was replaced, or after a multistatus response
+	discard bool
+}
+
+func (w *davResponseWriter) WriteHeader(status int) {
+	if w.Written() {
+		w.discard = true
+		return
+	}
+	if status >= http.StatusBadRequest && w.fs.status != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.ResponseWriter.WriteHeader(w.fs.status)
+		w.ResponseWriter.WriteString(w.fs.message)
+		w.discard = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *davResponseWriter) Write(data []byte) (int, error) {
+	if w.discard {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// davBody records the errors reading the body of a request, so an interrupted upload isn't stored as the file
+type davBody struct {
+	io.ReadCloser
+	fs *davFileSystem
+}
+
+func (body davBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		body.fs.bodyErr = err
+	}
+	return n, err
+}
+
+// davFileSystem is the tree seen by the user of a WebDAV request. The refused operations record the status and
+// the message of the response, and return the os error the webdav handler expects.
+type davFileSystem struct {
+	s                  *Service
+	c                  *gin.Context
+	claims             *auth.AuthCustomClaims
+	unlockedFiles      map[int64]bool
+	unlockedSubfolders map[int64]bool
+	// lockedSubfolders caches if the subfolders are locked with a password
+	lockedSubfolders map[int64]bool
+	status           int
+	message          string
+	bodyErr          error
+}
+
+// davItem is what a path of the WebDAV tree stands for: its root, a folder of the tree or a file
+type davItem struct {
+	root   bool
+	isFile bool
+	node   database.Node
+	file   database.FileEntry
+}
+
+func (item davItem) info() davFileInfo {
+	switch {
+	case item.root:
+		return davFileInfo{name: "/", isDir: true}
+	case item.isFile:
+		return davFileInfo{name: item.file.Filename, size: item.file.Size, modTime: item.file.ModifiedAt}
+	}
+	return davFileInfo{name: item.node.Name, modTime: item.node.CreatedAt, isDir: true}
+}
+
+// davFileInfo describes a folder or a file. The content type comes from the filename, so the listings don't
+// decrypt the files to sniff it.
+type davFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (info davFileInfo) Name() string       { return info.name }
+func (info davFileInfo) Size() int64        { return info.size }
+func (info davFileInfo) ModTime() time.Time { return info.modTime }
+func (info davFileInfo) IsDir() bool        { return info.isDir }
+func (info davFileInfo) Sys() interface{}   { return nil }
+
+func (info davFileInfo) Mode() os.FileMode {
+	if info.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType implements webdav.ContentTyper
+func (info davFileInfo) ContentType(ctx context.Context) (string, error) {
+	return database.MimeTypeForFilename(info.name), nil
+}
+
+// refuse records the response of a refused operation
+func (fs *davFileSystem) refuse(status int, message string) error {
+	fs.status, fs.message = status, message
+	if status == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return os.ErrPermission
+}
+
+// fail records the response of an error of the database, the unexpected ones being internal errors
+func (fs *davFileSystem) fail(err error) error {
+	if database.IsQuotaExceeded(err) {
+		return fs.refuse(http.StatusRequestEntityTooLarge, err.Error())
+	}
+	if status := nodeErrorStatus(err); status != 0 {
+		return fs.refuse(status, err.Error())
+	}
+	fs.refuse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	return err
+}
+
+// checkOwner refuses the changes of the items of the other users, like the routes removing, renaming and moving them
+func (fs *davFileSystem) checkOwner(ownerID int64) error {
+	if ownerID != fs.claims.Id {
+		log.Error("The user %d can't change an item of the user %d through WebDAV", fs.claims.Id, ownerID)
+		return fs.refuse(http.StatusForbidden, davNotOwned)
+	}
+	return nil
+}
+
+// checkSubfolder refuses to go inside a subfolder locked with a password, without an unlock grant for it
+func (fs *davFileSystem) checkSubfolder(folderID int64, subfolderID int64) error {
+	locked, found := fs.lockedSubfolders[subfolderID]
+	if !found {
+		subfolderDetails, err := database.GetAllSubfolderDetailsForID(fs.s.Database, subfolderID, folderID)
+		if err != nil {
+			return fs.fail(err)
+		}
+		locked = subfolderDetails.IsLocked
+		fs.lockedSubfolders[subfolderID] = locked
+	}
+	if locked && !fs.unlockedSubfolders[subfolderID] {
+		log.Error("The user %d has no unlock grant for the subfolder %d", fs.claims.Id, subfolderID)
+		return fs.refuse(http.StatusLocked, davSubfolderLocked)
+	}
+	return nil
+}
+
+// checkFile refuses the content of a file locked with a password, without an unlock grant for it
+func (fs *davFileSystem) checkFile(file database.FileEntry) error {
+	if file.FileLocked && !fs.unlockedFiles[file.ID] {
+		log.Error("The user %d has no unlock grant for the file %d", fs.claims.Id, file.ID)
+		return fs.refuse(http.StatusLocked, davFileLocked)
+	}
+	return nil
+}
+
+// checkLabel checks the action against the rules of the label of the target
+func (fs *davFileSystem) checkLabel(target labelTarget, action string, newFileLocked bool) (database.LabelRules, error) {
+	label, denial, err := fs.s.checkLabelRules(fs.claims, target, action, newFileLocked)
+	if err != nil {
+		return label, fs.fail(err)
+	} else if denial != nil {
+		return label, fs.refuse(denial.status, denial.message)
+	}
+	return label, nil
+}
+
+// checkListing checks the user can see what is inside the node: its label must allow reading it, and below a
+// workspace its subfolder must be unlocked
+func (fs *davFileSystem) checkListing(node database.Node) error {
+	_, err := fs.checkLabel(labelTarget{FolderID: node.FolderID, SubfolderID: node.SubfolderID}, labelActionRead, false)
+	if err != nil {
+		return err
+	}
+	if node.Depth > 0 {
+		return fs.checkSubfolder(node.FolderID, node.SubfolderID)
+	}
+	return nil
+}
+
+// resolve returns the item at the path of names. The folders of a subfolder and its files need the subfolder to
+// be unlocked, while the subfolder itself stays visible in the listing of its workspace.
+func (fs *davFileSystem) resolve(names []string) (davItem, error) {
+	if len(names) == 0 {
+		return davItem{root: true}, nil
+	}
+
+	node, err := database.ResolveNodePath(fs.s.Database, names)
+	if err == nil {
+		if node.Depth > 1 {
+			err = fs.checkSubfolder(node.FolderID, node.SubfolderID)
+		}
+		return davItem{node: node}, err
+	} else if err.Error() != database.NODE_NOT_FOUND {
+		return davItem{}, fs.fail(err)
+	} else if len(names) < 2 {
+		return davItem{}, os.ErrNotExist
+	}
+
+	parent, err := database.ResolveNodePath(fs.s.Database, names[:len(names)-1])
+	if err != nil && err.Error() == database.NODE_NOT_FOUND {
+		return davItem{}, os.ErrNotExist
+	} else if err != nil {
+		return davItem{}, fs.fail(err)
+	} else if parent.Depth == 0 {
+		return davItem{}, os.ErrNotExist
+	}
+	file, err := database.GetNodeFileEntry(fs.s.Database, parent.ID, names[len(names)-1])
+	if err == sql.ErrNoRows {
+		return davItem{}, os.ErrNotExist
+	} else if err != nil {
+		return davItem{}, fs.fail(err)
+	}
+	fs.lockedSubfolders[file.SubfolderID] = file.SubfolderLocked
+	return davItem{isFile: true, file: file}, fs.checkSubfolder(file.FolderID, file.SubfolderID)
+}
+
+// list returns the workspaces for the root, and the folders and the files of a node
+func (fs *davFileSystem) list(item davItem) ([]os.FileInfo, error) {
+	if !item.root {
+		if err := fs.checkListing(item.node); err != nil {
+			return nil, err
+		}
+	}
+
+	nodes, err := database.GetAllChildNodes(fs.s.Database, item.node.ID)
+	if err != nil {
+		return nil, fs.fail(err)
+	}
+	children := []os.FileInfo{}
+	for _, node := range nodes {
+		children = append(children, davItem{node: node}.info())
+	}
+	if item.root || item.node.Depth == 0 {
+		return children, nil
+	}
+
+	files, err := database.GetNodeFileEntries(fs.s.Database, item.node.ID, fs.claims.MFA)
+	if err != nil {
+		return nil, fs.fail(err)
+	}
+	for _, file := range files {
+		children = append(children, davItem{isFile: true, file: file}.info())
+	}
+	return children, nil
+}
+
+// Stat implements webdav.FileSystem
+func (fs *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	item, err := fs.resolve(database.SplitNodePath(name))
+	if err != nil {
+		return nil, err
+	}
+	return item.info(), nil
+}
+
+// Mkdir implements webdav.FileSystem, adding a workspace at the root, a subfolder in a workspace and a folder
+// deeper, like the requests creating nodes
+func (fs *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	names := database.SplitNodePath(name)
+	if _, err := fs.resolve(names); err == nil {
+		return os.ErrExist
+	} else if err != os.ErrNotExist {
+		return err
+	}
+	parent, err := fs.resolve(names[:len(names)-1])
+	if err != nil {
+		return err
+	} else if parent.isFile {
+		return os.ErrNotExist
+	}
+
+	nodeName := names[len(names)-1]
+	var node database.Node
+	switch {
+	case !database.IsNodeNameValid(nodeName):
+		err = errors.New(database.INVALID_NODE_NAME)
+	case parent.root:
+		var folderID int64
+		folderID, err = database.AddNewFolder(fs.s.Database, fs.claims.Id, nodeName)
+		if err == nil {
+			node, err = database.GetFolderNode(fs.s.Database, folderID, 0)
+		}
+	case parent.node.Depth == 0:
+		var subfolderID int64
+		subfolderID, err = database.AddNewSubfolder(fs.s.Database, fs.claims.Id, parent.node.FolderID, nodeName, "", false)
+		if err == nil {
+			node, err = database.GetFolderNode(fs.s.Database, parent.node.FolderID, subfolderID)
+		}
+	default:
+		if err = fs.checkSubfolder(parent.node.FolderID, parent.node.SubfolderID); err != nil {
+			return err
+		}
+		var nodeID int64
+		nodeID, err = database.AddNode(fs.s.Database, fs.claims.Id, parent.node, nodeName)
+		if err == nil {
+			node, err = database.GetNode(fs.s.Database, nodeID)
+		}
+	}
+	if err != nil {
+		return fs.fail(err)
+	}
+
+	setAuditTarget(fs.c, node.ID)
+	log.Info("Successfully created the node %s through WebDAV", name)
+	return nil
+}
+
+// OpenFile implements webdav.FileSystem. The creating and truncating flags open the file for writing its new
+// content, adding it when it doesn't exist, and the other flags open the folders and the files for reading.
+func (fs *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	names := database.SplitNodePath(name)
+	write := flag&(os.O_CREATE|os.O_TRUNC) != 0
+	item, err := fs.resolve(names)
+	if err == os.ErrNotExist && flag&os.O_CREATE != 0 && len(names) > 0 {
+		return fs.createFile(names)
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !item.isFile && write:
+		return nil, fs.refuse(http.StatusMethodNotAllowed, davFolderHasNoContent)
+	case !item.isFile:
+		return &davFolder{fs: fs, item: item}, nil
+	case write:
+		return fs.updateFile(item.file)
+	}
+	return &davFile{fs: fs, file: item.file}, nil
+}
+
+// createFile adds the file at the path, returning it open for its content
+func (fs *davFileSystem) createFile(names []string) (webdav.File, error) {
+	parent, err := fs.resolve(names[:len(names)-1])
+	if err != nil {
+		return nil, err
+	} else if parent.isFile {
+		return nil, os.ErrNotExist
+	} else if parent.root || parent.node.Depth == 0 {
+		return nil, fs.fail(errors.New(database.NODE_IS_WORKSPACE))
+	}
+	node := parent.node
+	if err = fs.checkSubfolder(node.FolderID, node.SubfolderID); err != nil {
+		return nil, err
+	}
+	_, err = fs.checkLabel(labelTarget{FolderID: node.FolderID, SubfolderID: node.SubfolderID}, labelActionUpload, false)
+	if err != nil {
+		return nil, err
+	}
+	if fs.c.Request.Method == http.MethodPut && fs.c.Request.ContentLength > 0 {
+		err = database.CheckQuota(fs.s.Database, fs.claims.Id, node.FolderID, fs.c.Request.ContentLength, 1)
+		if err != nil {
+			return nil, fs.fail(err)
+		}
+	}
+
+	filename := names[len(names)-1]
+	fileID, err := database.AddNewFile(fs.s.Database, fs.claims.Id, node.FolderID, node.SubfolderID, node.ID, filename, "", "", false)
+	if err != nil {
+		return nil, fs.fail(err)
+	}
+
+	setAuditAction(fs.c, database.AuditCreate, database.AuditTargetFile, fileID)
+	file := database.FileEntry{
+		ID:          fileID,
+		OwnerID:     fs.claims.Id,
+		FolderID:    node.FolderID,
+		SubfolderID: node.SubfolderID,
+		NodeID:      node.ID,
+		Filename:    filename,
+		ModifiedAt:  time.Now(),
+	}
+	return fs.startUpload(file, "", true), nil
+}
+
+// updateFile returns the file open for its new content, the previous one being kept as a version. The files
+// encrypted with their password need it in the X-File-Password header, like for the updates of the other routes.
+func (fs *davFileSystem) updateFile(file database.FileEntry) (webdav.File, error) {
+	if err := fs.checkFile(file); err != nil {
+		return nil, err
+	}
+	password := ""
+	if file.Blob.KeyID == encryption.PasswordKeyID {
+		password = fs.c.GetHeader(filePasswordHeader)
+		isPasswordCorrect, err := database.VerifyFilePassword(fs.s.Database, file.ID, file.FolderID, file.SubfolderID, password)
+		if err != nil {
+			return nil, fs.fail(err)
+		} else if !isPasswordCorrect {
+			log.Error("The password provided to update the file %d through WebDAV is not correct", file.ID)
+			return nil, fs.refuse(http.StatusForbidden, davInvalidFilePassword)
+		}
+	}
+	_, err := fs.checkLabel(labelTarget{FolderID: file.FolderID, SubfolderID: file.SubfolderID, FileID: file.ID}, labelActionUpload, false)
+	if err != nil {
+		return nil, err
+	}
+	if fs.c.Request.Method == http.MethodPut && fs.c.Request.ContentLength > 0 {
+		err = database.CheckQuota(fs.s.Database, file.OwnerID, file.FolderID, fs.c.Request.ContentLength, 0)
+		if err != nil {
+			return nil, fs.fail(err)
+		}
+	}
+
+	setAuditTarget(fs.c, file.ID)
+	return fs.startUpload(file, password, false), nil
+}
+
+// RemoveAll implements webdav.FileSystem, only for the owner of the item, like the routes removing the nodes and
+// the files
+func (fs *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	item, err := fs.resolve(database.SplitNodePath(name))
+	if err != nil {
+		return err
+	} else if item.root {
+		return fs.refuse(http.StatusForbidden, davRootNotChangeable)
+	}
+
+	if item.isFile {
+		file := item.file
+		if err = fs.checkOwner(file.OwnerID); err != nil {
+			return err
+		} else if err = fs.checkFile(file); err != nil {
+			return err
+		}
+		if !database.RemoveFile(fs.s.Database, file.ID, file.FolderID, fs.claims.Id, file.SubfolderID) {
+			return fs.refuse(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		}
+		// the content of the files stored as blobs is removed by the blob garbage collection once unreferenced
+		if file.Blob.ID == 0 && storage.IsStorageKey(file.Blob.StorageKey) {
+			if err = fs.s.Storage.Remove(file.Blob.StorageKey); err != nil {
+				log.Error("Error removing the file %s from the storage: %s", file.Filename, err)
+			}
+		}
+		setAuditAction(fs.c, database.AuditDelete, database.AuditTargetFile, file.ID)
+		log.Info("Successfully removed the file %d through WebDAV", file.ID)
+		return nil
+	}
+
+	node := item.node
+	if err = fs.checkOwner(node.OwnerID); err != nil {
+		return err
+	}
+	// the storage keys have to be retrieved before the files are removed from the database
+	storedFiles, err := database.GetStoredFilesForNode(fs.s.Database, node)
+	if err != nil {
+		return fs.fail(err)
+	}
+	if err = database.RemoveNode(fs.s.Database, node); err != nil {
+		return fs.fail(err)
+	}
+	fs.s.removeStoredFiles(storedFiles)
+
+	setAuditTarget(fs.c, node.ID)
+	log.Info("Successfully removed the node %d through WebDAV", node.ID)
+	return nil
+}
+
+// Rename implements webdav.FileSystem, moving the item to the folder of the new path when it changes, then
+// renaming it. Only the owner can rename and move the item, and the label of the target must allow its uploads.
+func (fs *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	newNames := database.SplitNodePath(newName)
+	item, err := fs.resolve(database.SplitNodePath(oldName))
+	if err != nil {
+		return err
+	} else if item.root || len(newNames) == 0 {
+		return fs.refuse(http.StatusForbidden, davRootNotChangeable)
+	}
+	parent, err := fs.resolve(newNames[:len(newNames)-1])
+	if err != nil {
+		return err
+	} else if parent.isFile {
+		return os.ErrNotExist
+	}
+
+	name := newNames[len(newNames)-1]
+	if item.isFile {
+		return fs.renameFile(item.file, parent, name)
+	}
+	return fs.renameNode(item.node, parent, name)
+}
+
+// renameFile moves the file to the parent and renames it
+func (fs *davFileSystem) renameFile(file database.FileEntry, parent davItem, name string) error {
+	if err := fs.checkOwner(file.OwnerID); err != nil {
+		return err
+	} else if err = fs.checkFile(file); err != nil {
+		return err
+	} else if parent.root {
+		return fs.fail(errors.New(database.FILE_MOVE_TO_WORKSPACE))
+	}
+	// like for the moves of the routes, the file must be readable where it is
+	source := labelTarget{FolderID: file.FolderID, SubfolderID: file.SubfolderID, FileID: file.ID}
+	if _, err := fs.checkLabel(source, labelActionRead, false); err != nil {
+		return err
+	}
+
+	if name != file.Filename {
+		contentMatches, err := fs.s.renamedContentMatches(fs.c, file.Blob, file.Filename, name)
+		if err == encryption.ErrInvalidPassword {
+			return fs.refuse(http.StatusForbidden, davInvalidFilePassword)
+		} else if err != nil {
+			return fs.fail(err)
+		} else if !contentMatches {
+			log.Error("The content of the file %d doesn't match the name %s", file.ID, name)
+			return fs.refuse(http.StatusBadRequest, renamedContentMismatch)
+		}
+	}
+
+	// the move and the rename are done together, so the new name is the one which must be free in the target
+	target := parent.node
+	if target.ID != file.NodeID {
+		if target.Depth > 0 {
+			if err := fs.checkSubfolder(target.FolderID, target.SubfolderID); err != nil {
+				return err
+			}
+		}
+		_, err := fs.checkLabel(labelTarget{FolderID: target.FolderID, SubfolderID: target.SubfolderID}, labelActionUpload, file.FileLocked)
+		if err != nil {
+			return err
+		}
+		if err = database.MoveAndRenameFile(fs.s.Database, file.ID, target, name); err != nil {
+			return fs.fail(err)
+		}
+	} else if name != file.Filename {
+		if err := database.RenameFile(fs.s.Database, file.ID, name); err != nil {
+			return fs.fail(err)
+		}
+	}
+
+	setAuditAction(fs.c, database.AuditUpdate, database.AuditTargetFile, file.ID)
+	log.Info("Successfully moved the file %d to %s in the node %d through WebDAV", file.ID, name, target.ID)
+	return nil
+}
+
+// renameNode moves the node under the parent and renames it. The workspaces can only be renamed.
+func (fs *davFileSystem) renameNode(node database.Node, parent davItem, name string) error {
+	if err := fs.checkOwner(node.OwnerID); err != nil {
+		return err
+	}
+
+	target := parent.node
+	if target.ID != node.ParentID {
+		if parent.root {
+			return fs.fail(errors.New(database.NODE_MOVE_NOT_SUPPORTED))
+		}
+		// like for the moves of the routes, what is inside the node must be readable where it is
+		if err := fs.checkListing(node); err != nil {
+			return err
+		}
+		if target.Depth > 0 {
+			if err := fs.checkSubfolder(target.FolderID, target.SubfolderID); err != nil {
+				return err
+			}
+		}
+		// a subfolder keeps its own password, the deeper folders get the one of the subfolder they land in
+		nodeLocked := false
+		if node.Depth == 1 {
+			subfolderDetails, err := database.GetAllSubfolderDetailsForID(fs.s.Database, node.SubfolderID, node.FolderID)
+			if err != nil {
+				return fs.fail(err)
+			}
+			nodeLocked = subfolderDetails.IsLocked
+		}
+		_, err := fs.checkLabel(labelTarget{FolderID: target.FolderID, SubfolderID: target.SubfolderID}, labelActionUpload, nodeLocked)
+		if err != nil {
+			return err
+		}
+		// the move and the rename are done together, so the new name is the one which must be free in the target
+		if err = database.MoveAndRenameNode(fs.s.Database, node, target, name); err != nil {
+			return fs.fail(err)
+		}
+	} else if name != node.Name {
+		if err := database.RenameNode(fs.s.Database, node, name); err != nil {
+			return fs.fail(err)
+		}
+	}
+
+	setAuditTarget(fs.c, node.ID)
+	log.Info("Successfully moved the node %d to %s under the node %d through WebDAV", node.ID, name, target.ID)
+	return nil
+}
+
+// davFolder is the root or a folder of the tree opened for its listing
+type davFolder struct {
+	fs       *davFileSystem
+	item     davItem
+	children []os.FileInfo
+	listed   bool
+	position int
+}
+
+func (f *davFolder) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.listed {
+		children, err := f.fs.list(f.item)
+		if err != nil {
+			return nil, err
+		}
+		f.children, f.listed = children, true
+	}
+
+	rest := f.children[f.position:]
+	if count <= 0 {
+		f.position = len(f.children)
+		return rest, nil
+	} else if len(rest) == 0 {
+		return nil, io.EOF
+	} else if count > len(rest) {
+		count = len(rest)
+	}
+	f.position += count
+	return rest[:count], nil
+}
+
+func (f *davFolder) Stat() (os.FileInfo, error)                   { return f.item.info(), nil }
+func (f *davFolder) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (f *davFolder) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (f *davFolder) Write(p []byte) (int, error)                  { return 0, os.ErrInvalid }
+func (f *davFolder) Close() error                                 { return nil }
+
+// davFile is a file opened for reading. The listings open every file for its properties, so the checks and the
+// decryption wait for the first read or seek.
+type davFile struct {
+	fs      *davFileSystem
+	file    database.FileEntry
+	checked bool
+	label   database.LabelRules
+	content io.ReadCloser
+	// stamped is the watermarked content, replacing the stream of the file when the label requires it
+	stamped *bytes.Reader
+	// offset is the position seeked to, and contentOffset the position of the stream of the content
+	offset        int64
+	contentOffset int64
+}
+
+// check checks once that the file can be downloaded
+func (f *davFile) check() error {
+	if f.checked {
+		return nil
+	}
+	if err := f.fs.checkFile(f.file); err != nil {
+		return err
+	}
+	target := labelTarget{FolderID: f.file.FolderID, SubfolderID: f.file.SubfolderID, FileID: f.file.ID}
+	label, err := f.fs.checkLabel(target, labelActionDownload, false)
+	if err != nil {
+		return err
+	}
+	f.label, f.checked = label, true
+	if f.fs.c.Request.Method == http.MethodGet || f.fs.c.Request.Method == http.MethodHead {
+		setAuditAction(f.fs.c, database.AuditDownload, database.AuditTargetFile, f.file.ID)
+	}
+	return nil
+}
+
+// open opens the content of the file from its start, stamping it when the label requires a watermark
+func (f *davFile) open() error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	if f.content != nil || f.stamped != nil {
+		return nil
+	}
+
+	content, err := f.fs.s.openBlob(f.fs.c, f.file.Blob)
+	if err == encryption.ErrInvalidPassword {
+		log.Error("The password provided to read the file %d through WebDAV is not correct", f.file.ID)
+		return f.fs.refuse(http.StatusForbidden, davInvalidFilePassword)
+	} else if err != nil {
+		log.Error("Error opening the file %d for WebDAV: %s", f.file.ID, err)
+		return f.fs.fail(err)
+	}
+	if !f.label.Watermark {
+		f.content, f.contentOffset = content, 0
+		return nil
+	}
+
+	defer content.Close()
+	stamped, err := stampWatermark(f.fs.claims.Email, f.file.Filename, content)
+	if err == errWatermarkRead {
+		return f.fs.fail(err)
+	} else if err != nil {
+		return f.fs.refuse(http.StatusForbidden, labelRequiresWatermark)
+	}
+	f.stamped = bytes.NewReader(stamped.Bytes())
+	return nil
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	if f.stamped != nil {
+		return f.stamped.Read(p)
+	}
+
+	// the decrypted stream can't go back, so it is opened again, and skipped forward to the position
+	if f.offset < f.contentOffset {
+		f.content.Close()
+		f.content = nil
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.offset > f.contentOffset {
+		skipped, err := io.CopyN(ioutil.Discard, f.content, f.offset-f.contentOffset)
+		f.contentOffset += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.content.Read(p)
+	f.offset += int64(n)
+	f.contentOffset += int64(n)
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	// the size of the watermarked content is only known once it is stamped
+	if f.label.Watermark {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+		return f.stamped.Seek(offset, whence)
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.file.Size
+	case io.SeekStart:
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *davFile) Close() error {
+	if f.content == nil && f.stamped == nil {
+		return nil
+	}
+	if f.content != nil {
+		f.content.Close()
+	}
+	if f.fs.c.Request.Method == http.MethodGet {
+		f.fs.s.notifyFileWatchers(f.fs.claims.Id, f.fs.claims.Email, f.file.ID, f.file.Filename, database.AuditDownload)
+	}
+	return nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error)               { return davItem{isFile: true, file: f.file}.info(), nil }
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *davFile) Write(p []byte) (int, error)              { return 0, os.ErrInvalid }
+
+// davUpload is a file opened for its new content, by a PUT or as the target of a COPY. What is written is piped to
+// the storage, and closing the file waits for the content to be stored.
+type davUpload struct {
+	fs      *davFileSystem
+	file    database.FileEntry
+	created bool
+	writer  *io.PipeWriter
+	written int64
+	stored  chan error
+}
+
+// startUpload starts storing the content written to the upload, keeping the previous content of an existing file
+// as a version. A new file is removed if its content can't be stored, so the failed uploads don't leave empty
+// files behind.
+func (fs *davFileSystem) startUpload(file database.FileEntry, password string, created bool) *davUpload {
+	reader, writer := io.Pipe()
+	upload := &davUpload{fs: fs, file: file, created: created, writer: writer, stored: make(chan error, 1)}
+	go func() {
+		err := fs.s.storeFileContent(file.ID, fs.claims.Id, reader, password, !created)
+		// a failed store stops reading, so the writes fail instead of waiting for it
+		reader.CloseWithError(err)
+		upload.stored <- err
+	}()
+	return upload
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	n, err := u.writer.Write(p)
+	u.written += int64(n)
+	return n, err
+}
+
+func (u *davUpload) Close() error {
+	// the content is only stored when the request was read to its end, and nothing was refused while copying it
+	interrupted := u.fs.bodyErr != nil || u.fs.status != 0
+	if interrupted {
+		u.writer.CloseWithError(errDavUploadInterrupted)
+	} else {
+		u.writer.Close()
+	}
+	err := <-u.stored
+	if err == nil {
+		log.Info("Successfully stored the file %d through WebDAV", u.file.ID)
+		return nil
+	}
+
+	log.Error("Error storing the file %d through WebDAV: %s", u.file.ID, err)
+	if u.created {
+		database.RemoveFile(u.fs.s.Database, u.file.ID, u.file.FolderID, u.fs.claims.Id, u.file.SubfolderID)
+	}
+	switch {
+	case u.fs.status != 0:
+		return os.ErrPermission
+	case interrupted:
+		return u.fs.refuse(http.StatusBadRequest, davUploadInterrupted)
+	}
+	return u.fs.fail(err)
+}
+
+func (u *davUpload) Stat() (os.FileInfo, error) {
+	return davFileInfo{name: u.file.Filename, size: u.written, modTime: u.file.ModifiedAt}, nil
+}
+
+func (u *davUpload) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (u *davUpload) Readdir(count int) ([]os.FileInfo, error)     { return nil, os.ErrInvalid }
@@ -0,0 +1,205 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+type FileTags struct {
+	Tags []string `json:"tags"`
+}
+
+// parseQueryInt64 returns 0 when the query parameter is missing
+func parseQueryInt64(c *gin.Context, name string) (int64, error) {
+	raw := c.Query(name)
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("the parameter %s must be a positive number", name)
+	}
+	return value, nil
+}
+
+// parseQueryTime accepts RFC 3339 timestamps and dates, returning the zero time when the query parameter is missing
+func parseQueryTime(c *gin.Context, name string) (time.Time, error) {
+	raw := c.Query(name)
+	if len(raw) == 0 {
+		return time.Time{}, nil
+	}
+	if value, err := time.Parse(time.RFC3339, raw); err == nil {
+		return value, nil
+	}
+	if value, err := time.Parse("2006-01-02", raw); err == nil {
+		return value, nil
+	}
+	return time.Time{}, fmt.Errorf("the parameter %s must be a date or an RFC 3339 timestamp", name)
+}
+
+// getFileFilter reads the filters of the file query from the query parameters
+func getFileFilter(c *gin.Context) (database.FileFilter, error) {
+	filter := database.FileFilter{
+		NamePattern: c.Query("name"),
+		Type:        c.Query("type"),
+		Tags:        c.QueryArray("tag"),
+		Metadata:    getMetadataFilters(c),
+	}
+
+	var errs []error
+	var err error
+	filter.UploaderID, err = parseQueryInt64(c, "uploader")
+	errs = append(errs, err)
+	filter.MinSize, err = parseQueryInt64(c, "minSize")
+	errs = append(errs, err)
+	filter.MaxSize, err = parseQueryInt64(c, "maxSize")
+	errs = append(errs, err)
+	filter.CreatedAfter, err = parseQueryTime(c, "createdAfter")
+	errs = append(errs, err)
+	filter.CreatedBefore, err = parseQueryTime(c, "createdBefore")
+	errs = append(errs, err)
+	filter.ModifiedAfter, err = parseQueryTime(c, "modifiedAfter")
+	errs = append(errs, err)
+	filter.ModifiedBefore, err = parseQueryTime(c, "modifiedBefore")
+	errs = append(errs, err)
+
+	for _, err := range errs {
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// HandleGetQueryFiles returns a page of the files matching the filters, across all the workspaces.
+// The files of the locked subfolders are only returned when their unlock grants are sent.
+func (s *Service) HandleGetQueryFiles(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	filter, err := getFileFilter(c)
+	if err != nil {
+		log.Error("Error reading the filters of the file query: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	_, filter.UnlockedSubfolderIDs = getUnlockedIDs(c, claims.Id)
+	filter.MFA = claims.MFA
+
+	page, err := getPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+
+	files, pageInfo, err := database.QueryFiles(s.Database, filter, page)
+	if respondPaginationError(c, err) || respondMetadataError(c, err) {
+		return
+	} else if err != nil {
+		errorMessage := "Error querying the files"
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	log.Info("Successfully queried the files for the user %d", claims.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"files":      files,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
+	})
+}
+
+// HandlePostFileTags replaces the tags of a file, only its owner can tag it
+func (s *Service) HandlePostFileTags(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var fileTags FileTags
+	err = c.BindJSON(&fileTags)
+	if err != nil {
+		log.Error("Error %s binding the JSON for HandlePostFileTags request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the "+
+			"HandlePostFileTags request: %s", err)
+		return
+	}
+
+	subfolderID, err := getIntParameterFromRequest(c, "subfolder_id")
+	if err != nil {
+		log.Error("Error retrieving subfolder_id parameter from the "+
+			"HandlePostFileTags request: %s", err)
+		return
+	}
+
+	fileID, err := getIntParameterFromRequest(c, "file_id")
+	if err != nil {
+		log.Error("Error retrieving file id parameter from the request: %s", err)
+		return
+	}
+
+	fileDetails, err := database.GetFilesDetailsForFileID(s.Database, fileID, folderID, subfolderID)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the file details for id %d: %s", fileID, err)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+	if fileDetails.OwnerID != claims.Id {
+		log.Error("The user %d tried to tag the file %s, owned by %d", claims.Id, fileDetails.Filename, fileDetails.OwnerID)
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	tags, err := database.SetFileTags(s.Database, fileID, fileTags.Tags)
+	if err != nil && err.Error() == database.INVALID_TAG {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully set the tags of the file %s", fileDetails.Filename)
+	c.JSON(http.StatusOK, gin.H{
+		"tags": tags,
+	})
+}
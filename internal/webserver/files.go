@@ -2,26 +2,36 @@ package webserver
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
+	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
 
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
 	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
 	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
 	"github.com/gin-gonic/gin"
 )
 
 var (
-	pathToSaveFiles = "/home/cosminel/DissertationAppFolders/"
 	invalidFileExtension = "this extension is not supported"
 	fileAlreadyExists = "the specific file already exists in subfolder"
+	invalidFileName = "the file name is not valid"
+	passwordRequiredForEncryption = "a password is required to encrypt the file with it"
+	filePasswordHeader = "X-File-Password"
+	fileLocked = "the file is locked, its password or an unlock grant for it is needed"
 )
 
 type VerifyFilePassword struct {
 	Password string `json:"password"`
 }
 
+type ChangeFilePassword struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
 func (s *Service) HandlePostAddFile(c *gin.Context) {
 	claims, err := verifyClaims(c)
 	if err != nil {
@@ -56,23 +66,29 @@ func (s *Service) HandlePostAddFile(c *gin.Context) {
 		return
 	}
 
-	file, err := c.FormFile("file")
+	folderName, err := database.GetFolderNameFromID(s.Database, folderID)
 	if err != nil {
-		log.Error("Error getting the file from the form: %s", err.Error())
+		log.Error("Error getting the folderName %s from the folderID %d: %s", folderName, folderID, err)
 		c.Status(http.StatusBadRequest)
 		return
 	}
 
-	folderName, err := database.GetFolderNameFromID(s.Database, folderID)
+	subfolderName, err := database.GetSubfolderNameFromID(s.Database, subfolderID)
 	if err != nil {
-		log.Error("Error getting the folderName %s from the folderID %d: %s", folderName, folderID, err)
+		log.Error("Error getting the subfolderName %s from the subfolderID %d: %s", subfolderName, subfolderID, err)
 		c.Status(http.StatusBadRequest)
 		return
 	}
 
-	subfolderName, err := database.GetSubfolderNameFromID(s.Database, subfolderID)
+	s.uploadFile(c, claims, folderID, subfolderID, 0)
+}
+
+// uploadFile adds the file of the form to the node, or directly in the subfolder for a zero nodeID, locked and
+// encrypted with the password of the form when there is one
+func (s *Service) uploadFile(c *gin.Context, claims *auth.AuthCustomClaims, folderID int64, subfolderID int64, nodeID int64) {
+	file, err := c.FormFile("file")
 	if err != nil {
-		log.Error("Error getting the subfolderName %s from the subfolderID %d: %s", subfolderName, subfolderID, err)
+		log.Error("Error getting the file from the form: %s", err.Error())
 		c.Status(http.StatusBadRequest)
 		return
 	}
@@ -85,9 +101,54 @@ func (s *Service) HandlePostAddFile(c *gin.Context) {
 		fileLocked = true
 	}
 
-	fullPath := pathToSaveFiles + folderName + "/" + subfolderName + "/"
+	// when requested, the locked file is encrypted with a key derived from its password, so the server can't read it
+	encryptWithPassword := c.Request.FormValue("encryptWithPassword") == "true"
+	if encryptWithPassword && !fileLocked {
+		log.Error("The file %s can't be encrypted with its password, no password was provided", file.Filename)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": passwordRequiredForEncryption,
+		})
+		return
+	}
+	encryptionPassword := ""
+	if encryptWithPassword {
+		encryptionPassword = password
+	}
+
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: folderID, SubfolderID: subfolderID}, labelActionUpload, fileLocked)
+	if !allowed {
+		return
+	}
 
- 	fileID, gsErr := database.AddNewFile(s.Database, claims.Id, folderID, subfolderID, file.Filename, fullPath, password, fileLocked)
+	fileID, ok := s.addUploadedFile(c, claims.Id, folderID, subfolderID, nodeID, file, password, fileLocked, encryptionPassword)
+	if !ok {
+		return
+	}
+
+	setAuditTarget(c, fileID)
+	log.Info("File %s successfully uploaded!", file.Filename)
+	c.JSON(http.StatusOK, gin.H{
+		"id": fileID,
+	})
+}
+
+// addUploadedFile adds the file to the node of the subfolder, or directly in the subfolder for a zero nodeID, and
+// stores its content, responding when it can't be added. The quotas of the user and of the workspace are checked
+// first, from the declared size.
+func (s *Service) addUploadedFile(c *gin.Context, userID int64, folderID int64, subfolderID int64, nodeID int64, file *multipart.FileHeader,
+	password string, fileLocked bool, encryptionPassword string) (int64, bool) {
+	// fail before reading the content when the declared size already goes over a quota
+	err := database.CheckQuota(s.Database, userID, folderID, file.Size, 1)
+	if respondQuotaExceeded(c, err) {
+		log.Error("The file %s can't be uploaded: %s", file.Filename, err)
+		return 0, false
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return 0, false
+	}
+
+	// the content is stored as a blob under a generated key, the name of the file only lives in the database
+ 	fileID, gsErr := database.AddNewFile(s.Database, userID, folderID, subfolderID, nodeID, file.Filename, "", password, fileLocked)
 	if gsErr != nil {
 		errorMessage := fmt.Sprintf("Error saving the file %s: %s", file.Filename, gsErr)
 		log.Error(errorMessage)
@@ -96,32 +157,45 @@ func (s *Service) HandlePostAddFile(c *gin.Context) {
 			c.JSON(http.StatusConflict, gin.H{
 				"error": errorMessage,
 			})
-			return
-		} else if gsErr.Error() == invalidFileExtension {
+			return 0, false
+		} else if gsErr.Error() == invalidFileExtension || gsErr.Error() == invalidFileName {
 			c.JSON(http.StatusForbidden, gin.H{
 				"error": errorMessage,
 			})
-			return
+			return 0, false
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": errorMessage,
 		})
-		return
-	} else if err := c.SaveUploadedFile(file, fullPath + file.Filename); err != nil {
+		return 0, false
+	} else if err := s.saveUploadedFile(fileID, userID, file, encryptionPassword); err != nil {
 		errorMessage := fmt.Sprintf("Error while saving the file: %s", err.Error())
+		database.RemoveFile(s.Database, fileID, folderID, userID, subfolderID)
+		if respondQuotaExceeded(c, err) {
+			return 0, false
+		}
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": errorMessage,
 		})
-		return
+		return 0, false
 	}
-
-	log.Info("File %s successfully uploaded!", file.Filename)
-	c.JSON(http.StatusOK, gin.H{
-		"id": fileID,
-	})
+	return fileID, true
 }
 
 func (s *Service) HandleGetAllFilesForCurrentFolder(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
 	folderID, err := getIntParameterFromRequest(c, "folder_id")
 	if err != nil {
 		log.Error("Error retrieving folder_id parameter from the "+
@@ -168,7 +242,7 @@ func (s *Service) HandleGetAllFilesForCurrentFolder(c *gin.Context) {
 	
 	doesFolderExist, err := database.FolderExists(s.Database, folderName)
 	if err != nil {
-		log.Error("Error while checking if the folder already exists in db: %s", doesFolderExist)
+		log.Error("Error while checking if the folder already exists in db: %s", err)
 		c.Status(http.StatusInternalServerError)
 		return
 	}
@@ -180,7 +254,7 @@ func (s *Service) HandleGetAllFilesForCurrentFolder(c *gin.Context) {
 
 	doesSubfolderExist, err := database.SubfolderExists(s.Database, folderID, subfolderName)
 	if err != nil {
-		log.Error("Error while checking if the subfolder %s already exists in db: %s", subfolderName, doesSubfolderExist)
+		log.Error("Error while checking if the subfolder %s already exists in db: %s", subfolderName, err)
 		c.Status(http.StatusInternalServerError)
 		return
 	}
@@ -190,8 +264,30 @@ func (s *Service) HandleGetAllFilesForCurrentFolder(c *gin.Context) {
 		return
 	}
 
-	filesDetails, gsErr := database.GetAllFilesDetails(s.Database, folderID, subfolderID)
-	if gsErr != nil {
+	page, err := getPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: folderID, SubfolderID: subfolderID}, labelActionRead, false)
+	if !allowed {
+		return
+	}
+
+	filter, err := getFileFilter(c)
+	if err != nil {
+		log.Error("Error reading the filters of the files for the subfolder %s: %s", subfolderName, err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	filter.MFA = claims.MFA
+
+	filesDetails, pageInfo, gsErr := database.GetAllFilesDetails(s.Database, folderID, subfolderID, filter, page)
+	if respondPaginationError(c, gsErr) || respondMetadataError(c, gsErr) {
+		return
+	} else if gsErr != nil {
 		errorMessage := fmt.Sprintf("Error retrieving all files for the subfolder %s: %s", subfolderName, gsErr)
 		log.Error(errorMessage)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -200,17 +296,32 @@ func (s *Service) HandleGetAllFilesForCurrentFolder(c *gin.Context) {
 		return
 	}
 
-	log.Info("Successfully retrieved all files for the subfolder %s", subfolderName)
+	log.Info("Successfully retrieved all files for the subfolder %s for the user %d", subfolderName, claims.Id)
 	c.JSON(http.StatusOK, gin.H{
 		"files": filesDetails,
 		"workspace" : folderName,
 		"currentFolder": subfolderDetails.Name,
 		"ownerID" : subfolderDetails.OwnerID,
 		"isLocked" : subfolderDetails.IsLocked,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
 	})
 }
 
 func (s *Service) HandleGetFileForFileID(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
 	fileID, err := getIntParameterFromRequest(c, "file_id")
 	if err != nil {
 		log.Error("Error retrieving file id parameter from the "+
@@ -251,15 +362,332 @@ func (s *Service) HandleGetFileForFileID(c *gin.Context) {
 		return
 	}
 
-	log.Info("Successfully retrieved details for the file with ID %d", fileID)
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: folderID, SubfolderID: subfolderID, FileID: fileID}, labelActionRead, false)
+	if !allowed {
+		return
+	}
+
+	s.notifyFileWatchers(claims.Id, claims.Email, fileID, fileDetails.Filename, database.AuditRead)
+	log.Info("Successfully retrieved details for the file with ID %d for the user %d", fileID, claims.Id)
 	c.JSON(http.StatusOK, gin.H{
 		"file": fileDetails,
 	})
 }
 
+// saveUploadedFile encrypts the uploaded file on disk, or reuses the stored blob with the same content.
+// If a password is provided the data key is wrapped with it instead of the master key.
+func (s *Service) saveUploadedFile(fileID int64, userID int64, file *multipart.FileHeader, password string) error {
+	src, err := file.Open()
+	if err != nil {
+		log.Error("Error opening the uploaded file %s: %s", file.Filename, err)
+		return err
+	}
+	defer src.Close()
+
+	err = s.storeFileContent(fileID, userID, src, password, false)
+	if err != nil {
+		return err
+	}
+	if len(password) > 0 {
+		return database.SetFilePasswordEncrypted(s.Database, fileID)
+	}
+	return nil
+}
+
+// storeFileContent writes src as the new content of the file. The previous content is kept as a version of the file
+// when keepVersion is set, otherwise it is released and removed by the blob garbage collection once unreferenced.
+func (s *Service) storeFileContent(fileID int64, userID int64, src io.Reader, password string, keepVersion bool) error {
+	tempBlob, err := s.Storage.WriteBlob(src, password)
+	if err != nil {
+		return err
+	}
+	storageKey, err := storage.NewStorageKey()
+	if err != nil {
+		s.Storage.Discard(tempBlob)
+		return err
+	}
+
+	blob := database.Blob{
+		Hash:       tempBlob.Hash,
+		StorageKey: storageKey,
+		Size:       tempBlob.Size,
+		KeyID:      tempBlob.KeyID,
+		WrappedKey: tempBlob.WrappedKey,
+		KeySalt:    tempBlob.KeySalt,
+	}
+	placed, err := database.AttachBlob(s.Database, fileID, userID, blob, keepVersion, func(storageKey string) error {
+		return s.Storage.Place(tempBlob, storageKey)
+	})
+	if !placed {
+		s.Storage.Discard(tempBlob)
+	} else if err != nil {
+		// the blob row was rolled back, so nothing references the placed content
+		s.Storage.Remove(blob.StorageKey)
+	} else if s.Indexer != nil {
+		s.Indexer.Notify()
+	}
+	return err
+}
+
+// reencryptFileContent encrypts the content and the versions of a file encrypted with its password again, under the
+// new password, or under the master key when it is empty. The versions the old password can't decrypt, encrypted
+// with a password the file had before, are removed.
+func (s *Service) reencryptFileContent(fileID int64, fileDetails database.SingleFileDetails, userID int64, oldPassword string, newPassword string) error {
+	tempBlobs := map[string]storage.TempBlob{}
+	defer func() {
+		// the placed blobs were moved, only the others are left to remove
+		for _, tempBlob := range tempBlobs {
+			s.Storage.Discard(tempBlob)
+		}
+	}()
+	reencrypt := func(blob database.Blob) (database.Blob, error) {
+		tempBlob, err := s.Storage.Reencrypt(blob.StorageKey, blob.KeySalt, blob.WrappedKey, oldPassword, newPassword)
+		if err != nil {
+			return blob, err
+		}
+		storageKey, err := storage.NewStorageKey()
+		if err != nil {
+			s.Storage.Discard(tempBlob)
+			return blob, err
+		}
+		tempBlobs[storageKey] = tempBlob
+		return database.Blob{
+			Hash:       tempBlob.Hash,
+			StorageKey: storageKey,
+			Size:       tempBlob.Size,
+			KeyID:      tempBlob.KeyID,
+			WrappedKey: tempBlob.WrappedKey,
+			KeySalt:    tempBlob.KeySalt,
+		}, nil
+	}
+
+	blob, err := reencrypt(database.Blob{
+		StorageKey: fileDetails.Filepath,
+		WrappedKey: fileDetails.WrappedKey,
+		KeySalt:    fileDetails.KeySalt,
+	})
+	if err != nil {
+		return err
+	}
+
+	versionBlobs, err := database.GetFileVersionBlobs(s.Database, fileID)
+	if err != nil {
+		return err
+	}
+	versions := map[int64]database.Blob{}
+	var removedVersionIDs []int64
+	for versionID, versionBlob := range versionBlobs {
+		if versionBlob.KeyID != encryption.PasswordKeyID {
+			continue
+		}
+		versions[versionID], err = reencrypt(versionBlob)
+		if err == encryption.ErrInvalidPassword {
+			delete(versions, versionID)
+			removedVersionIDs = append(removedVersionIDs, versionID)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	var placedKeys []string
+	err = database.ReencryptFileBlobs(s.Database, fileID, userID, blob, versions, removedVersionIDs, len(newPassword) > 0,
+		func(storageKey string) error {
+			err := s.Storage.Place(tempBlobs[storageKey], storageKey)
+			if err == nil {
+				placedKeys = append(placedKeys, storageKey)
+				delete(tempBlobs, storageKey)
+			}
+			return err
+		})
+	if err != nil {
+		// the blob rows were rolled back, so nothing references the placed contents
+		for _, storageKey := range placedKeys {
+			s.Storage.Remove(storageKey)
+		}
+		return err
+	}
+	if len(removedVersionIDs) > 0 {
+		log.Info("Removed %d versions of the file %s the old password couldn't decrypt", len(removedVersionIDs), fileDetails.Filename)
+	}
+	if s.Indexer != nil {
+		s.Indexer.Notify()
+	}
+	return nil
+}
+
+// removeStoredFiles removes the files from the storage after their rows were removed from the database,
+// a failure only leaves an unreferenced file behind
+func (s *Service) removeStoredFiles(storedFiles []database.StoredFile) {
+	for _, storedFile := range storedFiles {
+		err := s.Storage.Remove(storedFile.Filepath)
+		if err != nil {
+			log.Error("Error removing the file %s with ID %d from the storage: %s", storedFile.Filename, storedFile.ID, err)
+		}
+	}
+}
+
+// openStoredFile returns the plaintext of the file, reading the password from the request header
+// for the files encrypted with their password
+func (s *Service) openStoredFile(c *gin.Context, fileDetails database.SingleFileDetails) (io.ReadCloser, error) {
+	return s.openBlob(c, storedFileBlob(fileDetails))
+}
+
+// storedFileBlob returns the stored content of the file
+func storedFileBlob(fileDetails database.SingleFileDetails) database.Blob {
+	return database.Blob{
+		StorageKey: fileDetails.Filepath,
+		KeyID:      fileDetails.KeyID,
+		WrappedKey: fileDetails.WrappedKey,
+		KeySalt:    fileDetails.KeySalt,
+	}
+}
+
+func (s *Service) openBlob(c *gin.Context, blob database.Blob) (io.ReadCloser, error) {
+	if blob.KeyID == encryption.PasswordKeyID {
+		return s.Storage.OpenWithPassword(blob.StorageKey, blob.KeySalt, blob.WrappedKey, c.GetHeader(filePasswordHeader))
+	}
+	return s.Storage.Open(blob.StorageKey, blob.KeyID, blob.WrappedKey)
+}
+
+// verifyFileUnlocked checks that a locked file is unlocked by the password in the X-File-Password header or by an
+// unlock grant of the user, like for the archives and the search, and responds when it isn't. The files encrypted
+// with their password are left to the decryption, which needs the password anyway.
+func (s *Service) verifyFileUnlocked(c *gin.Context, claims *auth.AuthCustomClaims, fileID int64, folderID int64,
+	subfolderID int64, fileDetails database.SingleFileDetails) bool {
+	if !fileDetails.FileLocked || fileDetails.KeyID == encryption.PasswordKeyID {
+		return true
+	}
+	unlockedFileIDs, _ := getUnlockedIDs(c, claims.Id)
+	for _, unlockedFileID := range unlockedFileIDs {
+		if unlockedFileID == fileID {
+			return true
+		}
+	}
+
+	password := c.GetHeader(filePasswordHeader)
+	if len(password) > 0 {
+		isPasswordCorrect, err := database.VerifyFilePassword(s.Database, fileID, folderID, subfolderID, password)
+		if err != nil {
+			log.Error("Error while trying to verify the password of the file %s: %s", fileDetails.Filename, err)
+			c.Status(http.StatusInternalServerError)
+			return false
+		}
+		if isPasswordCorrect {
+			return true
+		}
+	}
+
+	log.Error("The user %d tried to download the locked file %s without unlocking it", claims.Id, fileDetails.Filename)
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error": fileLocked,
+	})
+	return false
+}
+
+func (s *Service) HandleGetDownloadFile(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	fileID, err := getIntParameterFromRequest(c, "file_id")
+	if err != nil {
+		log.Error("Error retrieving file id parameter from the "+
+			"HandleGetDownloadFile request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	subfolderID, err := getIntParameterFromRequest(c, "subfolder_id")
+	if err != nil {
+		log.Error("Error retrieving subfolder_id parameter from the "+
+			"HandleGetDownloadFile request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the "+
+			"HandleGetDownloadFile request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	fileDetails, gsErr := database.GetFilesDetailsForFileID(s.Database, fileID, folderID, subfolderID)
+	if gsErr != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the file details for id %d: %s", fileID, gsErr)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	label, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: folderID, SubfolderID: subfolderID, FileID: fileID}, labelActionDownload, false)
+	if !allowed {
+		return
+	}
+	if !s.verifyFileUnlocked(c, claims, fileID, folderID, subfolderID, fileDetails) {
+		return
+	}
+
+	file, err := s.openStoredFile(c, fileDetails)
+	if err == encryption.ErrInvalidPassword {
+		log.Error("The password provided to download the file %s is not correct", fileDetails.Filename)
+		c.Status(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		errorMessage := fmt.Sprintf("Error opening the file %s", fileDetails.Filename)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+	defer file.Close()
+
+	err = s.sendFile(c, claims.Email, label, fileDetails.Filename, file)
+	if err != nil {
+		// once the headers are sent, the client sees a truncated download
+		log.Error("Error sending the file %s: %s", fileDetails.Filename, err)
+		return
+	}
+
+	s.notifyFileWatchers(claims.Id, claims.Email, fileID, fileDetails.Filename, database.AuditDownload)
+	log.Info("Successfully downloaded the file with ID %d for the user %d", fileID, claims.Id)
+}
+
 func (s *Service) HandlePostCheckFilePassword(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
 	var verifyPassword VerifyFilePassword
-	err := c.BindJSON(&verifyPassword)
+	err = c.BindJSON(&verifyPassword)
 	if err != nil {
 		log.Error("Error %s binding the JSON for HandlePostCheckFilePassword request %s", err, c.Request.Body)
 		c.Status(http.StatusBadRequest)
@@ -314,15 +742,48 @@ func (s *Service) HandlePostCheckFilePassword(c *gin.Context) {
 		return
 	}
 
+	// the grant lets the search include the locked file
+	unlockGrant, err := auth.GenerateUnlockGrant(claims.Id, auth.UnlockGrantFile, fileID)
+	if err != nil {
+		log.Error("Error generating the unlock grant for the file %s: %s", fileName, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
 	log.Info("The password provided by the user for subfolder %s is correct", fileName)
-	c.Status(http.StatusOK)
+	c.JSON(http.StatusOK, gin.H{
+		"unlockGrant": unlockGrant,
+	})
 }
 
-func (s *Service) HandlePostModifiedFile(c *gin.Context) {
-	fileID, err := getIntParameterFromRequest(c, "file_id")
+// HandlePostChangeFilePassword changes the password of a locked file. The files encrypted with their password
+// are re-encrypted with their versions, under the new password or under the master key when it is removed.
+func (s *Service) HandlePostChangeFilePassword(c *gin.Context) {
+	claims, err := verifyClaims(c)
 	if err != nil {
-		log.Error("Error retrieving file id parameter from the "+
-			"HandlePostModifiedFile request: %s", err)
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var changePassword ChangeFilePassword
+	err = c.BindJSON(&changePassword)
+	if err != nil {
+		log.Error("Error %s binding the JSON for HandlePostChangeFilePassword request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the "+
+			"HandlePostChangeFilePassword request: %s", err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err,
 		})
@@ -332,76 +793,185 @@ func (s *Service) HandlePostModifiedFile(c *gin.Context) {
 	subfolderID, err := getIntParameterFromRequest(c, "subfolder_id")
 	if err != nil {
 		log.Error("Error retrieving subfolder_id parameter from the "+
-			"getIntParameterFromRequest request: %s", err)
+			"HandlePostChangeFilePassword request: %s", err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err,
 		})
 		return
 	}
 
-	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	fileID, err := getIntParameterFromRequest(c, "file_id")
 	if err != nil {
-		log.Error("Error retrieving folder_id parameter from the "+
-			"HandlePostModifiedFile request: %s", err)
+		log.Error("Error retrieving file id parameter from the request: %s", err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err,
 		})
 		return
 	}
 
-	folderName, err := database.GetFolderNameFromID(s.Database, folderID)
+	fileDetails, err := database.GetFilesDetailsForFileID(s.Database, fileID, folderID, subfolderID)
 	if err != nil {
-		log.Error("Error getting the folderName from the folderID %d: %s", folderID, err)
-		c.Status(http.StatusBadRequest)
+		errorMessage := fmt.Sprintf("Error retrieving the file details for id %d: %s", fileID, err)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+	if fileDetails.OwnerID != claims.Id {
+		log.Error("The user %d tried to change the password of the file %s, owned by %d", claims.Id, fileDetails.Filename, fileDetails.OwnerID)
+		c.Status(http.StatusForbidden)
 		return
 	}
 
-	subfolderName, err := database.GetSubfolderNameFromID(s.Database, subfolderID)
+	if fileDetails.FileLocked {
+		isPasswordCorrect, err := database.VerifyFilePassword(s.Database, fileID, folderID, subfolderID, changePassword.OldPassword)
+		if err != nil {
+			log.Error("Error while trying to verify the file password")
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if !isPasswordCorrect {
+			log.Error("The provided password for the file %s is not correct", fileDetails.Filename)
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if len(changePassword.NewPassword) == 0 {
+		target := labelTarget{FolderID: folderID, SubfolderID: subfolderID, FileID: fileID}
+		if _, allowed := s.enforceLabelRules(c, claims, target, labelActionRemovePassword, false); !allowed {
+			return
+		}
+	}
+
+	if fileDetails.KeyID != encryption.PasswordKeyID {
+		err = database.UpdateFilePassword(s.Database, fileID, claims.Id, changePassword.NewPassword)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		log.Info("Successfully changed the password of the file %s", fileDetails.Filename)
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// the content and the versions are re-encrypted with new data keys, wrapped with the master key when the
+	// password is removed. The previous blobs are not kept, they would still be readable with the old password
+	err = s.reencryptFileContent(fileID, fileDetails, claims.Id, changePassword.OldPassword, changePassword.NewPassword)
 	if err != nil {
-		log.Error("Error getting the subfolderName %s from the subfolderID %d: %s", subfolderName, subfolderID, err)
-		c.Status(http.StatusBadRequest)
+		log.Error("Error re-encrypting the file %s after changing its password: %s", fileDetails.Filename, err)
+		c.Status(http.StatusInternalServerError)
 		return
 	}
 
-	filename, err := database.GetFilenameFromID(s.Database, fileID)
+	log.Info("Successfully re-encrypted the file %s after changing its password", fileDetails.Filename)
+	c.Status(http.StatusOK)
+}
+
+func (s *Service) HandlePostModifiedFile(c *gin.Context) {
+	claims, err := verifyClaims(c)
 	if err != nil {
-		log.Error("Error getting the filename for the fileID %d: %s", fileID, err)
-		c.Status(http.StatusBadRequest)
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
 		return
 	}
 
-	buffer, err := ioutil.ReadAll(c.Request.Body)
+	fileID, err := getIntParameterFromRequest(c, "file_id")
 	if err != nil {
-		errorMessage := fmt.Sprintln("Error while reading the file")
-		log.Error(errorMessage)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": errorMessage,
+		log.Error("Error retrieving file id parameter from the "+
+			"HandlePostModifiedFile request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	subfolderID, err := getIntParameterFromRequest(c, "subfolder_id")
+	if err != nil {
+		log.Error("Error retrieving subfolder_id parameter from the "+
+			"getIntParameterFromRequest request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the "+
+			"HandlePostModifiedFile request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
 		})
 		return
 	}
 
-	filePath, err := filepath.Abs(pathToSaveFiles + folderName + "/" + subfolderName + "/" + filename )
+	fileDetails, err := database.GetFilesDetailsForFileID(s.Database, fileID, folderID, subfolderID)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error setting the file path %s", err)
+		errorMessage := fmt.Sprintf("Error retrieving the file details for id %d: %s", fileID, err)
 		log.Error(errorMessage)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": errorMessage,
 		})
 		return
-	 }
-	file, err := os.Create(filePath)
-	if err != nil {
-		errorMessage := fmt.Sprintf("Error creating the updated file on the path %s", filePath)
+	}
+	filename := fileDetails.Filename
+
+	// the updated content is encrypted with a new data key, wrapped the same way as the previous one,
+	// and the previous content is kept as a version of the file
+	password := ""
+	if fileDetails.KeyID == encryption.PasswordKeyID {
+		password = c.GetHeader(filePasswordHeader)
+		isPasswordCorrect, err := database.VerifyFilePassword(s.Database, fileID, folderID, subfolderID, password)
+		if err != nil {
+			log.Error("Error while trying to verify the password of the file %s", filename)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if !isPasswordCorrect {
+			log.Error("The password provided to update the file %s is not correct", filename)
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: folderID, SubfolderID: subfolderID, FileID: fileID}, labelActionUpload, false)
+	if !allowed {
+		return
+	}
+
+	if c.Request.ContentLength > 0 {
+		err = database.CheckQuota(s.Database, fileDetails.OwnerID, folderID, c.Request.ContentLength, 0)
+		if respondQuotaExceeded(c, err) {
+			log.Error("The file %s can't be updated: %s", filename, err)
+			return
+		} else if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = s.storeFileContent(fileID, claims.Id, c.Request.Body, password, true)
+	if respondQuotaExceeded(c, err) {
+		log.Error("The file %s can't be updated: %s", filename, err)
+		return
+	} else if err != nil {
+		errorMessage := fmt.Sprintf("Error saving the updated file %s", filename)
 		log.Error(errorMessage)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": errorMessage,
 		})
 		return
-	 }
-	defer file.Close()
-	bytesWritten, _ := file.Write(buffer)
+	}
 
-	log.Info("File %s successfully changed! Wrote %d bytes.", filename, bytesWritten)
+	log.Info("File %s successfully changed!", filename)
 	c.JSON(http.StatusOK, gin.H{
 		"id": fileID,
 	})
@@ -461,12 +1031,13 @@ func (s *Service) HandleRemoveFile(c *gin.Context) {
 		return
 	}
 
-	filename, err := database.GetFilenameFromID(s.Database, fileID)
+	fileDetails, err := database.GetFilesDetailsForFileID(s.Database, fileID, folderID, subfolderID)
 	if err != nil {
-		log.Error("Error getting the filename for the fileID %d: %s", fileID, err)
+		log.Error("Error getting the details for the fileID %d: %s", fileID, err)
 		c.Status(http.StatusBadRequest)
 		return
 	}
+	filename := fileDetails.Filename
 
 	isFileDeleted := database.RemoveFile(s.Database, fileID, folderID, claims.Id, subfolderID)
 	if !isFileDeleted {
@@ -475,9 +1046,12 @@ func (s *Service) HandleRemoveFile(c *gin.Context) {
 		c.Status(http.StatusInternalServerError)
 		return
 	} else {
-		err := os.Remove(pathToSaveFiles + "/" + folderName + "/" + subfolderName + "/" + filename)
-		if err != nil {
-			log.Fatal("%s", err)
+		// the content of the files stored as blobs is removed by the blob garbage collection once unreferenced
+		if fileDetails.BlobID == 0 && storage.IsStorageKey(fileDetails.Filepath) {
+			err := s.Storage.Remove(fileDetails.Filepath)
+			if err != nil {
+				log.Error("Error removing the file %s from the storage: %s", filename, err)
+			}
 		}
 		log.Info("Successfully deleted the file %s from workspace %s subfolder %s", filename, folderName, subfolderName)
 	}
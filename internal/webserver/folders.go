@@ -3,7 +3,6 @@ package webserver
 import (
 	"fmt"
 	"net/http"
-	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/CosminMocanu97/dissertationBackend/internal/database"
@@ -64,16 +63,7 @@ func (s *Service) HandlePostFolderRequest(c *gin.Context) {
 		return
 	} 
 
-	folderErr := os.Mkdir(pathToSaveFiles + folderDetails.Name, 0755)
-	if folderErr != nil {
-		errorMessage := fmt.Sprintf("Error creating the folder on file system for path %s : %s", pathToSaveFiles, folderErr)
-		log.Error(errorMessage)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": errorMessage,
-		})
-		return
-	}
-
+	setAuditTarget(c, folderId)
 	log.Info("Successfully created the folder with the name %s", folderDetails.Name)
 	c.JSON(http.StatusOK, gin.H{
 		"id": folderId,
@@ -94,8 +84,15 @@ func (s *Service) HandleGetAllFullFolderDetails(c *gin.Context) {
 		return
 	}
 
-	folderDetails, gsErr := database.GetAllFoldersDetails(s.Database)
-	if gsErr != nil {
+	page, err := getPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+
+	folderDetails, pageInfo, gsErr := database.GetAllFoldersDetails(s.Database, page)
+	if respondPaginationError(c, gsErr) {
+		return
+	} else if gsErr != nil {
 		errorMessage := fmt.Sprintf("Error retrieving all folders: %s", gsErr)
 		log.Error(errorMessage)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -107,6 +104,8 @@ func (s *Service) HandleGetAllFullFolderDetails(c *gin.Context) {
 	log.Info("Successfully retrieved the list of all folders for userID %d", claims.Id)
 	c.JSON(http.StatusOK, gin.H{
 		"folders": folderDetails,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
 	})
 }
 
@@ -139,6 +138,14 @@ func (s *Service) HandleRemoveFolder(c *gin.Context) {
 		return
 	}
 
+	// the storage keys have to be retrieved before the files are removed from the database
+	storedFiles, err := database.GetStoredFilesForFolder(s.Database, folderID, claims.Id)
+	if err != nil {
+		log.Error("Error retrieving the stored files of the folder %s: %s", folderName, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
 	folderErr := database.RemoveFolder(s.Database, folderID, claims.Id)
 	subfolderErr := database.RemoveSubfoldersFromFolder(s.Database, folderID, claims.Id)
 	filesErr := database.RemoveFilesFromFolder(s.Database, folderID, claims.Id)
@@ -159,11 +166,8 @@ func (s *Service) HandleRemoveFolder(c *gin.Context) {
 		c.Status(http.StatusInternalServerError)
 		return
 	} else {
-		err := os.RemoveAll(pathToSaveFiles + folderName)
-		if err != nil {
-			log.Fatal("%s", err)
-		}
-		log.Info("Successfully deleted the folder %s from file system", folderName)
+		s.removeStoredFiles(storedFiles)
+		log.Info("Successfully deleted the files of the folder %s from the storage", folderName)
 	}
 
 	log.Info("Successfully removed folder %s from the database", folderName)
@@ -0,0 +1,311 @@
+package webserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+// the limits of the imported archives, checked against the sizes declared by the archive, which archive/zip
+// enforces while the entries are read
+const (
+	maxImportArchiveSize  = 1 << 30
+	maxImportEntries      = 10000
+	maxImportExpandedSize = 4 << 30
+	maxImportFileSize     = 512 << 20
+	// maxImportCompressionRatio is the highest ratio between the size of an entry and its compressed size, only
+	// checked for the entries larger than importRatioMinSize, so the small documents full of blanks are accepted
+	maxImportCompressionRatio = 100
+	importRatioMinSize        = 1 << 20
+	// macOSMetadataFolder holds the resource forks added by the archives made on macOS
+	macOSMetadataFolder = "__MACOSX/"
+)
+
+// the statuses of the entries of an imported archive
+const (
+	importImported = "imported"
+	importSkipped  = "skipped"
+	importRejected = "rejected"
+)
+
+var (
+	invalidImportArchive        = "the file is not a valid ZIP archive"
+	importArchiveTooLarge       = "the archive can't be larger than 1 GiB"
+	tooManyImportEntries        = "the archive can't have more than 10000 entries"
+	importArchiveExpandsTooMuch = "the archive can't expand to more than 4 GiB"
+	importPathNotValid          = "the path of the entry is not valid"
+	importMacOSMetadata         = "the entry holds macOS metadata"
+	importFolderExists          = "the folder already exists, the files of the archive are added to it"
+	importNotRegularFile        = "only the regular files and the folders are imported"
+	importEntryEncrypted        = "the encrypted entries are not supported"
+	importFileTooLarge          = "the file can't be larger than 512 MiB"
+	importRatioTooHigh          = "the file is compressed more than 100 times, which is not expected from a document"
+	importContentMismatch       = "the content of the file doesn't match its extension"
+	importEntryCorrupted        = "the entry of the archive is corrupted"
+)
+
+// ImportReportEntry is the outcome of the import for an entry of the archive
+type ImportReportEntry struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	ID     int64  `json:"id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// archiveImport is the state of an import: the user, the subfolder the archive is extracted to, and the folders
+// already found or added, by their path in the archive
+type archiveImport struct {
+	claims  *auth.AuthCustomClaims
+	root    database.Node
+	folders map[string]database.Node
+}
+
+// importEntryPath splits the name of an entry into the names of its folders and its own name. The absolute names,
+// the Windows separators and the . and .. elements are refused, so the entries stay under the subfolder.
+func importEntryPath(name string) ([]string, bool) {
+	name = strings.TrimSuffix(name, "/")
+	if len(name) == 0 || strings.HasPrefix(name, "/") || strings.ContainsAny(name, "\\\x00") {
+		return nil, false
+	}
+	elements := strings.Split(name, "/")
+	for _, element := range elements {
+		if len(element) == 0 || element == "." || element == ".." {
+			return nil, false
+		}
+	}
+	return elements, true
+}
+
+// getImportFolder returns the folder of the path, adding it and its missing parents under the subfolder. The returned
+// bool tells if the folder itself was added.
+func (s *Service) getImportFolder(archiveImport *archiveImport, names []string) (database.Node, bool, error) {
+	folderPath := strings.Join(names, "/")
+	if folder, found := archiveImport.folders[folderPath]; found {
+		return folder, false, nil
+	}
+
+	parent, _, err := s.getImportFolder(archiveImport, names[:len(names)-1])
+	if err != nil {
+		return parent, false, err
+	}
+	folder, added, err := database.AddImportedNode(s.Database, archiveImport.claims.Id, parent, names[len(names)-1])
+	if err != nil {
+		return folder, false, err
+	}
+	archiveImport.folders[folderPath] = folder
+	return folder, added, nil
+}
+
+// importEntry extracts the entry of the archive, returning its report
+func (s *Service) importEntry(archiveImport *archiveImport, entry *zip.File) ImportReportEntry {
+	report := ImportReportEntry{Name: entry.Name, Type: "file"}
+	reject := func(reason string) ImportReportEntry {
+		report.Status, report.Reason = importRejected, reason
+		return report
+	}
+	if entry.FileInfo().IsDir() {
+		report.Type = "folder"
+	}
+
+	if strings.HasPrefix(entry.Name, macOSMetadataFolder) {
+		report.Status, report.Reason = importSkipped, importMacOSMetadata
+		return report
+	}
+	names, ok := importEntryPath(entry.Name)
+	if !ok {
+		log.Error("The entry %s of the imported archive has a path that is not valid", entry.Name)
+		return reject(importPathNotValid)
+	}
+
+	if entry.FileInfo().IsDir() {
+		folder, added, err := s.getImportFolder(archiveImport, names)
+		if err != nil && err.Error() == database.INVALID_NODE_NAME {
+			return reject(err.Error())
+		} else if err != nil {
+			return reject(http.StatusText(http.StatusInternalServerError))
+		}
+		report.ID, report.Status = folder.ID, importImported
+		if !added {
+			report.Status, report.Reason = importSkipped, importFolderExists
+		}
+		return report
+	}
+
+	// the checks only reading the headers of the entry come first
+	filename := names[len(names)-1]
+	switch {
+	case entry.Mode()&os.ModeType != 0:
+		return reject(importNotRegularFile)
+	case entry.Flags&0x1 != 0:
+		return reject(importEntryEncrypted)
+	case entry.UncompressedSize64 > maxImportFileSize:
+		return reject(importFileTooLarge)
+	case entry.UncompressedSize64 > importRatioMinSize && entry.UncompressedSize64 > maxImportCompressionRatio*entry.CompressedSize64:
+		log.Error("The entry %s of the imported archive is compressed %d times", entry.Name,
+			entry.UncompressedSize64/(entry.CompressedSize64+1))
+		return reject(importRatioTooHigh)
+	case !database.IsExtensionSupported(filename):
+		return reject(invalidFileExtension)
+	}
+
+	size := int64(entry.UncompressedSize64)
+	err := database.CheckQuota(s.Database, archiveImport.claims.Id, archiveImport.root.FolderID, size, 1)
+	if database.IsQuotaExceeded(err) {
+		return reject(err.Error())
+	} else if err != nil {
+		return reject(http.StatusText(http.StatusInternalServerError))
+	}
+
+	content, err := entry.Open()
+	if err != nil {
+		log.Error("Error opening the entry %s of the imported archive: %s", entry.Name, err)
+		return reject(importEntryCorrupted)
+	}
+	defer content.Close()
+	head := make([]byte, database.ContentSignatureLength)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Error("Error reading the entry %s of the imported archive: %s", entry.Name, err)
+		return reject(importEntryCorrupted)
+	}
+	if !database.ContentMatchesExtension(filename, head[:n]) {
+		log.Error("The content of the entry %s of the imported archive doesn't match its extension", entry.Name)
+		return reject(importContentMismatch)
+	}
+
+	folder, _, err := s.getImportFolder(archiveImport, names[:len(names)-1])
+	if err != nil && err.Error() == database.INVALID_NODE_NAME {
+		return reject(err.Error())
+	} else if err != nil {
+		return reject(http.StatusText(http.StatusInternalServerError))
+	}
+
+	root := archiveImport.root
+	fileID, err := database.AddNewFile(s.Database, archiveImport.claims.Id, root.FolderID, root.SubfolderID, folder.ID, filename, "", "", false)
+	if err != nil {
+		switch err.Error() {
+		case database.FILE_ALREADY_EXISTS:
+			report.Status, report.Reason = importSkipped, err.Error()
+			return report
+		case database.INVALID_FILE_NAME, database.UNSUPPORTED_EXTENSION:
+			return reject(err.Error())
+		}
+		return reject(http.StatusText(http.StatusInternalServerError))
+	}
+
+	err = s.storeFileContent(fileID, archiveImport.claims.Id, io.MultiReader(bytes.NewReader(head[:n]), content), "", false)
+	if err != nil {
+		log.Error("Error storing the entry %s of the imported archive: %s", entry.Name, err)
+		database.RemoveFile(s.Database, fileID, root.FolderID, archiveImport.claims.Id, root.SubfolderID)
+		switch {
+		case database.IsQuotaExceeded(err):
+			return reject(err.Error())
+		case err == zip.ErrFormat || err == zip.ErrChecksum || err == io.ErrUnexpectedEOF:
+			return reject(importEntryCorrupted)
+		}
+		return reject(http.StatusText(http.StatusInternalServerError))
+	}
+
+	report.ID, report.Status = fileID, importImported
+	return report
+}
+
+// HandlePostImportArchive extracts the ZIP archive of the archive form field into the subfolder, the folders of the
+// archive being added as folders of the subfolder, or merged with the existing ones. Each entry is validated on
+// its own, and the response reports the imported, skipped and rejected ones.
+func (s *Service) HandlePostImportArchive(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	root, ok := s.getFolderNodeFromRequest(c, true)
+	if !ok {
+		return
+	}
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: root.FolderID, SubfolderID: root.SubfolderID}, labelActionUpload, false)
+	if !allowed {
+		return
+	}
+
+	archiveFile, err := c.FormFile("archive")
+	if err != nil {
+		log.Error("Error getting the archive from the form: %s", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if archiveFile.Size > maxImportArchiveSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": importArchiveTooLarge,
+		})
+		return
+	}
+	src, err := archiveFile.Open()
+	if err != nil {
+		log.Error("Error opening the uploaded archive %s: %s", archiveFile.Filename, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+
+	archive, err := zip.NewReader(src, archiveFile.Size)
+	if err != nil {
+		log.Error("Error reading the uploaded archive %s: %s", archiveFile.Filename, err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": invalidImportArchive,
+		})
+		return
+	}
+	if len(archive.File) > maxImportEntries {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": tooManyImportEntries,
+		})
+		return
+	}
+	var expandedSize uint64
+	for _, entry := range archive.File {
+		expandedSize += entry.UncompressedSize64
+		if expandedSize > maxImportExpandedSize {
+			log.Error("The archive %s uploaded by the user %d expands to more than %d bytes", archiveFile.Filename, claims.Id, maxImportExpandedSize)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": importArchiveExpandsTooMuch,
+			})
+			return
+		}
+	}
+
+	archiveImport := &archiveImport{claims: claims, root: root, folders: map[string]database.Node{"": root}}
+	report := []ImportReportEntry{}
+	counts := map[string]int{}
+	for _, entry := range archive.File {
+		entryReport := s.importEntry(archiveImport, entry)
+		report = append(report, entryReport)
+		counts[entryReport.Status]++
+	}
+
+	log.Info("Successfully imported the archive %s into the subfolder %d: %d imported, %d skipped, %d rejected",
+		archiveFile.Filename, root.SubfolderID, counts[importImported], counts[importSkipped], counts[importRejected])
+	c.JSON(http.StatusOK, gin.H{
+		"entries":  report,
+		"imported": counts[importImported],
+		"skipped":  counts[importSkipped],
+		"rejected": counts[importRejected],
+	})
+}
@@ -0,0 +1,370 @@
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/watermark"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+// the actions checked against the rules of the sensitivity labels
+const (
+	labelActionRead     = "read"
+	labelActionDownload = "download"
+	labelActionUpload   = "upload"
+	labelActionShare    = "share"
+	// labelActionRemovePassword removes the password of a file
+	labelActionRemovePassword = "remove the password of"
+
+	// maxWatermarkedFileSize caps the files watermarked on download, the plaintext being stamped in memory
+	maxWatermarkedFileSize = 64 * 1024 * 1024
+)
+
+var (
+	mfaRequired             = "mfaRequired"
+	labelRequiresPassword   = "the sensitivity label requires the file or its subfolder to be locked with a password"
+	labelForbidsPublicShare = "the sensitivity label forbids public share links"
+	labelRequiresWatermark  = "the sensitivity label requires a watermark, which can't be applied to this file"
+)
+
+type LabelName struct {
+	Label string `json:"label"`
+}
+
+// labelTarget identifies a workspace, a subfolder or a file, the zero ids selecting the parent
+type labelTarget struct {
+	FolderID    int64
+	SubfolderID int64
+	FileID      int64
+}
+
+// labelDenial is why the rules of a label refuse an action, with the status of the response
+type labelDenial struct {
+	status  int
+	message string
+}
+
+// enforceLabelRules checks the action against the rules of the effective label of the target. When the action is
+// not allowed it responds and returns false. For uploads, newFileLocked tells if the uploaded file gets a password.
+// The label is returned, so the downloads can be watermarked.
+func (s *Service) enforceLabelRules(c *gin.Context, claims *auth.AuthCustomClaims, target labelTarget, action string,
+	newFileLocked bool) (database.LabelRules, bool) {
+	label, denial, err := s.checkLabelRules(claims, target, action, newFileLocked)
+	if err != nil {
+		errorMessage := "Error retrieving the sensitivity label"
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return label, false
+	}
+	if denial != nil {
+		c.JSON(denial.status, gin.H{
+			"error": denial.message,
+		})
+		return label, false
+	}
+	return label, true
+}
+
+// checkLabelRules is enforceLabelRules returning why the action is refused instead of responding, nil when it is
+// allowed
+func (s *Service) checkLabelRules(claims *auth.AuthCustomClaims, target labelTarget, action string,
+	newFileLocked bool) (database.LabelRules, *labelDenial, error) {
+	label, locked, err := database.GetEffectiveLabel(s.Database, target.FolderID, target.SubfolderID, target.FileID)
+	if err != nil {
+		return label, nil, err
+	}
+
+	if label.RequireMFA && !claims.MFA {
+		log.Error("The user %d needs the two factor authentication to %s items labeled %s", claims.Id, action, label.Name)
+		return label, &labelDenial{http.StatusForbidden, mfaRequired}, nil
+	}
+
+	switch action {
+	case labelActionDownload:
+		if label.RequirePassword && !locked {
+			log.Error("The file %d labeled %s is not locked with a password and can't be downloaded", target.FileID, label.Name)
+			return label, &labelDenial{http.StatusForbidden, labelRequiresPassword}, nil
+		}
+	case labelActionUpload:
+		if label.RequirePassword && !locked && !newFileLocked {
+			log.Error("The files uploaded to the subfolder %d labeled %s need a password", target.SubfolderID, label.Name)
+			return label, &labelDenial{http.StatusBadRequest, labelRequiresPassword}, nil
+		}
+	case labelActionRemovePassword:
+		if label.RequirePassword {
+			// the file can only lose its password when its subfolder is locked
+			_, subfolderLocked, err := database.GetEffectiveLabel(s.Database, target.FolderID, target.SubfolderID, 0)
+			if err != nil {
+				return label, nil, err
+			}
+			if !subfolderLocked {
+				log.Error("The password of the file %d labeled %s can't be removed", target.FileID, label.Name)
+				return label, &labelDenial{http.StatusConflict, labelRequiresPassword}, nil
+			}
+		}
+	case labelActionShare:
+		if label.ForbidPublicShare {
+			log.Error("The items labeled %s can't be shared publicly", label.Name)
+			return label, &labelDenial{http.StatusForbidden, labelForbidsPublicShare}, nil
+		}
+	}
+	return label, nil, nil
+}
+
+// sendFile streams the file as an attachment, stamped with who downloaded it and when if the label requires a watermark
+func (s *Service) sendFile(c *gin.Context, downloadedBy string, label database.LabelRules, filename string, file io.Reader) error {
+	if !label.Watermark {
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		c.Header("Content-Type", "application/octet-stream")
+		c.Status(http.StatusOK)
+		_, err := io.Copy(c.Writer, file)
+		return err
+	}
+
+	stamped, err := stampWatermark(downloadedBy, filename, file)
+	if err == errWatermarkRead {
+		c.Status(http.StatusInternalServerError)
+		return err
+	} else if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": labelRequiresWatermark,
+		})
+		return err
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Header("Content-Type", "application/octet-stream")
+	c.Status(http.StatusOK)
+	_, err = stamped.WriteTo(c.Writer)
+	return err
+}
+
+// errWatermarkRead is returned by stampWatermark when the file can't be read, the other errors meaning that the
+// file can't be stamped
+var errWatermarkRead = errors.New("the file to watermark could not be read")
+
+// stampWatermark returns the file stamped with who downloaded it and when. The stamped copy is built in memory,
+// so a document that can't be stamped is refused before anything is sent.
+func stampWatermark(downloadedBy string, filename string, file io.Reader) (*bytes.Buffer, error) {
+	if !watermark.Supported(filename) {
+		return nil, watermark.ErrUnsupportedFormat
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(file, maxWatermarkedFileSize+1))
+	if err != nil {
+		log.Error("Error reading the file %s to watermark: %s", filename, err)
+		return nil, errWatermarkRead
+	}
+	if len(content) > maxWatermarkedFileSize {
+		return nil, fmt.Errorf("the file is larger than %d bytes and can't be watermarked", maxWatermarkedFileSize)
+	}
+
+	var stamped bytes.Buffer
+	text := fmt.Sprintf("Downloaded by %s on %s", downloadedBy, time.Now().UTC().Format(time.RFC3339))
+	err = watermark.Stamp(&stamped, bytes.NewReader(content), int64(len(content)), filename, text)
+	if err != nil {
+		return nil, err
+	}
+	return &stamped, nil
+}
+
+// HandleGetLabels returns the sensitivity labels with their rules
+func (s *Service) HandleGetLabels(c *gin.Context) {
+	_, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	labels, err := database.GetLabels(s.Database)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"labels": labels,
+	})
+}
+
+// HandlePostLabelRules changes the rules of a sensitivity label, only the admins can change them
+func (s *Service) HandlePostLabelRules(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !s.verifyAdmin(c, claims) {
+		return
+	}
+
+	var label database.LabelRules
+	err = c.BindJSON(&label)
+	if err != nil {
+		log.Error("Error %s binding the JSON for HandlePostLabelRules request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	label.Name = c.Param("label")
+
+	err = database.SetLabelRules(s.Database, label)
+	if err != nil && err.Error() == database.UNKNOWN_LABEL {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("The admin %d changed the rules of the sensitivity label %s", claims.Id, label.Name)
+	c.JSON(http.StatusOK, gin.H{
+		"label": label,
+	})
+}
+
+// HandlePostFolderLabel sets the sensitivity label of a workspace
+func (s *Service) HandlePostFolderLabel(c *gin.Context) {
+	s.handlePostLabel(c, database.LabelFolder)
+}
+
+// HandlePostSubfolderLabel sets the sensitivity label of a subfolder
+func (s *Service) HandlePostSubfolderLabel(c *gin.Context) {
+	s.handlePostLabel(c, database.LabelSubfolder)
+}
+
+// HandlePostFileLabel sets the sensitivity label of a file
+func (s *Service) HandlePostFileLabel(c *gin.Context) {
+	s.handlePostLabel(c, database.LabelFile)
+}
+
+// handlePostLabel sets or removes, with an empty label, the label of the item. Only the owner of the item can label it,
+// and when the current or the new label requires the two factor authentication the owner must have logged in with it.
+func (s *Service) handlePostLabel(c *gin.Context, kind string) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var labelName LabelName
+	err = c.BindJSON(&labelName)
+	if err != nil {
+		log.Error("Error %s binding the JSON for the label request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	var target labelTarget
+	target.FolderID, err = getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		return
+	}
+	if kind != database.LabelFolder {
+		target.SubfolderID, err = getIntParameterFromRequest(c, "subfolder_id")
+		if err != nil {
+			return
+		}
+	}
+	if kind == database.LabelFile {
+		target.FileID, err = getIntParameterFromRequest(c, "file_id")
+		if err != nil {
+			return
+		}
+	}
+
+	var ownerID, itemID int64
+	switch kind {
+	case database.LabelFolder:
+		folderDetails, err := database.GetAllFoldersDetailsForID(s.Database, target.FolderID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		ownerID, itemID = folderDetails.OwnerID, target.FolderID
+	case database.LabelSubfolder:
+		subfolderDetails, err := database.GetAllSubfolderDetailsForID(s.Database, target.SubfolderID, target.FolderID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		ownerID, itemID = subfolderDetails.OwnerID, target.SubfolderID
+	case database.LabelFile:
+		fileDetails, err := database.GetFilesDetailsForFileID(s.Database, target.FileID, target.FolderID, target.SubfolderID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		ownerID, itemID = fileDetails.OwnerID, target.FileID
+	}
+	if ownerID != claims.Id {
+		log.Error("The user %d tried to label the %s %d, owned by %d", claims.Id, kind, itemID, ownerID)
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	// the current label is enforced, so an item can't be unlabeled without the second factor it requires
+	_, allowed := s.enforceLabelRules(c, claims, target, labelActionRead, false)
+	if !allowed {
+		return
+	}
+	newLabel, err := database.GetLabel(s.Database, labelName.Label)
+	if err != nil && err.Error() == database.UNKNOWN_LABEL {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if newLabel.RequireMFA && !claims.MFA {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": mfaRequired,
+		})
+		return
+	}
+
+	err = database.SetLabel(s.Database, kind, itemID, labelName.Label)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully set the label of the %s %d to %s", kind, itemID, labelName.Label)
+	c.JSON(http.StatusOK, gin.H{
+		"label": labelName.Label,
+	})
+}
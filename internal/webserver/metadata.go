@@ -0,0 +1,493 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+const metadataFilterPrefix = "meta."
+
+// ItemMetadataEdit is the body of the requests setting the metadata of a file or a subfolder. The tags are
+// replaced when they are sent, while the values are merged, a null value removing the field.
+type ItemMetadataEdit struct {
+	Tags   []string               `json:"tags"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// BulkMetadataEdit is the body of the requests editing the metadata of several files and subfolders at once
+type BulkMetadataEdit struct {
+	Files      []int64                `json:"files"`
+	Subfolders []int64                `json:"subfolders"`
+	Tags       []string               `json:"tags"`
+	AddTags    []string               `json:"addTags"`
+	RemoveTags []string               `json:"removeTags"`
+	Values     map[string]interface{} `json:"values"`
+}
+
+// getMetadataFilters reads the meta.<field>, meta.<field>.min and meta.<field>.max query parameters
+func getMetadataFilters(c *gin.Context) []database.MetadataFilter {
+	filtersByField := map[string]*database.MetadataFilter{}
+	var fields []string
+	for name, values := range c.Request.URL.Query() {
+		if !strings.HasPrefix(name, metadataFilterPrefix) || len(values) == 0 {
+			continue
+		}
+		field := strings.TrimPrefix(name, metadataFilterPrefix)
+		bound := ""
+		if strings.HasSuffix(field, ".min") || strings.HasSuffix(field, ".max") {
+			bound = field[len(field)-3:]
+			field = field[:len(field)-4]
+		}
+
+		filter, exists := filtersByField[field]
+		if !exists {
+			filter = &database.MetadataFilter{Field: field}
+			filtersByField[field] = filter
+			fields = append(fields, field)
+		}
+		switch bound {
+		case "min":
+			filter.Min = values[0]
+		case "max":
+			filter.Max = values[0]
+		default:
+			filter.Value = values[0]
+		}
+	}
+
+	filters := []database.MetadataFilter{}
+	for _, field := range fields {
+		filters = append(filters, *filtersByField[field])
+	}
+	return filters
+}
+
+// getMetadataValues converts the values of the request to text, numbers being sent either as JSON numbers or as strings
+func getMetadataValues(values map[string]interface{}) (map[string]*string, error) {
+	converted := map[string]*string{}
+	for name, value := range values {
+		switch typedValue := value.(type) {
+		case nil:
+			converted[name] = nil
+		case string:
+			converted[name] = &typedValue
+		case float64:
+			text := strconv.FormatFloat(typedValue, 'f', -1, 64)
+			converted[name] = &text
+		default:
+			return nil, fmt.Errorf("the value of the metadata field %s must be a string or a number", name)
+		}
+	}
+	return converted, nil
+}
+
+// respondMetadataError returns true, after responding, if the error is caused by the metadata of the request
+func respondMetadataError(c *gin.Context, err error) bool {
+	if err != nil && err.Error() == database.METADATA_ITEMS_NOT_OWNED {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		})
+		return true
+	}
+	if !database.IsMetadataError(err) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": err.Error(),
+	})
+	return true
+}
+
+// HandleGetMetadataFields returns the metadata schema of the workspace
+func (s *Service) HandleGetMetadataFields(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the "+
+			"HandleGetMetadataFields request: %s", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	fields, err := database.GetMetadataFields(s.Database, folderID)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the metadata fields of the folder %d", folderID)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	log.Info("Successfully retrieved the metadata fields of the folder %d for the user %d", folderID, claims.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"fields": fields,
+	})
+}
+
+// HandlePostMetadataField adds a field to the metadata schema of the workspace, only its owner can change it
+func (s *Service) HandlePostMetadataField(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var field database.MetadataField
+	err = c.BindJSON(&field)
+	if err != nil {
+		log.Error("Error %s binding the JSON for HandlePostMetadataField request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	folderID, ok := s.verifyWorkspaceOwner(c, claims.Id)
+	if !ok {
+		return
+	}
+
+	fieldID, err := database.AddMetadataField(s.Database, folderID, field)
+	if err != nil && err.Error() == database.METADATA_FIELD_ALREADY_EXISTS {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if respondMetadataError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully added the metadata field %s to the folder %d", field.Name, folderID)
+	c.JSON(http.StatusOK, gin.H{
+		"id": fieldID,
+	})
+}
+
+// HandleRemoveMetadataField removes a field from the metadata schema of the workspace, along with its values
+func (s *Service) HandleRemoveMetadataField(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	folderID, ok := s.verifyWorkspaceOwner(c, claims.Id)
+	if !ok {
+		return
+	}
+
+	fieldID, err := getIntParameterFromRequest(c, "field_id")
+	if err != nil {
+		log.Error("Error retrieving field_id parameter from the "+
+			"HandleRemoveMetadataField request: %s", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	err = database.RemoveMetadataField(s.Database, folderID, fieldID)
+	if err != nil && err.Error() == database.UNKNOWN_METADATA_FIELD {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully removed the metadata field %d from the folder %d", fieldID, folderID)
+	c.Status(http.StatusOK)
+}
+
+// verifyWorkspaceOwner returns the folder_id parameter, responding with 403 when the user doesn't own the workspace
+func (s *Service) verifyWorkspaceOwner(c *gin.Context, userID int64) (int64, bool) {
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the request: %s", err)
+		c.Status(http.StatusBadRequest)
+		return 0, false
+	}
+
+	folderDetails, err := database.GetAllFoldersDetailsForID(s.Database, folderID)
+	if err != nil {
+		log.Error("Error retrieving the details for the folder %d: %s", folderID, err)
+		c.Status(http.StatusInternalServerError)
+		return 0, false
+	}
+	if folderDetails.OwnerID != userID {
+		log.Error("The user %d tried to change the metadata schema of the folder %d, owned by %d", userID, folderID, folderDetails.OwnerID)
+		c.Status(http.StatusForbidden)
+		return 0, false
+	}
+	return folderID, true
+}
+
+// HandleGetFileMetadata returns the tags and the metadata values of the file
+func (s *Service) HandleGetFileMetadata(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	fileID, err := getIntParameterFromRequest(c, "file_id")
+	if err != nil {
+		log.Error("Error retrieving file id parameter from the request: %s", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		return
+	}
+	subfolderID, err := getIntParameterFromRequest(c, "subfolder_id")
+	if err != nil {
+		return
+	}
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: folderID, SubfolderID: subfolderID, FileID: fileID}, labelActionRead, false)
+	if !allowed {
+		return
+	}
+
+	metadata, err := database.GetFileMetadata(s.Database, fileID)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the metadata of the file %d", fileID)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	log.Info("Successfully retrieved the metadata of the file %d for the user %d", fileID, claims.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"tags":   metadata.Tags,
+		"values": metadata.Values,
+	})
+}
+
+// HandlePostFileMetadata sets the tags and the metadata values of the file, only its owner can change them
+func (s *Service) HandlePostFileMetadata(c *gin.Context) {
+	s.handlePostItemMetadata(c, "file_id")
+}
+
+// HandleGetSubfolderMetadata returns the tags and the metadata values of the subfolder
+func (s *Service) HandleGetSubfolderMetadata(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	subfolderID, err := getIntParameterFromRequest(c, "subfolder_id")
+	if err != nil {
+		log.Error("Error retrieving subfolder_id parameter from the request: %s", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		return
+	}
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: folderID, SubfolderID: subfolderID}, labelActionRead, false)
+	if !allowed {
+		return
+	}
+
+	metadata, err := database.GetSubfolderMetadata(s.Database, subfolderID)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the metadata of the subfolder %d", subfolderID)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	log.Info("Successfully retrieved the metadata of the subfolder %d for the user %d", subfolderID, claims.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"tags":   metadata.Tags,
+		"values": metadata.Values,
+	})
+}
+
+// HandlePostSubfolderMetadata sets the tags and the metadata values of the subfolder, only its owner can change them
+func (s *Service) HandlePostSubfolderMetadata(c *gin.Context) {
+	s.handlePostItemMetadata(c, "subfolder_id")
+}
+
+// handlePostItemMetadata edits the metadata of the file or of the subfolder identified by the parameter
+func (s *Service) handlePostItemMetadata(c *gin.Context, itemParameter string) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var itemEdit ItemMetadataEdit
+	err = c.BindJSON(&itemEdit)
+	if err != nil {
+		log.Error("Error %s binding the JSON for the metadata request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the metadata request: %s", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	itemID, err := getIntParameterFromRequest(c, itemParameter)
+	if err != nil {
+		log.Error("Error retrieving %s parameter from the metadata request: %s", itemParameter, err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	values, err := getMetadataValues(itemEdit.Values)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	edit := database.MetadataEdit{Tags: itemEdit.Tags, Values: values}
+	var fileIDs, subfolderIDs []int64
+	if itemParameter == "file_id" {
+		fileIDs = []int64{itemID}
+	} else {
+		subfolderIDs = []int64{itemID}
+	}
+	err = database.EditMetadata(s.Database, folderID, claims.Id, fileIDs, subfolderIDs, edit)
+	if respondMetadataError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully set the metadata of the item %d in the folder %d", itemID, folderID)
+	c.Status(http.StatusOK)
+}
+
+// HandlePostBulkMetadata edits the metadata of several files and subfolders of the workspace at once,
+// all of them being owned by the user. Either every item is edited or none is.
+func (s *Service) HandlePostBulkMetadata(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var bulkEdit BulkMetadataEdit
+	err = c.BindJSON(&bulkEdit)
+	if err != nil {
+		log.Error("Error %s binding the JSON for HandlePostBulkMetadata request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the "+
+			"HandlePostBulkMetadata request: %s", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	values, err := getMetadataValues(bulkEdit.Values)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	edit := database.MetadataEdit{
+		Tags:       bulkEdit.Tags,
+		AddTags:    bulkEdit.AddTags,
+		RemoveTags: bulkEdit.RemoveTags,
+		Values:     values,
+	}
+	err = database.EditMetadata(s.Database, folderID, claims.Id, bulkEdit.Files, bulkEdit.Subfolders, edit)
+	if respondMetadataError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully edited the metadata of %d files and %d subfolders in the folder %d",
+		len(bulkEdit.Files), len(bulkEdit.Subfolders), folderID)
+	c.JSON(http.StatusOK, gin.H{
+		"files":      len(bulkEdit.Files),
+		"subfolders": len(bulkEdit.Subfolders),
+	})
+}
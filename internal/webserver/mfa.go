@@ -0,0 +1,198 @@
+package webserver
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+const mfaIssuer = "Dissertation"
+
+type MFACode struct {
+	Code string `json:"code"`
+}
+
+// verifyMFACode returns true if the code is valid for the secret of the user and wasn't used before
+func verifyMFACode(db *sql.DB, userID int64, mfa database.UserMFA, code string) (bool, error) {
+	step, isValid := auth.ValidateTOTP(mfa.Secret, code, time.Now(), mfa.LastStep)
+	if !isValid {
+		log.Error("The user %d sent a two factor authentication code that is not valid", userID)
+		return false, nil
+	}
+	return database.UseMFAStep(db, userID, step)
+}
+
+// HandlePostMFASetup generates a new secret for the two factor authentication, which is enabled once a code
+// generated with it is sent to HandlePostMFAEnable
+func (s *Service) HandlePostMFASetup(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !verifyLoginSession(c) {
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		log.Error("Error generating the two factor authentication secret for the user %d: %s", claims.Id, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	err = database.SetUserMFASecret(s.Database, claims.Id, secret)
+	if err != nil && err.Error() == database.MFA_ALREADY_ENABLED {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully generated the two factor authentication secret for the user %d", claims.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    auth.TOTPURI(mfaIssuer, claims.Email, secret),
+	})
+}
+
+// HandlePostMFAEnable enables the two factor authentication after verifying a code of the new secret,
+// returning a token pair marked as logged in with the second factor
+func (s *Service) HandlePostMFAEnable(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !verifyLoginSession(c) {
+		return
+	}
+
+	var mfaCode MFACode
+	err = c.BindJSON(&mfaCode)
+	if err != nil {
+		log.Error("Error %s binding the JSON for HandlePostMFAEnable request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	mfa, err := database.GetUserMFA(s.Database, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if mfa.Enabled || len(mfa.Secret) == 0 {
+		log.Error("The user %d tried to enable the two factor authentication without setting it up", claims.Id)
+		c.JSON(http.StatusConflict, gin.H{
+			"error": database.MFA_NOT_SET_UP,
+		})
+		return
+	}
+
+	isCodeValid, err := verifyMFACode(s.Database, claims.Id, mfa, mfaCode.Code)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if !isCodeValid {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": ERROR_INVALID_MFA_CODE,
+		})
+		return
+	}
+
+	err = database.EnableUserMFA(s.Database, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	tokens := auth.JWTAuthService().GenerateToken(claims.Id, claims.Email, claims.IsActivated, true)
+	log.Info("Successfully enabled the two factor authentication for the user %d", claims.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokens["access_token"],
+		"refresh_token": tokens["refresh_token"],
+	})
+}
+
+// HandlePostMFADisable disables the two factor authentication, a current code being required
+func (s *Service) HandlePostMFADisable(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !verifyLoginSession(c) {
+		return
+	}
+
+	var mfaCode MFACode
+	err = c.BindJSON(&mfaCode)
+	if err != nil {
+		log.Error("Error %s binding the JSON for HandlePostMFADisable request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	mfa, err := database.GetUserMFA(s.Database, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if !mfa.Enabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": database.MFA_NOT_SET_UP,
+		})
+		return
+	}
+
+	isCodeValid, err := verifyMFACode(s.Database, claims.Id, mfa, mfaCode.Code)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if !isCodeValid {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": ERROR_INVALID_MFA_CODE,
+		})
+		return
+	}
+
+	err = database.DisableUserMFA(s.Database, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully disabled the two factor authentication for the user %d", claims.Id)
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,403 @@
+package webserver
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	sourceSubfolderLocked  = "the subfolder of the item is locked with a password, an unlock grant for it is needed"
+	renamedContentMismatch = "the content of the file doesn't match the extension of its new name"
+)
+
+// Rename is the body of the rename requests
+type Rename struct {
+	Name string `json:"name"`
+}
+
+// MoveTarget is the folder an item is moved to, either a node of the tree or a workspace with one of its
+// subfolders, the zero subfolder selecting the workspace itself
+type MoveTarget struct {
+	NodeID      int64 `json:"nodeId"`
+	FolderID    int64 `json:"folderId"`
+	SubfolderID int64 `json:"subfolderId"`
+}
+
+// getFolderNodeFromRequest returns the node of the folder_id parameter, or of the subfolder_id parameter
+func (s *Service) getFolderNodeFromRequest(c *gin.Context, isSubfolder bool) (database.Node, bool) {
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		return database.Node{}, false
+	}
+	var subfolderID int64
+	if isSubfolder {
+		subfolderID, err = getIntParameterFromRequest(c, "subfolder_id")
+		if err != nil {
+			return database.Node{}, false
+		}
+	}
+
+	node, err := database.GetFolderNode(s.Database, folderID, subfolderID)
+	if respondNodeError(c, err) {
+		return node, false
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return node, false
+	}
+	return node, true
+}
+
+// getMoveTarget reads the target of a move from the body of the request
+func (s *Service) getMoveTarget(c *gin.Context) (database.Node, bool) {
+	var moveTarget MoveTarget
+	err := c.BindJSON(&moveTarget)
+	if err != nil {
+		log.Error("Error %s binding the JSON of the move request", err)
+		c.Status(http.StatusBadRequest)
+		return database.Node{}, false
+	}
+	return s.getTargetNode(c, moveTarget)
+}
+
+// getTargetNode returns the node the target of a move or of a copy stands for
+func (s *Service) getTargetNode(c *gin.Context, moveTarget MoveTarget) (database.Node, bool) {
+	var target database.Node
+	var err error
+	if moveTarget.NodeID != 0 {
+		target, err = database.GetNode(s.Database, moveTarget.NodeID)
+	} else {
+		target, err = database.GetFolderNode(s.Database, moveTarget.FolderID, moveTarget.SubfolderID)
+	}
+	if respondNodeError(c, err) {
+		return target, false
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return target, false
+	}
+	return target, true
+}
+
+// checkSourceRules checks the user can take the item out of its subfolder, moving or copying it: the rules of its
+// label must allow reading it, and its subfolder, when locked with a password, must be unlocked by a grant of the
+// user. It returns why the item can't be taken, nil when it can.
+func (s *Service) checkSourceRules(c *gin.Context, claims *auth.AuthCustomClaims, source labelTarget) (*labelDenial, error) {
+	_, denial, err := s.checkLabelRules(claims, source, labelActionRead, false)
+	if err != nil || denial != nil {
+		return denial, err
+	}
+
+	_, subfolderLocked, err := database.GetEffectiveLabel(s.Database, source.FolderID, source.SubfolderID, 0)
+	if err != nil || !subfolderLocked {
+		return nil, err
+	}
+	_, unlockedSubfolderIDs := getUnlockedIDs(c, claims.Id)
+	for _, unlockedSubfolderID := range unlockedSubfolderIDs {
+		if unlockedSubfolderID == source.SubfolderID {
+			return nil, nil
+		}
+	}
+	log.Error("The user %d has no unlock grant to take an item out of the subfolder %d", claims.Id, source.SubfolderID)
+	return &labelDenial{http.StatusUnauthorized, sourceSubfolderLocked}, nil
+}
+
+// fileSource returns the file of the request as the source of a move or of a copy, once getOwnedFile found it in
+// the folder_id and subfolder_id parameters
+func fileSource(c *gin.Context, fileID int64) labelTarget {
+	folderID, _ := getIntParameterFromRequest(c, "folder_id")
+	subfolderID, _ := getIntParameterFromRequest(c, "subfolder_id")
+	return labelTarget{FolderID: folderID, SubfolderID: subfolderID, FileID: fileID}
+}
+
+// enforceSourceRules is checkSourceRules responding and returning false when the item can't be taken
+func (s *Service) enforceSourceRules(c *gin.Context, claims *auth.AuthCustomClaims, source labelTarget) bool {
+	denial, err := s.checkSourceRules(c, claims, source)
+	if err != nil {
+		errorMessage := "Error retrieving the sensitivity label"
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return false
+	}
+	if denial != nil {
+		c.JSON(denial.status, gin.H{
+			"error": denial.message,
+		})
+		return false
+	}
+	return true
+}
+
+// renamedContentMatches tells if the content of the file matches the extension of its new name, like for the
+// imported files, so a rename can't pass a file off as another type. The names keeping the extension and the
+// files without content are not checked.
+func (s *Service) renamedContentMatches(c *gin.Context, blob database.Blob, filename string, newFilename string) (bool, error) {
+	if strings.EqualFold(filepath.Ext(filename), filepath.Ext(newFilename)) || len(blob.StorageKey) == 0 {
+		return true, nil
+	}
+	file, err := s.openBlob(c, blob)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, database.ContentSignatureLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Error("Error reading the content of the file %s: %s", filename, err)
+		return false, err
+	}
+	return database.ContentMatchesExtension(newFilename, head[:n]), nil
+}
+
+// HandlePostRenameFile renames a file, only its owner can rename it. A new extension must match the content.
+func (s *Service) HandlePostRenameFile(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	fileID, fileDetails, ok := s.getOwnedFile(c, claims.Id)
+	if !ok {
+		return
+	}
+
+	var rename Rename
+	err = c.BindJSON(&rename)
+	if err != nil {
+		log.Error("Error %s binding the JSON of the rename request of the file %d", err, fileID)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	contentMatches, err := s.renamedContentMatches(c, storedFileBlob(fileDetails), fileDetails.Filename, rename.Name)
+	if err == encryption.ErrInvalidPassword {
+		log.Error("The password provided to rename the file %s is not correct", fileDetails.Filename)
+		c.Status(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	} else if !contentMatches {
+		log.Error("The content of the file %d doesn't match the name %s", fileID, rename.Name)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": renamedContentMismatch,
+		})
+		return
+	}
+
+	err = database.RenameFile(s.Database, fileID, rename.Name)
+	if respondNodeError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully renamed the file %d to %s", fileID, rename.Name)
+	c.Status(http.StatusOK)
+}
+
+// HandlePostMoveFile moves a file to another folder, only its owner can move it. The file must be readable where
+// it is, and the label of the target must allow the file to be uploaded there.
+func (s *Service) HandlePostMoveFile(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	fileID, fileDetails, ok := s.getOwnedFile(c, claims.Id)
+	if !ok {
+		return
+	}
+	target, ok := s.getMoveTarget(c)
+	if !ok {
+		return
+	}
+
+	if !s.enforceSourceRules(c, claims, fileSource(c, fileID)) {
+		return
+	}
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: target.FolderID, SubfolderID: target.SubfolderID}, labelActionUpload, fileDetails.FileLocked)
+	if !allowed {
+		return
+	}
+
+	err = database.MoveFile(s.Database, fileID, target)
+	if respondNodeError(c, err) || respondQuotaExceeded(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully moved the file %d to the node %d", fileID, target.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"folderId":    target.FolderID,
+		"subfolderId": target.SubfolderID,
+		"nodeId":      target.ID,
+	})
+}
+
+// HandlePostRenameFolder renames a workspace
+func (s *Service) HandlePostRenameFolder(c *gin.Context) {
+	s.handleRenameNode(c, func() (database.Node, bool) {
+		return s.getFolderNodeFromRequest(c, false)
+	})
+}
+
+// HandlePostRenameSubfolder renames a subfolder
+func (s *Service) HandlePostRenameSubfolder(c *gin.Context) {
+	s.handleRenameNode(c, func() (database.Node, bool) {
+		return s.getFolderNodeFromRequest(c, true)
+	})
+}
+
+// HandlePostRenameNode renames a folder of the tree
+func (s *Service) HandlePostRenameNode(c *gin.Context) {
+	s.handleRenameNode(c, func() (database.Node, bool) {
+		return s.getNode(c)
+	})
+}
+
+// handleRenameNode renames the node returned by getNode, only its owner can rename it
+func (s *Service) handleRenameNode(c *gin.Context, getNode func() (database.Node, bool)) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	node, ok := getNode()
+	if !ok || !verifyNodeOwner(c, claims, node) {
+		return
+	}
+
+	var rename Rename
+	err = c.BindJSON(&rename)
+	if err != nil {
+		log.Error("Error %s binding the JSON of the rename request of the node %d", err, node.ID)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	err = database.RenameNode(s.Database, node, rename.Name)
+	if respondNodeError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully renamed the node %d to %s", node.ID, rename.Name)
+	c.Status(http.StatusOK)
+}
+
+// HandlePostMoveSubfolder moves a subfolder to another workspace
+func (s *Service) HandlePostMoveSubfolder(c *gin.Context) {
+	s.handleMoveNode(c, func() (database.Node, bool) {
+		return s.getFolderNodeFromRequest(c, true)
+	})
+}
+
+// HandlePostMoveNode moves a folder of the tree under another one
+func (s *Service) HandlePostMoveNode(c *gin.Context) {
+	s.handleMoveNode(c, func() (database.Node, bool) {
+		return s.getNode(c)
+	})
+}
+
+// handleMoveNode moves the node returned by getNode, only its owner can move it. The node must be readable where
+// it is, and the label of the target must allow the content of the node to be uploaded there.
+func (s *Service) handleMoveNode(c *gin.Context, getNode func() (database.Node, bool)) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	node, ok := getNode()
+	if !ok || !verifyNodeOwner(c, claims, node) {
+		return
+	}
+	target, ok := s.getMoveTarget(c)
+	if !ok {
+		return
+	}
+	if !s.enforceSourceRules(c, claims, labelTarget{FolderID: node.FolderID, SubfolderID: node.SubfolderID}) {
+		return
+	}
+
+	// a subfolder keeps its own password, the deeper folders get the one of the subfolder they land in
+	var nodeLocked bool
+	if node.Depth == 1 {
+		subfolderDetails, err := database.GetAllSubfolderDetailsForID(s.Database, node.SubfolderID, node.FolderID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		nodeLocked = subfolderDetails.IsLocked
+	}
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: target.FolderID, SubfolderID: target.SubfolderID}, labelActionUpload, nodeLocked)
+	if !allowed {
+		return
+	}
+
+	err = database.MoveNode(s.Database, node, target)
+	if respondNodeError(c, err) || respondQuotaExceeded(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully moved the node %d under the node %d", node.ID, target.ID)
+	c.Status(http.StatusOK)
+}
+
+// verifyNodeOwner responds with 403 and returns false when the user doesn't own the node
+func verifyNodeOwner(c *gin.Context, claims *auth.AuthCustomClaims, node database.Node) bool {
+	if node.OwnerID != claims.Id {
+		log.Error("The user %d can't change the node %d of the user %d", claims.Id, node.ID, node.OwnerID)
+		c.Status(http.StatusForbidden)
+		return false
+	}
+	return true
+}
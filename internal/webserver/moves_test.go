@@ -0,0 +1,149 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+)
+
+// targetBody is the JSON body of a move to the subfolder
+func targetBody(folderID int64, subfolderID int64) *strings.Reader {
+	return strings.NewReader(fmt.Sprintf(`{"folderId": %d, "subfolderId": %d}`, folderID, subfolderID))
+}
+
+// subfolderGrant returns an unlock grant of the user for the subfolder
+func subfolderGrant(t *testing.T, userID int64, subfolderID int64) string {
+	grant, err := auth.GenerateUnlockGrant(userID, auth.UnlockGrantSubfolder, subfolderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return grant
+}
+
+// setLabel sets the label of the workspace, subfolder or file
+func (s *testService) setLabel(t *testing.T, kind string, id int64, name string) {
+	if err := database.SetLabel(s.Database, kind, id, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMoveFileNeedsAnUnlockedSource(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, token := s.addUser(t, "owner@example.com")
+	folderID, subfolderID := s.addSubfolder(t, ownerID, "locked", "subfolder password")
+	targetFolderID, targetSubfolderID := s.addSubfolder(t, ownerID, "target", "")
+	fileID := s.addFile(t, ownerID, folderID, subfolderID, "report.pdf", "%PDF-1.4 report", "")
+	path := "/user/" + itoa(folderID) + "/" + itoa(subfolderID) + "/" + itoa(fileID) + "/move"
+
+	response := s.serve(http.MethodPost, path, token, targetBody(targetFolderID, targetSubfolderID))
+	expectStatus(t, response, http.StatusUnauthorized, "moving a file out of a locked subfolder without its grant")
+
+	response = s.serve(http.MethodPost, path, token, targetBody(targetFolderID, targetSubfolderID),
+		unlockGrantsHeader, subfolderGrant(t, ownerID, subfolderID))
+	expectStatus(t, response, http.StatusOK, "moving a file out of an unlocked subfolder")
+}
+
+func TestMoveFileKeepsTheRulesOfItsLabel(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, token := s.addUser(t, "owner@example.com")
+	restrictedFolderID, restrictedSubfolderID := s.addSubfolder(t, ownerID, "restricted", "")
+	confidentialFolderID, confidentialSubfolderID := s.addSubfolder(t, ownerID, "confidential", "")
+	publicFolderID, publicSubfolderID := s.addSubfolder(t, ownerID, "public", "")
+	targetFolderID, targetSubfolderID := s.addSubfolder(t, ownerID, "target", "")
+	s.setLabel(t, database.LabelSubfolder, restrictedSubfolderID, "restricted")
+	s.setLabel(t, database.LabelSubfolder, confidentialSubfolderID, "confidential")
+	s.setLabel(t, database.LabelSubfolder, targetSubfolderID, "confidential")
+	restrictedFileID := s.addFile(t, ownerID, restrictedFolderID, restrictedSubfolderID, "restricted.pdf", "%PDF-1.4", "file password")
+	confidentialFileID := s.addFile(t, ownerID, confidentialFolderID, confidentialSubfolderID, "confidential.pdf", "%PDF-1.4", "")
+
+	// the restricted files can't be read without the second factor
+	path := "/user/" + itoa(restrictedFolderID) + "/" + itoa(restrictedSubfolderID) + "/" + itoa(restrictedFileID) + "/move"
+	response := s.serve(http.MethodPost, path, token, targetBody(targetFolderID, targetSubfolderID))
+	expectStatus(t, response, http.StatusForbidden, "moving a restricted file without the second factor")
+
+	path = "/user/" + itoa(confidentialFolderID) + "/" + itoa(confidentialSubfolderID) + "/" + itoa(confidentialFileID) + "/move"
+	response = s.serve(http.MethodPost, path, token, targetBody(publicFolderID, publicSubfolderID))
+	expectStatus(t, response, http.StatusForbidden, "moving a confidential file to an unlabeled subfolder")
+	if !strings.Contains(response.Body.String(), database.LABEL_LOWERED) {
+		t.Fatalf("the move was refused with %s", response.Body.String())
+	}
+
+	response = s.serve(http.MethodPost, path, token, targetBody(targetFolderID, targetSubfolderID))
+	expectStatus(t, response, http.StatusOK, "moving a confidential file to a confidential subfolder")
+}
+
+func TestMoveNodeNeedsAnUnlockedSource(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, token := s.addUser(t, "owner@example.com")
+	folderID, subfolderID := s.addSubfolder(t, ownerID, "locked", "subfolder password")
+	targetFolderID, targetSubfolderID := s.addSubfolder(t, ownerID, "target", "")
+	subfolderNode, err := database.GetFolderNode(s.Database, folderID, subfolderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeID, err := database.AddNode(s.Database, ownerID, subfolderNode, "drafts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/nodes/" + itoa(nodeID) + "/move"
+
+	response := s.serve(http.MethodPost, path, token, targetBody(targetFolderID, targetSubfolderID))
+	expectStatus(t, response, http.StatusUnauthorized, "moving a folder out of a locked subfolder without its grant")
+
+	// the files of the folder would lose the password of the subfolder
+	response = s.serve(http.MethodPost, path, token, targetBody(targetFolderID, targetSubfolderID),
+		unlockGrantsHeader, subfolderGrant(t, ownerID, subfolderID))
+	expectStatus(t, response, http.StatusForbidden, "moving a folder out of an unlocked subfolder")
+}
+
+func TestRenameFileChecksTheContentOfANewExtension(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, token := s.addUser(t, "owner@example.com")
+	folderID, subfolderID := s.addSubfolder(t, ownerID, "reports", "")
+	fileID := s.addFile(t, ownerID, folderID, subfolderID, "report.pdf", "%PDF-1.4 report", "")
+	path := "/user/" + itoa(folderID) + "/" + itoa(subfolderID) + "/" + itoa(fileID) + "/rename"
+
+	response := s.serve(http.MethodPost, path, token, strings.NewReader(`{"name": "report.docx"}`))
+	expectStatus(t, response, http.StatusBadRequest, "renaming a PDF file to a DOCX name")
+
+	response = s.serve(http.MethodPost, path, token, strings.NewReader(`{"name": "final report.PDF"}`))
+	expectStatus(t, response, http.StatusOK, "renaming a PDF file to another PDF name")
+}
+
+func TestDAVMoveRenamesInTheSameStep(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, token := s.addUser(t, "owner@example.com")
+	folderID, subfolderID := s.addSubfolder(t, ownerID, "reports", "")
+	targetFolderID, targetSubfolderID := s.addSubfolder(t, ownerID, "target", "")
+	fileID := s.addFile(t, ownerID, folderID, subfolderID, "report.pdf", "%PDF-1.4", "")
+	s.addFile(t, ownerID, targetFolderID, targetSubfolderID, "report.pdf", "%PDF-1.4 target", "")
+	lockedFolderID, lockedSubfolderID := s.addSubfolder(t, ownerID, "locked", "subfolder password")
+	s.addFile(t, ownerID, lockedFolderID, lockedSubfolderID, "locked.pdf", "%PDF-1.4", "")
+
+	// the content of the file must match a new extension
+	response := s.serve("MOVE", "/dav/reports/reports/report.pdf", token, nil, "Destination", "/dav/target/target/report.png")
+	expectStatus(t, response, http.StatusBadRequest, "moving a file through WebDAV to a name not matching its content")
+
+	// the current name being taken in the target doesn't matter
+	response = s.serve("MOVE", "/dav/reports/reports/report.pdf", token, nil, "Destination", "/dav/target/target/moved.pdf")
+	expectStatus(t, response, http.StatusCreated, "moving a file through WebDAV to a free name")
+	fileDetails, err := database.GetFilesDetailsForFileID(s.Database, fileID, targetFolderID, targetSubfolderID)
+	if err != nil {
+		t.Fatalf("the file wasn't moved: %v", err)
+	}
+	if fileDetails.Filename != "moved.pdf" {
+		t.Fatalf("the moved file is named %s, want moved.pdf", fileDetails.Filename)
+	}
+
+	response = s.serve("MOVE", "/dav/locked/locked", token, nil, "Destination", "/dav/target/unlocked")
+	expectStatus(t, response, http.StatusLocked, "moving a locked subfolder through WebDAV without its grant")
+}
@@ -0,0 +1,425 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+// NewNode is the body of the requests creating a folder of the tree, a zero ParentID creating a workspace.
+// Only the folders directly in a workspace can have a password.
+type NewNode struct {
+	ParentID int64  `json:"parentId"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// respondNodeError responds to the errors of the tree, returning false for the unexpected ones
+func respondNodeError(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	status := nodeErrorStatus(err)
+	if status == 0 {
+		return false
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+	return true
+}
+
+// nodeErrorStatus returns the status responded for the errors of the tree, 0 for the other errors
+func nodeErrorStatus(err error) int {
+	switch err.Error() {
+	case database.NODE_NOT_FOUND, database.COPY_JOB_NOT_FOUND:
+		return http.StatusNotFound
+	case database.NODE_ALREADY_EXISTS, database.FOLDER_ALREADY_EXISTS, database.SUBFOLDER_ALREADY_EXISTS,
+		database.FILE_ALREADY_EXISTS, database.FILE_NOT_COPYABLE:
+		return http.StatusConflict
+	case database.NODE_MOVE_OUT_OF_LOCKED, database.LABEL_LOWERED:
+		return http.StatusForbidden
+	case database.INVALID_NODE_NAME, database.NODE_PASSWORD_NOT_SUPPORTED, database.NODE_IS_WORKSPACE,
+		database.NAME_IS_EMPTY, database.SUBFOLDERNAME_IS_EMPTY, database.INVALID_FILE_NAME, database.UNSUPPORTED_EXTENSION,
+		database.NODE_MOVE_NOT_SUPPORTED, database.NODE_MOVE_INTO_ITSELF, database.FILE_MOVE_TO_WORKSPACE,
+		database.NODE_COPY_NOT_SUPPORTED, database.NODE_COPY_INTO_ITSELF, database.FILE_COPY_TO_WORKSPACE,
+		database.INVALID_COPY_CONFLICT:
+		return http.StatusBadRequest
+	}
+	return 0
+}
+
+// getNode returns the node of the node_id parameter, responding when it can't be found
+func (s *Service) getNode(c *gin.Context) (database.Node, bool) {
+	nodeID, err := getIntParameterFromRequest(c, "node_id")
+	if err != nil {
+		return database.Node{}, false
+	}
+
+	node, err := database.GetNode(s.Database, nodeID)
+	if respondNodeError(c, err) {
+		return node, false
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return node, false
+	}
+	return node, true
+}
+
+// HandleGetNodes returns a page of the workspaces, the roots of the tree
+func (s *Service) HandleGetNodes(c *gin.Context) {
+	_, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	page, err := getPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+
+	nodes, pageInfo, err := database.GetChildNodes(s.Database, 0, page)
+	if respondPaginationError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"nodes":      nodes,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
+	})
+}
+
+// HandlePostNode creates a folder at any depth of the tree. The workspaces and their folders are added to the
+// folders and subfolders tables, so they are also reachable through the two-level routes.
+func (s *Service) HandlePostNode(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var newNode NewNode
+	err = c.BindJSON(&newNode)
+	if err != nil {
+		log.Error("Error %s binding the JSON for the add new node request", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	var parent database.Node
+	if newNode.ParentID != 0 {
+		parent, err = database.GetNode(s.Database, newNode.ParentID)
+		if respondNodeError(c, err) {
+			return
+		} else if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var node database.Node
+	switch {
+	case !database.IsNodeNameValid(newNode.Name):
+		err = errors.New(database.INVALID_NODE_NAME)
+	case len(newNode.Password) > 0 && (newNode.ParentID == 0 || parent.Depth > 0):
+		err = errors.New(database.NODE_PASSWORD_NOT_SUPPORTED)
+	case newNode.ParentID == 0:
+		var folderID int64
+		folderID, err = database.AddNewFolder(s.Database, claims.Id, newNode.Name)
+		if err == nil {
+			node, err = database.GetFolderNode(s.Database, folderID, 0)
+		}
+	case parent.Depth == 0:
+		var subfolderID int64
+		subfolderID, err = database.AddNewSubfolder(s.Database, claims.Id, parent.FolderID, newNode.Name, newNode.Password,
+			len(newNode.Password) > 0)
+		if err == nil {
+			node, err = database.GetFolderNode(s.Database, parent.FolderID, subfolderID)
+		}
+	default:
+		var nodeID int64
+		nodeID, err = database.AddNode(s.Database, claims.Id, parent, newNode.Name)
+		if err == nil {
+			node, err = database.GetNode(s.Database, nodeID)
+		}
+	}
+	if respondNodeError(c, err) {
+		return
+	} else if err != nil {
+		errorMessage := fmt.Sprintf("Error creating the node %s: %s", newNode.Name, err)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	setAuditTarget(c, node.ID)
+	log.Info("Successfully created the node %s under the node %d", node.Name, newNode.ParentID)
+	c.JSON(http.StatusOK, node)
+}
+
+// HandleGetNode returns the node with its ancestors and a page of its children
+func (s *Service) HandleGetNode(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	node, ok := s.getNode(c)
+	if !ok {
+		return
+	}
+	s.respondNode(c, claims, node)
+}
+
+// respondNode responds with the node, its ancestors and a page of its children, when its label can be read
+func (s *Service) respondNode(c *gin.Context, claims *auth.AuthCustomClaims, node database.Node) {
+	page, err := getPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: node.FolderID, SubfolderID: node.SubfolderID}, labelActionRead, false)
+	if !allowed {
+		return
+	}
+
+	ancestors, err := database.GetNodeAncestors(s.Database, node)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	children, pageInfo, err := database.GetChildNodes(s.Database, node.ID, page)
+	if respondPaginationError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"node":       node,
+		"ancestors":  ancestors,
+		"children":   children,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
+	})
+}
+
+// HandleGetNodePath addresses the tree by names, like /tree/Workspace/Reports/2021. When the last name is a file
+// of the folder, the file is returned with the ids addressing it through the file routes.
+func (s *Service) HandleGetNodePath(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	names := database.SplitNodePath(c.Param("path"))
+	node, err := database.ResolveNodePath(s.Database, names)
+	if err != nil && err.Error() == database.NODE_NOT_FOUND && len(names) > 1 {
+		parent, parentErr := database.ResolveNodePath(s.Database, names[:len(names)-1])
+		if parentErr != nil {
+			respondNodeError(c, err)
+			return
+		}
+		s.respondNodeFile(c, claims, parent, names[len(names)-1])
+		return
+	} else if respondNodeError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	setAuditTarget(c, node.ID)
+	s.respondNode(c, claims, node)
+}
+
+// respondNodeFile responds with the file with the name in the node, when its label can be read
+func (s *Service) respondNodeFile(c *gin.Context, claims *auth.AuthCustomClaims, node database.Node, filename string) {
+	fileID, err := database.GetNodeFileID(s.Database, node.ID, filename)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	} else if fileID == 0 {
+		respondNodeError(c, errors.New(database.NODE_NOT_FOUND))
+		return
+	}
+
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: node.FolderID, SubfolderID: node.SubfolderID, FileID: fileID}, labelActionRead, false)
+	if !allowed {
+		return
+	}
+
+	setAuditAction(c, database.AuditRead, database.AuditTargetFile, fileID)
+	c.JSON(http.StatusOK, gin.H{
+		"node": node,
+		"file": gin.H{
+			"id":          fileID,
+			"name":        filename,
+			"folderId":    node.FolderID,
+			"subfolderId": node.SubfolderID,
+		},
+	})
+}
+
+// HandleGetNodeFiles returns a page of the files directly in the node, with the filters of the subfolder listings
+func (s *Service) HandleGetNodeFiles(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	node, ok := s.getNode(c)
+	if !ok {
+		return
+	}
+
+	page, err := getPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+
+	_, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: node.FolderID, SubfolderID: node.SubfolderID}, labelActionRead, false)
+	if !allowed {
+		return
+	}
+
+	filter, err := getFileFilter(c)
+	if err != nil {
+		log.Error("Error reading the filters of the files for the node %d: %s", node.ID, err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	filter.MFA = claims.MFA
+	filter.NodeID = node.ID
+
+	filesDetails, pageInfo, err := database.GetAllFilesDetails(s.Database, node.FolderID, node.SubfolderID, filter, page)
+	if respondPaginationError(c, err) || respondMetadataError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"files":      filesDetails,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
+	})
+}
+
+// HandlePostNodeUpload uploads a file to a folder of the tree, like the uploads to a subfolder
+func (s *Service) HandlePostNodeUpload(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	node, ok := s.getNode(c)
+	if !ok {
+		return
+	}
+	if node.Depth == 0 {
+		respondNodeError(c, errors.New(database.NODE_IS_WORKSPACE))
+		return
+	}
+
+	s.uploadFile(c, claims, node.FolderID, node.SubfolderID, node.ID)
+}
+
+// HandleRemoveNode removes a folder of the tree with everything below it, only its owner can remove it
+func (s *Service) HandleRemoveNode(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	node, ok := s.getNode(c)
+	if !ok || !verifyNodeOwner(c, claims, node) {
+		return
+	}
+
+	// the storage keys have to be retrieved before the files are removed from the database
+	storedFiles, err := database.GetStoredFilesForNode(s.Database, node)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	err = database.RemoveNode(s.Database, node)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	s.removeStoredFiles(storedFiles)
+
+	log.Info("Successfully removed the node %s", node.Name)
+	c.Status(http.StatusOK)
+}
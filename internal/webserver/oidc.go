@@ -0,0 +1,158 @@
+package webserver
+
+import (
+	"net/http"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/oidc"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	oidcNotConfigured = "the single sign-on is not configured"
+	oidcLoginFailed   = "the login with the identity provider failed"
+)
+
+// OIDCCallback is the body sent by the frontend when the identity provider redirects the user back to it
+type OIDCCallback struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+// verifyOIDCConfigured responds with 404 and returns false when the single sign-on is not configured
+func (s *Service) verifyOIDCConfigured(c *gin.Context) bool {
+	if s.OIDC == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": oidcNotConfigured,
+		})
+		return false
+	}
+	return true
+}
+
+// respondOIDCError responds with the status of the error of the identity provider
+func respondOIDCError(c *gin.Context, err error) {
+	switch err {
+	case oidc.ErrProviderUnavailable, oidc.ErrPKCENotSupported:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	case oidc.ErrCodeRejected, oidc.ErrInvalidIDToken:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": oidcLoginFailed})
+	default:
+		c.Status(http.StatusInternalServerError)
+	}
+}
+
+// HandleGetOIDCLogin starts a login with the identity provider, returning the address the frontend sends the user
+// to. The state, the nonce and the PKCE verifier stay on the server until the user comes back.
+func (s *Service) HandleGetOIDCLogin(c *gin.Context) {
+	if !s.verifyOIDCConfigured(c) {
+		return
+	}
+
+	login, err := oidc.NewLogin()
+	if err != nil {
+		log.Error("Error generating the single sign-on login: %s", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	authURL, err := s.OIDC.AuthCodeURL(login)
+	if err != nil {
+		respondOIDCError(c, err)
+		return
+	}
+	err = database.AddOIDCLogin(s.Database, login.State, login.Nonce, login.Verifier)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"url":   authURL,
+		"state": login.State,
+	})
+}
+
+// HandlePostOIDCCallback finishes the login with the authorization code of the identity provider, like
+// HandlePostLoginRequest. The users are provisioned or linked by their verified email on their first login, and
+// their roles follow their groups when the groups are mapped.
+func (s *Service) HandlePostOIDCCallback(c *gin.Context) {
+	if !s.verifyOIDCConfigured(c) {
+		return
+	}
+
+	var callback OIDCCallback
+	err := c.BindJSON(&callback)
+	if err != nil || len(callback.Code) == 0 || len(callback.State) == 0 {
+		log.Error("Error binding the JSON of the single sign-on callback: %s", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	login := oidc.Login{State: callback.State}
+	login.Nonce, login.Verifier, err = database.TakeOIDCLogin(s.Database, callback.State)
+	if err != nil && err.Error() == database.OIDC_LOGIN_NOT_FOUND {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	rawIDToken, err := s.OIDC.Exchange(callback.Code, login)
+	if err != nil {
+		respondOIDCError(c, err)
+		return
+	}
+	idToken, err := s.OIDC.VerifyIDToken(rawIDToken, login)
+	if err != nil {
+		respondOIDCError(c, err)
+		return
+	}
+
+	user, created, err := database.ProvisionOIDCUser(s.Database, database.OIDCIdentity{
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		Email:         idToken.Email,
+		EmailVerified: idToken.EmailVerified,
+	})
+	if err != nil && (err.Error() == database.OIDC_EMAIL_NOT_VERIFIED || err.Error() == database.OIDC_EMAIL_ALREADY_LINKED) {
+		log.Error("The identity %s of %s can't log in: %s", idToken.Subject, idToken.Email, err)
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	setAuditActor(c, user.ID)
+	if !user.IsActivated {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	if s.OIDC.Config.MapsRoles() {
+		isAdmin, isAuditor := s.OIDC.Config.Roles(idToken.Groups)
+		err = database.SetUserRoles(s.Database, user.ID, isAdmin, isAuditor)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		user.IsAdmin = isAdmin
+	}
+
+	// the second factor is the one of the identity provider, reported in the amr claim
+	tokens := auth.JWTAuthService().GenerateToken(user.ID, user.Email, user.IsActivated, idToken.MFA)
+	log.Info("The user %d logged in with the identity provider", user.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"id":            user.ID,
+		"admin":         user.IsAdmin,
+		"token":         tokens["access_token"],
+		"refresh_token": tokens["refresh_token"],
+		"created":       created,
+	})
+}
@@ -0,0 +1,32 @@
+package webserver
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/oidc"
+)
+
+func TestOIDCCallbackTakesTheStateOnce(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	response := s.serve(http.MethodPost, "/oidc/callback", "", strings.NewReader(`{"code": "code", "state": "state"}`))
+	expectStatus(t, response, http.StatusNotFound, "a callback without the single sign-on")
+
+	// the provider can't be reached, the state being checked before it is
+	s.OIDC = oidc.NewProvider(oidc.Config{Issuer: "http://127.0.0.1:1", ClientID: "dissertation", RedirectURL: "https://app.example.com/callback"})
+	response = s.serve(http.MethodPost, "/oidc/callback", "", strings.NewReader(`{"code": "code", "state": "unknown state"}`))
+	expectStatus(t, response, http.StatusBadRequest, "a callback with an unknown state")
+	response = s.serve(http.MethodPost, "/oidc/callback", "", strings.NewReader(`{"code": "code"}`))
+	expectStatus(t, response, http.StatusBadRequest, "a callback without a state")
+
+	if err := database.AddOIDCLogin(s.Database, "state", "nonce", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+	response = s.serve(http.MethodPost, "/oidc/callback", "", strings.NewReader(`{"code": "code", "state": "state"}`))
+	expectStatus(t, response, http.StatusBadGateway, "a callback with the provider down")
+	response = s.serve(http.MethodPost, "/oidc/callback", "", strings.NewReader(`{"code": "code", "state": "state"}`))
+	expectStatus(t, response, http.StatusBadRequest, "a callback replaying a state")
+}
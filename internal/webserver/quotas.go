@@ -0,0 +1,136 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+// QuotaLimits are the limits set by an admin, a missing limit meaning unlimited
+type QuotaLimits struct {
+	MaxBytes *int64 `json:"maxBytes"`
+	MaxFiles *int64 `json:"maxFiles"`
+}
+
+// respondQuotaExceeded returns true, after responding with 413, if the error is a quota error
+func respondQuotaExceeded(c *gin.Context, err error) bool {
+	if !database.IsQuotaExceeded(err) {
+		return false
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error": err.Error(),
+	})
+	return true
+}
+
+// HandleGetUsage returns the usage and the limits of the user, and of the workspaces the user owns
+func (s *Service) HandleGetUsage(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	userQuota, err := database.GetQuota(s.Database, database.UserQuotaScope, claims.Id)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the usage of the user %d", claims.Id)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	workspaceQuotas, err := database.GetWorkspaceQuotasForOwner(s.Database, claims.Id)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the usage of the workspaces of the user %d", claims.Id)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	log.Info("Successfully retrieved the usage of the user %d", claims.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"user":       userQuota,
+		"workspaces": workspaceQuotas,
+	})
+}
+
+func (s *Service) HandlePostUserQuota(c *gin.Context) {
+	s.handlePostQuota(c, database.UserQuotaScope, "user_id")
+}
+
+func (s *Service) HandlePostWorkspaceQuota(c *gin.Context) {
+	s.handlePostQuota(c, database.WorkspaceQuotaScope, "folder_id")
+}
+
+func (s *Service) handlePostQuota(c *gin.Context, scope string, paramName string) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+	if !s.verifyAdmin(c, claims) {
+		return
+	}
+
+	scopeID, err := getIntParameterFromRequest(c, paramName)
+	if err != nil {
+		log.Error("Error retrieving %s parameter from the "+
+			"handlePostQuota request: %s", paramName, err)
+		return
+	}
+
+	var limits QuotaLimits
+	err = c.BindJSON(&limits)
+	if err != nil {
+		log.Error("Error %s binding the JSON for the quota limits of the %s %d", err, scope, scopeID)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	err = database.SetQuotaLimits(s.Database, scope, scopeID, limits.MaxBytes, limits.MaxFiles)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error setting the quota limits of the %s %d: %s", scope, scopeID, err)
+		if err.Error() == database.INVALID_QUOTA_LIMIT {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": errorMessage,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	quota, err := database.GetQuota(s.Database, scope, scopeID)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("The admin %d set the quota limits of the %s %d", claims.Id, scope, scopeID)
+	c.JSON(http.StatusOK, gin.H{
+		"quota": quota,
+	})
+}
@@ -0,0 +1,553 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/utils"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	scimPrefix      = "/scim/v2"
+	scimContentType = "application/scim+json"
+	// scimDefaultCount is the size of the pages of the lists without a count
+	scimDefaultCount = 100
+
+	scimUserSchema    = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema   = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema    = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema   = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema   = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema  = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimInvalidFilter = "invalidFilter"
+	scimInvalidValue  = "invalidValue"
+	scimInvalidSyntax = "invalidSyntax"
+	scimUniqueness    = "uniqueness"
+	scimPatchAdd      = "add"
+	scimPatchRemove   = "remove"
+	scimPatchReplace  = "replace"
+)
+
+var (
+	scimNotConfigured   = "the provisioning is not configured"
+	scimInvalidToken    = "the provisioning token is missing or not valid"
+	scimUserNameInvalid = "the userName must be the email of the user"
+	scimInvalidPatch    = "the patch operation is not valid"
+	errSCIMFilter       = errors.New("only the eq comparisons joined by and are supported in the filters")
+)
+
+// SCIMName is the name of a provisioned user
+type SCIMName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+// SCIMUser is the body of the requests provisioning a user, the attributes which aren't stored being ignored
+type SCIMUser struct {
+	UserName    string    `json:"userName"`
+	ExternalID  string    `json:"externalId"`
+	DisplayName string    `json:"displayName"`
+	Name        *SCIMName `json:"name"`
+	Active      *bool     `json:"active"`
+	Password    string    `json:"password"`
+}
+
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        *SCIMName   `json:"name,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []scimEmail `json:"emails"`
+	Active      bool        `json:"active"`
+	Meta        scimMeta    `json:"meta"`
+}
+
+// SCIMPatchOperation is an operation of a PATCH request, its value depending on the path
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// SCIMPatch is the body of the PATCH requests
+type SCIMPatch struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+// writeSCIM responds with the SCIM media type
+func writeSCIM(c *gin.Context, status int, value interface{}) {
+	c.Header("Content-Type", scimContentType+"; charset=utf-8")
+	c.JSON(status, value)
+}
+
+// respondSCIMError responds with the error message of SCIM, the scimType being optional
+func respondSCIMError(c *gin.Context, status int, scimType string, detail string) {
+	response := gin.H{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if len(scimType) > 0 {
+		response["scimType"] = scimType
+	}
+	c.Header("Content-Type", scimContentType+"; charset=utf-8")
+	c.AbortWithStatusJSON(status, response)
+}
+
+// respondSCIMDatabaseError returns true, after responding, if the error is caused by the request
+func respondSCIMDatabaseError(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.Error() {
+	case database.SCIM_USER_NOT_FOUND, database.SCIM_GROUP_NOT_FOUND:
+		respondSCIMError(c, http.StatusNotFound, "", err.Error())
+	case database.ERROR_USER_ALREADY_EXISTS, database.SCIM_GROUP_ALREADY_EXISTS:
+		respondSCIMError(c, http.StatusConflict, scimUniqueness, err.Error())
+	case database.SCIM_MEMBER_NOT_FOUND:
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidValue, err.Error())
+	case database.SCIM_INVALID_FILTER:
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidFilter, err.Error())
+	default:
+		respondSCIMError(c, http.StatusInternalServerError, "", http.StatusText(http.StatusInternalServerError))
+	}
+	return true
+}
+
+// AuthorizeSCIM authenticates the identity provider with the provisioning token of SCIM_TOKEN, sent as a bearer
+// token. The provisioning is disabled without it.
+func (s *Service) AuthorizeSCIM() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(s.SCIMToken) == 0 {
+			respondSCIMError(c, http.StatusNotFound, "", scimNotConfigured)
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		// the hashes have the same length, so the comparison doesn't tell the length of the token
+		expectedHash := sha256.Sum256([]byte(s.SCIMToken))
+		tokenHash := sha256.Sum256([]byte(token))
+		if subtle.ConstantTimeCompare(expectedHash[:], tokenHash[:]) != 1 {
+			log.Error("Refused a provisioning request to %s without the provisioning token", c.Request.URL.Path)
+			c.Header("WWW-Authenticate", `Bearer realm="scim"`)
+			respondSCIMError(c, http.StatusUnauthorized, "", scimInvalidToken)
+			return
+		}
+		c.Next()
+	}
+}
+
+// scimLocation returns the address of the resource
+func scimLocation(c *gin.Context, resourceType string, id int64) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + scimPrefix + "/" + resourceType + "/" + strconv.FormatInt(id, 10)
+}
+
+// getSCIMID returns the id of the resource of the path, responding with 404 when it is not an id
+func getSCIMID(c *gin.Context, param string, detail string) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param(param), 10, 64)
+	if err != nil || id <= 0 {
+		respondSCIMError(c, http.StatusNotFound, "", detail)
+		return 0, false
+	}
+	return id, true
+}
+
+// getSCIMPage returns the offset and the limit of the startIndex and count parameters, startIndex starting at 1
+func getSCIMPage(c *gin.Context) (int, int, int) {
+	startIndex, err := strconv.Atoi(c.Query("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.Query("count"))
+	if err != nil {
+		count = scimDefaultCount
+	}
+	if count < 0 {
+		count = 0
+	} else if count > database.SCIMMaxResults {
+		count = database.SCIMMaxResults
+	}
+	return startIndex, startIndex - 1, count
+}
+
+// scimListResponse is a page of resources
+func scimListResponse(resources interface{}, total int, startIndex int, count int) gin.H {
+	return gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": count,
+		"Resources":    resources,
+	}
+}
+
+// nextFilterToken returns the next word of the filter and the rest of it
+func nextFilterToken(filter string) (string, string) {
+	filter = strings.TrimLeft(filter, " ")
+	end := strings.IndexByte(filter, ' ')
+	if end < 0 {
+		return filter, ""
+	}
+	return filter[:end], filter[end:]
+}
+
+// parseSCIMFilter parses the filters made of eq comparisons joined by and, like the userName eq "john@example.com"
+// sent by the identity providers to find a user. The attributes can be prefixed by the schema of the resource.
+func parseSCIMFilter(filter string, schema string) ([]database.SCIMFilter, error) {
+	var filters []database.SCIMFilter
+	rest := strings.TrimSpace(filter)
+	for len(rest) > 0 {
+		var attribute, operator string
+		attribute, rest = nextFilterToken(rest)
+		operator, rest = nextFilterToken(rest)
+		if !strings.EqualFold(operator, "eq") {
+			return nil, errSCIMFilter
+		}
+		if strings.HasPrefix(strings.ToLower(attribute), strings.ToLower(schema)+":") {
+			attribute = attribute[len(schema)+1:]
+		}
+
+		var value string
+		rest = strings.TrimLeft(rest, " ")
+		if strings.HasPrefix(rest, `"`) {
+			// the quoted values are JSON strings, ending at the first quote not escaped
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) || json.Unmarshal([]byte(rest[:end+1]), &value) != nil {
+				return nil, errSCIMFilter
+			}
+			rest = rest[end+1:]
+		} else {
+			value, rest = nextFilterToken(rest)
+			if len(value) == 0 {
+				return nil, errSCIMFilter
+			}
+		}
+		filters = append(filters, database.SCIMFilter{Attribute: attribute, Value: value})
+
+		var conjunction string
+		conjunction, rest = nextFilterToken(rest)
+		if len(conjunction) > 0 && !strings.EqualFold(conjunction, "and") {
+			return nil, errSCIMFilter
+		} else if len(conjunction) > 0 && len(strings.TrimSpace(rest)) == 0 {
+			return nil, errSCIMFilter
+		}
+		rest = strings.TrimSpace(rest)
+	}
+	return filters, nil
+}
+
+// getSCIMFilters returns the filters of the filter parameter, responding with 400 when they can't be parsed
+func getSCIMFilters(c *gin.Context, schema string) ([]database.SCIMFilter, bool) {
+	filters, err := parseSCIMFilter(c.Query("filter"), schema)
+	if err != nil {
+		log.Error("Error parsing the SCIM filter %s: %s", c.Query("filter"), err)
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidFilter, err.Error())
+		return nil, false
+	}
+	return filters, true
+}
+
+// getSCIMPatch binds the body of a PATCH request, responding with 400 when it is not a PatchOp
+func getSCIMPatch(c *gin.Context) (SCIMPatch, bool) {
+	var patch SCIMPatch
+	err := c.ShouldBindJSON(&patch)
+	if err != nil || len(patch.Operations) == 0 {
+		log.Error("Error binding the JSON of the SCIM patch: %s", err)
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidSyntax, scimInvalidPatch)
+		return patch, false
+	}
+	for _, schema := range patch.Schemas {
+		if schema != scimPatchSchema {
+			respondSCIMError(c, http.StatusBadRequest, scimInvalidSyntax, scimInvalidPatch)
+			return patch, false
+		}
+	}
+	return patch, true
+}
+
+// scimString decodes a string value of a patch
+func scimString(value json.RawMessage) (string, error) {
+	var text string
+	err := json.Unmarshal(value, &text)
+	return text, err
+}
+
+// scimBool decodes a boolean value of a patch, which some providers send as a string
+func scimBool(value json.RawMessage) (bool, error) {
+	var flag bool
+	if err := json.Unmarshal(value, &flag); err == nil {
+		return flag, nil
+	}
+	text, err := scimString(value)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.ToLower(text))
+}
+
+// scimUserResource returns the SCIM representation of the user
+func scimUserResource(c *gin.Context, user database.SCIMUser) scimUser {
+	resource := scimUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          strconv.FormatInt(user.ID, 10),
+		ExternalID:  user.ExternalID,
+		UserName:    user.Email,
+		DisplayName: user.DisplayName,
+		Emails:      []scimEmail{{Value: user.Email, Primary: true}},
+		Active:      user.Active,
+		Meta: scimMeta{
+			ResourceType: "User",
+			Location:     scimLocation(c, "Users", user.ID),
+		},
+	}
+	if len(user.GivenName) > 0 || len(user.FamilyName) > 0 {
+		resource.Name = &SCIMName{GivenName: user.GivenName, FamilyName: user.FamilyName}
+	}
+	return resource
+}
+
+// applySCIMUserPatch applies an operation to the user. The attributes which aren't stored are ignored, like the
+// emails, the email being the userName.
+func applySCIMUserPatch(user *database.SCIMUser, op string, path string, value json.RawMessage) error {
+	var err error
+	remove := op == scimPatchRemove
+	switch strings.ToLower(strings.TrimPrefix(path, scimUserSchema+":")) {
+	case "":
+		// without a path, the value holds the attributes to set
+		var attributes map[string]json.RawMessage
+		if remove || json.Unmarshal(value, &attributes) != nil {
+			return errors.New(scimInvalidPatch)
+		}
+		for attribute, attributeValue := range attributes {
+			if err = applySCIMUserPatch(user, op, attribute, attributeValue); err != nil {
+				return err
+			}
+		}
+	case "active":
+		if remove {
+			return errors.New(scimInvalidPatch)
+		}
+		user.Active, err = scimBool(value)
+	case "username":
+		if remove {
+			return errors.New(scimInvalidPatch)
+		}
+		if user.Email, err = scimString(value); err == nil && !utils.ValidateEmail(user.Email) {
+			return errors.New(scimUserNameInvalid)
+		}
+	case "externalid":
+		user.ExternalID = ""
+		if !remove {
+			user.ExternalID, err = scimString(value)
+		}
+	case "displayname":
+		user.DisplayName = ""
+		if !remove {
+			user.DisplayName, err = scimString(value)
+		}
+	case "name":
+		if remove {
+			user.GivenName, user.FamilyName = "", ""
+			return nil
+		}
+		// the parts of the name missing from the value are kept
+		var name map[string]json.RawMessage
+		if json.Unmarshal(value, &name) != nil {
+			return errors.New(scimInvalidPatch)
+		}
+		for part, partValue := range name {
+			if err = applySCIMUserPatch(user, op, "name."+part, partValue); err != nil {
+				return err
+			}
+		}
+	case "name.givenname":
+		user.GivenName = ""
+		if !remove {
+			user.GivenName, err = scimString(value)
+		}
+	case "name.familyname":
+		user.FamilyName = ""
+		if !remove {
+			user.FamilyName, err = scimString(value)
+		}
+	}
+	if err != nil {
+		return errors.New(scimInvalidPatch)
+	}
+	return nil
+}
+
+// HandleGetSCIMServiceProviderConfig describes the features of the provisioning to the identity provider
+func (s *Service) HandleGetSCIMServiceProviderConfig(c *gin.Context) {
+	writeSCIM(c, http.StatusOK, gin.H{
+		"schemas":        []string{scimConfigSchema},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": database.SCIMMaxResults},
+		"changePassword": gin.H{"supported": false},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": false},
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "Provisioning token",
+			"description": "The bearer token of SCIM_TOKEN",
+		}},
+	})
+}
+
+// HandleGetSCIMUsers lists the users matching the filter, the identity providers looking up their users by
+// userName or externalId
+func (s *Service) HandleGetSCIMUsers(c *gin.Context) {
+	filters, ok := getSCIMFilters(c, scimUserSchema)
+	if !ok {
+		return
+	}
+	startIndex, offset, count := getSCIMPage(c)
+
+	users, total, err := database.GetSCIMUsers(s.Database, filters, offset, count)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+
+	resources := make([]scimUser, 0, len(users))
+	for _, user := range users {
+		resources = append(resources, scimUserResource(c, user))
+	}
+	writeSCIM(c, http.StatusOK, scimListResponse(resources, total, startIndex, len(resources)))
+}
+
+// HandleGetSCIMUser returns the user with the id
+func (s *Service) HandleGetSCIMUser(c *gin.Context) {
+	userID, ok := getSCIMID(c, "user_id", database.SCIM_USER_NOT_FOUND)
+	if !ok {
+		return
+	}
+
+	user, err := database.GetSCIMUser(s.Database, userID)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	writeSCIM(c, http.StatusOK, scimUserResource(c, user))
+}
+
+// HandlePostSCIMUser provisions a user, activated without the activation email
+func (s *Service) HandlePostSCIMUser(c *gin.Context) {
+	var newUser SCIMUser
+	err := c.ShouldBindJSON(&newUser)
+	if err != nil {
+		log.Error("Error binding the JSON of the provisioned user: %s", err)
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidSyntax, err.Error())
+		return
+	}
+	if !utils.ValidateEmail(newUser.UserName) {
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidValue, scimUserNameInvalid)
+		return
+	}
+	if len(newUser.Password) > 0 && !utils.ValidatePassword(newUser.Password) {
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidValue, ERROR_PASSWORD_IS_TOO_SHORT)
+		return
+	}
+
+	user := database.SCIMUser{
+		Email:       newUser.UserName,
+		ExternalID:  newUser.ExternalID,
+		DisplayName: newUser.DisplayName,
+		Active:      newUser.Active == nil || *newUser.Active,
+	}
+	if newUser.Name != nil {
+		user.GivenName, user.FamilyName = newUser.Name.GivenName, newUser.Name.FamilyName
+	}
+
+	user.ID, err = database.AddSCIMUser(s.Database, user, newUser.Password)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+
+	setAuditTarget(c, user.ID)
+	resource := scimUserResource(c, user)
+	c.Header("Location", resource.Meta.Location)
+	writeSCIM(c, http.StatusCreated, resource)
+}
+
+// HandlePatchSCIMUser updates the attributes of the user, the identity providers deactivating the users leaving
+// with active set to false
+func (s *Service) HandlePatchSCIMUser(c *gin.Context) {
+	userID, ok := getSCIMID(c, "user_id", database.SCIM_USER_NOT_FOUND)
+	if !ok {
+		return
+	}
+	patch, ok := getSCIMPatch(c)
+	if !ok {
+		return
+	}
+
+	user, err := database.GetSCIMUser(s.Database, userID)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	for _, operation := range patch.Operations {
+		op := strings.ToLower(operation.Op)
+		if op != scimPatchAdd && op != scimPatchReplace && op != scimPatchRemove {
+			respondSCIMError(c, http.StatusBadRequest, scimInvalidSyntax, scimInvalidPatch)
+			return
+		}
+		if err = applySCIMUserPatch(&user, op, operation.Path, operation.Value); err != nil {
+			respondSCIMError(c, http.StatusBadRequest, scimInvalidValue, err.Error())
+			return
+		}
+	}
+
+	err = database.UpdateSCIMUser(s.Database, user)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	log.Info("The provisioning updated the user %d, active: %t", user.ID, user.Active)
+	writeSCIM(c, http.StatusOK, scimUserResource(c, user))
+}
+
+// HandleRemoveSCIMUser deprovisions the user. Its account is deactivated and hidden from the provisioning, its
+// documents being kept.
+func (s *Service) HandleRemoveSCIMUser(c *gin.Context) {
+	userID, ok := getSCIMID(c, "user_id", database.SCIM_USER_NOT_FOUND)
+	if !ok {
+		return
+	}
+
+	err := database.DeprovisionSCIMUser(s.Database, userID)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	log.Info("The provisioning removed the user %d", userID)
+	c.Status(http.StatusNoContent)
+}
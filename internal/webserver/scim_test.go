@@ -0,0 +1,81 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/gin-gonic/gin"
+)
+
+// serveSCIM handles a request with the Authorization header by AuthorizeSCIM in front of a handler responding
+// with 200
+func serveSCIM(s *Service, authorization string) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.GET("/scim/v2/Users", s.AuthorizeSCIM(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	request := httptest.NewRequest(http.MethodGet, "/scim/v2/Users", nil)
+	if len(authorization) > 0 {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAuthorizeSCIM(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	response := serveSCIM(&Service{}, "Bearer ")
+	expectStatus(t, response, http.StatusNotFound, "provisioning without SCIM_TOKEN")
+
+	s := &Service{SCIMToken: "provisioning token"}
+	for _, authorization := range []string{
+		"",
+		"Bearer",
+		"Bearer provisioning",
+		"Bearer provisioning token2",
+		"Bearer PROVISIONING TOKEN",
+		"Basic cHJvdmlzaW9uaW5nIHRva2Vu",
+	} {
+		response = serveSCIM(s, authorization)
+		expectStatus(t, response, http.StatusUnauthorized, "provisioning with the Authorization "+authorization)
+		if !strings.HasPrefix(response.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("the Authorization %q got the challenge %q", authorization, response.Header().Get("WWW-Authenticate"))
+		}
+	}
+	response = serveSCIM(s, "Bearer provisioning token")
+	expectStatus(t, response, http.StatusOK, "provisioning with the provisioning token")
+}
+
+func TestSCIMNeedsTheProvisioningToken(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	s.SCIMToken = "provisioning token"
+	userID, token := s.addUser(t, "admin@example.com")
+	if err := database.SetUserRoles(s.Database, userID, true, false); err != nil {
+		t.Fatal(err)
+	}
+	_, apiToken := s.addAPIToken(t, token, database.APITokenAdmin)
+
+	// neither the logins nor the API tokens of the users, even the admins, provision the users
+	newUser := `{"userName": "provisioned@example.com"}`
+	for _, authorization := range []string{"", token, "Bearer " + token, apiToken} {
+		response := s.serve(http.MethodPost, "/scim/v2/Users", authorization, strings.NewReader(newUser))
+		expectStatus(t, response, http.StatusUnauthorized, "provisioning a user without the provisioning token")
+		response = s.serve(http.MethodGet, "/scim/v2/Users", authorization, nil)
+		expectStatus(t, response, http.StatusUnauthorized, "listing the users without the provisioning token")
+	}
+	var provisioned int
+	if err := s.Database.QueryRow("SELECT count(*) FROM users WHERE email=$1", "provisioned@example.com").Scan(&provisioned); err != nil {
+		t.Fatal(err)
+	}
+	if provisioned != 0 {
+		t.Fatal("a user was provisioned without the provisioning token")
+	}
+
+	response := s.serve(http.MethodPost, "/scim/v2/Users", "Bearer provisioning token", strings.NewReader(newUser))
+	expectStatus(t, response, http.StatusCreated, "provisioning a user with the provisioning token")
+}
@@ -0,0 +1,292 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	scimGroupNameMissing  = "the group needs a displayName"
+	scimInvalidMemberID   = "the value of a member must be the id of a user"
+	scimMemberValueFilter = regexp.MustCompile(`(?i)^members\[value eq "([^"]*)"\]$`)
+)
+
+// SCIMMember is a member sent by the identity provider, its value being the id of the user
+type SCIMMember struct {
+	Value string `json:"value"`
+}
+
+// SCIMGroup is the body of the requests provisioning a group
+type SCIMGroup struct {
+	DisplayName string       `json:"displayName"`
+	ExternalID  string       `json:"externalId"`
+	Members     []SCIMMember `json:"members"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display"`
+	Ref     string `json:"$ref"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members,omitempty"`
+	Meta        scimMeta     `json:"meta"`
+}
+
+// scimGroupResource returns the SCIM representation of the group
+func scimGroupResource(c *gin.Context, group database.SCIMGroup) scimGroup {
+	resource := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          strconv.FormatInt(group.ID, 10),
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Meta: scimMeta{
+			ResourceType: "Group",
+			Location:     scimLocation(c, "Groups", group.ID),
+		},
+	}
+	for _, member := range group.Members {
+		resource.Members = append(resource.Members, scimMember{
+			Value:   strconv.FormatInt(member.UserID, 10),
+			Display: member.Email,
+			Ref:     scimLocation(c, "Users", member.UserID),
+		})
+	}
+	return resource
+}
+
+// scimMembers returns the users of the members
+func scimMembers(members []SCIMMember) ([]database.SCIMMember, error) {
+	users := make([]database.SCIMMember, 0, len(members))
+	for _, member := range members {
+		userID, err := strconv.ParseInt(member.Value, 10, 64)
+		if err != nil {
+			return nil, errors.New(scimInvalidMemberID)
+		}
+		users = append(users, database.SCIMMember{UserID: userID})
+	}
+	return users, nil
+}
+
+// withoutMembers returns the members not in the removed ones
+func withoutMembers(members []database.SCIMMember, removed []database.SCIMMember) []database.SCIMMember {
+	removedIDs := map[int64]bool{}
+	for _, member := range removed {
+		removedIDs[member.UserID] = true
+	}
+	var kept []database.SCIMMember
+	for _, member := range members {
+		if !removedIDs[member.UserID] {
+			kept = append(kept, member)
+		}
+	}
+	return kept
+}
+
+// applySCIMGroupPatch applies an operation to the group. The members are added, replaced or removed, the
+// identity providers removing a member with the members[value eq "id"] path or with the members in the value.
+func applySCIMGroupPatch(group *database.SCIMGroup, op string, path string, value json.RawMessage) error {
+	var err error
+	remove := op == scimPatchRemove
+	if matches := scimMemberValueFilter.FindStringSubmatch(path); matches != nil && remove {
+		members, err := scimMembers([]SCIMMember{{Value: matches[1]}})
+		if err != nil {
+			return err
+		}
+		group.Members = withoutMembers(group.Members, members)
+		return nil
+	}
+
+	switch strings.ToLower(strings.TrimPrefix(path, scimGroupSchema+":")) {
+	case "":
+		var attributes map[string]json.RawMessage
+		if remove || json.Unmarshal(value, &attributes) != nil {
+			return errors.New(scimInvalidPatch)
+		}
+		for attribute, attributeValue := range attributes {
+			if err = applySCIMGroupPatch(group, op, attribute, attributeValue); err != nil {
+				return err
+			}
+		}
+	case "displayname":
+		if remove {
+			return errors.New(scimGroupNameMissing)
+		}
+		if group.DisplayName, err = scimString(value); err == nil && len(strings.TrimSpace(group.DisplayName)) == 0 {
+			return errors.New(scimGroupNameMissing)
+		}
+	case "externalid":
+		group.ExternalID = ""
+		if !remove {
+			group.ExternalID, err = scimString(value)
+		}
+	case "members":
+		var values []SCIMMember
+		if len(value) > 0 {
+			if err = json.Unmarshal(value, &values); err != nil {
+				return errors.New(scimInvalidPatch)
+			}
+		}
+		members, err := scimMembers(values)
+		if err != nil {
+			return err
+		}
+		switch {
+		case remove && len(values) == 0:
+			group.Members = nil
+		case remove:
+			group.Members = withoutMembers(group.Members, members)
+		case op == scimPatchReplace:
+			group.Members = members
+		default:
+			group.Members = append(withoutMembers(group.Members, members), members...)
+		}
+	}
+	if err != nil {
+		return errors.New(scimInvalidPatch)
+	}
+	return nil
+}
+
+// HandleGetSCIMGroups lists the groups matching the filter, without their members when excludedAttributes holds
+// members
+func (s *Service) HandleGetSCIMGroups(c *gin.Context) {
+	filters, ok := getSCIMFilters(c, scimGroupSchema)
+	if !ok {
+		return
+	}
+	startIndex, offset, count := getSCIMPage(c)
+	withMembers := !strings.Contains(strings.ToLower(c.Query("excludedAttributes")), "members")
+
+	groups, total, err := database.GetSCIMGroups(s.Database, filters, offset, count, withMembers)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+
+	resources := make([]scimGroup, 0, len(groups))
+	for _, group := range groups {
+		resources = append(resources, scimGroupResource(c, group))
+	}
+	writeSCIM(c, http.StatusOK, scimListResponse(resources, total, startIndex, len(resources)))
+}
+
+// HandleGetSCIMGroup returns the group with the id
+func (s *Service) HandleGetSCIMGroup(c *gin.Context) {
+	groupID, ok := getSCIMID(c, "group_id", database.SCIM_GROUP_NOT_FOUND)
+	if !ok {
+		return
+	}
+	withMembers := !strings.Contains(strings.ToLower(c.Query("excludedAttributes")), "members")
+
+	group, err := database.GetSCIMGroup(s.Database, groupID, withMembers)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	writeSCIM(c, http.StatusOK, scimGroupResource(c, group))
+}
+
+// HandlePostSCIMGroup provisions a group with its members
+func (s *Service) HandlePostSCIMGroup(c *gin.Context) {
+	var newGroup SCIMGroup
+	err := c.ShouldBindJSON(&newGroup)
+	if err != nil {
+		log.Error("Error binding the JSON of the provisioned group: %s", err)
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidSyntax, err.Error())
+		return
+	}
+	if len(strings.TrimSpace(newGroup.DisplayName)) == 0 {
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidValue, scimGroupNameMissing)
+		return
+	}
+	members, err := scimMembers(newGroup.Members)
+	if err != nil {
+		respondSCIMError(c, http.StatusBadRequest, scimInvalidValue, err.Error())
+		return
+	}
+
+	group := database.SCIMGroup{
+		DisplayName: newGroup.DisplayName,
+		ExternalID:  newGroup.ExternalID,
+		Members:     members,
+	}
+	groupID, err := database.AddSCIMGroup(s.Database, group)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	group, err = database.GetSCIMGroup(s.Database, groupID, true)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+
+	setAuditTarget(c, groupID)
+	resource := scimGroupResource(c, group)
+	c.Header("Location", resource.Meta.Location)
+	writeSCIM(c, http.StatusCreated, resource)
+}
+
+// HandlePatchSCIMGroup renames the group or changes its members
+func (s *Service) HandlePatchSCIMGroup(c *gin.Context) {
+	groupID, ok := getSCIMID(c, "group_id", database.SCIM_GROUP_NOT_FOUND)
+	if !ok {
+		return
+	}
+	patch, ok := getSCIMPatch(c)
+	if !ok {
+		return
+	}
+
+	group, err := database.GetSCIMGroup(s.Database, groupID, true)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	for _, operation := range patch.Operations {
+		op := strings.ToLower(operation.Op)
+		if op != scimPatchAdd && op != scimPatchReplace && op != scimPatchRemove {
+			respondSCIMError(c, http.StatusBadRequest, scimInvalidSyntax, scimInvalidPatch)
+			return
+		}
+		if err = applySCIMGroupPatch(&group, op, operation.Path, operation.Value); err != nil {
+			respondSCIMError(c, http.StatusBadRequest, scimInvalidValue, err.Error())
+			return
+		}
+	}
+
+	err = database.UpdateSCIMGroup(s.Database, group)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	group, err = database.GetSCIMGroup(s.Database, groupID, true)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	log.Info("The provisioning updated the group %d", groupID)
+	writeSCIM(c, http.StatusOK, scimGroupResource(c, group))
+}
+
+// HandleRemoveSCIMGroup removes the group, its members keeping their accounts
+func (s *Service) HandleRemoveSCIMGroup(c *gin.Context) {
+	groupID, ok := getSCIMID(c, "group_id", database.SCIM_GROUP_NOT_FOUND)
+	if !ok {
+		return
+	}
+
+	err := database.RemoveSCIMGroup(s.Database, groupID)
+	if respondSCIMDatabaseError(c, err) {
+		return
+	}
+	log.Info("The provisioning removed the group %d", groupID)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	unlockGrantsHeader = "X-Unlock-Grants"
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+var (
+	emptySearchQuery   = "the search query cannot be empty"
+	invalidSearchLimit = "the limit must be a number between 1 and 100"
+)
+
+// getUnlockedIDs returns the files and subfolders unlocked by the grants sent in the X-Unlock-Grants header,
+// comma separated. The invalid, expired and other users' grants are ignored.
+func getUnlockedIDs(c *gin.Context, userID int64) ([]int64, []int64) {
+	unlockedFileIDs := []int64{}
+	unlockedSubfolderIDs := []int64{}
+	for _, encodedGrant := range strings.Split(c.GetHeader(unlockGrantsHeader), ",") {
+		encodedGrant = strings.TrimSpace(encodedGrant)
+		if len(encodedGrant) == 0 {
+			continue
+		}
+		grant, err := auth.ValidateUnlockGrant(encodedGrant)
+		if err != nil || grant.UserID != userID {
+			log.Error("The user %d sent an unlock grant that is not valid", userID)
+			continue
+		}
+
+		switch grant.Kind {
+		case auth.UnlockGrantFile:
+			unlockedFileIDs = append(unlockedFileIDs, grant.ID)
+		case auth.UnlockGrantSubfolder:
+			unlockedSubfolderIDs = append(unlockedSubfolderIDs, grant.ID)
+		}
+	}
+	return unlockedFileIDs, unlockedSubfolderIDs
+}
+
+// getLimitFromRequest returns the limit query parameter, or the default when it is missing
+func getLimitFromRequest(c *gin.Context, defaultLimit int, maxLimit int) (int, error) {
+	rawLimit := c.Query("limit")
+	if len(rawLimit) == 0 {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(rawLimit)
+	if err != nil || limit < 1 || limit > maxLimit {
+		return 0, fmt.Errorf("the limit must be a number between 1 and %d", maxLimit)
+	}
+	return limit, nil
+}
+
+// HandleGetSearch searches the names and the contents of the files. The locked files, and the files
+// in locked subfolders, are only searched when an unlock grant for them is sent.
+func (s *Service) HandleGetSearch(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	query := strings.TrimSpace(c.Query("q"))
+	if len(query) == 0 {
+		log.Error("The user %d sent an empty search query", claims.Id)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": emptySearchQuery,
+		})
+		return
+	}
+
+	limit, err := getLimitFromRequest(c, defaultSearchLimit, maxSearchLimit)
+	if err != nil {
+		log.Error("Error retrieving the limit of the search: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": invalidSearchLimit,
+		})
+		return
+	}
+
+	unlockedFileIDs, unlockedSubfolderIDs := getUnlockedIDs(c, claims.Id)
+	hits, err := database.SearchFiles(s.Database, query, unlockedFileIDs, unlockedSubfolderIDs, claims.MFA, limit)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error searching the files for %s", query)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	log.Info("Successfully searched the files for the user %d, %d hits", claims.Id, len(hits))
+	c.JSON(http.StatusOK, gin.H{
+		"hits": hits,
+	})
+}
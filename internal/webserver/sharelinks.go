@@ -0,0 +1,506 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/internal/utils"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	shareLinkPasswordHeader = "X-Share-Password"
+	shareTokenSize          = 32
+)
+
+// NewShareLink is the body of the requests creating a share link, the omitted fields leaving the link unlimited.
+// RequireUploader, MaxFiles and MaxBytes only apply to the file requests, the upload-only links.
+type NewShareLink struct {
+	Mode            string     `json:"mode"`
+	Password        string     `json:"password"`
+	ExpiresAt       *time.Time `json:"expiresAt"`
+	MaxDownloads    *int64     `json:"maxDownloads"`
+	RequireUploader bool       `json:"requireUploader"`
+	MaxFiles        *int64     `json:"maxFiles"`
+	MaxBytes        *int64     `json:"maxBytes"`
+}
+
+// anonymousClaims are used to check the rules of the sensitivity labels for the accesses through share links
+var anonymousClaims = &auth.AuthCustomClaims{}
+
+func generateShareToken() (string, error) {
+	token := make([]byte, shareTokenSize)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// respondShareLinkError returns true, after responding, if the error is caused by the share link
+func respondShareLinkError(c *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.Error() {
+	case database.SHARE_LINK_NOT_FOUND:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case database.SHARE_LINK_EXPIRED, database.SHARE_LINK_LIMIT_REACHED:
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case database.SHARE_LINK_UPLOAD_LIMIT:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case database.SHARE_LINK_PASSWORD_REQUIRED:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case database.INVALID_SHARE_LINK, database.SHARE_LINK_UPLOAD_TO_FILE, database.SHARE_LINK_EXPIRY_IN_THE_PAST,
+		database.SHARE_LINK_UPLOADER_REQUIRED:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
+
+// enforceShareLinkLabel checks that the label of the target still allows public share links, and the action
+func (s *Service) enforceShareLinkLabel(c *gin.Context, target labelTarget, action string) (database.LabelRules, bool) {
+	_, allowed := s.enforceLabelRules(c, anonymousClaims, target, labelActionShare, false)
+	if !allowed {
+		return database.LabelRules{}, false
+	}
+	return s.enforceLabelRules(c, anonymousClaims, target, action, false)
+}
+
+// HandlePostSubfolderShareLink creates a link giving access to the files of a subfolder, or letting anyone upload to it
+func (s *Service) HandlePostSubfolderShareLink(c *gin.Context) {
+	s.handlePostShareLink(c, false, false)
+}
+
+// HandlePostFileShareLink creates a link to download a file
+func (s *Service) HandlePostFileShareLink(c *gin.Context) {
+	s.handlePostShareLink(c, true, false)
+}
+
+// HandlePostFileRequest creates a file request, an upload-only link collecting files in a subfolder
+func (s *Service) HandlePostFileRequest(c *gin.Context) {
+	s.handlePostShareLink(c, false, true)
+}
+
+// handlePostShareLink creates the link of the subfolder or of the file, only their owner can share them. The token
+// is only returned in this response.
+func (s *Service) handlePostShareLink(c *gin.Context, isFileLink bool, isFileRequest bool) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var newLink NewShareLink
+	err = c.BindJSON(&newLink)
+	if err != nil {
+		log.Error("Error %s binding the JSON for the share link request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if isFileRequest {
+		newLink.Mode = database.ShareLinkUpload
+	} else if len(newLink.Mode) == 0 {
+		newLink.Mode = database.ShareLinkRead
+	}
+
+	link := database.ShareLink{
+		OwnerID:         claims.Id,
+		Mode:            newLink.Mode,
+		ExpiresAt:       newLink.ExpiresAt,
+		MaxDownloads:    newLink.MaxDownloads,
+		RequireUploader: newLink.RequireUploader,
+		MaxFiles:        newLink.MaxFiles,
+		MaxBytes:        newLink.MaxBytes,
+	}
+	link.FolderID, err = getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		return
+	}
+	link.SubfolderID, err = getIntParameterFromRequest(c, "subfolder_id")
+	if err != nil {
+		return
+	}
+	if isFileLink {
+		var ok bool
+		link.FileID, ok = s.getOwnedFileID(c, claims.Id)
+		if !ok {
+			return
+		}
+	} else {
+		subfolderDetails, err := database.GetAllSubfolderDetailsForID(s.Database, link.SubfolderID, link.FolderID)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if subfolderDetails.OwnerID != claims.Id {
+			log.Error("The user %d tried to share the subfolder %d, owned by %d", claims.Id, link.SubfolderID, subfolderDetails.OwnerID)
+			c.Status(http.StatusForbidden)
+			return
+		}
+	}
+
+	target := labelTarget{FolderID: link.FolderID, SubfolderID: link.SubfolderID, FileID: link.FileID}
+	_, allowed := s.enforceLabelRules(c, claims, target, labelActionShare, false)
+	if !allowed {
+		return
+	}
+
+	token, err := generateShareToken()
+	if err != nil {
+		log.Error("Error generating the token of the share link: %s", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	link.ID, err = database.AddShareLink(s.Database, link, token, newLink.Password)
+	if respondShareLinkError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	setAuditAction(c, database.AuditCreate, database.AuditTargetShareLink, link.ID)
+	log.Info("The user %d created the share link %d", claims.Id, link.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"id":    link.ID,
+		"token": token,
+		"url":   "/s/" + token,
+	})
+}
+
+// HandleGetShareLinks returns the share links created by the user
+func (s *Service) HandleGetShareLinks(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	links, err := database.GetShareLinks(s.Database, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"links": links,
+	})
+}
+
+// HandleRemoveShareLink revokes a share link of the user
+func (s *Service) HandleRemoveShareLink(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	linkID, err := getIntParameterFromRequest(c, "share_id")
+	if err != nil {
+		return
+	}
+
+	err = database.RevokeShareLink(s.Database, linkID, claims.Id)
+	if respondShareLinkError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("The user %d revoked the share link %d", claims.Id, linkID)
+	c.Status(http.StatusOK)
+}
+
+// getShareLink returns the link of the token parameter, responding when it can't be used
+func (s *Service) getShareLink(c *gin.Context) (database.ShareLink, bool) {
+	link, err := database.GetShareLinkForToken(s.Database, c.Param("token"), c.GetHeader(shareLinkPasswordHeader))
+	if link.ID != 0 {
+		setAuditAction(c, database.AuditRead, database.AuditTargetShareLink, link.ID)
+	}
+	if respondShareLinkError(c, err) {
+		return link, false
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return link, false
+	}
+	return link, true
+}
+
+// HandleGetShareLink serves the content of a share link: the file of a file link, the files of a subfolder link,
+// and only the details of an upload-only link
+func (s *Service) HandleGetShareLink(c *gin.Context) {
+	link, ok := s.getShareLink(c)
+	if !ok {
+		return
+	}
+
+	if link.FileID != 0 {
+		s.sendSharedFile(c, link, link.FileID)
+		return
+	}
+	if link.Mode == database.ShareLinkUpload {
+		c.JSON(http.StatusOK, gin.H{
+			"mode":            link.Mode,
+			"expiresAt":       link.ExpiresAt,
+			"requireUploader": link.RequireUploader,
+			"maxFiles":        link.MaxFiles,
+			"maxBytes":        link.MaxBytes,
+			"uploadedFiles":   link.UploadedFiles,
+			"uploadedBytes":   link.UploadedBytes,
+		})
+		return
+	}
+
+	target := labelTarget{FolderID: link.FolderID, SubfolderID: link.SubfolderID}
+	_, allowed := s.enforceShareLinkLabel(c, target, labelActionRead)
+	if !allowed {
+		return
+	}
+
+	page, err := getPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+	// the locked files, and the files whose label forbids the share links or requires the second factor, are left out
+	filter := database.FileFilter{Shared: true}
+	files, pageInfo, err := database.GetAllFilesDetails(s.Database, link.FolderID, link.SubfolderID, filter, page)
+	if respondPaginationError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully listed the files of the share link %d", link.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"mode":       link.Mode,
+		"files":      files,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
+	})
+}
+
+// HandleGetShareLinkFile downloads a file of the subfolder shared by the link
+func (s *Service) HandleGetShareLinkFile(c *gin.Context) {
+	link, ok := s.getShareLink(c)
+	if !ok {
+		return
+	}
+	if link.FileID != 0 || link.Mode != database.ShareLinkRead {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": database.INVALID_SHARE_LINK,
+		})
+		return
+	}
+
+	fileID, err := getIntParameterFromRequest(c, "file_id")
+	if err != nil {
+		return
+	}
+	s.sendSharedFile(c, link, fileID)
+}
+
+// sendSharedFile downloads the file through the link, counting the download against the limit of the link
+func (s *Service) sendSharedFile(c *gin.Context, link database.ShareLink, fileID int64) {
+	setAuditAction(c, database.AuditDownload, database.AuditTargetFile, fileID)
+
+	fileDetails, err := database.GetFilesDetailsForFileID(s.Database, fileID, link.FolderID, link.SubfolderID)
+	if err != nil || len(fileDetails.Filename) == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	// the link of a subfolder doesn't give access to its locked files, only a link of the file itself does
+	if link.FileID == 0 && fileDetails.FileLocked {
+		log.Error("The locked file %d can't be downloaded through the share link %d", fileID, link.ID)
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	label, allowed := s.enforceShareLinkLabel(c, labelTarget{FolderID: link.FolderID, SubfolderID: link.SubfolderID, FileID: fileID}, labelActionDownload)
+	if !allowed {
+		return
+	}
+
+	err = database.UseShareLinkDownload(s.Database, link.ID)
+	if respondShareLinkError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	file, err := s.openStoredFile(c, fileDetails)
+	if err == encryption.ErrInvalidPassword {
+		log.Error("The password provided to download the file %s is not correct", fileDetails.Filename)
+		c.Status(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Error("Error opening the file %s", fileDetails.Filename)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	downloadedBy := fmt.Sprintf("the share link %d", link.ID)
+	err = s.sendFile(c, downloadedBy, label, fileDetails.Filename, file)
+	if err != nil {
+		// once the headers are sent, the client sees a truncated download
+		log.Error("Error sending the file %s through the share link %d: %s", fileDetails.Filename, link.ID, err)
+		return
+	}
+
+	s.notifyFileWatchers(0, downloadedBy, fileID, fileDetails.Filename, database.AuditDownload)
+	log.Info("Successfully downloaded the file with ID %d through the share link %d", fileID, link.ID)
+}
+
+// HandlePostShareLinkUpload uploads a file through a file request, the file being owned by the owner of the link.
+// The uploader can give a name and an email, required when the link asks for them, and the owner is notified.
+func (s *Service) HandlePostShareLinkUpload(c *gin.Context) {
+	link, ok := s.getShareLink(c)
+	if !ok {
+		return
+	}
+	if link.Mode != database.ShareLinkUpload {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": database.INVALID_SHARE_LINK,
+		})
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		log.Error("Error getting the file from the form: %s", err.Error())
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	uploaderName := strings.TrimSpace(c.Request.FormValue("name"))
+	uploaderEmail := strings.TrimSpace(c.Request.FormValue("email"))
+	if link.RequireUploader && (len(uploaderName) == 0 || len(uploaderEmail) == 0) {
+		respondShareLinkError(c, errors.New(database.SHARE_LINK_UPLOADER_REQUIRED))
+		return
+	}
+	if len(uploaderEmail) > 0 && !utils.ValidateEmail(uploaderEmail) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ERROR_EMAIL_IS_INVALID,
+		})
+		return
+	}
+
+	_, allowed := s.enforceShareLinkLabel(c, labelTarget{FolderID: link.FolderID, SubfolderID: link.SubfolderID}, labelActionUpload)
+	if !allowed {
+		return
+	}
+
+	// the upload is counted before the file is stored, so concurrent uploads can't go over the limits together
+	err = database.ReserveShareLinkUpload(s.Database, link.ID, file.Size)
+	if respondShareLinkError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	fileID, ok := s.addUploadedFile(c, link.OwnerID, link.FolderID, link.SubfolderID, 0, file, "", false, "")
+	if !ok {
+		database.ReleaseShareLinkUpload(s.Database, link.ID, file.Size)
+		return
+	}
+	err = database.AddShareLinkUpload(s.Database, link.ID, fileID, uploaderName, uploaderEmail)
+	if err != nil {
+		log.Error("The file %d was uploaded, but the uploader couldn't be recorded", fileID)
+	}
+
+	setAuditAction(c, database.AuditCreate, database.AuditTargetFile, fileID)
+	s.notifyFileRequestOwner(link, file.Filename, uploaderName, uploaderEmail)
+	log.Info("File %s successfully uploaded through the share link %d", file.Filename, link.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"id": fileID,
+	})
+}
+
+// notifyFileRequestOwner emails the owner of the file request that a file arrived, in the background
+func (s *Service) notifyFileRequestOwner(link database.ShareLink, filename string, uploaderName string, uploaderEmail string) {
+	ownerEmail, err := database.GetUserEmailForID(s.Database, link.OwnerID)
+	if err != nil {
+		return
+	}
+
+	uploadedBy := "an anonymous uploader"
+	if len(uploaderName) > 0 || len(uploaderEmail) > 0 {
+		uploadedBy = strings.TrimSpace(fmt.Sprintf("%s <%s>", uploaderName, uploaderEmail))
+	}
+	subject := fmt.Sprintf("Fisierul %s a fost incarcat", filename)
+	content := fmt.Sprintf("The file %s was uploaded through the file request %d by %s", filename, link.ID, uploadedBy)
+	go func() {
+		err := s.MailingService.SendEmail([]string{ownerEmail}, subject, content, content)
+		if err != nil {
+			log.Error("Error notifying the owner of the file request %d: %s", link.ID, err)
+		}
+	}()
+}
+
+// HandleGetFileRequestUploads returns the files uploaded through a file request of the user, with their uploaders
+func (s *Service) HandleGetFileRequestUploads(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	linkID, err := getIntParameterFromRequest(c, "share_id")
+	if err != nil {
+		return
+	}
+
+	uploads, err := database.GetShareLinkUploads(s.Database, linkID, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"uploads": uploads,
+	})
+}
@@ -0,0 +1,75 @@
+package webserver
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+)
+
+func TestShareLinksOnlyGiveAccessToTheirItems(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, _ := s.addUser(t, "owner@example.com")
+	folderID, subfolderID := s.addSubfolder(t, ownerID, "shared", "")
+	otherFolderID, otherSubfolderID := s.addSubfolder(t, ownerID, "private", "")
+	sharedFileID := s.addFile(t, ownerID, folderID, subfolderID, "shared.pdf", "shared content", "")
+	lockedFileID := s.addFile(t, ownerID, folderID, subfolderID, "locked.pdf", "locked content", "file password")
+	privateFileID := s.addFile(t, ownerID, otherFolderID, otherSubfolderID, "private.pdf", "private content", "")
+
+	subfolderLink := database.ShareLink{OwnerID: ownerID, FolderID: folderID, SubfolderID: subfolderID, Mode: database.ShareLinkRead}
+	if _, err := database.AddShareLink(s.Database, subfolderLink, "subfolder-token", ""); err != nil {
+		t.Fatal(err)
+	}
+	fileLink := subfolderLink
+	fileLink.FileID = sharedFileID
+	if _, err := database.AddShareLink(s.Database, fileLink, "file-token", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	response := s.serve(http.MethodGet, "/s/subfolder-token/"+itoa(sharedFileID), "", nil)
+	expectStatus(t, response, http.StatusOK, "downloading a file of the shared subfolder")
+	if response.Body.String() != "shared content" {
+		t.Fatalf("the shared file has the content %q", response.Body.String())
+	}
+
+	response = s.serve(http.MethodGet, "/s/subfolder-token/"+itoa(privateFileID), "", nil)
+	expectStatus(t, response, http.StatusNotFound, "downloading a file of another subfolder")
+
+	response = s.serve(http.MethodGet, "/s/subfolder-token/"+itoa(lockedFileID), "", nil)
+	expectStatus(t, response, http.StatusForbidden, "downloading a locked file through the link of its subfolder")
+
+	response = s.serve(http.MethodGet, "/s/file-token/"+itoa(privateFileID), "", nil)
+	expectStatus(t, response, http.StatusForbidden, "downloading another file through the link of a file")
+
+	response = s.serve(http.MethodGet, "/s/file-token", "", nil)
+	expectStatus(t, response, http.StatusOK, "downloading the file of its link")
+
+	response = s.serve(http.MethodGet, "/s/unknown-token", "", nil)
+	expectStatus(t, response, http.StatusNotFound, "using an unknown token")
+}
+
+func TestShareLinkPasswordAndDownloadLimit(t *testing.T) {
+	s, cleanup := newTestService(t)
+	defer cleanup()
+	ownerID, _ := s.addUser(t, "owner@example.com")
+	folderID, subfolderID := s.addSubfolder(t, ownerID, "shared", "")
+	fileID := s.addFile(t, ownerID, folderID, subfolderID, "shared.pdf", "shared content", "")
+
+	maxDownloads := int64(1)
+	link := database.ShareLink{OwnerID: ownerID, FolderID: folderID, SubfolderID: subfolderID, FileID: fileID,
+		Mode: database.ShareLinkRead, MaxDownloads: &maxDownloads}
+	if _, err := database.AddShareLink(s.Database, link, "protected-token", "link password"); err != nil {
+		t.Fatal(err)
+	}
+
+	response := s.serve(http.MethodGet, "/s/protected-token", "", nil)
+	expectStatus(t, response, http.StatusUnauthorized, "downloading without the password of the link")
+	response = s.serve(http.MethodGet, "/s/protected-token", "", nil, shareLinkPasswordHeader, "wrong password")
+	expectStatus(t, response, http.StatusUnauthorized, "downloading with a wrong password")
+
+	response = s.serve(http.MethodGet, "/s/protected-token", "", nil, shareLinkPasswordHeader, "link password")
+	expectStatus(t, response, http.StatusOK, "downloading with the password of the link")
+	response = s.serve(http.MethodGet, "/s/protected-token", "", nil, shareLinkPasswordHeader, "link password")
+	expectStatus(t, response, http.StatusGone, "downloading over the limit of the link")
+}
@@ -3,15 +3,14 @@ package webserver
 import (
 	"fmt"
 	"net/http"
-	"os"
 
 	"github.com/gin-gonic/gin"
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
 	"github.com/CosminMocanu97/dissertationBackend/internal/database"
 	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
 )
 
 var (
-	pathToSaveSubfolders = "/home/cosminel/DissertationAppFolders/"
 	SUBFOLDER_NAME_IS_EMPTY = "subfolder name cannot be empty"
 	SUBFOLDER_ALREADY_EXISTS = "this subfolder already exists in the database"
 )
@@ -56,7 +55,6 @@ func (s *Service) HandlePostSubfolderRequest(c *gin.Context) {
 		return
 	}
 
-	subfolderPath := pathToSaveSubfolders + folderName + "/"
 	var subfolderDetails Subfolder
 	var isLocked bool
 	err = c.BindJSON(&subfolderDetails)
@@ -92,16 +90,7 @@ func (s *Service) HandlePostSubfolderRequest(c *gin.Context) {
 		return
 	} 
 
-	subfolderErr := os.Mkdir(subfolderPath + subfolderDetails.Name, 0755)
-	if subfolderErr != nil {
-		errorMessage := fmt.Sprintf("Error creating the subfolder on file system for path %s : subfolder already exists", subfolderPath)
-		log.Error(errorMessage)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": errorMessage,
-		})
-		return
-	}
-
+	setAuditTarget(c, subfolderId)
 	log.Info("Successfully created the subfolder with the name %s in folder %s", subfolderDetails.Name, folderName)
 	c.JSON(http.StatusOK, gin.H{
 		"id": subfolderId,
@@ -149,8 +138,19 @@ func (s *Service) HandleGetAllFullSubfolderDetails(c *gin.Context) {
 		return
 	}	
 
-	subfolderDetails, gsErr := database.GetAllSubFoldersDetails(s.Database, folderID)
-	if gsErr != nil {
+	page, err := getPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+
+	filter := database.SubfolderFilter{
+		Tags:     c.QueryArray("tag"),
+		Metadata: getMetadataFilters(c),
+	}
+	subfolderDetails, pageInfo, gsErr := database.GetAllSubFoldersDetails(s.Database, folderID, filter, page)
+	if respondPaginationError(c, gsErr) || respondMetadataError(c, gsErr) {
+		return
+	} else if gsErr != nil {
 		errorMessage := fmt.Sprintf("Error retrieving all subfolders from %s: %s", folderName, gsErr)
 		log.Error(errorMessage)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -164,12 +164,27 @@ func (s *Service) HandleGetAllFullSubfolderDetails(c *gin.Context) {
 		"subfolders": subfolderDetails,
 		"rootfolder" : folderDetails.Name,
 		"ownerID" : folderDetails.OwnerID,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
 	})
 }
 
 func (s *Service) HandlePostCheckPasswordSubfolder(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
 	var verifyPassword VerifyPasswordSubfolder
-	err := c.BindJSON(&verifyPassword)
+	err = c.BindJSON(&verifyPassword)
 	if err != nil {
 		log.Error("Error %s binding the JSON for HandlePostCheckPasswordSubfolder request %s", err, c.Request.Body)
 		c.Status(http.StatusBadRequest)
@@ -216,8 +231,18 @@ func (s *Service) HandlePostCheckPasswordSubfolder(c *gin.Context) {
 		return
 	}
 
+	// the grant lets the search include the content of the subfolder
+	unlockGrant, err := auth.GenerateUnlockGrant(claims.Id, auth.UnlockGrantSubfolder, subfolderID)
+	if err != nil {
+		log.Error("Error generating the unlock grant for the subfolder %s: %s", subfolderName, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
 	log.Info("The password provided by the user for subfolder %s is correct", subfolderName)
-	c.Status(http.StatusOK)
+	c.JSON(http.StatusOK, gin.H{
+		"unlockGrant": unlockGrant,
+	})
 }
 
 func (s *Service) HandleRemoveSubfolder(c *gin.Context) {
@@ -267,6 +292,14 @@ func (s *Service) HandleRemoveSubfolder(c *gin.Context) {
 		return
 	}
 
+	// the storage keys have to be retrieved before the files are removed from the database
+	storedFiles, err := database.GetStoredFilesForSubfolder(s.Database, subfolderID, folderID, claims.Id)
+	if err != nil {
+		log.Error("Error retrieving the stored files of the subfolder %s: %s", subfolderName, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
 	subfolderErr := database.RemoveSubfolder(s.Database, subfolderID, folderID, claims.Id)
 	filesErr := database.RemoveFilesFromSubfolder(s.Database, subfolderID, folderID, claims.Id)
 
@@ -281,11 +314,8 @@ func (s *Service) HandleRemoveSubfolder(c *gin.Context) {
 		c.Status(http.StatusInternalServerError)
 		return
 	} else {
-		err := os.RemoveAll(pathToSaveFiles + folderName + "/" + subfolderName)
-		if err != nil {
-			log.Fatal("%s", err)
-		}
-		log.Info("Successfully deleted the subfolder %s from file system", subfolderName)
+		s.removeStoredFiles(storedFiles)
+		log.Info("Successfully deleted the files of the subfolder %s from the storage", subfolderName)
 	}
 
 	log.Info("Successfully removed subfolder %s from the database", subfolderName)
@@ -3,10 +3,23 @@ package webserver
 import (
 	"database/sql"
 	"github.com/CosminMocanu97/dissertationBackend/internal/mail"
+	"github.com/CosminMocanu97/dissertationBackend/internal/oidc"
+	"github.com/CosminMocanu97/dissertationBackend/internal/search"
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
+	"golang.org/x/net/webdav"
 )
 
 type Service struct {
 	Database       *sql.DB
 	JwtSecret      string
 	MailingService mail.Mailer
+	Storage        *storage.Store
+	Indexer        *search.Indexer
+	// OIDC logs the users in with the identity provider, nil when the single sign-on is not configured
+	OIDC *oidc.Provider
+	// SCIMToken is the bearer token of the identity provider provisioning the users, empty when the provisioning
+	// is disabled
+	SCIMToken string
+	// davLocks holds the WebDAV locks, shared by the requests
+	davLocks webdav.LockSystem
 }
\ No newline at end of file
@@ -20,6 +20,8 @@ const (
 	ERROR_USER_ALREADY_EXISTS     = "the email already exists in the database"
 	ERROR_INVALID_CREDENTIALS 	  = "invalid credentials"
 	ERROR_USER_NOT_ACTIVATED 	  = "account is not activated"
+	ERROR_MFA_CODE_REQUIRED       = "mfaCodeRequired"
+	ERROR_INVALID_MFA_CODE        = "invalid two factor authentication code"
 )
 
 //login contorller interface
@@ -59,8 +61,27 @@ func Login(db *sql.DB, ctx *gin.Context) (int64, bool, map[string]string, error)
 		log.Error("Error retrieving the user details for email %s: %s", credential.Email, err)
 		return 0, false, map[string]string{}, err
 	}
+
+	// with the two factor authentication enabled, the code of the authenticator app is required too
+	mfa, gsErr := database.GetUserMFA(db, user.ID)
+	if gsErr != nil {
+		return 0, false, map[string]string{}, gsErr
+	}
+	if mfa.Enabled {
+		if len(credential.Code) == 0 {
+			return 0, false, map[string]string{}, errors.New(ERROR_MFA_CODE_REQUIRED)
+		}
+		isCodeValid, gsErr := verifyMFACode(db, user.ID, mfa, credential.Code)
+		if gsErr != nil {
+			return 0, false, map[string]string{}, gsErr
+		}
+		if !isCodeValid {
+			return 0, false, map[string]string{}, errors.New(ERROR_INVALID_MFA_CODE)
+		}
+	}
+
 	log.Info("Jwt token was successfully generated!")
-	return user.ID, user.IsAdmin, jwtService.GenerateToken(user.ID, credential.Email, user.IsActivated), nil
+	return user.ID, user.IsAdmin, jwtService.GenerateToken(user.ID, credential.Email, user.IsActivated, mfa.Enabled), nil
 }
 
 // HandlePostRegisterRequest godoc
@@ -132,6 +153,7 @@ func (s *Service) HandlePostRegisterRequest(c *gin.Context) {
 				return
 			}
 
+			setAuditActor(c, user.ID)
 			activationToken := utils.BuildActivationTokenWithUserId(user.ID, activationToken)
 			// send activation email
 			recipients := []string{registrationData.Email}
@@ -178,6 +200,11 @@ func (s *Service) HandlePostLoginRequest(c *gin.Context) {
 		} else if err.Error() == ERROR_USER_NOT_ACTIVATED {
 			c.Status(http.StatusForbidden)
 			return
+		} else if err.Error() == ERROR_MFA_CODE_REQUIRED || err.Error() == ERROR_INVALID_MFA_CODE {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": err.Error(),
+			})
+			return
 		} else {
 			log.Error("%s", err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -185,6 +212,7 @@ func (s *Service) HandlePostLoginRequest(c *gin.Context) {
 			})
 		}
 	} else {
+		setAuditActor(c, id)
 		c.JSON(http.StatusOK, gin.H {
 			"id":    id,
 			"admin" : isAdmin,
@@ -225,6 +253,7 @@ func (s *Service) HandlePostActivateAccount(c *gin.Context) {
 		})
 		return
 	} else {
+		setAuditActor(c, userID)
 		tokenIsCorrect, gsErr := database.VerifyActivationToken(s.Database, userID, activationToken)
 		if gsErr != nil {
 			log.Error("Error validating the activation token: %s", gsErr)
@@ -235,7 +264,13 @@ func (s *Service) HandlePostActivateAccount(c *gin.Context) {
 		} else {
 			if tokenIsCorrect {
 				gsErr = database.ActivateAccount(s.Database, userID)
-				if gsErr != nil {
+				if gsErr != nil && gsErr.Error() == database.USER_DEACTIVATED {
+					log.Error("The account with ID %d was deactivated by the provisioning", userID)
+					c.JSON(http.StatusForbidden, gin.H{
+						"error": gsErr.Error(),
+					})
+					return
+				} else if gsErr != nil {
 					log.Error("Error activating the account for ID %d: %s", userID, gsErr)
 					c.JSON(http.StatusInternalServerError, gin.H{
 						"error": "Error while trying to activate the account",
@@ -286,10 +321,11 @@ func (s *Service) HandlePostForgotPasswordRequest(c *gin.Context) {
 		})
 		return
 	} else {
+		setAuditActor(c, user.ID)
 		newTokenWithUserId := utils.BuildActivationTokenWithUserId(user.ID, newToken)
 		gsErr = database.RenewActivationToken(s.Database, user.ID, newToken)
 		if gsErr != nil {
-			log.Error("UUID: %s; Error changing the token for the account with ID %d: %s", user.ID, gsErr)
+			log.Error("Error changing the token for the account with ID %d: %s", user.ID, gsErr)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": gsErr,
 			})
@@ -341,9 +377,10 @@ func (s *Service) HandlePostRenewPasswordRequest(c *gin.Context) {
 			"error": "Invalid token format",
 		})
 	} else {
+		setAuditActor(c, userID)
 		tokenIsCorrect, gsErr := database.VerifyActivationToken(s.Database, userID, activationToken)
 		if gsErr != nil {
-			log.Error("UUID: %s; Error validating the token for password update: %s", gsErr)
+			log.Error("Error validating the token for password update: %s", gsErr)
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "Invalid token for password update",
 			})
@@ -8,6 +8,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
 	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
 )
 
@@ -43,7 +44,7 @@ func getIntParameterFromRequest(c *gin.Context, paramName string) (int64, error)
 	rawParam := c.Params.ByName(paramName)
 	if len(rawParam) == 0 {
 		errorMessage := fmt.Sprintf("Error retrieving the parameter %s from the request", paramName)
-		log.Error("UUID: %s; %s", errorMessage)
+		log.Error("%s", errorMessage)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": errorMessage,
 		})
@@ -60,3 +61,52 @@ func getIntParameterFromRequest(c *gin.Context, paramName string) (int64, error)
 	param := int64(intParam)
 	return param, nil
 }
+
+// verifyAdmin returns true if the user is an admin, otherwise it responds with 403
+func (s *Service) verifyAdmin(c *gin.Context, claims *auth.AuthCustomClaims) bool {
+	// the API tokens of the admins need the admin scope
+	if !verifyAPITokenScope(c, database.APITokenAdmin) {
+		return false
+	}
+	isAdmin, err := database.UserIsAdmin(s.Database, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return false
+	}
+	if !isAdmin {
+		log.Error("The user %d tried to perform an admin operation", claims.Id)
+		c.Status(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// getPageRequest reads the limit, cursor, sort and order query parameters of a listing
+func getPageRequest(c *gin.Context) (database.PageRequest, error) {
+	page := database.PageRequest{
+		Cursor: c.Query("cursor"),
+		Sort:   c.Query("sort"),
+		Order:  c.Query("order"),
+	}
+
+	rawLimit := c.Query("limit")
+	if len(rawLimit) > 0 {
+		limit, err := strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 {
+			return page, errors.New(database.INVALID_PAGE_LIMIT)
+		}
+		page.Limit = limit
+	}
+	return page, nil
+}
+
+// respondPaginationError returns true, after responding with 400, if the error is caused by the page request
+func respondPaginationError(c *gin.Context, err error) bool {
+	if !database.IsPaginationError(err) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": err.Error(),
+	})
+	return true
+}
@@ -0,0 +1,176 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+func (s *Service) HandleGetFileVersions(c *gin.Context) {
+	fileID, err := getIntParameterFromRequest(c, "file_id")
+	if err != nil {
+		log.Error("Error retrieving file id parameter from the "+
+			"HandleGetFileVersions request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	subfolderID, err := getIntParameterFromRequest(c, "subfolder_id")
+	if err != nil {
+		log.Error("Error retrieving subfolder_id parameter from the "+
+			"HandleGetFileVersions request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the "+
+			"HandleGetFileVersions request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	fileDetails, err := database.GetFilesDetailsForFileID(s.Database, fileID, folderID, subfolderID)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the file details for id %d: %s", fileID, err)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	versions, err := database.GetFileVersions(s.Database, fileID)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the versions of the file %s", fileDetails.Filename)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	log.Info("Successfully retrieved the versions of the file with ID %d", fileID)
+	c.JSON(http.StatusOK, gin.H{
+		"versions": versions,
+	})
+}
+
+// HandleGetDownloadFileVersion streams a previous content of the file. The versions of the files encrypted
+// with their password need the current password of the file, they are re-encrypted when it changes.
+func (s *Service) HandleGetDownloadFileVersion(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	fileID, err := getIntParameterFromRequest(c, "file_id")
+	if err != nil {
+		log.Error("Error retrieving file id parameter from the "+
+			"HandleGetDownloadFileVersion request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	subfolderID, err := getIntParameterFromRequest(c, "subfolder_id")
+	if err != nil {
+		log.Error("Error retrieving subfolder_id parameter from the "+
+			"HandleGetDownloadFileVersion request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		log.Error("Error retrieving folder_id parameter from the "+
+			"HandleGetDownloadFileVersion request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	versionID, err := getIntParameterFromRequest(c, "version_id")
+	if err != nil {
+		log.Error("Error retrieving version_id parameter from the "+
+			"HandleGetDownloadFileVersion request: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	fileDetails, err := database.GetFilesDetailsForFileID(s.Database, fileID, folderID, subfolderID)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Error retrieving the file details for id %d: %s", fileID, err)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+
+	blob, err := database.GetFileVersionBlob(s.Database, fileID, versionID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	label, allowed := s.enforceLabelRules(c, claims, labelTarget{FolderID: folderID, SubfolderID: subfolderID, FileID: fileID}, labelActionDownload, false)
+	if !allowed {
+		return
+	}
+	if !s.verifyFileUnlocked(c, claims, fileID, folderID, subfolderID, fileDetails) {
+		return
+	}
+
+	file, err := s.openBlob(c, blob)
+	if err == encryption.ErrInvalidPassword {
+		log.Error("The password provided to download the version %d of the file %s is not correct", versionID, fileDetails.Filename)
+		c.Status(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		errorMessage := fmt.Sprintf("Error opening the version %d of the file %s", versionID, fileDetails.Filename)
+		log.Error(errorMessage)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errorMessage,
+		})
+		return
+	}
+	defer file.Close()
+
+	err = s.sendFile(c, claims.Email, label, fileDetails.Filename, file)
+	if err != nil {
+		// once the headers are sent, the client sees a truncated download
+		log.Error("Error sending the version %d of the file %s: %s", versionID, fileDetails.Filename, err)
+		return
+	}
+
+	s.notifyFileWatchers(claims.Id, claims.Email, fileID, fileDetails.Filename, database.AuditDownload)
+	log.Info("Successfully downloaded the version %d of the file with ID %d", versionID, fileID)
+}
@@ -0,0 +1,167 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
+	"github.com/gin-gonic/gin"
+)
+
+type FileWatch struct {
+	Watch bool `json:"watch"`
+}
+
+// watcherNotificationInterval is the time a watcher isn't emailed again about the same file, the accesses made
+// meanwhile are only listed in its access log
+const watcherNotificationInterval = 15 * time.Minute
+
+// notifyFileWatchers emails the users watching the file that it was accessed by someone else. The emails are sent
+// in the background, so the access doesn't wait for them.
+func (s *Service) notifyFileWatchers(actorID int64, accessedBy string, fileID int64, filename string, action string) {
+	recipients, err := database.ClaimFileWatcherNotifications(s.Database, fileID, actorID, watcherNotificationInterval)
+	if err != nil || len(recipients) == 0 {
+		return
+	}
+
+	subject := fmt.Sprintf("Fisierul %s a fost accesat", filename)
+	content := fmt.Sprintf("The file %s was accessed (%s) by %s on %s. The accesses of the next %d minutes are only "+
+		"listed in the access log of the file.", filename, action, accessedBy, time.Now().UTC().Format(time.RFC3339),
+		int(watcherNotificationInterval.Minutes()))
+	go func() {
+		err := s.MailingService.SendEmail(recipients, subject, content, content)
+		if err != nil {
+			log.Error("Error notifying the watchers of the file %d: %s", fileID, err)
+		}
+	}()
+}
+
+// getOwnedFileID returns the file_id parameter, responding with 404 when the file doesn't exist and with 403 when
+// the user doesn't own it
+func (s *Service) getOwnedFileID(c *gin.Context, userID int64) (int64, bool) {
+	fileID, _, ok := s.getOwnedFile(c, userID)
+	return fileID, ok
+}
+
+// getOwnedFile is getOwnedFileID also returning the details of the file
+func (s *Service) getOwnedFile(c *gin.Context, userID int64) (int64, database.SingleFileDetails, bool) {
+	var fileDetails database.SingleFileDetails
+	folderID, err := getIntParameterFromRequest(c, "folder_id")
+	if err != nil {
+		return 0, fileDetails, false
+	}
+	subfolderID, err := getIntParameterFromRequest(c, "subfolder_id")
+	if err != nil {
+		return 0, fileDetails, false
+	}
+	fileID, err := getIntParameterFromRequest(c, "file_id")
+	if err != nil {
+		return 0, fileDetails, false
+	}
+
+	fileDetails, err = database.GetFilesDetailsForFileID(s.Database, fileID, folderID, subfolderID)
+	if err != nil && err.Error() == database.FILE_NOT_FOUND {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return 0, fileDetails, false
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return 0, fileDetails, false
+	}
+	if fileDetails.OwnerID != userID {
+		log.Error("The user %d tried to manage the file %d, owned by %d", userID, fileID, fileDetails.OwnerID)
+		c.Status(http.StatusForbidden)
+		return 0, fileDetails, false
+	}
+	return fileID, fileDetails, true
+}
+
+// HandleGetFileAccessLog returns who viewed or downloaded the file, newest first. Only its owner can read it.
+func (s *Service) HandleGetFileAccessLog(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	fileID, ok := s.getOwnedFileID(c, claims.Id)
+	if !ok {
+		return
+	}
+
+	page, err := getAuditPageRequest(c)
+	if respondPaginationError(c, err) {
+		return
+	}
+	accesses, pageInfo, err := database.GetFileAccessLog(s.Database, fileID, page)
+	if respondPaginationError(c, err) {
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	isWatched, err := database.FileIsWatched(s.Database, fileID, claims.Id)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("Successfully retrieved the access log of the file %d for the user %d", fileID, claims.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"accesses":   accesses,
+		"watched":    isWatched,
+		"nextCursor": pageInfo.NextCursor,
+		"totalCount": pageInfo.TotalCount,
+	})
+}
+
+// HandlePostFileWatch subscribes the owner of the file to an email each time someone else accesses it
+func (s *Service) HandlePostFileWatch(c *gin.Context) {
+	claims, err := verifyClaims(c)
+	if err != nil {
+		// if the claims not exist, mark it as unauthorised, otherwise, when the account is not activated,
+		// just return, so the status code is 403, from the verifyClaims logic
+		if err.Error() == ClaimsNotExist {
+			log.Error("Error retrieving the claims from JWT")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": ClaimsNotExist,
+			})
+		}
+		return
+	}
+
+	var fileWatch FileWatch
+	err = c.BindJSON(&fileWatch)
+	if err != nil {
+		log.Error("Error %s binding the JSON for HandlePostFileWatch request %s", err, c.Request.Body)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	fileID, ok := s.getOwnedFileID(c, claims.Id)
+	if !ok {
+		return
+	}
+
+	err = database.SetFileWatch(s.Database, fileID, claims.Id, fileWatch.Watch)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info("The user %d set the watch of the file %d to %t", claims.Id, fileID, fileWatch.Watch)
+	c.JSON(http.StatusOK, gin.H{
+		"watch": fileWatch.Watch,
+	})
+}
@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"github.com/dgrijalva/jwt-go"
 
 	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
 	"github.com/CosminMocanu97/dissertationBackend/internal/database"
 	"github.com/CosminMocanu97/dissertationBackend/pkg/log"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
 )
 
 type tokenReqBody struct {
@@ -20,10 +22,11 @@ func CORS() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-File-Password, X-Unlock-Grants, X-Share-Password, Depth, Destination, Overwrite, If, Lock-Token, Timeout")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK")
 
-		if c.Request.Method == "OPTIONS" {
+		// the WebDAV clients ask for the supported methods with OPTIONS
+		if c.Request.Method == "OPTIONS" && !strings.HasPrefix(c.Request.URL.Path, davPrefix) {
 			c.AbortWithStatus(204)
 			return
 		}
@@ -35,40 +38,167 @@ func CORS() gin.HandlerFunc {
 func Api(s *Service) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
+	// the client IP recorded in the audit log is only read from X-Forwarded-For when the request comes from one of
+	// the proxies listed in TRUSTED_PROXIES, gin trusting every proxy by default
+	r.TrustedProxies = nil
+	for _, trustedProxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if trustedProxy = strings.TrimSpace(trustedProxy); len(trustedProxy) > 0 {
+			r.TrustedProxies = append(r.TrustedProxies, trustedProxy)
+		}
+	}
 	r.Use(CORS())
+	s.davLocks = webdav.NewMemLS()
 
 	// Routes
 	// used for CORS
 	r.GET("/", func(context *gin.Context) {
 		context.Status(http.StatusOK)
 	})
-	r.Static("/getFile", "/home/cosminel/DissertationAppFolders/")
 	//authentication
 	r.GET("/ping", s.HandleGetPingRequest)
-	r.POST("/register", s.HandlePostRegisterRequest)
-	r.POST("/login", s.HandlePostLoginRequest)
-	r.GET("/activate/:token", s.HandlePostActivateAccount)
-	r.POST("/forgot-password", s.HandlePostForgotPasswordRequest)
-	r.POST("/renew-password/:token", s.HandlePostRenewPasswordRequest)
+	r.POST("/register", s.Audit(database.AuditRegister, database.AuditTargetUser, ""), s.HandlePostRegisterRequest)
+	r.POST("/login", s.Audit(database.AuditLogin, database.AuditTargetUser, ""), s.HandlePostLoginRequest)
+	r.GET("/oidc/login", s.HandleGetOIDCLogin)
+	r.POST("/oidc/callback", s.Audit(database.AuditLogin, database.AuditTargetUser, ""), s.HandlePostOIDCCallback)
+	r.GET("/activate/:token", s.Audit(database.AuditActivate, database.AuditTargetUser, ""), s.HandlePostActivateAccount)
+	r.POST("/forgot-password", s.Audit(database.AuditPasswordResetRequest, database.AuditTargetUser, ""), s.HandlePostForgotPasswordRequest)
+	r.POST("/renew-password/:token", s.Audit(database.AuditPasswordReset, database.AuditTargetUser, ""), s.HandlePostRenewPasswordRequest)
 
 	//folders endpoints
-	r.GET("/user", AuthorizeJWT(), s.HandleGetAllFullFolderDetails)
-	r.POST("/new_folder", AuthorizeJWT(), s.HandlePostFolderRequest)
-	r.DELETE("/user/:folder_id/remove_folder", AuthorizeJWT(), s.HandleRemoveFolder)
+	r.GET("/user", s.Audit(database.AuditRead, database.AuditTargetFolder, ""), s.AuthorizeJWT(), s.HandleGetAllFullFolderDetails)
+	r.POST("/new_folder", s.Audit(database.AuditCreate, database.AuditTargetFolder, ""), s.AuthorizeJWT(), s.HandlePostFolderRequest)
+	r.DELETE("/user/:folder_id/remove_folder", s.Audit(database.AuditDelete, database.AuditTargetFolder, "folder_id"), s.AuthorizeJWT(), s.HandleRemoveFolder)
+	r.POST("/user/:folder_id/rename", s.Audit(database.AuditUpdate, database.AuditTargetFolder, "folder_id"), s.AuthorizeJWT(), s.HandlePostRenameFolder)
 
 	//subfolder endpoints
-	r.GET("/user/:folder_id", AuthorizeJWT(), s.HandleGetAllFullSubfolderDetails)
-	r.POST("/user/:folder_id/new_subfolder", AuthorizeJWT(), s.HandlePostSubfolderRequest)
-	r.POST("/user/:folder_id/:subfolder_id", AuthorizeJWT(), s.HandlePostCheckPasswordSubfolder)
-	r.DELETE("/user/:folder_id/:subfolder_id/remove_subfolder", AuthorizeJWT(), s.HandleRemoveSubfolder)
+	r.GET("/user/:folder_id", s.Audit(database.AuditRead, database.AuditTargetFolder, "folder_id"), s.AuthorizeJWT(), s.HandleGetAllFullSubfolderDetails)
+	r.POST("/user/:folder_id/new_subfolder", s.Audit(database.AuditCreate, database.AuditTargetSubfolder, ""), s.AuthorizeJWT(), s.HandlePostSubfolderRequest)
+	r.POST("/user/:folder_id/:subfolder_id", s.Audit(database.AuditPasswordCheck, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandlePostCheckPasswordSubfolder)
+	r.DELETE("/user/:folder_id/:subfolder_id/remove_subfolder", s.Audit(database.AuditDelete, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandleRemoveSubfolder)
+	r.POST("/user/:folder_id/:subfolder_id/rename", s.Audit(database.AuditUpdate, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandlePostRenameSubfolder)
+	r.POST("/user/:folder_id/:subfolder_id/move", s.Audit(database.AuditUpdate, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandlePostMoveSubfolder)
+	r.POST("/user/:folder_id/:subfolder_id/copy", s.Audit(database.AuditCreate, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandlePostCopySubfolder)
+	r.GET("/user/:folder_id/:subfolder_id/metadata", s.Audit(database.AuditRead, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandleGetSubfolderMetadata)
+	r.POST("/user/:folder_id/:subfolder_id/metadata", s.Audit(database.AuditUpdate, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandlePostSubfolderMetadata)
 
 	//files endpoints
-	r.GET("/user/:folder_id/:subfolder_id", AuthorizeJWT(), s.HandleGetAllFilesForCurrentFolder)
-	r.GET("/user/:folder_id/:subfolder_id/:file_id", AuthorizeJWT(), s.HandleGetFileForFileID)
-	r.POST("/user/:folder_id/:subfolder_id/:file_id", AuthorizeJWT(), s.HandlePostCheckFilePassword)
-	r.POST("/user/:folder_id/:subfolder_id/upload", AuthorizeJWT(), s.HandlePostAddFile)
-	r.POST("/user/:folder_id/:subfolder_id/:file_id/update", AuthorizeJWT(), s.HandlePostModifiedFile)
-	r.DELETE("/user/:folder_id/:subfolder_id/:file_id/remove_file", AuthorizeJWT(), s.HandleRemoveFile)
+	r.GET("/user/:folder_id/:subfolder_id", s.Audit(database.AuditRead, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandleGetAllFilesForCurrentFolder)
+	r.GET("/user/:folder_id/:subfolder_id/:file_id", s.Audit(database.AuditRead, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandleGetFileForFileID)
+	r.GET("/user/:folder_id/:subfolder_id/:file_id/download", s.Audit(database.AuditDownload, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandleGetDownloadFile)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id", s.Audit(database.AuditPasswordCheck, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostCheckFilePassword)
+	r.POST("/user/:folder_id/:subfolder_id/upload", s.Audit(database.AuditCreate, database.AuditTargetFile, ""), s.AuthorizeJWT(), s.HandlePostAddFile)
+	r.POST("/user/:folder_id/:subfolder_id/import", s.Audit(database.AuditCreate, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandlePostImportArchive)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/update", s.Audit(database.AuditUpdate, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostModifiedFile)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/change_password", s.Audit(database.AuditUpdate, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostChangeFilePassword)
+	r.DELETE("/user/:folder_id/:subfolder_id/:file_id/remove_file", s.Audit(database.AuditDelete, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandleRemoveFile)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/rename", s.Audit(database.AuditUpdate, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostRenameFile)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/move", s.Audit(database.AuditUpdate, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostMoveFile)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/copy", s.Audit(database.AuditCreate, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostCopyFile)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/tags", s.Audit(database.AuditUpdate, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostFileTags)
+	r.GET("/user/:folder_id/:subfolder_id/:file_id/versions", s.Audit(database.AuditRead, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandleGetFileVersions)
+	r.GET("/user/:folder_id/:subfolder_id/:file_id/versions/:version_id/download", s.Audit(database.AuditDownload, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandleGetDownloadFileVersion)
+	r.GET("/user/:folder_id/:subfolder_id/:file_id/metadata", s.Audit(database.AuditRead, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandleGetFileMetadata)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/metadata", s.Audit(database.AuditUpdate, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostFileMetadata)
+
+	//archive endpoints
+	r.GET("/user/:folder_id/archive", s.Audit(database.AuditDownload, database.AuditTargetFolder, "folder_id"), s.AuthorizeJWT(), s.HandleGetFolderArchive)
+	r.GET("/user/:folder_id/:subfolder_id/archive", s.Audit(database.AuditDownload, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandleGetSubfolderArchive)
+	r.GET("/nodes/:node_id/archive", s.Audit(database.AuditDownload, database.AuditTargetNode, "node_id"), s.AuthorizeJWT(), s.HandleGetNodeArchive)
+	r.POST("/archive", s.Audit(database.AuditDownload, database.AuditTargetFile, ""), s.AuthorizeJWT(), s.HandlePostArchive)
+
+	//metadata endpoints
+	r.GET("/user/:folder_id/metadata/fields", s.AuthorizeJWT(), s.HandleGetMetadataFields)
+	r.POST("/user/:folder_id/metadata/fields", s.Audit(database.AuditUpdate, database.AuditTargetFolder, "folder_id"), s.AuthorizeJWT(), s.HandlePostMetadataField)
+	r.DELETE("/user/:folder_id/metadata/fields/:field_id", s.Audit(database.AuditUpdate, database.AuditTargetFolder, "folder_id"), s.AuthorizeJWT(), s.HandleRemoveMetadataField)
+	r.POST("/user/:folder_id/metadata/bulk", s.Audit(database.AuditUpdate, database.AuditTargetFolder, "folder_id"), s.AuthorizeJWT(), s.HandlePostBulkMetadata)
+
+	//sensitivity labels endpoints
+	r.GET("/labels", s.AuthorizeJWT(), s.HandleGetLabels)
+	r.POST("/admin/labels/:label", s.Audit(database.AuditUpdate, database.AuditTargetLabel, ""), s.AuthorizeJWT(), s.HandlePostLabelRules)
+	r.POST("/user/:folder_id/label", s.Audit(database.AuditUpdate, database.AuditTargetFolder, "folder_id"), s.AuthorizeJWT(), s.HandlePostFolderLabel)
+	r.POST("/user/:folder_id/:subfolder_id/label", s.Audit(database.AuditUpdate, database.AuditTargetSubfolder, "subfolder_id"), s.AuthorizeJWT(), s.HandlePostSubfolderLabel)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/label", s.Audit(database.AuditUpdate, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostFileLabel)
+
+	//two factor authentication endpoints
+	r.POST("/mfa/setup", s.Audit(database.AuditUpdate, database.AuditTargetUser, ""), s.AuthorizeJWT(), s.HandlePostMFASetup)
+	r.POST("/mfa/enable", s.Audit(database.AuditUpdate, database.AuditTargetUser, ""), s.AuthorizeJWT(), s.HandlePostMFAEnable)
+	r.POST("/mfa/disable", s.Audit(database.AuditUpdate, database.AuditTargetUser, ""), s.AuthorizeJWT(), s.HandlePostMFADisable)
+
+	//search endpoints
+	r.GET("/search", s.AuthorizeJWT(), s.HandleGetSearch)
+	r.GET("/files", s.AuthorizeJWT(), s.HandleGetQueryFiles)
+
+	//quotas endpoints
+	r.GET("/usage", s.AuthorizeJWT(), s.HandleGetUsage)
+	r.POST("/admin/quotas/users/:user_id", s.Audit(database.AuditUpdate, database.AuditTargetUser, "user_id"), s.AuthorizeJWT(), s.HandlePostUserQuota)
+	r.POST("/admin/quotas/workspaces/:folder_id", s.Audit(database.AuditUpdate, database.AuditTargetFolder, "folder_id"), s.AuthorizeJWT(), s.HandlePostWorkspaceQuota)
+
+	//audit endpoints
+	r.GET("/audit", s.Audit(database.AuditRead, database.AuditTargetAuditLog, ""), s.AuthorizeJWT(), s.HandleGetAudit)
+	r.GET("/admin/audit/verify", s.AuthorizeJWT(), s.HandleGetVerifyAudit)
+	r.POST("/admin/auditors/:user_id", s.Audit(database.AuditUpdate, database.AuditTargetUser, "user_id"), s.AuthorizeJWT(), s.HandlePostAuditor)
+	r.GET("/user/:folder_id/:subfolder_id/:file_id/activity", s.AuthorizeJWT(), s.HandleGetFileActivity)
+	r.GET("/user/:folder_id/:subfolder_id/:file_id/access-log", s.AuthorizeJWT(), s.HandleGetFileAccessLog)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/watch", s.Audit(database.AuditUpdate, database.AuditTargetFile, "file_id"), s.AuthorizeJWT(), s.HandlePostFileWatch)
+
+	//share links endpoints
+	r.POST("/user/:folder_id/:subfolder_id/share", s.Audit(database.AuditCreate, database.AuditTargetShareLink, ""), s.AuthorizeJWT(), s.HandlePostSubfolderShareLink)
+	r.POST("/user/:folder_id/:subfolder_id/:file_id/share", s.Audit(database.AuditCreate, database.AuditTargetShareLink, ""), s.AuthorizeJWT(), s.HandlePostFileShareLink)
+	r.POST("/user/:folder_id/:subfolder_id/file-request", s.Audit(database.AuditCreate, database.AuditTargetShareLink, ""), s.AuthorizeJWT(), s.HandlePostFileRequest)
+	r.GET("/shares", s.AuthorizeJWT(), s.HandleGetShareLinks)
+	r.GET("/shares/:share_id/uploads", s.AuthorizeJWT(), s.HandleGetFileRequestUploads)
+	r.DELETE("/shares/:share_id", s.Audit(database.AuditDelete, database.AuditTargetShareLink, "share_id"), s.AuthorizeJWT(), s.HandleRemoveShareLink)
+	r.GET("/s/:token", s.Audit(database.AuditRead, database.AuditTargetShareLink, ""), s.HandleGetShareLink)
+	r.GET("/s/:token/:file_id", s.Audit(database.AuditDownload, database.AuditTargetFile, "file_id"), s.HandleGetShareLinkFile)
+	r.POST("/s/:token/upload", s.Audit(database.AuditCreate, database.AuditTargetFile, ""), s.HandlePostShareLinkUpload)
+
+	//tree endpoints
+	r.GET("/nodes", s.AuthorizeJWT(), s.HandleGetNodes)
+	r.POST("/nodes", s.Audit(database.AuditCreate, database.AuditTargetNode, ""), s.AuthorizeJWT(), s.HandlePostNode)
+	r.GET("/nodes/:node_id", s.Audit(database.AuditRead, database.AuditTargetNode, "node_id"), s.AuthorizeJWT(), s.HandleGetNode)
+	r.GET("/nodes/:node_id/files", s.Audit(database.AuditRead, database.AuditTargetNode, "node_id"), s.AuthorizeJWT(), s.HandleGetNodeFiles)
+	r.POST("/nodes/:node_id/upload", s.Audit(database.AuditCreate, database.AuditTargetFile, ""), s.AuthorizeJWT(), s.HandlePostNodeUpload)
+	r.DELETE("/nodes/:node_id", s.Audit(database.AuditDelete, database.AuditTargetNode, "node_id"), s.AuthorizeJWT(), s.HandleRemoveNode)
+	r.POST("/nodes/:node_id/rename", s.Audit(database.AuditUpdate, database.AuditTargetNode, "node_id"), s.AuthorizeJWT(), s.HandlePostRenameNode)
+	r.POST("/nodes/:node_id/move", s.Audit(database.AuditUpdate, database.AuditTargetNode, "node_id"), s.AuthorizeJWT(), s.HandlePostMoveNode)
+	r.POST("/nodes/:node_id/copy", s.Audit(database.AuditCreate, database.AuditTargetNode, "node_id"), s.AuthorizeJWT(), s.HandlePostCopyNode)
+	r.GET("/copy-jobs/:job_id", s.AuthorizeJWT(), s.HandleGetCopyJob)
+	r.POST("/batch", s.Audit(database.AuditUpdate, database.AuditTargetFile, ""), s.AuthorizeJWT(), s.HandlePostBatch)
+	r.GET("/tree/*path", s.Audit(database.AuditRead, database.AuditTargetNode, ""), s.AuthorizeJWT(), s.HandleGetNodePath)
+
+	//WebDAV endpoints, the root without its trailing slash being listed too, as some clients don't follow redirects
+	r.Handle("OPTIONS", "/dav", s.AuthorizeDAV(), s.HandleDAV)
+	r.Handle("PROPFIND", "/dav", s.AuthorizeDAV(), s.HandleDAV)
+	r.Handle("OPTIONS", "/dav/*path", s.AuthorizeDAV(), s.HandleDAV)
+	r.Handle("PROPFIND", "/dav/*path", s.AuthorizeDAV(), s.HandleDAV)
+	r.Handle("PROPPATCH", "/dav/*path", s.AuthorizeDAV(), s.HandleDAV)
+	r.GET("/dav/*path", s.Audit(database.AuditDownload, database.AuditTargetFile, ""), s.AuthorizeDAV(), s.HandleDAV)
+	r.HEAD("/dav/*path", s.AuthorizeDAV(), s.HandleDAV)
+	r.PUT("/dav/*path", s.Audit(database.AuditUpdate, database.AuditTargetFile, ""), s.AuthorizeDAV(), s.HandleDAV)
+	r.DELETE("/dav/*path", s.Audit(database.AuditDelete, database.AuditTargetNode, ""), s.AuthorizeDAV(), s.HandleDAV)
+	r.Handle("MKCOL", "/dav/*path", s.Audit(database.AuditCreate, database.AuditTargetNode, ""), s.AuthorizeDAV(), s.HandleDAV)
+	r.Handle("COPY", "/dav/*path", s.Audit(database.AuditCreate, database.AuditTargetNode, ""), s.AuthorizeDAV(), s.HandleDAV)
+	r.Handle("MOVE", "/dav/*path", s.Audit(database.AuditUpdate, database.AuditTargetNode, ""), s.AuthorizeDAV(), s.HandleDAV)
+	r.Handle("LOCK", "/dav/*path", s.AuthorizeDAV(), s.HandleDAV)
+	r.Handle("UNLOCK", "/dav/*path", s.AuthorizeDAV(), s.HandleDAV)
+
+	//API tokens endpoints
+	r.POST("/tokens", s.Audit(database.AuditCreate, database.AuditTargetAPIToken, ""), s.AuthorizeJWT(), s.HandlePostAPIToken)
+	r.GET("/tokens", s.AuthorizeJWT(), s.HandleGetAPITokens)
+	r.DELETE("/tokens/:token_id", s.Audit(database.AuditDelete, database.AuditTargetAPIToken, "token_id"), s.AuthorizeJWT(), s.HandleRemoveAPIToken)
+
+	//provisioning endpoints
+	r.GET("/scim/v2/ServiceProviderConfig", s.AuthorizeSCIM(), s.HandleGetSCIMServiceProviderConfig)
+	r.GET("/scim/v2/Users", s.AuthorizeSCIM(), s.HandleGetSCIMUsers)
+	r.GET("/scim/v2/Users/:user_id", s.AuthorizeSCIM(), s.HandleGetSCIMUser)
+	r.POST("/scim/v2/Users", s.Audit(database.AuditCreate, database.AuditTargetUser, ""), s.AuthorizeSCIM(), s.HandlePostSCIMUser)
+	r.PATCH("/scim/v2/Users/:user_id", s.Audit(database.AuditUpdate, database.AuditTargetUser, "user_id"), s.AuthorizeSCIM(), s.HandlePatchSCIMUser)
+	r.DELETE("/scim/v2/Users/:user_id", s.Audit(database.AuditDelete, database.AuditTargetUser, "user_id"), s.AuthorizeSCIM(), s.HandleRemoveSCIMUser)
+	r.GET("/scim/v2/Groups", s.AuthorizeSCIM(), s.HandleGetSCIMGroups)
+	r.GET("/scim/v2/Groups/:group_id", s.AuthorizeSCIM(), s.HandleGetSCIMGroup)
+	r.POST("/scim/v2/Groups", s.Audit(database.AuditCreate, database.AuditTargetGroup, ""), s.AuthorizeSCIM(), s.HandlePostSCIMGroup)
+	r.PATCH("/scim/v2/Groups/:group_id", s.Audit(database.AuditUpdate, database.AuditTargetGroup, "group_id"), s.AuthorizeSCIM(), s.HandlePatchSCIMGroup)
+	r.DELETE("/scim/v2/Groups/:group_id", s.Audit(database.AuditDelete, database.AuditTargetGroup, "group_id"), s.AuthorizeSCIM(), s.HandleRemoveSCIMGroup)
 
 	//generate new jwt
 	r.POST("/newtoken", s.GenerateNewToken)
@@ -76,10 +206,27 @@ func Api(s *Service) *gin.Engine {
 	return r
 }
 
-// JWT authorisation middleware
-func AuthorizeJWT() gin.HandlerFunc {
+// JWT authorisation middleware, also accepting the API tokens, with or without the Bearer scheme. The requests
+// authenticated with an API token need its read scope for the GET requests and its write scope for the others.
+func (s *Service) AuthorizeJWT() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenString := c.GetHeader("Authorization")
+		if secret, isAPIToken := isAPITokenSecret(tokenString); isAPIToken {
+			claims, message := s.getAPITokenClaims(c, secret)
+			if claims == nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+					"error": message,
+				})
+				return
+			}
+			if !verifyAPITokenMethodScope(c) {
+				return
+			}
+			c.Set("claims", claims)
+			c.Next()
+			return
+		}
+
 		// if the token doesn't exist, return unauthorised
 		if len(tokenString) == 0  {
 			c.JSON(http.StatusUnauthorized, gin.H{
@@ -172,7 +319,7 @@ func (s *Service) GenerateNewToken(c *gin.Context)  {
 				c.Status(http.StatusBadRequest)
 				return
 			} 
-			newTokenPair := auth.JWTAuthService().GenerateToken(user.ID, user.Email, user.IsActivated)
+			newTokenPair := auth.JWTAuthService().GenerateToken(user.ID, user.Email, user.IsActivated, claims.MFA)
 			log.Info("Refresh token is valid. Successfully generated a new token pair")
 			c.JSON(http.StatusOK, gin.H{
 				"id" : user.ID,
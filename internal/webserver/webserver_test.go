@@ -0,0 +1,152 @@
+package webserver
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CosminMocanu97/dissertationBackend/internal/auth"
+	"github.com/CosminMocanu97/dissertationBackend/internal/database"
+	"github.com/CosminMocanu97/dissertationBackend/internal/encryption"
+	"github.com/CosminMocanu97/dissertationBackend/internal/storage"
+	"github.com/CosminMocanu97/dissertationBackend/internal/types"
+	"github.com/gin-gonic/gin"
+)
+
+// testService is a service on a test database, with the router serving its routes
+type testService struct {
+	*Service
+	router *gin.Engine
+}
+
+// newTestService connects to the database in TEST_DATABASE_URL, creating the tables in a schema of their own, and
+// stores the files in a temporary folder. Both are removed by the returned function. The tests are skipped when no
+// test database is configured.
+func newTestService(t *testing.T) (*testService, func()) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if len(url) == 0 {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("test_%d_%d", os.Getpid(), time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	root, err := ioutil.TempDir("", "webserver")
+	if err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		os.RemoveAll(root)
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	}
+
+	// the connections of the test only see the tables of its schema
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("postgres", url+separator+"search_path="+schema)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	database.InitiateDatabaseTables(db)
+
+	keys, err := encryption.NewStaticKeyManager("test", map[string][]byte{"test": bytes.Repeat([]byte{7}, encryption.KeySize)})
+	if err != nil {
+		db.Close()
+		cleanup()
+		t.Fatal(err)
+	}
+	s := &testService{Service: &Service{Database: db, Storage: storage.NewStore(root, keys)}}
+	s.router = Api(s.Service)
+	return s, func() {
+		db.Close()
+		cleanup()
+	}
+}
+
+// serve handles the request with the router, authenticated by the token when it isn't empty
+func (s *testService) serve(method string, path string, token string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, body)
+	request.RemoteAddr = "192.0.2.1:1234"
+	if len(token) > 0 {
+		request.Header.Set("Authorization", token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// addUser adds an activated user, returning its id and an access token
+func (s *testService) addUser(t *testing.T, email string) (int64, string) {
+	if _, err := database.AddNewUser(s.Database, types.RegistrationData{Email: email, Password: "password"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	var userID int64
+	if err := s.Database.QueryRow("SELECT id FROM users WHERE email=$1", email).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.ActivateAccount(s.Database, userID); err != nil {
+		t.Fatal(err)
+	}
+	return userID, auth.JWTAuthService().GenerateToken(userID, email, true, false)["access_token"]
+}
+
+// addSubfolder adds a workspace of the user with a subfolder, returning their ids
+func (s *testService) addSubfolder(t *testing.T, userID int64, name string, password string) (int64, int64) {
+	folderID, err := database.AddNewFolder(s.Database, userID, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subfolderID, err := database.AddNewSubfolder(s.Database, userID, folderID, name, password, len(password) > 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return folderID, subfolderID
+}
+
+// addFile adds a file of the user with the content directly in the subfolder, locked by the password when it
+// isn't empty, returning its id
+func (s *testService) addFile(t *testing.T, userID int64, folderID int64, subfolderID int64, filename string, content string, password string) int64 {
+	fileID, err := database.AddNewFile(s.Database, userID, folderID, subfolderID, 0, filename, "", password, len(password) > 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.storeFileContent(fileID, userID, strings.NewReader(content), "", false); err != nil {
+		t.Fatal(err)
+	}
+	return fileID
+}
+
+// expectStatus fails the test when the response doesn't have the status
+func expectStatus(t *testing.T, response *httptest.ResponseRecorder, status int, request string) {
+	t.Helper()
+	if response.Code != status {
+		t.Fatalf("%s answered %d %s, want %d", request, response.Code, strings.TrimSpace(response.Body.String()), status)
+	}
+}
+
+// itoa formats the id for the paths of the requests
+func itoa(id int64) string {
+	return strconv.FormatInt(id, 10)
+}